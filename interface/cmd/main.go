@@ -1,76 +1,784 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"thinkpol-vpn/interface/internal/acl"
+	"thinkpol-vpn/interface/internal/api"
+	"thinkpol-vpn/interface/internal/capture"
+	"thinkpol-vpn/interface/internal/compress"
+	"thinkpol-vpn/interface/internal/config"
+	"thinkpol-vpn/interface/internal/dns"
+	"thinkpol-vpn/interface/internal/ethernet"
+	"thinkpol-vpn/interface/internal/gateway"
+	"thinkpol-vpn/interface/internal/keepalive"
+	"thinkpol-vpn/interface/internal/lifecycle"
+	"thinkpol-vpn/interface/internal/localproxy"
+	"thinkpol-vpn/interface/internal/mtu"
+	"thinkpol-vpn/interface/internal/netstack"
+	"thinkpol-vpn/interface/internal/obfuscate"
 	"thinkpol-vpn/interface/internal/proxy"
+	"thinkpol-vpn/interface/internal/pt"
+	"thinkpol-vpn/interface/internal/scheduler"
 	"thinkpol-vpn/interface/internal/tun"
+	"thinkpol-vpn/interface/internal/upstream"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
 	// Parse command line flags
 	logFile := flag.String("log", "logs/vpn-interface.log", "Log file path")
+	configFile := flag.String("config", "config.json", "Configuration file path")
+	journalFile := flag.String("journal", "/var/run/thinkpol-vpn/journal", "Journal of system changes, used to clean up after a crash")
 	addr := flag.String("transport-addr", "localhost:8888", "address for websocket proxy server to listen to")
+	mode := flag.String("mode", "tun", "where tunnel packets go: `tun` for a TUN interface, `netstack` for a userspace stack (no root), `gateway` for a userspace stack serving many clients, `proxy` for local SOCKS5 and HTTP proxies (no root)")
+	stageTimeout := flag.Duration("stage-timeout", 15*time.Second, "How long each component gets to start or stop")
 	flag.Parse()
 
 	log.Println("⚙️ Configuring for start up")
 	log.Println("")
 
-	log.Println("Configuring websocket transport...")
-	transport := proxy.NewRawWebSocketVpnProxy()
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	aclEngine := acl.NewEngine()
+	ruleSet, err := acl.FromConfig(cfg.ACL)
+	if err != nil {
+		log.Fatalf("Invalid ACL configuration: %v", err)
+	}
+	aclEngine.Load(ruleSet)
+
+	// gw is only set in gateway mode, where it replaces the single-peer transport
+	var gw *gateway.Gateway
+
+	// The rules can be changed on the fly by editing the config and reloading
+	reloadACL := func() error {
+		cfg, err := config.Load(*configFile)
+		if err != nil {
+			return err
+		}
+		ruleSet, err := acl.FromConfig(cfg.ACL)
+		if err != nil {
+			return err
+		}
+		if gw != nil {
+			if err := gw.LoadACLs(cfg.Gateway); err != nil {
+				return err
+			}
+		}
+		aclEngine.Load(ruleSet)
+		return nil
+	}
+
+	// Components are started in the order they are added and stopped in reverse
+	supervisor := lifecycle.NewSupervisor(*stageTimeout)
+
+	capturer := capture.NewCapturer(cfg.Capture.Directory, capture.Options{
+		Name:        "capture",
+		Format:      cfg.Capture.Format,
+		MaxFileSize: cfg.Capture.MaxFileSize,
+		MaxFiles:    cfg.Capture.MaxFiles,
+		Snaplen:     cfg.Capture.Snaplen,
+	})
+
+	// Added first so a running capture is flushed after everything else stopped
+	supervisor.Add(lifecycle.Stage{
+		Name: "packet capture",
+		Start: func(ctx context.Context) error {
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			if !capturer.Status().Running {
+				return nil
+			}
+			return capturer.Stop()
+		},
+	})
+
+	// transport is nil in gateway mode, webSocket is the transport unless
+	// CONNECT-IP replaces it. It connects to the peer when one is configured
+	// and waits for the peer to connect otherwise.
+	var transport proxy.Transport
+	var webSocket *proxy.RawWebSocketVpnProxy
+
+	keepaliveSettings, err := keepalive.New(cfg.Keepalive)
+	if err != nil {
+		log.Fatalf("Invalid keepalive configuration: %v", err)
+	}
+
+	obfuscation, err := obfuscate.New(cfg.Obfuscation)
+	if err != nil {
+		log.Fatalf("Invalid obfuscation configuration: %v", err)
+	}
+
+	// Only the websocket transport in front of a TUN interface carries the
+	// Ethernet frames of TAP mode
+	if cfg.TAP.Enabled {
+		if *mode != "tun" {
+			log.Fatalf("TAP mode needs -mode tun, %s mode carries IP packets", *mode)
+		}
+		if cfg.ConnectIP.Enabled {
+			log.Fatalf("The CONNECT-IP transport carries IP packets and cannot be used in TAP mode")
+		}
+		if cfg.TAP.MAC != "" {
+			if _, err := ethernet.ParseMAC(cfg.TAP.MAC); err != nil {
+				log.Fatalf("Invalid TAP configuration: %v", err)
+			}
+		}
+	}
+
+	// Padding makes every packet on the wire larger
+	overhead := mtu.WebSocketOverhead + obfuscation.Overhead()
+	if cfg.ConnectIP.Enabled {
+		overhead = mtu.ConnectIPOverhead
+	}
+	if cfg.TAP.Enabled {
+		overhead += mtu.EthernetOverhead
+	}
+	tunnelMTU, err := mtu.Resolve(cfg.MTU, overhead)
+	if err != nil {
+		log.Fatalf("Invalid MTU configuration: %v", err)
+	}
+	log.Printf("    [MTU] Tunnel MTU is %d", tunnelMTU)
+
+	if *mode == "gateway" {
+		if cfg.ConnectIP.Enabled {
+			log.Fatalf("The CONNECT-IP transport serves a single peer and cannot be used in gateway mode")
+		}
+		if cfg.Peer.URL != "" {
+			log.Fatalf("The gateway waits for its clients and cannot connect to a peer")
+		}
+
+		log.Println("Configuring gateway...")
+		gw, err = gateway.NewGateway(cfg.Gateway, cfg.RateLimit)
+		if err != nil {
+			log.Fatalf("Invalid gateway configuration: %v", err)
+		}
+		gw.SetCapturer(capturer)
+		gw.SetKeepalive(keepaliveSettings)
+		gw.SetObfuscation(obfuscation)
+
+		supervisor.Add(lifecycle.Stage{
+			Name: "gateway",
+			Start: func(ctx context.Context) error {
+				return gw.Start()
+			},
+			Stop: func(ctx context.Context) error {
+				return gw.Stop()
+			},
+		})
+	} else if cfg.ConnectIP.Enabled {
+		log.Println("Configuring CONNECT-IP transport...")
+		pathMTU := cfg.MTU.Path
+		if pathMTU == 0 {
+			pathMTU = mtu.DefaultPath
+		}
+		connectIP, err := proxy.NewConnectIPProxy(cfg.ConnectIP, pathMTU)
+		if err != nil {
+			log.Fatalf("Invalid CONNECT-IP configuration: %v", err)
+		}
+		connectIP.SetCapturer(capturer)
+		sendQueue, err := scheduler.New(cfg.Scheduler)
+		if err != nil {
+			log.Fatalf("Invalid scheduler configuration: %v", err)
+		}
+		connectIP.SetScheduler(sendQueue)
+		connectIP.SetKeepalive(keepaliveSettings)
+		upstreamProxy, err := upstream.New(cfg.UpstreamProxy)
+		if err != nil {
+			log.Fatalf("Invalid upstream proxy configuration: %v", err)
+		}
+		connectIP.SetUpstreamProxy(upstreamProxy)
+		// The HTTP/2 implementation of Go only turns extended CONNECT on when
+		// the environment asks for it at startup
+		if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+			log.Println("    [CONNECT-IP] HTTP/2 needs GODEBUG=http2xconnect=1, only HTTP/3 is available")
+		}
+		if err := connectIP.RateLimit().Configure(cfg.RateLimit); err != nil {
+			log.Fatalf("Invalid rate limit configuration: %v", err)
+		}
+		transport = connectIP
+
+		supervisor.Add(lifecycle.Stage{
+			Name: "CONNECT-IP transport",
+			Start: func(ctx context.Context) error {
+				if err := connectIP.Listen(); err != nil {
+					return err
+				}
+				connectIP.Start()
+				return nil
+			},
+			Stop: func(ctx context.Context) error {
+				connectIP.Stop()
+				return nil
+			},
+		})
+	} else {
+		log.Println("Configuring websocket transport...")
+		webSocket = proxy.NewRawWebSocketVpnProxy()
+		webSocket.SetCapturer(capturer)
+		sendQueue, err := scheduler.New(cfg.Scheduler)
+		if err != nil {
+			log.Fatalf("Invalid scheduler configuration: %v", err)
+		}
+		webSocket.SetScheduler(sendQueue)
+		webSocket.SetKeepalive(keepaliveSettings)
+		compression, err := compress.New(cfg.Compression)
+		if err != nil {
+			log.Fatalf("Invalid compression configuration: %v", err)
+		}
+		webSocket.SetCompression(compression)
+		webSocket.SetObfuscation(obfuscation)
+		webSocket.SetEthernet(cfg.TAP.Enabled)
+		if cfg.Peer.URL != "" {
+			if err := webSocket.SetPeer(cfg.Peer); err != nil {
+				log.Fatalf("Invalid peer configuration: %v", err)
+			}
+			upstreamProxy, err := upstream.New(cfg.UpstreamProxy)
+			if err != nil {
+				log.Fatalf("Invalid upstream proxy configuration: %v", err)
+			}
+			webSocket.SetUpstreamProxy(upstreamProxy)
+
+			if client := cfg.PluggableTransports.Client; client.Path != "" {
+				ptProxy, err := pluggableTransportProxy(upstreamProxy, cfg.Peer.URL)
+				if err != nil {
+					log.Fatalf("Invalid pluggable transport configuration: %v", err)
+				}
+				addPluggableTransportClient(supervisor, webSocket, client, cfg.PluggableTransports.StateDir, ptProxy)
+			}
+		} else if cfg.PluggableTransports.Client.Path != "" {
+			log.Fatalf("The pluggable transport client needs a peer to connect to")
+		}
+		if err := webSocket.RateLimit().Configure(cfg.RateLimit); err != nil {
+			log.Fatalf("Invalid rate limit configuration: %v", err)
+		}
+		transport = webSocket
+
+		supervisor.Add(lifecycle.Stage{
+			Name: "websocket transport",
+			Start: func(ctx context.Context) error {
+				webSocket.Start()
+				return nil
+			},
+			Stop: func(ctx context.Context) error {
+				webSocket.Stop()
+				return nil
+			},
+		})
+	}
+
+	var im *tun.InterfaceManager
+	var journal *tun.Journal
+
+	switch *mode {
+	case "tun":
+		log.Println("Configuring interface manager...")
+		im = tun.NewInterfaceManager("utun9", tunnelMTU, "10.0.0.1", "255.255.255.0", transport)
+
+		journal, err = tun.OpenJournal(*journalFile)
+		if err != nil {
+			log.Fatalf("Failed to open journal: %v", err)
+		}
+		im.UseJournal(journal)
+		im.SetCapturer(capturer)
+		im.SetACL(aclEngine)
+		im.SetMSSClamping(cfg.MTU.ClampMSS)
+		if cfg.TAP.Enabled {
+			im.SetTAP(cfg.TAP.MAC, cfg.TAP.Bridge)
+		}
+
+		routes, err := routesFromConfig(cfg.Routing)
+		if err != nil {
+			log.Fatalf("Invalid routing configuration: %v", err)
+		}
+
+		// A bridged interface has no address, the bridge holds the routes,
+		// resolvers and firewall rules of the network behind it
+		bridged := cfg.TAP.Enabled && cfg.TAP.Bridge != ""
+		if bridged {
+			log.Printf("    [MANAGER] Interface joins bridge %s, leaving routes, DNS and the kill switch to it", cfg.TAP.Bridge)
+			routes = nil
+		}
+		if err := im.SetRoutes(routes); err != nil {
+			log.Fatalf("Failed to set routes: %v", err)
+		}
+		if cfg.Routing.InterceptAll && !bridged {
+			if err := im.InterceptAllTraffic(); err != nil {
+				log.Fatalf("Failed to intercept all traffic: %v", err)
+			}
+		}
+		if !bridged {
+			// The DNS forwarder queries its upstream from the host, outside the tunnel
+			var forwarderUpstreams []netip.AddrPort
+			if cfg.DNS.BlockLeaks && len(cfg.DNS.Domains) > 0 {
+				forwarderUpstreams, err = resolveEndpoints([]string{cfg.DNS.Upstream})
+				if err != nil {
+					log.Fatalf("Invalid DNS forwarder configuration: %v", err)
+				}
+			}
+			im.SetDNS(cfg.DNS.Servers, cfg.DNS.SearchDomains, cfg.DNS.BlockLeaks, forwarderUpstreams)
+		}
+
+		if cfg.KillSwitch.Enabled && !bridged {
+			gateways, err := resolveEndpoints(cfg.KillSwitch.Gateways)
+			if err != nil {
+				log.Fatalf("Invalid kill switch configuration: %v", err)
+			}
+			listenPorts, err := listenPortsFromConfig(*addr, cfg)
+			if err != nil {
+				log.Fatalf("Invalid kill switch configuration: %v", err)
+			}
+			im.SetKillSwitch(true, gateways, listenPorts, cfg.KillSwitch.AllowLAN)
+		}
+
+		supervisor.Add(lifecycle.Stage{
+			Name: "TUN interface",
+			Start: func(ctx context.Context) error {
+				return im.Create()
+			},
+			Stop: func(ctx context.Context) error {
+				err := im.Cleanup()
+				// Only an explicit shutdown lifts the kill switch, after a
+				// failure it keeps traffic from leaving in the clear
+				if supervisor.Err() == nil {
+					err = errors.Join(err, im.DisableKillSwitch())
+				} else if cfg.KillSwitch.Enabled {
+					log.Println("    [MANAGER] Keeping the kill switch in place after the failure")
+				}
+				return err
+			},
+		})
+
+		// Packet processing owns the routes, they are installed when it starts
+		// and removed when it stops
+		supervisor.Add(lifecycle.Stage{
+			Name: "packet processing",
+			Start: func(ctx context.Context) error {
+				return im.Start()
+			},
+			Stop: func(ctx context.Context) error {
+				return im.Stop()
+			},
+		})
+
+		if len(cfg.DNS.Domains) > 0 {
+			forwarder := dns.NewForwarder(
+				cfg.DNS.Listen,
+				cfg.DNS.Upstream,
+				cfg.DNS.Domains,
+				time.Duration(cfg.DNS.MinTTL)*time.Second,
+				im.SystemManager(),
+				im.InterfaceName,
+			)
+
+			supervisor.Add(lifecycle.Stage{
+				Name: "DNS forwarder",
+				Start: func(ctx context.Context) error {
+					return forwarder.Start()
+				},
+				Stop: func(ctx context.Context) error {
+					return forwarder.Stop()
+				},
+			})
+		}
+	case "netstack", "gateway":
+		log.Println("Configuring userspace network stack...")
+		var stackTransport netstack.Transport = transport
+		if gw != nil {
+			stackTransport = gw
+		}
+		ns := netstack.NewStack(tunnelMTU, stackTransport)
+		ns.SetACL(aclEngine)
+
+		supervisor.Add(lifecycle.Stage{
+			Name: "userspace network stack",
+			Start: func(ctx context.Context) error {
+				return ns.Start()
+			},
+			Stop: func(ctx context.Context) error {
+				return ns.Stop()
+			},
+		})
+	case "proxy":
+		log.Println("Configuring local proxies...")
+		localProxy, err := localproxy.New(cfg.LocalProxy, tunnelMTU, transport)
+		if err != nil {
+			log.Fatalf("Invalid local proxy configuration: %v", err)
+		}
+		localProxy.SetACL(aclEngine)
+
+		supervisor.Add(lifecycle.Stage{
+			Name: "local proxies",
+			Start: func(ctx context.Context) error {
+				return localProxy.Start()
+			},
+			Stop: func(ctx context.Context) error {
+				return localProxy.Stop()
+			},
+		})
+	default:
+		log.Fatalf("Unknown mode %q, expected tun, netstack, gateway or proxy", *mode)
+	}
+
+	// Server transports are started once the HTTP server is up to take the
+	// connections they accept
+	var ptProcesses []*pt.Process
+	var ptMutex sync.Mutex
+	pluggableTransports := func() []pt.Method {
+		ptMutex.Lock()
+		defer ptMutex.Unlock()
+		var methods []pt.Method
+		for _, process := range ptProcesses {
+			methods = append(methods, process.Methods()...)
+		}
+		return methods
+	}
+
+	log.Println("Setting up HTTP servers...")
+	// Peers only reach the transport, the control API and the metrics are
+	// served on their own listener
+	var upgrade http.HandlerFunc
+	if gw != nil {
+		upgrade = gw.UpgradeConnection
+	} else if webSocket != nil && cfg.Peer.URL == "" {
+		upgrade = webSocket.UpgradeConnection
+	}
+
+	apiMux := http.NewServeMux()
+	api.NewServer(api.Options{
+		InterfaceManager: im,
+		Transport:        transport,
+		Gateway:          gw,
+		Capturer:         capturer,
+		ACL:              aclEngine,
+		ReloadACL:        reloadACL,
+
+		PluggableTransports: pluggableTransports,
+	}).Register(apiMux)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		aclEngine.Collector(),
+	)
+	if transport != nil {
+		registry.MustRegister(transport.Collector())
+	}
+	if gw != nil {
+		registry.MustRegister(gw.Collector())
+	}
+	if im != nil {
+		registry.MustRegister(im.Collector())
+	}
+	apiMux.Handle("GET /metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	if cfg.API.Token == "" && !isLoopback(cfg.API.Listen) {
+		log.Printf("    [API] Warning: the control API on %s has no token, anyone who reaches it controls the tunnel", cfg.API.Listen)
+	}
+	addHTTPServer(supervisor, "control API", cfg.API.Listen, api.RequireToken(cfg.API.Token, apiMux))
+
+	// The transport goes last so peers only connect once everything behind it is up
+	if upgrade != nil {
+		transportMux := http.NewServeMux()
+		transportMux.Handle(obfuscation.Path(), obfuscation.Handler(upgrade))
+		addHTTPServer(supervisor, "transport server", *addr, transportMux)
+	}
 
-	log.Println("Setting up HTTP server...")
-	http.HandleFunc("/transport", transport.UpgradeConnection)
+	if len(cfg.PluggableTransports.Servers) > 0 {
+		supervisor.Add(lifecycle.Stage{
+			Name: "pluggable transports",
+			Start: func(ctx context.Context) error {
+				for _, server := range cfg.PluggableTransports.Servers {
+					process, err := pt.StartServer(ctx, pt.ServerOptions{
+						Path:       server.Path,
+						Args:       server.Args,
+						Transports: server.Transports,
+						Listen:     server.Listen,
+						Options:    server.Options,
+						ORPort:     *addr,
+						StateDir:   cfg.PluggableTransports.StateDir,
+					})
+					if err != nil {
+						return err
+					}
+
+					ptMutex.Lock()
+					ptProcesses = append(ptProcesses, process)
+					ptMutex.Unlock()
+
+					go func() {
+						if err := process.Wait(); err != nil {
+							supervisor.Fail(fmt.Errorf("pluggable transport: %w", err))
+						}
+					}()
+				}
+				return nil
+			},
+			Stop: func(ctx context.Context) error {
+				ptMutex.Lock()
+				defer ptMutex.Unlock()
+
+				var errs []error
+				for _, process := range ptProcesses {
+					errs = append(errs, process.Stop())
+				}
+				ptProcesses = nil
+				return errors.Join(errs...)
+			},
+		})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	// SIGHUP reloads the ACL rules
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
 	go func() {
-		log.Printf("Http server starting up on %s", *addr)
-		log.Fatal(http.ListenAndServe(*addr, nil))
+		for range hangup {
+			if err := reloadACL(); err != nil {
+				log.Printf("Failed to reload ACL: %v", err)
+			}
+		}
 	}()
-	log.Println("Starting websocket handlers...")
-	transport.Start()
-	log.Println("Transport set up!")
+
+	log.Printf("📝 Logs are being written to: %s", *logFile)
+	log.Println("Press Ctrl+C to stop gracefully")
 	log.Println("")
 
-	log.Println("Configuring interface manager...")
-	im := tun.NewInterfaceManager("utun9", 1500, "10.0.0.1", "255.255.255.0", transport)
+	err = supervisor.Run(ctx)
 
-	log.Println("Creating TUN interface...")
-	im.Create()
+	if journal != nil {
+		journal.Close()
+	}
 
-	log.Println("Creating routes for 10th subnet...")
-	im.CreateRouteFor10Subnet()
+	log.Println("")
+	if err != nil {
+		log.Fatalf("Shutdown after failure: %v", err)
+	}
+	log.Println("Shutdown complete")
+}
 
-	log.Println("Starting packets capture...")
-	im.Start()
+// addPluggableTransportClient adds a stage running the client side of a
+// pluggable transport binary, which the websocket transport connects to its
+// peer through. It has to go before the transport.
+func addPluggableTransportClient(supervisor *lifecycle.Supervisor, webSocket *proxy.RawWebSocketVpnProxy, client config.PluggableTransportClientConfig, stateDir string, proxyURL string) {
+	var process *pt.Process
 
-	log.Println("")
-	log.Println("✅ Started succesfully")
-	log.Printf("📝 Logs are being written to: %s", *logFile)
+	supervisor.Add(lifecycle.Stage{
+		Name: "pluggable transport client",
+		Start: func(ctx context.Context) error {
+			var err error
+			process, err = pt.StartClient(ctx, pt.ClientOptions{
+				Path:       client.Path,
+				Args:       client.Args,
+				Transports: []string{client.Transport},
+				StateDir:   stateDir,
+				Proxy:      proxyURL,
+			})
+			if err != nil {
+				return err
+			}
 
-	log.Println("")
-	log.Println("Press Ctrl+C to stop gracefully")
+			dialer, err := process.Dialer(client.Transport, pt.Args(client.Options))
+			if err != nil {
+				return err
+			}
+			webSocket.SetPluggableTransport(dialer.DialContext)
 
-	// Set up signal handling for graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+			go func() {
+				if err := process.Wait(); err != nil {
+					supervisor.Fail(fmt.Errorf("pluggable transport client: %w", err))
+				}
+			}()
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			if process == nil {
+				return nil
+			}
+			return process.Stop()
+		},
+	})
+}
 
-	// Wait for shutdown signal
-	sig := <-sigChan
-	log.Printf("Received signal %v, shutting down gracefully...", sig)
+// pluggableTransportProxy returns the upstream proxy a client pluggable
+// transport connects to the peer through, as pt-spec TOR_PT_PROXY takes it,
+// "" to connect directly
+func pluggableTransportProxy(upstreamProxy upstream.Settings, peer string) (string, error) {
+	peerURL, err := url.Parse(peer)
+	if err != nil {
+		return "", err
+	}
+	port := peerURL.Port()
+	if port == "" {
+		port = "80"
+		if peerURL.Scheme == "wss" {
+			port = "443"
+		}
+	}
 
-	log.Println("Deleting routes for 10th subnet...")
-	im.RemoveRouteFor10Subnet()
+	proxyURL, err := upstreamProxy.Proxy(net.JoinHostPort(peerURL.Hostname(), port))
+	if err != nil || proxyURL == nil {
+		return "", err
+	}
+	// Only scheme, credentials and address, pt-spec has no room for more
+	ptProxy := url.URL{Scheme: proxyURL.Scheme, User: proxyURL.User, Host: proxyURL.Host}
+	switch ptProxy.Scheme {
+	case "http", "socks5":
+	case "socks5h":
+		ptProxy.Scheme = "socks5"
+	default:
+		return "", fmt.Errorf("pluggable transports cannot connect through %s proxies", ptProxy.Scheme)
+	}
+	return ptProxy.String(), nil
+}
 
-	log.Println("Cleaning up...")
-	im.Cleanup()
+// addHTTPServer adds a stage serving handler on addr
+func addHTTPServer(supervisor *lifecycle.Supervisor, name string, addr string, handler http.Handler) {
+	server := &http.Server{Addr: addr, Handler: handler}
 
-	log.Println("Stopping websocket handlers...")
-	transport.Stop()
+	supervisor.Add(lifecycle.Stage{
+		Name: name,
+		Start: func(ctx context.Context) error {
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
 
-	log.Println("")
-	log.Println("Shutdown complete")
+			log.Printf("%s starting up on %s", strings.ToUpper(name[:1])+name[1:], addr)
+			go func() {
+				if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					supervisor.Fail(fmt.Errorf("%s: %w", name, err))
+				}
+			}()
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			return server.Shutdown(ctx)
+		},
+	})
+}
+
+// isLoopback reports whether addr only listens on a loopback address
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// routesFromConfig converts the routing section of the config into manager routes
+func routesFromConfig(routing config.RoutingConfig) ([]tun.Route, error) {
+	var routes []tun.Route
+
+	for _, include := range routing.Include {
+		route, err := tun.NewRoute(include.Prefix, include.Metric, false)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+
+	for _, exclude := range routing.Exclude {
+		route, err := tun.NewRoute(exclude.Prefix, exclude.Metric, true)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
+// listenPortsFromConfig returns the ports peers connect to, the transport
+// answers them from these ports
+func listenPortsFromConfig(transportAddr string, cfg *config.Config) ([]int, error) {
+	addrs := []string{transportAddr}
+	if cfg.ConnectIP.Enabled && cfg.ConnectIP.Server == "" {
+		addrs = append(addrs, cfg.ConnectIP.Listen)
+	}
+	for _, server := range cfg.PluggableTransports.Servers {
+		for _, listen := range server.Listen {
+			addrs = append(addrs, listen)
+		}
+	}
+
+	var ports []int
+	for _, addr := range addrs {
+		_, portString, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+		port, err := strconv.ParseUint(portString, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen port %q: %w", addr, err)
+		}
+		if !slices.Contains(ports, int(port)) {
+			ports = append(ports, int(port))
+		}
+	}
+	return ports, nil
+}
+
+// resolveEndpoints resolves the "host:port" endpoints the firewall lets through,
+// such as the kill switch gateways. Names are resolved up front since DNS is
+// blocked once the rules are on.
+func resolveEndpoints(endpoints []string) ([]netip.AddrPort, error) {
+	var resolved []netip.AddrPort
+
+	for _, endpoint := range endpoints {
+		host, portString, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+		}
+
+		port, err := strconv.ParseUint(portString, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint port %q: %w", endpoint, err)
+		}
+
+		addrs, err := net.LookupHost(host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve endpoint %q: %w", endpoint, err)
+		}
+
+		for _, addr := range addrs {
+			parsed, err := netip.ParseAddr(addr)
+			if err != nil {
+				continue
+			}
+			resolved = append(resolved, netip.AddrPortFrom(parsed.Unmap(), uint16(port)))
+		}
+	}
+
+	return resolved, nil
 }
@@ -1,11 +1,31 @@
 module thinkpol-vpn/interface
 
-go 1.23.4
+go 1.24
 
 require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/klauspost/compress v1.18.0
+	github.com/pierrec/lz4/v4 v4.1.31
+	github.com/prometheus/client_golang v1.22.0
+	github.com/quic-go/quic-go v0.59.1
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
-	golang.org/x/sys v0.34.0
+	golang.org/x/net v0.43.0
+	golang.org/x/sys v0.35.0
+	golang.org/x/time v0.7.0
 	google.golang.org/protobuf v1.36.8
+	gvisor.dev/gvisor v0.0.0-20250205023644-9414b50a5633
 )
 
-require github.com/gorilla/websocket v1.5.3 // indirect
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/google/btree v1.1.2 // indirect
+	github.com/kylelemons/godebug v1.1.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.62.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+)
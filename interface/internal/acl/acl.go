@@ -0,0 +1,179 @@
+// Package acl filters the packets that go through the tunnel
+package acl
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"thinkpol-vpn/interface/internal/config"
+	"thinkpol-vpn/interface/internal/packet"
+)
+
+// RuleSet is an ordered list of rules and the action for packets no rule
+// allows or denies. The first allow or deny rule that matches wins.
+type RuleSet struct {
+	rules         []*ruleState
+	defaultAction Action
+	defaultHits   atomic.Uint64
+}
+
+// ruleState is a rule with its hit counter
+type ruleState struct {
+	Rule
+	hits atomic.Uint64
+}
+
+// NewRuleSet creates a rule set, the default action must be Allow or Deny
+func NewRuleSet(rules []Rule, defaultAction Action) (*RuleSet, error) {
+	if defaultAction == Log {
+		return nil, fmt.Errorf("the default action must be allow or deny")
+	}
+
+	ruleSet := &RuleSet{defaultAction: defaultAction}
+	names := map[string]bool{"default": true}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		// Hit counters are reported by name, so names must be unique
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate rule name %q", rule.Name)
+		}
+		names[rule.Name] = true
+		ruleSet.rules = append(ruleSet.rules, &ruleState{Rule: rule})
+	}
+	return ruleSet, nil
+}
+
+// FromConfig builds a rule set from the acl section of the configuration
+func FromConfig(aclConfig config.ACLConfig) (*RuleSet, error) {
+	defaultAction := Allow
+	if aclConfig.Default != "" {
+		var err error
+		if defaultAction, err = parseAction(aclConfig.Default); err != nil {
+			return nil, fmt.Errorf("invalid default action: %w", err)
+		}
+	}
+
+	var rules []Rule
+	for i, ruleConfig := range aclConfig.Rules {
+		rule, err := ParseRule(ruleConfig)
+		if err != nil {
+			label := fmt.Sprintf("%d", i+1)
+			if ruleConfig.Name != "" {
+				label += " (" + ruleConfig.Name + ")"
+			}
+			return nil, fmt.Errorf("invalid ACL rule %s: %w", label, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return NewRuleSet(rules, defaultAction)
+}
+
+// RuleStats is the state of a rule for the control API
+type RuleStats struct {
+	Name             string   `json:"name"`
+	Action           string   `json:"action"`
+	Directions       []string `json:"directions,omitempty"`
+	Protocol         string   `json:"protocol,omitempty"`
+	Sources          []string `json:"source,omitempty"`
+	Destinations     []string `json:"destination,omitempty"`
+	SourcePorts      []string `json:"source_ports,omitempty"`
+	DestinationPorts []string `json:"destination_ports,omitempty"`
+	Hits             uint64   `json:"hits"`
+}
+
+// Status is the state of the rule set for the control API
+type Status struct {
+	Default     string      `json:"default"`
+	DefaultHits uint64      `json:"default_hits"`
+	Rules       []RuleStats `json:"rules"`
+}
+
+// Engine evaluates packets against the current rule set. The rule set can be
+// replaced at any time without stopping packet processing.
+type Engine struct {
+	ruleSet atomic.Pointer[RuleSet]
+}
+
+// NewEngine creates an engine that allows everything until rules are loaded
+func NewEngine() *Engine {
+	engine := &Engine{}
+	ruleSet, _ := NewRuleSet(nil, Allow)
+	engine.ruleSet.Store(ruleSet)
+	return engine
+}
+
+// Load replaces the rule set. Hit counters start over with the new rules.
+func (engine *Engine) Load(ruleSet *RuleSet) {
+	engine.ruleSet.Store(ruleSet)
+	log.Printf("    [ACL] Loaded %d rules, default %s", len(ruleSet.rules), ruleSet.defaultAction)
+}
+
+// Allow evaluates a packet travelling in direction and reports whether it may
+// pass. Packets that cannot be parsed only get the default action.
+func (engine *Engine) Allow(direction Direction, parsed *packet.Packet) bool {
+	ruleSet := engine.ruleSet.Load()
+
+	if parsed != nil {
+		for _, rule := range ruleSet.rules {
+			if !rule.Match(direction, parsed) {
+				continue
+			}
+
+			rule.hits.Add(1)
+			switch rule.Action {
+			case Allow:
+				return true
+			case Deny:
+				return false
+			case Log:
+				log.Printf("    [ACL] Rule %s matched %s packet %s", rule.Name, direction, parsed)
+			}
+		}
+	}
+
+	ruleSet.defaultHits.Add(1)
+	return ruleSet.defaultAction == Allow
+}
+
+// Status returns the current rules and their hit counters
+func (engine *Engine) Status() Status {
+	ruleSet := engine.ruleSet.Load()
+
+	status := Status{
+		Default:     ruleSet.defaultAction.String(),
+		DefaultHits: ruleSet.defaultHits.Load(),
+		Rules:       []RuleStats{},
+	}
+
+	for _, rule := range ruleSet.rules {
+		stats := RuleStats{
+			Name:             rule.Name,
+			Action:           rule.Action.String(),
+			Sources:          stringList(rule.Sources),
+			Destinations:     stringList(rule.Destinations),
+			SourcePorts:      stringList(rule.SourcePorts),
+			DestinationPorts: stringList(rule.DestinationPorts),
+			Directions:       stringList(rule.Directions),
+			Hits:             rule.hits.Load(),
+		}
+		if rule.HasProtocol {
+			stats.Protocol = rule.Protocol.String()
+		}
+		status.Rules = append(status.Rules, stats)
+	}
+
+	return status
+}
+
+// stringList formats every value of a list
+func stringList[T fmt.Stringer](values []T) []string {
+	var list []string
+	for _, value := range values {
+		list = append(list, value.String())
+	}
+	return list
+}
@@ -0,0 +1,263 @@
+package acl
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"thinkpol-vpn/interface/internal/config"
+	"thinkpol-vpn/interface/internal/packet"
+)
+
+// buildIPv4 builds an IPv4 packet with a transport header carrying the ports.
+// A non-zero fragment offset leaves the transport header out, like the
+// fragments after the first.
+func buildIPv4(t *testing.T, protocol packet.Protocol, src, dst string, srcPort, dstPort uint16, fragmentOffset int) *packet.Packet {
+	t.Helper()
+
+	var segment []byte
+	switch {
+	case fragmentOffset != 0:
+		segment = make([]byte, 8)
+	case protocol == packet.TCP:
+		segment = make([]byte, 20)
+		segment[12] = 5 << 4
+	case protocol == packet.UDP:
+		segment = make([]byte, 8)
+		binary.BigEndian.PutUint16(segment[4:6], 8)
+	default:
+		segment = make([]byte, 8)
+	}
+	if fragmentOffset == 0 && (protocol == packet.TCP || protocol == packet.UDP) {
+		binary.BigEndian.PutUint16(segment[0:2], srcPort)
+		binary.BigEndian.PutUint16(segment[2:4], dstPort)
+	}
+
+	data := make([]byte, 20+len(segment))
+	data[0] = 0x45
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)))
+	binary.BigEndian.PutUint16(data[6:8], uint16(fragmentOffset/8))
+	data[8] = 64
+	data[9] = byte(protocol)
+	copy(data[12:16], netip.MustParseAddr(src).AsSlice())
+	copy(data[16:20], netip.MustParseAddr(dst).AsSlice())
+	copy(data[20:], segment)
+
+	parsed, err := packet.Parse(data)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return parsed
+}
+
+// loadRules builds an engine from rule configs
+func loadRules(t *testing.T, defaultAction string, rules ...config.ACLRuleConfig) *Engine {
+	t.Helper()
+
+	ruleSet, err := FromConfig(config.ACLConfig{Default: defaultAction, Rules: rules})
+	if err != nil {
+		t.Fatalf("FromConfig: %v", err)
+	}
+	engine := NewEngine()
+	engine.Load(ruleSet)
+	return engine
+}
+
+func TestRuleMatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		rule      config.ACLRuleConfig
+		direction Direction
+		packet    *packet.Packet
+		want      bool
+	}{
+		{
+			name:   "empty rule matches anything",
+			rule:   config.ACLRuleConfig{Action: "deny"},
+			packet: buildIPv4(t, packet.ICMP, "10.0.0.2", "1.1.1.1", 0, 0, 0),
+			want:   true,
+		},
+		{
+			name:      "direction",
+			rule:      config.ACLRuleConfig{Action: "deny", Direction: "in"},
+			direction: Outbound,
+			packet:    buildIPv4(t, packet.TCP, "10.0.0.2", "1.1.1.1", 40000, 443, 0),
+			want:      false,
+		},
+		{
+			name:   "protocol",
+			rule:   config.ACLRuleConfig{Action: "deny", Protocol: "udp"},
+			packet: buildIPv4(t, packet.TCP, "10.0.0.2", "1.1.1.1", 40000, 53, 0),
+			want:   false,
+		},
+		{
+			name:   "source prefix",
+			rule:   config.ACLRuleConfig{Action: "deny", Source: []string{"10.0.0.0/8"}},
+			packet: buildIPv4(t, packet.TCP, "10.0.0.2", "1.1.1.1", 40000, 443, 0),
+			want:   true,
+		},
+		{
+			name:   "mapped destination address",
+			rule:   config.ACLRuleConfig{Action: "deny", Destination: []string{"::ffff:1.1.1.1"}},
+			packet: buildIPv4(t, packet.TCP, "10.0.0.2", "1.1.1.1", 40000, 443, 0),
+			want:   true,
+		},
+		{
+			name:   "mapped destination prefix",
+			rule:   config.ACLRuleConfig{Action: "deny", Destination: []string{"::ffff:1.1.1.0/120"}},
+			packet: buildIPv4(t, packet.TCP, "10.0.0.2", "1.1.1.1", 40000, 443, 0),
+			want:   true,
+		},
+		{
+			name:   "destination port range",
+			rule:   config.ACLRuleConfig{Action: "deny", Protocol: "tcp", DestinationPorts: []string{"137-139", "445"}},
+			packet: buildIPv4(t, packet.TCP, "10.0.0.2", "10.0.0.1", 40000, 138, 0),
+			want:   true,
+		},
+		{
+			name:   "destination port outside the ranges",
+			rule:   config.ACLRuleConfig{Action: "deny", Protocol: "tcp", DestinationPorts: []string{"137-139", "445"}},
+			packet: buildIPv4(t, packet.TCP, "10.0.0.2", "10.0.0.1", 40000, 443, 0),
+			want:   false,
+		},
+		{
+			name:   "ports never match icmp",
+			rule:   config.ACLRuleConfig{Action: "deny", DestinationPorts: []string{"0-65535"}},
+			packet: buildIPv4(t, packet.ICMP, "10.0.0.2", "1.1.1.1", 0, 0, 0),
+			want:   false,
+		},
+		{
+			name:   "deny with ports matches later fragments",
+			rule:   config.ACLRuleConfig{Action: "deny", Protocol: "udp", DestinationPorts: []string{"53"}},
+			packet: buildIPv4(t, packet.UDP, "10.0.0.2", "1.1.1.1", 0, 0, 1480),
+			want:   true,
+		},
+		{
+			name:   "allow with ports does not match later fragments",
+			rule:   config.ACLRuleConfig{Action: "allow", Protocol: "udp", DestinationPorts: []string{"53"}},
+			packet: buildIPv4(t, packet.UDP, "10.0.0.2", "1.1.1.1", 0, 0, 1480),
+			want:   false,
+		},
+		{
+			name:   "deny with ports does not match later fragments of other protocols",
+			rule:   config.ACLRuleConfig{Action: "deny", DestinationPorts: []string{"53"}},
+			packet: buildIPv4(t, packet.ICMP, "10.0.0.2", "1.1.1.1", 0, 0, 1480),
+			want:   false,
+		},
+	}
+
+	for _, test := range tests {
+		rule, err := ParseRule(test.rule)
+		if err != nil {
+			t.Fatalf("%s: ParseRule: %v", test.name, err)
+		}
+		if got := rule.Match(test.direction, test.packet); got != test.want {
+			t.Errorf("%s: Match = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	engine := loadRules(t, "allow",
+		config.ACLRuleConfig{Name: "log-all", Action: "log"},
+		config.ACLRuleConfig{Name: "allow-dns", Action: "allow", Protocol: "udp", DestinationPorts: []string{"53"}},
+		config.ACLRuleConfig{Name: "deny-udp", Action: "deny", Protocol: "udp"},
+	)
+
+	tests := []struct {
+		name   string
+		packet *packet.Packet
+		want   bool
+	}{
+		{"first decisive rule wins", buildIPv4(t, packet.UDP, "10.0.0.2", "1.1.1.1", 40000, 53, 0), true},
+		{"later rule", buildIPv4(t, packet.UDP, "10.0.0.2", "1.1.1.1", 40000, 123, 0), false},
+		{"default", buildIPv4(t, packet.TCP, "10.0.0.2", "1.1.1.1", 40000, 443, 0), true},
+		// The fragments of a DNS datagram after the first have no ports
+		{"later fragment", buildIPv4(t, packet.UDP, "10.0.0.2", "1.1.1.1", 0, 0, 1480), false},
+	}
+	for _, test := range tests {
+		if got := engine.Allow(Outbound, test.packet); got != test.want {
+			t.Errorf("%s: Allow = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	hits := map[string]uint64{}
+	status := engine.Status()
+	for _, rule := range status.Rules {
+		hits[rule.Name] = rule.Hits
+	}
+	want := map[string]uint64{"log-all": 4, "allow-dns": 1, "deny-udp": 2}
+	for name, count := range want {
+		if hits[name] != count {
+			t.Errorf("%s hits = %d, want %d", name, hits[name], count)
+		}
+	}
+	if status.DefaultHits != 1 {
+		t.Errorf("default hits = %d, want 1", status.DefaultHits)
+	}
+
+	// Unparsable packets only get the default action
+	if !engine.Allow(Outbound, nil) {
+		t.Errorf("Allow(nil) = false, want the default action")
+	}
+}
+
+func TestFragmentDeny(t *testing.T) {
+	engine := loadRules(t, "allow",
+		config.ACLRuleConfig{Name: "no-smb", Action: "deny", Protocol: "tcp", DestinationPorts: []string{"445"}},
+	)
+
+	if engine.Allow(Outbound, buildIPv4(t, packet.TCP, "10.0.0.2", "10.0.0.1", 40000, 445, 0)) {
+		t.Errorf("first fragment to port 445 allowed")
+	}
+	if engine.Allow(Outbound, buildIPv4(t, packet.TCP, "10.0.0.2", "10.0.0.1", 0, 0, 1480)) {
+		t.Errorf("later fragment allowed past a port restricted deny rule")
+	}
+}
+
+func TestReload(t *testing.T) {
+	deny := loadRules(t, "deny")
+	allow := loadRules(t, "allow")
+	engine := NewEngine()
+	probe := buildIPv4(t, packet.TCP, "10.0.0.2", "1.1.1.1", 40000, 443, 0)
+
+	// Packets keep being evaluated against a complete rule set while rules
+	// are replaced, run with -race
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					engine.Allow(Outbound, probe)
+					engine.Status()
+				}
+			}
+		}()
+	}
+	for i := range 1000 {
+		if i%2 == 0 {
+			engine.Load(deny.ruleSet.Load())
+		} else {
+			engine.Load(allow.ruleSet.Load())
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	engine.Load(deny.ruleSet.Load())
+	if engine.Allow(Outbound, probe) {
+		t.Errorf("Allow = true after loading a deny rule set")
+	}
+
+	// A config with invalid rules is rejected before anything is replaced
+	if _, err := FromConfig(config.ACLConfig{Rules: []config.ACLRuleConfig{{Action: "drop"}}}); err == nil {
+		t.Errorf("FromConfig accepted an unknown action")
+	}
+}
@@ -0,0 +1,34 @@
+package acl
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var aclHitsDesc = prometheus.NewDesc(
+	"thinkpol_vpn_acl_hits_total",
+	"Packets matched by an ACL rule, the default rule counts packets no rule decided.",
+	[]string{"rule", "action"}, nil,
+)
+
+// engineCollector exports the rule hit counters as Prometheus metrics
+type engineCollector struct {
+	engine *Engine
+}
+
+// Collector returns a Prometheus collector for the rule hit counters
+func (engine *Engine) Collector() prometheus.Collector {
+	return &engineCollector{engine: engine}
+}
+
+// Describe implements prometheus.Collector
+func (collector *engineCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- aclHitsDesc
+}
+
+// Collect implements prometheus.Collector
+func (collector *engineCollector) Collect(metrics chan<- prometheus.Metric) {
+	status := collector.engine.Status()
+
+	metrics <- prometheus.MustNewConstMetric(aclHitsDesc, prometheus.CounterValue, float64(status.DefaultHits), "default", status.Default)
+	for _, rule := range status.Rules {
+		metrics <- prometheus.MustNewConstMetric(aclHitsDesc, prometheus.CounterValue, float64(rule.Hits), rule.Name, rule.Action)
+	}
+}
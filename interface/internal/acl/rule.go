@@ -0,0 +1,271 @@
+package acl
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"thinkpol-vpn/interface/internal/config"
+	"thinkpol-vpn/interface/internal/packet"
+)
+
+// Action is what a rule does with a matching packet
+type Action int
+
+const (
+	// Allow lets the packet through
+	Allow Action = iota
+	// Deny drops the packet
+	Deny
+	// Log logs the packet and goes on with the next rule
+	Log
+)
+
+// String returns the action name used in the configuration
+func (action Action) String() string {
+	switch action {
+	case Allow:
+		return "allow"
+	case Deny:
+		return "deny"
+	case Log:
+		return "log"
+	default:
+		return fmt.Sprintf("action(%d)", int(action))
+	}
+}
+
+// parseAction parses an action name
+func parseAction(name string) (Action, error) {
+	switch strings.ToLower(name) {
+	case "allow":
+		return Allow, nil
+	case "deny":
+		return Deny, nil
+	case "log":
+		return Log, nil
+	default:
+		return 0, fmt.Errorf("unknown action %q, expected allow, deny or log", name)
+	}
+}
+
+// Direction is the way a packet travels through the tunnel
+type Direction int
+
+const (
+	// Outbound packets are sent into the tunnel
+	Outbound Direction = iota
+	// Inbound packets are received from the tunnel
+	Inbound
+)
+
+// String returns the direction name used in the configuration
+func (direction Direction) String() string {
+	if direction == Inbound {
+		return "in"
+	}
+	return "out"
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	Low  uint16
+	High uint16
+}
+
+// contains reports whether port is in the range
+func (portRange PortRange) contains(port uint16) bool {
+	return port >= portRange.Low && port <= portRange.High
+}
+
+// String returns the range as "low-high", or a single port
+func (portRange PortRange) String() string {
+	if portRange.Low == portRange.High {
+		return strconv.Itoa(int(portRange.Low))
+	}
+	return fmt.Sprintf("%d-%d", portRange.Low, portRange.High)
+}
+
+// parsePortRange parses "port" or "low-high"
+func parsePortRange(value string) (PortRange, error) {
+	lowValue, highValue, found := strings.Cut(value, "-")
+	if !found {
+		highValue = lowValue
+	}
+
+	low, lowErr := strconv.ParseUint(strings.TrimSpace(lowValue), 10, 16)
+	high, highErr := strconv.ParseUint(strings.TrimSpace(highValue), 10, 16)
+	if lowErr != nil || highErr != nil || low > high {
+		return PortRange{}, fmt.Errorf("invalid port range %q", value)
+	}
+	return PortRange{Low: uint16(low), High: uint16(high)}, nil
+}
+
+// Rule matches packets. Empty fields match anything.
+type Rule struct {
+	Name   string
+	Action Action
+	// Directions the rule applies to, both when empty
+	Directions []Direction
+	// Protocol restricts the rule to one IP protocol when set
+	Protocol     packet.Protocol
+	HasProtocol  bool
+	Sources      []netip.Prefix
+	Destinations []netip.Prefix
+	// Port ranges only match TCP and UDP packets
+	SourcePorts      []PortRange
+	DestinationPorts []PortRange
+}
+
+// Match reports whether the rule matches a packet travelling in direction
+func (rule *Rule) Match(direction Direction, parsed *packet.Packet) bool {
+	if len(rule.Directions) > 0 && !containsDirection(rule.Directions, direction) {
+		return false
+	}
+	if rule.HasProtocol && parsed.Protocol != rule.Protocol {
+		return false
+	}
+	if len(rule.Sources) > 0 && !containsAddr(rule.Sources, parsed.Src) {
+		return false
+	}
+	if len(rule.Destinations) > 0 && !containsAddr(rule.Destinations, parsed.Dst) {
+		return false
+	}
+
+	if len(rule.SourcePorts) > 0 || len(rule.DestinationPorts) > 0 {
+		srcPort, dstPort, ok := parsed.Ports()
+		if !ok {
+			// Only the first fragment carries the ports. Deny rules match the
+			// others too, so a fragment cannot slip past a port restriction.
+			return rule.Action == Deny && parsed.FragmentOffset != 0 &&
+				(parsed.Protocol == packet.TCP || parsed.Protocol == packet.UDP)
+		}
+		if len(rule.SourcePorts) > 0 && !containsPort(rule.SourcePorts, srcPort) {
+			return false
+		}
+		if len(rule.DestinationPorts) > 0 && !containsPort(rule.DestinationPorts, dstPort) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsDirection(directions []Direction, direction Direction) bool {
+	for _, candidate := range directions {
+		if candidate == direction {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(ranges []PortRange, port uint16) bool {
+	for _, portRange := range ranges {
+		if portRange.contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// protocolNames are the protocols rules can name instead of giving a number
+var protocolNames = map[string]packet.Protocol{
+	"icmp":   packet.ICMP,
+	"tcp":    packet.TCP,
+	"udp":    packet.UDP,
+	"icmp6":  packet.ICMPv6,
+	"icmpv6": packet.ICMPv6,
+}
+
+// ParseRule converts a rule from the configuration
+func ParseRule(ruleConfig config.ACLRuleConfig) (Rule, error) {
+	rule := Rule{Name: ruleConfig.Name}
+
+	action, err := parseAction(ruleConfig.Action)
+	if err != nil {
+		return rule, err
+	}
+	rule.Action = action
+
+	switch strings.ToLower(ruleConfig.Direction) {
+	case "", "both":
+	case "in":
+		rule.Directions = []Direction{Inbound}
+	case "out":
+		rule.Directions = []Direction{Outbound}
+	default:
+		return rule, fmt.Errorf("unknown direction %q, expected in, out or both", ruleConfig.Direction)
+	}
+
+	switch protocol := strings.ToLower(ruleConfig.Protocol); protocol {
+	case "", "any":
+	default:
+		rule.HasProtocol = true
+		if named, ok := protocolNames[protocol]; ok {
+			rule.Protocol = named
+			break
+		}
+		number, err := strconv.ParseUint(protocol, 10, 8)
+		if err != nil {
+			return rule, fmt.Errorf("unknown protocol %q", ruleConfig.Protocol)
+		}
+		rule.Protocol = packet.Protocol(number)
+	}
+
+	if rule.Sources, err = parsePrefixes(ruleConfig.Source); err != nil {
+		return rule, err
+	}
+	if rule.Destinations, err = parsePrefixes(ruleConfig.Destination); err != nil {
+		return rule, err
+	}
+	if rule.SourcePorts, err = parsePortRanges(ruleConfig.SourcePorts); err != nil {
+		return rule, err
+	}
+	if rule.DestinationPorts, err = parsePortRanges(ruleConfig.DestinationPorts); err != nil {
+		return rule, err
+	}
+
+	if (len(rule.SourcePorts) > 0 || len(rule.DestinationPorts) > 0) && rule.HasProtocol &&
+		rule.Protocol != packet.TCP && rule.Protocol != packet.UDP {
+		return rule, fmt.Errorf("ports need protocol tcp or udp, not %s", rule.Protocol)
+	}
+
+	return rule, nil
+}
+
+// parsePrefixes parses CIDR prefixes, a bare address is a single host
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		prefix, err := packet.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix %q: %w", value, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// parsePortRanges parses a list of ports and port ranges
+func parsePortRanges(values []string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, value := range values {
+		portRange, err := parsePortRange(value)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, portRange)
+	}
+	return ranges, nil
+}
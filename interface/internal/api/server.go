@@ -0,0 +1,298 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"thinkpol-vpn/interface/internal/acl"
+	"thinkpol-vpn/interface/internal/capture"
+	"thinkpol-vpn/interface/internal/gateway"
+	"thinkpol-vpn/interface/internal/proxy"
+	"thinkpol-vpn/interface/internal/pt"
+	"thinkpol-vpn/interface/internal/ratelimit"
+	"thinkpol-vpn/interface/internal/tun"
+)
+
+// Server is the HTTP control API for the interface and the transport
+type Server struct {
+	// interfaceManager is nil when no TUN interface is used (netstack mode)
+	interfaceManager *tun.InterfaceManager
+	// transport is nil in gateway mode, gateway is nil otherwise
+	transport proxy.Transport
+	gateway   *gateway.Gateway
+	capturer  *capture.Capturer
+	aclEngine *acl.Engine
+	reloadACL func() error
+
+	pluggableTransports func() []pt.Method
+}
+
+// Options are the components the control API manages
+type Options struct {
+	// InterfaceManager is nil when no TUN interface is used (netstack mode)
+	InterfaceManager *tun.InterfaceManager
+	// Transport is nil in gateway mode, Gateway is nil otherwise
+	Transport proxy.Transport
+	Gateway   *gateway.Gateway
+	Capturer  *capture.Capturer
+	ACL       *acl.Engine
+	// ReloadACL reloads the ACL rules from the configuration
+	ReloadACL func() error
+	// PluggableTransports returns the running server transports
+	PluggableTransports func() []pt.Method
+}
+
+// NewServer creates a new control API server
+func NewServer(options Options) *Server {
+	return &Server{
+		interfaceManager: options.InterfaceManager,
+		transport:        options.Transport,
+		gateway:          options.Gateway,
+		capturer:         options.Capturer,
+		aclEngine:        options.ACL,
+		reloadACL:        options.ReloadACL,
+
+		pluggableTransports: options.PluggableTransports,
+	}
+}
+
+// Register adds the API endpoints to the mux
+func (server *Server) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /health", server.handleHealth)
+	mux.HandleFunc("GET /api/interface/status", server.withInterface(server.handleInterfaceStatus))
+	mux.HandleFunc("POST /api/interface/start", server.withInterface(server.handleInterfaceStart))
+	mux.HandleFunc("POST /api/interface/stop", server.withInterface(server.handleInterfaceStop))
+	mux.HandleFunc("GET /api/transport/status", server.withTransport(server.handleTransportStatus))
+	mux.HandleFunc("PUT /api/transport/rate_limit", server.withTransport(server.handleTransportRateLimit))
+	mux.HandleFunc("GET /api/gateway", server.withGateway(server.handleGatewayStatus))
+	mux.HandleFunc("PUT /api/gateway/clients/{name}/rate_limit", server.withGateway(server.handleClientRateLimit))
+	mux.HandleFunc("GET /api/capture/status", server.handleCaptureStatus)
+	mux.HandleFunc("POST /api/capture/start", server.handleCaptureStart)
+	mux.HandleFunc("POST /api/capture/stop", server.handleCaptureStop)
+	mux.HandleFunc("GET /api/acl", server.handleACLStatus)
+	mux.HandleFunc("POST /api/acl/reload", server.handleACLReload)
+	mux.HandleFunc("GET /api/pluggable_transports", server.handlePluggableTransports)
+}
+
+// handleHealth reports that the process is alive
+func (server *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+// handleInterfaceStatus returns the interface status including its counters
+func (server *Server) handleInterfaceStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, server.interfaceManager.GetStatus())
+}
+
+// handleInterfaceStart starts packet processing
+func (server *Server) handleInterfaceStart(w http.ResponseWriter, r *http.Request) {
+	if err := server.interfaceManager.Start(); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeSuccess(w)
+}
+
+// handleInterfaceStop stops packet processing
+func (server *Server) handleInterfaceStop(w http.ResponseWriter, r *http.Request) {
+	if err := server.interfaceManager.Stop(); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeSuccess(w)
+}
+
+// handleTransportStatus returns the transport counters
+func (server *Server) handleTransportStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, server.transport.Stats())
+}
+
+// handleTransportRateLimit changes the rate limits of the transport
+func (server *Server) handleTransportRateLimit(w http.ResponseWriter, r *http.Request) {
+	configureRateLimit(w, r, server.transport.RateLimit())
+}
+
+// handleClientRateLimit changes the rate limits of a gateway client
+func (server *Server) handleClientRateLimit(w http.ResponseWriter, r *http.Request) {
+	shaper := server.gateway.RateLimit(r.PathValue("name"))
+	if shaper == nil {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"status": "error",
+			"error":  "unknown client " + r.PathValue("name"),
+		})
+		return
+	}
+	configureRateLimit(w, r, shaper)
+}
+
+// configureRateLimit applies the limits in the body, fields left out keep
+// their current value
+func configureRateLimit(w http.ResponseWriter, r *http.Request, shaper *ratelimit.Shaper) {
+	rateLimitConfig := shaper.Config()
+	if err := json.NewDecoder(r.Body).Decode(&rateLimitConfig); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := shaper.Configure(rateLimitConfig); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, shaper.Status())
+}
+
+// handleGatewayStatus returns the gateway clients, their sessions and counters
+func (server *Server) handleGatewayStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, server.gateway.Status())
+}
+
+// handleCaptureStatus returns the state of the packet capture
+func (server *Server) handleCaptureStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, server.capturer.Status())
+}
+
+// handleCaptureStart starts a packet capture, the body holds the capture options
+func (server *Server) handleCaptureStart(w http.ResponseWriter, r *http.Request) {
+	var options capture.Options
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&options); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	if err := server.capturer.Start(options); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, server.capturer.Status())
+}
+
+// handleCaptureStop stops the packet capture
+func (server *Server) handleCaptureStop(w http.ResponseWriter, r *http.Request) {
+	status := server.capturer.Status()
+	if err := server.capturer.Stop(); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	status.Running = false
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleACLStatus returns the ACL rules and their hit counters
+func (server *Server) handleACLStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, server.aclEngine.Status())
+}
+
+// handleACLReload reloads the ACL rules from the configuration file
+func (server *Server) handleACLReload(w http.ResponseWriter, r *http.Request) {
+	if err := server.reloadACL(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, server.aclEngine.Status())
+}
+
+// handlePluggableTransports returns the addresses and arguments clients
+// connect to the server transports with
+func (server *Server) handlePluggableTransports(w http.ResponseWriter, r *http.Request) {
+	methods := []pt.Method{}
+	if server.pluggableTransports != nil {
+		methods = append(methods, server.pluggableTransports()...)
+	}
+	writeJSON(w, http.StatusOK, methods)
+}
+
+// RequireToken makes handler answer only requests that carry the token as
+// "Authorization: Bearer <token>". An empty token lets every request through.
+func RequireToken(token string, handler http.Handler) http.Handler {
+	if token == "" {
+		return handler
+	}
+	want := sha256.Sum256([]byte(token))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Hashes have the same length, so comparing them takes the same time
+		// whatever the length of the token sent
+		given, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		hash := sha256.Sum256([]byte(given))
+		if !found || subtle.ConstantTimeCompare(hash[:], want[:]) != 1 {
+			log.Printf("    [API] Rejected unauthenticated request from %s", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+				"status": "error",
+				"error":  "unauthorized",
+			})
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// withInterface rejects interface requests when there is no TUN interface
+func (server *Server) withInterface(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if server.interfaceManager == nil {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{
+				"status": "error",
+				"error":  "no TUN interface in this mode",
+			})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// withTransport rejects transport requests in gateway mode
+func (server *Server) withTransport(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if server.transport == nil {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{
+				"status": "error",
+				"error":  "no single-peer transport in this mode, see /api/gateway",
+			})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// withGateway rejects gateway requests when not running as a gateway
+func (server *Server) withGateway(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if server.gateway == nil {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{
+				"status": "error",
+				"error":  "not running as a gateway",
+			})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// writeSuccess writes the response for a successful action
+func writeSuccess(w http.ResponseWriter) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "success"})
+}
+
+// writeError writes the response for a failed action
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]interface{}{
+		"status": "error",
+		"error":  err.Error(),
+	})
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("    [API] Error writing response: %v", err)
+	}
+}
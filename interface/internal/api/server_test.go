@@ -0,0 +1,43 @@
+package api
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(output)
+
+	mux := http.NewServeMux()
+	NewServer(Options{}).Register(mux)
+
+	tests := []struct {
+		token         string
+		authorization string
+		want          int
+	}{
+		{"", "", http.StatusOK},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/health", nil)
+		if test.authorization != "" {
+			request.Header.Set("Authorization", test.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		RequireToken(test.token, mux).ServeHTTP(recorder, request)
+
+		if recorder.Code != test.want {
+			t.Errorf("token %q, Authorization %q: status = %d, want %d", test.token, test.authorization, recorder.Code, test.want)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package capture
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Source is where in the data path a packet was seen
+type Source string
+
+const (
+	// SourceTUN is the TUN interface
+	SourceTUN Source = "tun"
+	// SourceTransport is the websocket transport
+	SourceTransport Source = "transport"
+)
+
+// capturePoints lists every source, in pcapng interface ID order
+var capturePoints = []Source{SourceTUN, SourceTransport}
+
+// interfaceID returns the pcapng interface ID of the source
+func (source Source) interfaceID() int {
+	for id, point := range capturePoints {
+		if point == source {
+			return id
+		}
+	}
+	return 0
+}
+
+// Direction is the way a packet travels relative to this host
+type Direction int
+
+const (
+	// Outbound packets leave through the tunnel
+	Outbound Direction = iota
+	// Inbound packets come back from the tunnel
+	Inbound
+)
+
+// Point is a place packets are captured at
+type Point struct {
+	Source    Source
+	Direction Direction
+}
+
+// Options describe a capture
+type Options struct {
+	// Name is the file name prefix, files are written to the capture directory
+	Name string `json:"name"`
+	// Format is "pcap" or "pcapng"
+	Format string `json:"format"`
+	// Filter selects the packets to capture, see Filter
+	Filter string `json:"filter"`
+	// MaxFileSize rotates to a new file once a file reaches this many bytes, 0 never rotates
+	MaxFileSize int64 `json:"max_file_size"`
+	// MaxFiles is how many rotated files are kept, 0 keeps all of them
+	MaxFiles int `json:"max_files"`
+	// Snaplen truncates packets to this many bytes
+	Snaplen int `json:"snaplen"`
+}
+
+// Status describes the current capture
+type Status struct {
+	Running bool     `json:"running"`
+	Format  string   `json:"format,omitempty"`
+	Filter  string   `json:"filter,omitempty"`
+	Files   []string `json:"files,omitempty"`
+	Packets uint64   `json:"packets"`
+	Bytes   uint64   `json:"bytes"`
+}
+
+// Capturer writes packets seen on the data path to capture files. Capture is
+// a no-op unless a capture is running, so capture points can always call it.
+type Capturer struct {
+	directory string
+	defaults  Options
+
+	controlMutex sync.Mutex
+	session      atomic.Pointer[session]
+}
+
+// NewCapturer creates a capturer that writes files to directory.
+// Options left zero when starting a capture are taken from defaults.
+func NewCapturer(directory string, defaults Options) *Capturer {
+	return &Capturer{
+		directory: directory,
+		defaults:  defaults,
+	}
+}
+
+// Start starts a capture, it fails if one is already running
+func (capturer *Capturer) Start(options Options) error {
+	capturer.controlMutex.Lock()
+	defer capturer.controlMutex.Unlock()
+
+	if capturer.session.Load() != nil {
+		return fmt.Errorf("a capture is already running")
+	}
+
+	options = capturer.withDefaults(options)
+
+	// The name comes from the control API, so it must not escape the directory
+	if options.Name == "" || strings.ContainsAny(options.Name, `/\`) || strings.HasPrefix(options.Name, ".") {
+		return fmt.Errorf("invalid capture name %q", options.Name)
+	}
+	if options.Snaplen <= 0 {
+		return fmt.Errorf("invalid snaplen %d", options.Snaplen)
+	}
+
+	format, err := newFormatWriter(options.Format)
+	if err != nil {
+		return err
+	}
+
+	filter, err := ParseFilter(options.Filter)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(capturer.directory, 0750); err != nil {
+		return fmt.Errorf("failed to create capture directory: %w", err)
+	}
+
+	session := &session{
+		options:   options,
+		directory: capturer.directory,
+		format:    format,
+		filter:    filter,
+		started:   time.Now(),
+	}
+	if err := session.rotate(); err != nil {
+		return err
+	}
+
+	capturer.session.Store(session)
+	log.Printf("    [CAPTURE] Capturing to %s (%s, filter %q)", session.files[0], options.Format, filter)
+	return nil
+}
+
+// Stop stops the running capture and flushes its last file
+func (capturer *Capturer) Stop() error {
+	capturer.controlMutex.Lock()
+	defer capturer.controlMutex.Unlock()
+
+	session := capturer.session.Swap(nil)
+	if session == nil {
+		return fmt.Errorf("no capture is running")
+	}
+
+	err := session.close()
+	log.Printf("    [CAPTURE] Stopped capture, %d packets in %d files", session.packets, len(session.files))
+	return err
+}
+
+// Status returns the state of the current capture
+func (capturer *Capturer) Status() Status {
+	session := capturer.session.Load()
+	if session == nil {
+		return Status{}
+	}
+	return session.status()
+}
+
+// Capture records a packet seen at a capture point, if a capture is running
+// and the packet passes its filter
+func (capturer *Capturer) Capture(point Point, packet []byte) {
+	if capturer == nil {
+		return
+	}
+
+	session := capturer.session.Load()
+	if session == nil || !session.filter.Match(packet) {
+		return
+	}
+
+	if err := session.write(point, packet); err != nil {
+		// Only the capture that failed is stopped, not one started since
+		if capturer.session.CompareAndSwap(session, nil) {
+			log.Printf("    [CAPTURE] Error writing packet, stopping capture: %v", err)
+			session.close()
+		}
+	}
+}
+
+// withDefaults fills in the options left zero
+func (capturer *Capturer) withDefaults(options Options) Options {
+	if options.Name == "" {
+		options.Name = capturer.defaults.Name
+	}
+	if options.Format == "" {
+		options.Format = capturer.defaults.Format
+	}
+	if options.Format == "" {
+		options.Format = FormatPcapng
+	}
+	if options.MaxFileSize == 0 {
+		options.MaxFileSize = capturer.defaults.MaxFileSize
+	}
+	if options.MaxFiles == 0 {
+		options.MaxFiles = capturer.defaults.MaxFiles
+	}
+	if options.Snaplen == 0 {
+		options.Snaplen = capturer.defaults.Snaplen
+	}
+	return options
+}
+
+// session is a running capture
+type session struct {
+	options   Options
+	directory string
+	format    formatWriter
+	filter    *Filter
+	// started keeps the files of successive captures with the same name apart
+	started time.Time
+
+	mutex   sync.Mutex
+	closed  bool
+	file    *os.File
+	writer  *bufio.Writer
+	size    int64
+	files   []string
+	index   int
+	packets uint64
+	bytes   uint64
+}
+
+// write appends a packet, rotating to a new file when the current one is full
+func (session *session) write(point Point, packet []byte) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.closed {
+		return nil
+	}
+
+	if session.options.MaxFileSize > 0 && session.size >= session.options.MaxFileSize {
+		if err := session.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := session.format.writePacket(session.writer, session.options.Snaplen, point, time.Now(), packet)
+	session.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	session.packets++
+	session.bytes += uint64(len(packet))
+	return nil
+}
+
+// rotate closes the current file, starts the next one and removes the
+// oldest files beyond MaxFiles
+func (session *session) rotate() error {
+	if err := session.closeFile(); err != nil {
+		return err
+	}
+
+	session.index++
+	path := filepath.Join(session.directory, fmt.Sprintf("%s-%s-%04d.%s",
+		session.options.Name, session.started.Format("20060102-150405"), session.index, session.options.Format))
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to create capture file: %w", err)
+	}
+
+	session.file = file
+	session.writer = bufio.NewWriter(file)
+	session.files = append(session.files, path)
+
+	n, err := session.format.writeHeader(session.writer, session.options.Snaplen)
+	session.size = int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write capture header: %w", err)
+	}
+
+	for session.options.MaxFiles > 0 && len(session.files) > session.options.MaxFiles {
+		if err := os.Remove(session.files[0]); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("    [CAPTURE] Warning: failed to remove old capture file: %v", err)
+		}
+		session.files = session.files[1:]
+	}
+
+	return nil
+}
+
+// closeFile flushes and closes the current file
+func (session *session) closeFile() error {
+	if session.file == nil {
+		return nil
+	}
+
+	flushErr := session.writer.Flush()
+	closeErr := session.file.Close()
+	session.file = nil
+	session.writer = nil
+
+	if err := errors.Join(flushErr, closeErr); err != nil {
+		return fmt.Errorf("failed to close capture file: %w", err)
+	}
+	return nil
+}
+
+// close ends the session
+func (session *session) close() error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.closed = true
+	return session.closeFile()
+}
+
+// status returns the state of the session
+func (session *session) status() Status {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return Status{
+		Running: !session.closed,
+		Format:  session.options.Format,
+		Filter:  session.filter.String(),
+		Files:   append([]string(nil), session.files...),
+		Packets: session.packets,
+		Bytes:   session.bytes,
+	}
+}
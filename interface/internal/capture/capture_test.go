@@ -0,0 +1,196 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPacket is an IPv4 UDP packet from 10.0.0.2:1234 to 10.0.0.1:53
+var testPacket = []byte{
+	0x45, 0x00, 0x00, 0x1c, 0x00, 0x00, 0x00, 0x00, 0x40, 0x11, 0x00, 0x00,
+	10, 0, 0, 2, 10, 0, 0, 1,
+	0x04, 0xd2, 0x00, 0x35, 0x00, 0x08, 0x00, 0x00,
+}
+
+func TestCaptureName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"capture", true},
+		{"tunnel.debug", true},
+		{"../escape", false},
+		{"sub/dir", false},
+		{`sub\dir`, false},
+		{".hidden", false},
+		{"..", false},
+	}
+
+	for _, test := range tests {
+		directory := t.TempDir()
+		capturer := NewCapturer(directory, Options{Snaplen: 65535})
+
+		err := capturer.Start(Options{Name: test.name})
+		if (err == nil) != test.valid {
+			t.Errorf("Start(%q) = %v, want valid %v", test.name, err, test.valid)
+		}
+		if err != nil {
+			continue
+		}
+
+		files := capturer.Status().Files
+		capturer.Stop()
+		if len(files) != 1 || filepath.Dir(files[0]) != directory {
+			t.Errorf("Start(%q) wrote %q, want one file in %s", test.name, files, directory)
+		}
+	}
+}
+
+func TestCaptureRotation(t *testing.T) {
+	directory := t.TempDir()
+	capturer := NewCapturer(directory, Options{Name: "capture", Snaplen: 65535})
+
+	// The pcap header and one packet record fill a file
+	fileSize := int64(24 + 16 + len(testPacket))
+	if err := capturer.Start(Options{Format: FormatPcap, MaxFileSize: fileSize, MaxFiles: 2}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	for range 5 {
+		capturer.Capture(Point{Source: SourceTUN, Direction: Outbound}, testPacket)
+	}
+	status := capturer.Status()
+	if err := capturer.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	if status.Packets != 5 {
+		t.Errorf("packets = %d, want 5", status.Packets)
+	}
+	if len(status.Files) != 2 {
+		t.Fatalf("files = %q, want the 2 newest", status.Files)
+	}
+	for i, suffix := range []string{"-0004.pcap", "-0005.pcap"} {
+		if !strings.HasSuffix(status.Files[i], suffix) {
+			t.Errorf("files[%d] = %s, want it to end in %s", i, status.Files[i], suffix)
+		}
+	}
+
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("directory holds %d files, want the older ones removed", len(entries))
+	}
+	for _, path := range status.Files {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if info.Size() != fileSize {
+			t.Errorf("%s is %d bytes, want %d", path, info.Size(), fileSize)
+		}
+	}
+}
+
+// captureOne captures a single inbound transport packet and returns the file
+func captureOne(t *testing.T, format string, snaplen int) []byte {
+	t.Helper()
+
+	capturer := NewCapturer(t.TempDir(), Options{Name: "capture"})
+	if err := capturer.Start(Options{Format: format, Snaplen: snaplen}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	capturer.Capture(Point{Source: SourceTransport, Direction: Inbound}, testPacket)
+	files := capturer.Status().Files
+	if err := capturer.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	if !strings.HasSuffix(files[0], "."+format) {
+		t.Errorf("file = %s, want the .%s extension", files[0], format)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	return data
+}
+
+func TestCapturePcap(t *testing.T) {
+	data := captureOne(t, FormatPcap, 20)
+
+	if len(data) != 24+16+20 {
+		t.Fatalf("file is %d bytes, want a header and one truncated record", len(data))
+	}
+	if magic := binary.LittleEndian.Uint32(data[0:4]); magic != 0xa1b2c3d4 {
+		t.Errorf("magic = %#x, want the microsecond pcap magic", magic)
+	}
+	if linkType := binary.LittleEndian.Uint32(data[20:24]); linkType != linkTypeRaw {
+		t.Errorf("link type = %d, want %d", linkType, linkTypeRaw)
+	}
+
+	record := data[24:]
+	if captured := binary.LittleEndian.Uint32(record[8:12]); captured != 20 {
+		t.Errorf("captured length = %d, want the snaplen", captured)
+	}
+	if original := binary.LittleEndian.Uint32(record[12:16]); original != uint32(len(testPacket)) {
+		t.Errorf("original length = %d, want %d", original, len(testPacket))
+	}
+	if !bytes.Equal(record[16:], testPacket[:20]) {
+		t.Errorf("record = %x, want the start of the packet", record[16:])
+	}
+}
+
+func TestCapturePcapng(t *testing.T) {
+	data := captureOne(t, FormatPcapng, 65535)
+
+	// Walk the blocks: a section header, an interface per capture point and the packet
+	var types []uint32
+	var packet []byte
+	for offset := 0; offset < len(data); {
+		blockType := binary.LittleEndian.Uint32(data[offset:])
+		length := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		if trailer := int(binary.LittleEndian.Uint32(data[offset+length-4:])); trailer != length {
+			t.Fatalf("block at %d has length %d and trailer %d", offset, length, trailer)
+		}
+		types = append(types, blockType)
+		if blockType == pcapngEnhancedPacket {
+			packet = data[offset+8 : offset+length-4]
+		}
+		offset += length
+	}
+
+	want := []uint32{pcapngSectionHeader, pcapngInterfaceDesc, pcapngInterfaceDesc, pcapngEnhancedPacket}
+	if len(types) != len(want) {
+		t.Fatalf("block types = %x, want %x", types, want)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Errorf("block %d type = %#x, want %#x", i, types[i], want[i])
+		}
+	}
+
+	if id := binary.LittleEndian.Uint32(packet[0:4]); id != uint32(SourceTransport.interfaceID()) {
+		t.Errorf("interface ID = %d, want the transport's", id)
+	}
+	if captured := binary.LittleEndian.Uint32(packet[12:16]); captured != uint32(len(testPacket)) {
+		t.Errorf("captured length = %d, want %d", captured, len(testPacket))
+	}
+	if !bytes.Equal(packet[20:20+len(testPacket)], testPacket) {
+		t.Errorf("packet data = %x, want %x", packet[20:20+len(testPacket)], testPacket)
+	}
+
+	// The flags option follows the padded packet data
+	options := packet[20+len(testPacket)+padding(len(testPacket)):]
+	if code := binary.LittleEndian.Uint16(options[0:2]); code != pcapngOptionEpbFlags {
+		t.Fatalf("option code = %d, want the flags", code)
+	}
+	if flags := binary.LittleEndian.Uint32(options[4:8]); flags != pcapngFlagInbound {
+		t.Errorf("flags = %d, want inbound", flags)
+	}
+}
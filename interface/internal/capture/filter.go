@@ -0,0 +1,281 @@
+package capture
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"thinkpol-vpn/interface/internal/packet"
+)
+
+// IP protocols the filter knows by name
+var protocolNames = map[string]packet.Protocol{
+	"icmp":   packet.ICMP,
+	"tcp":    packet.TCP,
+	"udp":    packet.UDP,
+	"icmp6":  packet.ICMPv6,
+	"icmpv6": packet.ICMPv6,
+}
+
+// matcher reports whether a packet passes a filter expression
+type matcher func(parsed *packet.Packet) bool
+
+// Filter selects the packets that are captured. It understands a subset of
+// the tcpdump syntax:
+//
+//	tcp, udp, icmp, icmp6, ip, ip6, proto <name|number>
+//	[src|dst] host <address>
+//	[src|dst] net <prefix>
+//	[src|dst] port <port>
+//	[src|dst] portrange <low>-<high>
+//
+// combined with and (&&), or (||), not (!) and parentheses.
+type Filter struct {
+	expression string
+	match      matcher
+}
+
+// ParseFilter compiles a filter expression, the empty expression matches everything
+func ParseFilter(expression string) (*Filter, error) {
+	filter := &Filter{expression: strings.TrimSpace(expression)}
+	if filter.expression == "" {
+		return filter, nil
+	}
+
+	parser := &filterParser{tokens: tokenize(filter.expression)}
+	match, err := parser.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", filter.expression, err)
+	}
+	if token := parser.peek(); token != "" {
+		return nil, fmt.Errorf("invalid filter %q: unexpected %q", filter.expression, token)
+	}
+
+	filter.match = match
+	return filter, nil
+}
+
+// String returns the filter expression
+func (filter *Filter) String() string {
+	return filter.expression
+}
+
+// Match reports whether the packet passes the filter. Packets that are not
+// IP packets only pass the empty filter.
+func (filter *Filter) Match(data []byte) bool {
+	if filter.match == nil {
+		return true
+	}
+
+	parsed, err := packet.Parse(data)
+	if err != nil {
+		return false
+	}
+	return filter.match(parsed)
+}
+
+// tokenize splits an expression into words and parentheses
+func tokenize(expression string) []string {
+	expression = strings.NewReplacer("(", " ( ", ")", " ) ", "&&", " and ", "||", " or ", "!", " not ").Replace(expression)
+	return strings.Fields(strings.ToLower(expression))
+}
+
+// filterParser is a recursive descent parser over the expression tokens
+type filterParser struct {
+	tokens   []string
+	position int
+}
+
+// peek returns the next token without consuming it
+func (parser *filterParser) peek() string {
+	if parser.position >= len(parser.tokens) {
+		return ""
+	}
+	return parser.tokens[parser.position]
+}
+
+// next consumes the next token
+func (parser *filterParser) next() string {
+	token := parser.peek()
+	if token != "" {
+		parser.position++
+	}
+	return token
+}
+
+// parseOr parses alternatives, which bind weaker than and
+func (parser *filterParser) parseOr() (matcher, error) {
+	left, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for parser.peek() == "or" {
+		parser.next()
+		right, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orMatcher(left, right)
+	}
+	return left, nil
+}
+
+// parseAnd parses conjunctions
+func (parser *filterParser) parseAnd() (matcher, error) {
+	left, err := parser.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for parser.peek() == "and" {
+		parser.next()
+		right, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andMatcher(left, right)
+	}
+	return left, nil
+}
+
+// parseUnary parses negations, parenthesised expressions and primitives
+func (parser *filterParser) parseUnary() (matcher, error) {
+	switch parser.peek() {
+	case "not":
+		parser.next()
+		inner, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(parsed *packet.Packet) bool { return !inner(parsed) }, nil
+	case "(":
+		parser.next()
+		inner, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if parser.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return inner, nil
+	default:
+		return parser.parsePrimitive()
+	}
+}
+
+// parsePrimitive parses a single match such as "src port 53"
+func (parser *filterParser) parsePrimitive() (matcher, error) {
+	token := parser.next()
+
+	if protocol, ok := protocolNames[token]; ok {
+		return protocolMatcher(protocol), nil
+	}
+
+	switch token {
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case "ip":
+		return func(parsed *packet.Packet) bool { return parsed.Version == 4 }, nil
+	case "ip6":
+		return func(parsed *packet.Packet) bool { return parsed.Version == 6 }, nil
+	case "proto":
+		value := parser.next()
+		if protocol, ok := protocolNames[value]; ok {
+			return protocolMatcher(protocol), nil
+		}
+		number, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("unknown protocol %q", value)
+		}
+		return protocolMatcher(packet.Protocol(number)), nil
+	}
+
+	// An optional direction qualifier comes before the address and port matches
+	matchSrc, matchDst := true, true
+	switch token {
+	case "src":
+		matchDst = false
+		token = parser.next()
+	case "dst":
+		matchSrc = false
+		token = parser.next()
+	}
+
+	switch token {
+	case "host", "net", "port", "portrange":
+	default:
+		return nil, fmt.Errorf("unknown primitive %q", token)
+	}
+
+	value := parser.next()
+	if value == "" {
+		return nil, fmt.Errorf("%q needs a value", token)
+	}
+
+	switch token {
+	case "host":
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host %q", value)
+		}
+		return addressMatcher(netip.PrefixFrom(addr, addr.BitLen()), matchSrc, matchDst), nil
+	case "net":
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid net %q", value)
+		}
+		return addressMatcher(prefix.Masked(), matchSrc, matchDst), nil
+	case "port":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", value)
+		}
+		return portMatcher(uint16(port), uint16(port), matchSrc, matchDst), nil
+	case "portrange":
+		lowValue, highValue, found := strings.Cut(value, "-")
+		low, lowErr := strconv.ParseUint(lowValue, 10, 16)
+		high, highErr := strconv.ParseUint(highValue, 10, 16)
+		if !found || lowErr != nil || highErr != nil || low > high {
+			return nil, fmt.Errorf("invalid port range %q", value)
+		}
+		return portMatcher(uint16(low), uint16(high), matchSrc, matchDst), nil
+	}
+	return nil, fmt.Errorf("unknown primitive %q", token)
+}
+
+// andMatcher matches when both matchers do
+func andMatcher(left, right matcher) matcher {
+	return func(parsed *packet.Packet) bool { return left(parsed) && right(parsed) }
+}
+
+// orMatcher matches when either matcher does
+func orMatcher(left, right matcher) matcher {
+	return func(parsed *packet.Packet) bool { return left(parsed) || right(parsed) }
+}
+
+// protocolMatcher matches the IP protocol
+func protocolMatcher(protocol packet.Protocol) matcher {
+	return func(parsed *packet.Packet) bool { return parsed.Protocol == protocol }
+}
+
+// addressMatcher matches the source and/or destination address against a prefix
+func addressMatcher(prefix netip.Prefix, matchSrc, matchDst bool) matcher {
+	return func(parsed *packet.Packet) bool {
+		return (matchSrc && prefix.Contains(parsed.Src)) || (matchDst && prefix.Contains(parsed.Dst))
+	}
+}
+
+// portMatcher matches the source and/or destination port against a range
+func portMatcher(low, high uint16, matchSrc, matchDst bool) matcher {
+	inRange := func(port uint16) bool { return port >= low && port <= high }
+
+	return func(parsed *packet.Packet) bool {
+		srcPort, dstPort, ok := parsed.Ports()
+		if !ok {
+			return false
+		}
+		return (matchSrc && inRange(srcPort)) || (matchDst && inRange(dstPort))
+	}
+}
@@ -0,0 +1,161 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// linkTypeRaw is LINKTYPE_RAW, packets start with the IPv4 or IPv6 header
+const linkTypeRaw = 101
+
+// Capture file formats
+const (
+	FormatPcap   = "pcap"
+	FormatPcapng = "pcapng"
+)
+
+// formatWriter encodes packets in one capture file format
+type formatWriter interface {
+	// writeHeader starts a new file
+	writeHeader(w io.Writer, snaplen int) (int, error)
+	// writePacket appends a packet truncated to snaplen
+	writePacket(w io.Writer, snaplen int, point Point, timestamp time.Time, packet []byte) (int, error)
+}
+
+// newFormatWriter returns the writer for a format name
+func newFormatWriter(format string) (formatWriter, error) {
+	switch format {
+	case FormatPcap, "":
+		return pcapWriter{}, nil
+	case FormatPcapng:
+		return pcapngWriter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown capture format %q, expected %s or %s", format, FormatPcap, FormatPcapng)
+	}
+}
+
+// pcapWriter writes the classic libpcap format with microsecond timestamps.
+// It has a single link type, so packets from every capture point are mixed.
+type pcapWriter struct{}
+
+func (pcapWriter) writeHeader(w io.Writer, snaplen int) (int, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], uint32(snaplen))
+	binary.LittleEndian.PutUint32(header[20:24], linkTypeRaw)
+	return w.Write(header)
+}
+
+func (pcapWriter) writePacket(w io.Writer, snaplen int, point Point, timestamp time.Time, packet []byte) (int, error) {
+	captured := packet[:min(len(packet), snaplen)]
+
+	record := make([]byte, 16, 16+len(captured))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(timestamp.Unix()))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(timestamp.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:12], uint32(len(captured)))
+	binary.LittleEndian.PutUint32(record[12:16], uint32(len(packet)))
+	return w.Write(append(record, captured...))
+}
+
+// pcapngWriter writes the pcapng format with one interface per capture point
+// and the packet direction recorded in the flags of every packet.
+type pcapngWriter struct{}
+
+// pcapng block types and options
+const (
+	pcapngSectionHeader    = 0x0a0d0d0a
+	pcapngInterfaceDesc    = 0x00000001
+	pcapngEnhancedPacket   = 0x00000006
+	pcapngOptionEnd        = 0
+	pcapngOptionIfName     = 2
+	pcapngOptionEpbFlags   = 2
+	pcapngFlagInbound      = 1
+	pcapngFlagOutbound     = 2
+	pcapngByteOrderMagic   = 0x1a2b3c4d
+	pcapngSectionUnknown   = 0xffffffffffffffff
+	pcapngBlockOverhead    = 12
+	pcapngMaxOptionPadding = 3
+)
+
+func (pcapngWriter) writeHeader(w io.Writer, snaplen int) (int, error) {
+	section := make([]byte, 16)
+	binary.LittleEndian.PutUint32(section[0:4], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(section[4:6], 1)
+	binary.LittleEndian.PutUint16(section[6:8], 0)
+	binary.LittleEndian.PutUint64(section[8:16], pcapngSectionUnknown)
+
+	written, err := w.Write(pcapngBlock(pcapngSectionHeader, section))
+	if err != nil {
+		return written, err
+	}
+
+	// The interface ID of a point is its index in capturePoints
+	for _, source := range capturePoints {
+		body := make([]byte, 8)
+		binary.LittleEndian.PutUint16(body[0:2], linkTypeRaw)
+		binary.LittleEndian.PutUint32(body[4:8], uint32(snaplen))
+		body = appendOption(body, pcapngOptionIfName, []byte(source))
+		body = appendOption(body, pcapngOptionEnd, nil)
+
+		n, err := w.Write(pcapngBlock(pcapngInterfaceDesc, body))
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+func (pcapngWriter) writePacket(w io.Writer, snaplen int, point Point, timestamp time.Time, packet []byte) (int, error) {
+	captured := packet[:min(len(packet), snaplen)]
+	micros := uint64(timestamp.UnixMicro())
+
+	body := make([]byte, 20, 20+len(captured)+pcapngMaxOptionPadding+16)
+	binary.LittleEndian.PutUint32(body[0:4], uint32(point.Source.interfaceID()))
+	binary.LittleEndian.PutUint32(body[4:8], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(micros))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(captured)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(len(packet)))
+	body = append(body, captured...)
+	body = append(body, make([]byte, padding(len(captured)))...)
+
+	flags := make([]byte, 4)
+	if point.Direction == Inbound {
+		binary.LittleEndian.PutUint32(flags, pcapngFlagInbound)
+	} else {
+		binary.LittleEndian.PutUint32(flags, pcapngFlagOutbound)
+	}
+	body = appendOption(body, pcapngOptionEpbFlags, flags)
+	body = appendOption(body, pcapngOptionEnd, nil)
+
+	return w.Write(pcapngBlock(pcapngEnhancedPacket, body))
+}
+
+// pcapngBlock frames a block body, which must be padded to 32 bits
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	length := uint32(len(body) + pcapngBlockOverhead)
+
+	block := make([]byte, 8, length)
+	binary.LittleEndian.PutUint32(block[0:4], blockType)
+	binary.LittleEndian.PutUint32(block[4:8], length)
+	block = append(block, body...)
+	return binary.LittleEndian.AppendUint32(block, length)
+}
+
+// appendOption appends a pcapng option padded to 32 bits
+func appendOption(body []byte, code uint16, value []byte) []byte {
+	body = binary.LittleEndian.AppendUint16(body, code)
+	body = binary.LittleEndian.AppendUint16(body, uint16(len(value)))
+	body = append(body, value...)
+	return append(body, make([]byte, padding(len(value)))...)
+}
+
+// padding returns the bytes needed to pad length to 32 bits
+func padding(length int) int {
+	return (4 - length%4) % 4
+}
@@ -0,0 +1,258 @@
+// Package compress compresses the packets a transport carries once both ends
+// agreed on an algorithm in the handshake
+package compress
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"thinkpol-vpn/interface/internal/config"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Header carries the algorithms the client offers, in order of preference,
+// and the one the server picked in the handshake response
+const Header = "X-Tunnel-Compression"
+
+// Supported algorithms
+const (
+	Zstd = "zstd"
+	LZ4  = "lz4"
+)
+
+// Every message starts with a flag telling whether the rest is compressed,
+// so packets that do not compress well can be sent as they are
+const (
+	flagRaw        = 0
+	flagCompressed = 1
+)
+
+// maxMessageSize bounds decompressed messages, a marshaled packet of up to
+// 64 KiB and its framing
+const maxMessageSize = 65535 + 64
+
+const (
+	// entropySample is how many bytes of a packet are looked at to tell
+	// whether it is already compressed or encrypted
+	entropySample = 1024
+	// entropyMinSample is the smallest sample the estimate is trusted on
+	entropyMinSample = 512
+	// entropyThreshold is the bits per byte above which the payload is
+	// taken to be compressed or encrypted. Random data scores about 7.6 on
+	// the smallest sample, text and most binary formats far lower.
+	entropyThreshold = 7.5
+	// headerSkip keeps the IP and transport headers out of the sample
+	headerSkip = 64
+)
+
+// ErrMalformed is returned for a message that cannot be decompressed
+var ErrMalformed = errors.New("malformed compressed message")
+
+// Settings are the algorithms a transport accepts and when it compresses
+type Settings struct {
+	algorithms []string
+	minSize    int
+}
+
+// New validates the compression configuration
+func New(compressionConfig config.CompressionConfig) (Settings, error) {
+	for _, algorithm := range compressionConfig.Algorithms {
+		if algorithm != Zstd && algorithm != LZ4 {
+			return Settings{}, fmt.Errorf("unknown compression algorithm %q, expected %s or %s", algorithm, Zstd, LZ4)
+		}
+	}
+	if compressionConfig.MinSize < 0 {
+		return Settings{}, fmt.Errorf("compression min size must not be negative")
+	}
+
+	return Settings{
+		algorithms: compressionConfig.Algorithms,
+		minSize:    compressionConfig.MinSize,
+	}, nil
+}
+
+// Negotiate picks the first algorithm of the client's offer the settings
+// accept, the offer is the value of Header. It returns "" when there is none
+// and the connection goes uncompressed.
+func (settings Settings) Negotiate(offer string) string {
+	for _, offered := range strings.Split(offer, ",") {
+		offered = strings.ToLower(strings.TrimSpace(offered))
+		for _, algorithm := range settings.algorithms {
+			if offered == algorithm {
+				return algorithm
+			}
+		}
+	}
+	return ""
+}
+
+// Offer returns the algorithms a client offers in the handshake, the value of
+// Header. It is "" when compression is off.
+func (settings Settings) Offer() string {
+	return strings.Join(settings.algorithms, ", ")
+}
+
+// codec is a compression algorithm
+type codec interface {
+	// compress appends the compressed src to dst, ok is false when it did
+	// not get any smaller
+	compress(dst, src []byte) (compressed []byte, ok bool)
+	decompress(src []byte) ([]byte, error)
+}
+
+// Compressor compresses the messages of one connection. Encode and Decode
+// may be used at the same time, but neither from several goroutines.
+type Compressor struct {
+	algorithm string
+	codec     codec
+	minSize   int
+	stats     *Stats
+}
+
+// NewCompressor creates the compressor of a connection that negotiated the
+// algorithm, counting into stats
+func (settings Settings) NewCompressor(algorithm string, stats *Stats) (*Compressor, error) {
+	var compressor codec
+	switch algorithm {
+	case Zstd:
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxMessageSize), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+		}
+		compressor = &zstdCodec{encoder: encoder, decoder: decoder}
+	case LZ4:
+		compressor = &lz4Codec{}
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %q", algorithm)
+	}
+
+	return &Compressor{
+		algorithm: algorithm,
+		codec:     compressor,
+		minSize:   settings.minSize,
+		stats:     stats,
+	}, nil
+}
+
+// Algorithm returns the negotiated algorithm
+func (compressor *Compressor) Algorithm() string {
+	return compressor.algorithm
+}
+
+// Encode frames a marshaled message for the wire, compressed unless packet,
+// the IP packet it carries, is too small or looks compressed already
+func (compressor *Compressor) Encode(message []byte, packet []byte) []byte {
+	stats := compressor.stats
+
+	switch {
+	case len(packet) < compressor.minSize:
+		stats.skippedSmall.Add(1)
+	case looksCompressed(packet):
+		stats.skippedEntropy.Add(1)
+	default:
+		flag := []byte{flagCompressed}
+		if compressed, ok := compressor.codec.compress(flag, message); ok {
+			stats.sent.record(len(message), len(compressed))
+			return compressed
+		}
+		stats.incompressible.Add(1)
+	}
+
+	framed := make([]byte, 1+len(message))
+	framed[0] = flagRaw
+	copy(framed[1:], message)
+	return framed
+}
+
+// Decode returns the marshaled message a frame from the wire carries
+func (compressor *Compressor) Decode(framed []byte) ([]byte, error) {
+	if len(framed) == 0 {
+		return nil, ErrMalformed
+	}
+
+	switch framed[0] {
+	case flagRaw:
+		return framed[1:], nil
+	case flagCompressed:
+		message, err := compressor.codec.decompress(framed[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+		}
+		compressor.stats.received.record(len(message), len(framed))
+		return message, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown flag %d", ErrMalformed, framed[0])
+	}
+}
+
+// looksCompressed estimates the entropy of the packet payload. Compressed
+// and encrypted data, most of what goes through a tunnel, is close to random
+// and not worth the time.
+func looksCompressed(packet []byte) bool {
+	if len(packet) < headerSkip+entropyMinSample {
+		return false
+	}
+	sample := packet[headerSkip:min(len(packet), headerSkip+entropySample)]
+
+	var counts [256]int
+	for _, b := range sample {
+		counts[b]++
+	}
+
+	entropy := 0.0
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / float64(len(sample))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy > entropyThreshold
+}
+
+// zstdCodec is Zstandard at its fastest level
+type zstdCodec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func (codec *zstdCodec) compress(dst, src []byte) ([]byte, bool) {
+	compressed := codec.encoder.EncodeAll(src, dst)
+	return compressed, len(compressed) < 1+len(src)
+}
+
+func (codec *zstdCodec) decompress(src []byte) ([]byte, error) {
+	return codec.decoder.DecodeAll(src, nil)
+}
+
+// lz4Codec is LZ4 block compression
+type lz4Codec struct {
+	compressor lz4.Compressor
+}
+
+func (codec *lz4Codec) compress(dst, src []byte) ([]byte, bool) {
+	buffer := make([]byte, lz4.CompressBlockBound(len(src)))
+	n, err := codec.compressor.CompressBlock(src, buffer)
+	// n is 0 for data that does not compress
+	if err != nil || n == 0 || n >= len(src) {
+		return dst, false
+	}
+	return append(dst, buffer[:n]...), true
+}
+
+func (codec *lz4Codec) decompress(src []byte) ([]byte, error) {
+	buffer := make([]byte, maxMessageSize)
+	n, err := lz4.UncompressBlock(src, buffer)
+	if err != nil {
+		return nil, err
+	}
+	return buffer[:n], nil
+}
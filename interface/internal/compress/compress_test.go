@@ -0,0 +1,92 @@
+package compress
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"thinkpol-vpn/interface/internal/config"
+)
+
+func TestNegotiate(t *testing.T) {
+	settings, err := New(config.CompressionConfig{Algorithms: []string{Zstd, LZ4}})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	tests := []struct {
+		offer string
+		want  string
+	}{
+		{"zstd, lz4", Zstd},
+		{"LZ4,zstd", LZ4},
+		{"brotli, lz4", LZ4},
+		{"brotli", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := settings.Negotiate(test.offer); got != test.want {
+			t.Errorf("Negotiate(%q) = %q, want %q", test.offer, got, test.want)
+		}
+	}
+
+	if _, err := New(config.CompressionConfig{Algorithms: []string{"gzip"}}); err == nil {
+		t.Error("New accepted an unknown algorithm")
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	settings, err := New(config.CompressionConfig{Algorithms: []string{Zstd, LZ4}, MinSize: 256})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	text := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"), 30)
+	random := make([]byte, 1400)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, algorithm := range []string{Zstd, LZ4} {
+		t.Run(algorithm, func(t *testing.T) {
+			stats := &Stats{}
+			sender, err := settings.NewCompressor(algorithm, stats)
+			if err != nil {
+				t.Fatalf("NewCompressor: %v", err)
+			}
+			receiver, err := settings.NewCompressor(algorithm, &Stats{})
+			if err != nil {
+				t.Fatalf("NewCompressor: %v", err)
+			}
+
+			for name, packet := range map[string][]byte{
+				"compressible": text,
+				"small":        text[:100],
+				"random":       random,
+			} {
+				framed := sender.Encode(packet, packet)
+				decoded, err := receiver.Decode(framed)
+				if err != nil {
+					t.Fatalf("%s: Decode: %v", name, err)
+				}
+				if !bytes.Equal(decoded, packet) {
+					t.Errorf("%s: decoded message differs from the original", name)
+				}
+				if name == "compressible" && len(framed) >= len(packet) {
+					t.Errorf("%s: %d bytes framed, not smaller than %d", name, len(framed), len(packet))
+				}
+			}
+
+			status := stats.Status()
+			if status.Sent.Messages != 1 || status.SkippedSmall != 1 || status.SkippedEntropy != 1 {
+				t.Errorf("compressed %d, skipped %d small and %d by entropy, want 1 each",
+					status.Sent.Messages, status.SkippedSmall, status.SkippedEntropy)
+			}
+			if status.Sent.Ratio <= 1 {
+				t.Errorf("ratio = %.2f, want more than 1", status.Sent.Ratio)
+			}
+		})
+	}
+
+	if _, err := (&Compressor{codec: &lz4Codec{}, stats: &Stats{}}).Decode([]byte{flagCompressed, 0xff}); err == nil {
+		t.Error("Decode accepted a corrupt message")
+	}
+}
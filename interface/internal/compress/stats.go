@@ -0,0 +1,73 @@
+package compress
+
+import "sync/atomic"
+
+// Stats count how well compression works on a transport, across its
+// connections. Only compressed messages count towards the byte counters.
+type Stats struct {
+	sent     directionStats
+	received directionStats
+
+	// Messages sent without compression and why
+	skippedSmall   atomic.Uint64
+	skippedEntropy atomic.Uint64
+	incompressible atomic.Uint64
+}
+
+// directionStats count compressed messages in one direction
+type directionStats struct {
+	messages          atomic.Uint64
+	uncompressedBytes atomic.Uint64
+	compressedBytes   atomic.Uint64
+}
+
+func (stats *directionStats) record(uncompressed, compressed int) {
+	stats.messages.Add(1)
+	stats.uncompressedBytes.Add(uint64(uncompressed))
+	stats.compressedBytes.Add(uint64(compressed))
+}
+
+// DirectionStatus is a snapshot of the compressed messages in one direction
+type DirectionStatus struct {
+	Messages          uint64 `json:"messages"`
+	UncompressedBytes uint64 `json:"uncompressed_bytes"`
+	CompressedBytes   uint64 `json:"compressed_bytes"`
+	// Ratio is the uncompressed size over the compressed size, 0 before
+	// anything was compressed
+	Ratio float64 `json:"ratio"`
+}
+
+func (stats *directionStats) snapshot() DirectionStatus {
+	status := DirectionStatus{
+		Messages:          stats.messages.Load(),
+		UncompressedBytes: stats.uncompressedBytes.Load(),
+		CompressedBytes:   stats.compressedBytes.Load(),
+	}
+	if status.CompressedBytes > 0 {
+		status.Ratio = float64(status.UncompressedBytes) / float64(status.CompressedBytes)
+	}
+	return status
+}
+
+// Status is a snapshot of the compression counters for the control API
+type Status struct {
+	// Algorithm is the one negotiated with the connected peer, empty when
+	// the connection is not compressed
+	Algorithm      string          `json:"algorithm"`
+	Sent           DirectionStatus `json:"sent"`
+	Received       DirectionStatus `json:"received"`
+	SkippedSmall   uint64          `json:"skipped_small"`
+	SkippedEntropy uint64          `json:"skipped_entropy"`
+	Incompressible uint64          `json:"incompressible"`
+}
+
+// Status returns the current value of every counter
+func (stats *Stats) Status() Status {
+	return Status{
+		Sent:           stats.sent.snapshot(),
+		Received:       stats.received.snapshot(),
+		SkippedSmall:   stats.skippedSmall.Load(),
+		SkippedEntropy: stats.skippedEntropy.Load(),
+		Incompressible: stats.incompressible.Load(),
+	}
+}
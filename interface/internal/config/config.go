@@ -0,0 +1,471 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Config is the application configuration read from config.json
+type Config struct {
+	Routing     RoutingConfig     `json:"routing"`
+	DNS         DNSConfig         `json:"dns"`
+	KillSwitch  KillSwitchConfig  `json:"kill_switch"`
+	Capture     CaptureConfig     `json:"capture"`
+	ACL         ACLConfig         `json:"acl"`
+	Gateway     GatewayConfig     `json:"gateway"`
+	RateLimit   RateLimitConfig   `json:"rate_limit"`
+	Scheduler   SchedulerConfig   `json:"scheduler"`
+	Keepalive   KeepaliveConfig   `json:"keepalive"`
+	MTU         MTUConfig         `json:"mtu"`
+	Compression CompressionConfig `json:"compression"`
+	Obfuscation ObfuscationConfig `json:"obfuscation"`
+	Peer        PeerConfig        `json:"peer"`
+
+	PluggableTransports PluggableTransportsConfig `json:"pluggable_transports"`
+	ConnectIP           ConnectIPConfig           `json:"connect_ip"`
+	LocalProxy          LocalProxyConfig          `json:"local_proxy"`
+	UpstreamProxy       UpstreamProxyConfig       `json:"upstream_proxy"`
+	TAP                 TAPConfig                 `json:"tap"`
+	API                 APIConfig                 `json:"api"`
+}
+
+// RoutingConfig describes which prefixes go through the tunnel
+type RoutingConfig struct {
+	// Include prefixes are routed through the TUN interface
+	Include []RouteConfig `json:"include"`
+	// Exclude prefixes keep using the default gateway, even when an
+	// include prefix (or full tunnel mode) covers them
+	Exclude []RouteConfig `json:"exclude"`
+	// InterceptAll sends all internet traffic through the tunnel
+	InterceptAll bool `json:"intercept_all"`
+}
+
+// RouteConfig is a single routed prefix
+type RouteConfig struct {
+	Prefix string `json:"prefix"`
+	Metric int    `json:"metric"`
+}
+
+// DNSConfig describes DNS handling on the tunnel
+type DNSConfig struct {
+	// Listen is where the forwarder answers queries, usually the tunnel address
+	Listen string `json:"listen"`
+	// Upstream is the resolver queries are relayed to
+	Upstream string `json:"upstream"`
+	// Domains resolved through the forwarder get host routes through the
+	// tunnel, e.g. "*.corp.example". The forwarder is off when empty.
+	Domains []string `json:"domains"`
+	// MinTTL is the shortest lifetime of a host route, in seconds
+	MinTTL int `json:"min_ttl"`
+
+	// Servers are pushed to the system resolver when the tunnel comes up
+	Servers []string `json:"servers"`
+	// SearchDomains are pushed together with Servers
+	SearchDomains []string `json:"search_domains"`
+	// BlockLeaks firewalls off DNS traffic that does not go through the tunnel
+	BlockLeaks bool `json:"block_leaks"`
+}
+
+// KillSwitchConfig describes the firewall that keeps traffic from leaving outside the tunnel
+type KillSwitchConfig struct {
+	Enabled bool `json:"enabled"`
+	// Gateways are the "host:port" endpoints the transport connects through
+	Gateways []string `json:"gateways"`
+	// AllowLAN keeps private address ranges reachable
+	AllowLAN bool `json:"allow_lan"`
+}
+
+// CaptureConfig describes where packet captures started through the control API go
+type CaptureConfig struct {
+	// Directory receives the capture files
+	Directory string `json:"directory"`
+	// Format is "pcap" or "pcapng", used when a capture does not ask for one
+	Format string `json:"format"`
+	// MaxFileSize rotates to a new file once a file reaches this many bytes
+	MaxFileSize int64 `json:"max_file_size"`
+	// MaxFiles is how many rotated files of a capture are kept
+	MaxFiles int `json:"max_files"`
+	// Snaplen truncates captured packets to this many bytes
+	Snaplen int `json:"snaplen"`
+}
+
+// ACLConfig describes which packets may go through the tunnel
+type ACLConfig struct {
+	// Default is "allow" or "deny", applied when no rule allows or denies a packet
+	Default string `json:"default"`
+	// Rules are evaluated in order, the first allow or deny rule that matches wins
+	Rules []ACLRuleConfig `json:"rules"`
+}
+
+// ACLRuleConfig is a single ACL rule, empty fields match anything
+type ACLRuleConfig struct {
+	Name string `json:"name"`
+	// Action is "allow", "deny" or "log". Log rules log the packet and go on.
+	Action string `json:"action"`
+	// Direction is "in" (received from the tunnel), "out" (sent into it) or "both"
+	Direction string `json:"direction"`
+	// Protocol is "tcp", "udp", "icmp", "icmpv6" or a protocol number
+	Protocol string `json:"protocol"`
+	// Source and Destination are CIDR prefixes or addresses
+	Source      []string `json:"source"`
+	Destination []string `json:"destination"`
+	// SourcePorts and DestinationPorts are ports or "low-high" ranges
+	SourcePorts      []string `json:"source_ports"`
+	DestinationPorts []string `json:"destination_ports"`
+}
+
+// GatewayConfig describes the clients a gateway serves (-mode gateway)
+type GatewayConfig struct {
+	// AddressPool is the prefix tunnel addresses are leased from to clients
+	// without a static address. Its first host address is the gateway's own.
+	AddressPool string `json:"address_pool"`
+	// Clients are the identities allowed to connect
+	Clients []GatewayClientConfig `json:"clients"`
+}
+
+// GatewayClientConfig is a client of the gateway and the policy it is held to
+type GatewayClientConfig struct {
+	Name string `json:"name"`
+	// Token authenticates the client in the websocket handshake
+	Token string `json:"token"`
+	// Address is the client's static tunnel address, leased from the pool when empty
+	Address string `json:"address"`
+	// AllowedIPs are the prefixes the client may send to, anything when empty
+	AllowedIPs []string `json:"allowed_ips"`
+	// ACL further restricts the client's traffic. Packets from the client are
+	// "in", packets to the client are "out".
+	ACL ACLConfig `json:"acl"`
+	// RateLimit replaces the top-level rate limits for this client when set
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty"`
+}
+
+// RateLimitConfig shapes the traffic of a transport session, per direction
+type RateLimitConfig struct {
+	// Send limits packets sent to the peer
+	Send BucketConfig `json:"send"`
+	// Receive limits packets received from the peer
+	Receive BucketConfig `json:"receive"`
+	// MaxDelayMS is how long a packet may be held back to stay within the
+	// rate, packets that would wait longer are dropped
+	MaxDelayMS int `json:"max_delay_ms"`
+}
+
+// BucketConfig is a token bucket
+type BucketConfig struct {
+	// Rate is the sustained rate in bytes per second, unlimited when 0
+	Rate int64 `json:"rate"`
+	// Burst is how many bytes may go through at once, a tenth of the rate
+	// (and at least 64 KiB) when 0
+	Burst int64 `json:"burst"`
+}
+
+// SchedulerConfig describes how packets waiting for the transport are queued
+type SchedulerConfig struct {
+	// Capacity is the number of packets each traffic class queues
+	Capacity int `json:"capacity"`
+	// Policy is what happens to a packet when its class is full: "tail-drop"
+	// drops it, "head-drop" drops the oldest queued packet to make room and
+	// "block" holds the sender back for up to BlockTimeoutMS, then drops it
+	Policy         string `json:"policy"`
+	BlockTimeoutMS int    `json:"block_timeout_ms"`
+	// AQM drops packets that waited too long so the flows sending them back off
+	AQM AQMConfig `json:"aqm"`
+}
+
+// AQMConfig is CoDel active queue management, applied to each traffic class
+type AQMConfig struct {
+	Enabled bool `json:"enabled"`
+	// TargetMS is the queueing delay that is tolerated, in milliseconds
+	TargetMS int `json:"target_ms"`
+	// IntervalMS is how long the delay may stay above the target before
+	// packets are dropped, in milliseconds
+	IntervalMS int `json:"interval_ms"`
+}
+
+// KeepaliveConfig describes how transport peers are checked for liveness
+type KeepaliveConfig struct {
+	// IntervalMS is how often a keepalive is sent to the peer, the answers
+	// also measure the round trip time
+	IntervalMS int `json:"interval_ms"`
+	// TimeoutMS is how long the peer may stay silent before it is declared
+	// dead and its connection is dropped so it can reconnect
+	TimeoutMS int `json:"timeout_ms"`
+	// WriteTimeoutMS is how long writing a message to the peer may take
+	WriteTimeoutMS int `json:"write_timeout_ms"`
+}
+
+// MTUConfig describes how large packets inside the tunnel may be
+type MTUConfig struct {
+	// Tunnel is the MTU of the tunnel, derived from Path and the transport
+	// overhead when 0
+	Tunnel int `json:"tunnel"`
+	// Path is the MTU of the path to the peer the transport runs over
+	Path int `json:"path"`
+	// ClampMSS lowers the MSS option of TCP SYNs through the TUN interface
+	// so connections never send segments larger than the tunnel MTU
+	ClampMSS bool `json:"clamp_mss"`
+}
+
+// CompressionConfig describes compression of the packets on the transport.
+// A client offers algorithms in the handshake and the first one accepted is
+// used for the connection.
+type CompressionConfig struct {
+	// Algorithms are the accepted algorithms, "zstd" and "lz4". Packets are
+	// not compressed when empty.
+	Algorithms []string `json:"algorithms"`
+	// MinSize is the smallest packet that is compressed, in bytes
+	MinSize int `json:"min_size"`
+}
+
+// PeerConfig describes the peer the websocket transport connects to. Peers
+// connect to this end instead while URL is empty.
+type PeerConfig struct {
+	// URL is the transport of the peer or gateway, e.g.
+	// wss://vpn.example.org/transport
+	URL string `json:"url"`
+	// Token authenticates with a gateway, sent as "Authorization: Bearer <token>"
+	Token string `json:"token"`
+	// InsecureSkipVerify accepts any server certificate, for testing
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+}
+
+// ObfuscationConfig describes how the transport disguises its traffic
+type ObfuscationConfig struct {
+	// Path is where the transport is served, "/transport" when empty
+	Path string `json:"path"`
+	// Headers are added to every response of the transport
+	Headers map[string]string `json:"headers"`
+	// MaxPadding is the most random bytes added to a packet, 0 disables padding
+	MaxPadding int `json:"max_padding"`
+	// JitterMS is the most a packet is delayed before it is sent
+	JitterMS int            `json:"jitter_ms"`
+	Fronting FrontingConfig `json:"fronting"`
+}
+
+// FrontingConfig separates the domain in the TLS handshake from the one in
+// the Host header, for a transport reached through a CDN
+type FrontingConfig struct {
+	// Host is the domain of this server. The transport only answers requests
+	// for it when set.
+	Host string `json:"host"`
+	// SNI is the front domain clients name in the TLS handshake
+	SNI string `json:"sni"`
+}
+
+// PluggableTransportsConfig describes the Tor pluggable transports that
+// clients can reach the transport through, and the one this end reaches its
+// peer through
+type PluggableTransportsConfig struct {
+	// StateDir is where the transports keep their state, such as keys
+	StateDir string `json:"state_dir"`
+	// Servers are the pluggable transport binaries to run
+	Servers []PluggableTransportConfig `json:"servers"`
+	// Client is the binary the websocket transport connects to its peer
+	// through, off when its path is empty
+	Client PluggableTransportClientConfig `json:"client"`
+}
+
+// PluggableTransportClientConfig is the client side of a pluggable transport
+// binary, run as a managed proxy the connections to the peer go through
+type PluggableTransportClientConfig struct {
+	// Path is the binary and Args its command line arguments
+	Path string   `json:"path"`
+	Args []string `json:"args"`
+	// Transport is the transport to connect with, e.g. obfs4
+	Transport string `json:"transport"`
+	// Options are the arguments the server transport reports, such as the
+	// obfs4 cert
+	Options map[string]string `json:"options"`
+}
+
+// PluggableTransportConfig is a pluggable transport binary, run as a managed
+// proxy that hands the connections it accepts to the transport
+type PluggableTransportConfig struct {
+	// Path is the binary and Args its command line arguments
+	Path string   `json:"path"`
+	Args []string `json:"args"`
+	// Transports are the names of the transports to run, e.g. obfs4
+	Transports []string `json:"transports"`
+	// Listen is the address each transport accepts clients on, the binary
+	// picks one for transports not listed
+	Listen map[string]string `json:"listen"`
+	// Options are the parameters of each transport, keyed by transport
+	Options map[string]map[string]string `json:"options"`
+}
+
+// ConnectIPConfig describes the CONNECT-IP (RFC 9484) transport, which
+// replaces the websocket transport when enabled. It either serves a peer
+// over HTTP/3 and HTTP/2, or connects to a MASQUE server when Server is set.
+type ConnectIPConfig struct {
+	Enabled bool `json:"enabled"`
+	// Listen is the UDP address of HTTP/3 and the TCP address of HTTP/2
+	Listen string `json:"listen"`
+	// CertFile and KeyFile are the TLS certificate served to peers
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// Path is the path of the CONNECT-IP requests served
+	Path string `json:"path"`
+	// PeerAddress is the tunnel address assigned to the peer, e.g. 10.0.0.2/32
+	PeerAddress string `json:"peer_address"`
+	// Routes are the prefixes advertised to the peer as reachable
+	Routes []string `json:"routes"`
+
+	// Server is the URL of the MASQUE server to connect to, e.g.
+	// https://masque.example.org/.well-known/masque/ip/*/*/
+	Server string `json:"server"`
+	// HTTP2Fallback connects over HTTP/2 when HTTP/3 fails
+	HTTP2Fallback bool `json:"http2_fallback"`
+	// InsecureSkipVerify accepts any server certificate, for testing
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+}
+
+// APIConfig describes the control API and the metrics endpoint, served apart
+// from the transport so peers cannot reach them
+type APIConfig struct {
+	// Listen is where the API and /metrics are served
+	Listen string `json:"listen"`
+	// Token is required as "Authorization: Bearer <token>" when set
+	Token string `json:"token"`
+}
+
+// LocalProxyConfig describes the local proxies of proxy mode, which carry
+// the connections of applications through the tunnel without a TUN interface
+type LocalProxyConfig struct {
+	// Address is the tunnel address of this end, the source of the packets
+	Address string `json:"address"`
+	// SOCKS5 is where the SOCKS5 proxy listens, off when empty
+	SOCKS5 string `json:"socks5"`
+	// HTTP is where the HTTP proxy listens, off when empty
+	HTTP string `json:"http"`
+	// Username and Password are required by both proxies when set
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// DNS is the resolver host names are looked up with, through the tunnel
+	DNS string `json:"dns"`
+}
+
+// UpstreamProxyConfig describes the proxy that connections to the peer go
+// through, for networks that allow no direct connections
+type UpstreamProxyConfig struct {
+	// URL is the proxy, e.g. http://proxy.corp:3128 or socks5://proxy:1080,
+	// optionally with credentials. Direct connections when empty.
+	URL string `json:"url"`
+	// Username and Password authenticate with the proxy, overriding the
+	// credentials in URL
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// FromEnvironment uses HTTPS_PROXY and NO_PROXY when URL is empty
+	FromEnvironment bool `json:"from_environment"`
+}
+
+// TAPConfig describes TAP mode, where the interface carries Ethernet frames
+// through the tunnel instead of IP packets
+type TAPConfig struct {
+	// Enabled opens a TAP interface instead of a TUN interface, the peer has
+	// to ask for frames as well
+	Enabled bool `json:"enabled"`
+	// MAC is the Ethernet address of the interface, picked by the system
+	// when empty
+	MAC string `json:"mac"`
+	// Bridge is a Linux bridge the interface joins. The bridge then holds
+	// the addresses and routes, the interface gets none.
+	Bridge string `json:"bridge"`
+}
+
+// Default returns the configuration used when no config file is present
+func Default() *Config {
+	return &Config{
+		Routing: RoutingConfig{
+			Include: []RouteConfig{{Prefix: "10.0.0.0/24"}},
+		},
+		DNS: DNSConfig{
+			Listen:   "10.0.0.1:53",
+			Upstream: "1.1.1.1:53",
+			MinTTL:   60,
+		},
+		Capture: CaptureConfig{
+			Directory:   "captures",
+			Format:      "pcapng",
+			MaxFileSize: 64 << 20,
+			MaxFiles:    10,
+			Snaplen:     65535,
+		},
+		ACL: ACLConfig{
+			Default: "allow",
+		},
+		Gateway: GatewayConfig{
+			AddressPool: "10.0.0.0/24",
+		},
+		RateLimit: RateLimitConfig{
+			MaxDelayMS: 100,
+		},
+		Scheduler: SchedulerConfig{
+			Capacity:       256,
+			Policy:         "tail-drop",
+			BlockTimeoutMS: 50,
+			AQM: AQMConfig{
+				Enabled:    true,
+				TargetMS:   5,
+				IntervalMS: 100,
+			},
+		},
+		Keepalive: KeepaliveConfig{
+			IntervalMS:     10000,
+			TimeoutMS:      30000,
+			WriteTimeoutMS: 10000,
+		},
+		MTU: MTUConfig{
+			Path:     1500,
+			ClampMSS: true,
+		},
+		Compression: CompressionConfig{
+			MinSize: 256,
+		},
+		Obfuscation: ObfuscationConfig{
+			Path: "/transport",
+		},
+		PluggableTransports: PluggableTransportsConfig{
+			StateDir: "pt_state",
+		},
+		ConnectIP: ConnectIPConfig{
+			Listen:        ":8443",
+			Path:          "/.well-known/masque/ip/*/*/",
+			HTTP2Fallback: true,
+		},
+		LocalProxy: LocalProxyConfig{
+			Address: "10.0.0.1",
+			SOCKS5:  "127.0.0.1:1080",
+			HTTP:    "127.0.0.1:8118",
+			DNS:     "1.1.1.1:53",
+		},
+		UpstreamProxy: UpstreamProxyConfig{
+			FromEnvironment: true,
+		},
+		API: APIConfig{
+			Listen: "127.0.0.1:8889",
+		},
+	}
+}
+
+// Load reads the configuration from path, falling back to defaults when the file does not exist
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("    [CONFIG] %s not found, using defaults", path)
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,324 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// upstreamTimeout bounds a single query to the upstream resolver
+	upstreamTimeout = 5 * time.Second
+
+	// expiryInterval is how often expired host routes are swept
+	expiryInterval = 5 * time.Second
+
+	// maxMessageSize is the largest DNS message we relay
+	maxMessageSize = 65535
+
+	// maxPendingQueries bounds the udp queries waiting for the upstream
+	// resolver, queries beyond it are dropped and left to the client to retry
+	maxPendingQueries = 256
+)
+
+// Forwarder answers DNS queries on the tunnel by relaying them to an upstream
+// resolver. Answers for names matching the configured domains install host
+// routes through the TUN interface that live as long as the records' TTL.
+type Forwarder struct {
+	listen   string
+	upstream string
+	matcher  *domainMatcher
+	routes   *hostRoutes
+
+	udpConn     net.PacketConn
+	tcpListener net.Listener
+	pending     chan struct{}
+
+	// Cleanup management
+	ctx          context.Context
+	cancel       context.CancelFunc
+	wg           sync.WaitGroup
+	controlMutex sync.Mutex
+	isRunning    bool
+}
+
+// NewForwarder creates a forwarder listening on listen and relaying to upstream.
+// interfaceName is queried each time a route changes so it follows the live interface.
+func NewForwarder(listen, upstream string, domains []string, minTTL time.Duration, routeManager RouteManager, interfaceName func() string) *Forwarder {
+	return &Forwarder{
+		listen:   listen,
+		upstream: upstream,
+		matcher:  newDomainMatcher(domains),
+		routes:   newHostRoutes(routeManager, interfaceName, minTTL),
+		pending:  make(chan struct{}, maxPendingQueries),
+	}
+}
+
+// Start begins serving DNS over UDP and TCP
+func (forwarder *Forwarder) Start() error {
+	forwarder.controlMutex.Lock()
+	defer forwarder.controlMutex.Unlock()
+
+	if forwarder.isRunning {
+		return fmt.Errorf("dns forwarder is already running")
+	}
+
+	udpConn, err := net.ListenPacket("udp", forwarder.listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on udp %s: %w", forwarder.listen, err)
+	}
+
+	tcpListener, err := net.Listen("tcp", forwarder.listen)
+	if err != nil {
+		udpConn.Close()
+		return fmt.Errorf("failed to listen on tcp %s: %w", forwarder.listen, err)
+	}
+
+	forwarder.udpConn = udpConn
+	forwarder.tcpListener = tcpListener
+	forwarder.ctx, forwarder.cancel = context.WithCancel(context.Background())
+
+	log.Printf("    [DNS] Forwarding queries on %s to %s", forwarder.listen, forwarder.upstream)
+
+	forwarder.wg.Add(3)
+	forwarder.isRunning = true
+	go forwarder.serveUDP()
+	go forwarder.serveTCP()
+	go forwarder.expireRoutes()
+
+	return nil
+}
+
+// Stop stops serving and removes every host route the forwarder installed
+func (forwarder *Forwarder) Stop() error {
+	forwarder.controlMutex.Lock()
+	defer forwarder.controlMutex.Unlock()
+
+	if !forwarder.isRunning {
+		return fmt.Errorf("dns forwarder is not running")
+	}
+
+	log.Printf("    [DNS] Stopping forwarder on %s", forwarder.listen)
+
+	forwarder.cancel()
+	forwarder.udpConn.Close()
+	forwarder.tcpListener.Close()
+	forwarder.wg.Wait()
+
+	forwarder.routes.flush()
+
+	forwarder.isRunning = false
+	return nil
+}
+
+// RouteCount returns the number of host routes currently installed
+func (forwarder *Forwarder) RouteCount() int {
+	return forwarder.routes.count()
+}
+
+// serveUDP answers queries received over UDP
+func (forwarder *Forwarder) serveUDP() {
+	defer forwarder.wg.Done()
+
+	buffer := make([]byte, maxMessageSize)
+	for {
+		n, client, err := forwarder.udpConn.ReadFrom(buffer)
+		if err != nil {
+			if forwarder.ctx.Err() == nil {
+				log.Printf("    [DNS] Error reading udp query: %v", err)
+			}
+			return
+		}
+
+		select {
+		case forwarder.pending <- struct{}{}:
+		default:
+			log.Printf("    [DNS] Dropping udp query from %s, %d queries pending", client, maxPendingQueries)
+			continue
+		}
+
+		query := make([]byte, n)
+		copy(query, buffer[:n])
+
+		forwarder.wg.Add(1)
+		go forwarder.answerUDP(query, client)
+	}
+}
+
+// answerUDP relays a single udp query and sends the response to the client
+func (forwarder *Forwarder) answerUDP(query []byte, client net.Addr) {
+	defer forwarder.wg.Done()
+	defer func() { <-forwarder.pending }()
+
+	response, err := forwarder.exchange("udp", query)
+	if err != nil {
+		log.Printf("    [DNS] Upstream query failed: %v", err)
+		return
+	}
+
+	if _, err := forwarder.udpConn.WriteTo(response, client); err != nil && forwarder.ctx.Err() == nil {
+		log.Printf("    [DNS] Error writing udp response to %s: %v", client, err)
+	}
+}
+
+// serveTCP answers queries received over TCP
+func (forwarder *Forwarder) serveTCP() {
+	defer forwarder.wg.Done()
+
+	for {
+		conn, err := forwarder.tcpListener.Accept()
+		if err != nil {
+			if forwarder.ctx.Err() == nil {
+				log.Printf("    [DNS] Error accepting tcp connection: %v", err)
+			}
+			return
+		}
+
+		go forwarder.serveTCPConn(conn)
+	}
+}
+
+// serveTCPConn answers the queries of a single TCP client
+func (forwarder *Forwarder) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(upstreamTimeout))
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+
+		response, err := forwarder.exchange("tcp", query)
+		if err != nil {
+			log.Printf("    [DNS] Upstream query failed: %v", err)
+			return
+		}
+
+		if err := writeTCPMessage(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+// exchange relays a query upstream and inspects the response for routed names
+func (forwarder *Forwarder) exchange(network string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(forwarder.ctx, upstreamTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, forwarder.upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	var response []byte
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		if response, err = readTCPMessage(conn); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buffer := make([]byte, maxMessageSize)
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		response = buffer[:n]
+	}
+
+	forwarder.inspect(response)
+	return response, nil
+}
+
+// inspect installs host routes for the addresses of matching names
+func (forwarder *Forwarder) inspect(response []byte) {
+	var message dnsmessage.Message
+	if err := message.Unpack(response); err != nil {
+		return
+	}
+
+	if len(message.Questions) == 0 || message.RCode != dnsmessage.RCodeSuccess {
+		return
+	}
+
+	name := message.Questions[0].Name.String()
+	if !forwarder.matcher.matches(name) {
+		return
+	}
+
+	// CNAME chains are answered in the same message, so every address in
+	// the answer section belongs to the name that was asked for
+	for _, answer := range message.Answers {
+		ttl := time.Duration(answer.Header.TTL) * time.Second
+
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			forwarder.routes.add(netip.AddrFrom4(body.A), ttl, name)
+		case *dnsmessage.AAAAResource:
+			forwarder.routes.add(netip.AddrFrom16(body.AAAA), ttl, name)
+		}
+	}
+}
+
+// expireRoutes periodically removes host routes whose TTL ran out
+func (forwarder *Forwarder) expireRoutes() {
+	defer forwarder.wg.Done()
+
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-forwarder.ctx.Done():
+			return
+		case now := <-ticker.C:
+			forwarder.routes.expire(now)
+		}
+	}
+}
+
+// readTCPMessage reads a length-prefixed DNS message
+func readTCPMessage(reader io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, errors.New("empty dns message")
+	}
+
+	message := make([]byte, length)
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// writeTCPMessage writes a length-prefixed DNS message
+func writeTCPMessage(writer io.Writer, message []byte) error {
+	framed := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(framed, uint16(len(message)))
+	copy(framed[2:], message)
+
+	_, err := writer.Write(framed)
+	return err
+}
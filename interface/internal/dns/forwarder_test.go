@@ -0,0 +1,226 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestTCPMessageFraming(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := writeTCPMessage(&buffer, []byte{1, 2, 3}); err != nil {
+		t.Fatalf("writeTCPMessage: %v", err)
+	}
+	if err := writeTCPMessage(&buffer, []byte{4}); err != nil {
+		t.Fatalf("writeTCPMessage: %v", err)
+	}
+	if want := []byte{0, 3, 1, 2, 3, 0, 1, 4}; !bytes.Equal(buffer.Bytes(), want) {
+		t.Fatalf("framed = %v, want %v", buffer.Bytes(), want)
+	}
+
+	for _, want := range [][]byte{{1, 2, 3}, {4}} {
+		message, err := readTCPMessage(&buffer)
+		if err != nil {
+			t.Fatalf("readTCPMessage: %v", err)
+		}
+		if !bytes.Equal(message, want) {
+			t.Errorf("readTCPMessage = %v, want %v", message, want)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  error
+	}{
+		{"empty stream", nil, io.EOF},
+		{"short length", []byte{0}, io.ErrUnexpectedEOF},
+		{"short message", []byte{0, 5, 1, 2}, io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		if _, err := readTCPMessage(bytes.NewReader(test.input)); !errors.Is(err, test.want) {
+			t.Errorf("%s: readTCPMessage error = %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	if _, err := readTCPMessage(bytes.NewReader([]byte{0, 0})); err == nil {
+		t.Error("readTCPMessage of an empty message succeeded, want an error")
+	}
+}
+
+// answer builds the response of the fake upstream: an A and an AAAA record
+// for the name asked for
+func answer(t *testing.T, query []byte, ttl uint32) []byte {
+	var message dnsmessage.Message
+	if err := message.Unpack(query); err != nil {
+		t.Errorf("upstream received an invalid query: %v", err)
+		return nil
+	}
+
+	name := message.Questions[0].Name
+	message.Header.Response = true
+	message.Answers = []dnsmessage.Resource{
+		{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 10}},
+		},
+		{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 0x10}},
+		},
+	}
+
+	response, err := message.Pack()
+	if err != nil {
+		t.Errorf("Pack: %v", err)
+	}
+	return response
+}
+
+// fakeUpstream serves answer over udp and tcp on the same port and returns its address
+func fakeUpstream(t *testing.T, ttl uint32) string {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { udpConn.Close() })
+
+	tcpListener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { tcpListener.Close() })
+
+	go func() {
+		buffer := make([]byte, maxMessageSize)
+		for {
+			n, client, err := udpConn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			udpConn.WriteTo(answer(t, buffer[:n], ttl), client)
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				writeTCPMessage(conn, answer(t, query, ttl))
+			}()
+		}
+	}()
+
+	return udpConn.LocalAddr().String()
+}
+
+// query builds an A query for name
+func query(t *testing.T, id uint16, name string) []byte {
+	message := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		},
+	}
+
+	packed, err := message.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	return packed
+}
+
+// checkResponse verifies a response answers the query with the given id
+func checkResponse(t *testing.T, response []byte, id uint16) {
+	var message dnsmessage.Message
+	if err := message.Unpack(response); err != nil {
+		t.Fatalf("Unpack response: %v", err)
+	}
+	if message.Header.ID != id || len(message.Answers) != 2 {
+		t.Errorf("response = id %d with %d answers, want id %d with 2 answers", message.Header.ID, len(message.Answers), id)
+	}
+}
+
+func TestForwarder(t *testing.T) {
+	discardLogs(t)
+
+	routeManager := &fakeRouteManager{}
+	forwarder := NewForwarder("127.0.0.1:0", fakeUpstream(t, 60), []string{"*.corp.example"}, 0, routeManager, func() string { return "utun9" })
+	if err := forwarder.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer forwarder.Stop()
+
+	// An unrouted name is answered without installing routes
+	udpConn, err := net.Dial("udp", forwarder.udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial udp: %v", err)
+	}
+	defer udpConn.Close()
+	udpConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	buffer := make([]byte, maxMessageSize)
+	for i, name := range []string{"www.example.org.", "git.corp.example."} {
+		id := uint16(i + 1)
+		if _, err := udpConn.Write(query(t, id, name)); err != nil {
+			t.Fatalf("Write udp: %v", err)
+		}
+		n, err := udpConn.Read(buffer)
+		if err != nil {
+			t.Fatalf("Read udp: %v", err)
+		}
+		checkResponse(t, buffer[:n], id)
+	}
+
+	if count := forwarder.RouteCount(); count != 2 {
+		t.Errorf("RouteCount() = %d after udp queries, want 2", count)
+	}
+
+	tcpConn, err := net.Dial("tcp", forwarder.tcpListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial tcp: %v", err)
+	}
+	defer tcpConn.Close()
+	tcpConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := writeTCPMessage(tcpConn, query(t, 3, "wiki.corp.example.")); err != nil {
+		t.Fatalf("writeTCPMessage: %v", err)
+	}
+	response, err := readTCPMessage(tcpConn)
+	if err != nil {
+		t.Fatalf("readTCPMessage: %v", err)
+	}
+	checkResponse(t, response, 3)
+
+	// The answers of both names carry the same addresses
+	if count := forwarder.RouteCount(); count != 2 {
+		t.Errorf("RouteCount() = %d after the tcp query, want 2", count)
+	}
+
+	forwarder.routes.expire(time.Now().Add(61 * time.Second))
+	if count := forwarder.RouteCount(); count != 0 {
+		t.Errorf("RouteCount() = %d after the TTL, want 0", count)
+	}
+
+	want := []string{
+		"add 192.0.2.10/32 dev utun9",
+		"add 2001:db8::10/128 dev utun9",
+	}
+	if got := routeManager.recorded()[:2]; !reflect.DeepEqual(got, want) {
+		t.Errorf("routes = %q, want %q", got, want)
+	}
+}
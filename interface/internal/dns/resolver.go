@@ -0,0 +1,538 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	// resolvConfPath is the resolver configuration rewritten when systemd-resolved is not in use
+	resolvConfPath = "/etc/resolv.conf"
+
+	// resolvConfBackupPath keeps the original resolv.conf on disk so it
+	// survives a crash. A symlinked resolv.conf is backed up as the link.
+	resolvConfBackupPath = "/etc/resolv.conf.thinkpol-vpn"
+
+	// serviceDNSBackupPath keeps the original DNS setting of the primary
+	// network service on macOS. The dynamic store is rebuilt at boot and so
+	// is /var/run, a backup never outlives the setting it belongs to.
+	serviceDNSBackupPath = "/var/run/thinkpol-vpn.dns.json"
+)
+
+// ResolverManager points the system resolver at the tunnel DNS servers and
+// puts the original configuration back afterwards. It uses systemd-resolved
+// or resolv.conf on Linux and the dynamic store through scutil on macOS.
+type ResolverManager struct {
+	mutex   sync.Mutex
+	applied bool
+
+	// Linux state
+	interfaceName   string
+	resolved        bool
+	resolvConf      []byte
+	resolvConfLink  string
+	resolvConfIsSet bool
+
+	// macOS state
+	serviceKey  string
+	originalDNS *scutilDict
+
+	// resolvConfPath and backupPath are the files of the resolv.conf path,
+	// run and resolvedActive the commands of the systemd-resolved path,
+	// serviceBackupPath and scutil those of the macOS path
+	resolvConfPath    string
+	backupPath        string
+	run               func(name string, args ...string) error
+	resolvedActive    func() bool
+	serviceBackupPath string
+	scutil            func(script string) (string, error)
+}
+
+// serviceDNSBackup is the DNS setting of a network service saved before it
+// is overridden. Original is nil when the service had none.
+type serviceDNSBackup struct {
+	ServiceKey string      `json:"service_key"`
+	Original   *scutilDict `json:"original"`
+}
+
+// NewResolverManager creates a new resolver manager
+func NewResolverManager() *ResolverManager {
+	return &ResolverManager{
+		resolvConfPath:    resolvConfPath,
+		backupPath:        resolvConfBackupPath,
+		run:               run,
+		resolvedActive:    systemdResolvedActive,
+		serviceBackupPath: serviceDNSBackupPath,
+		scutil:            runScutil,
+	}
+}
+
+// Apply sets the tunnel DNS servers and search domains. With routeAll the
+// tunnel servers answer every query, otherwise only the search domains are
+// sent their way where the platform supports it.
+func (resolverManager *ResolverManager) Apply(interfaceName string, servers, searchDomains []string, routeAll bool) error {
+	resolverManager.mutex.Lock()
+	defer resolverManager.mutex.Unlock()
+
+	if resolverManager.applied {
+		return nil
+	}
+
+	if len(servers) == 0 {
+		return fmt.Errorf("no DNS servers to apply")
+	}
+
+	var err error
+	switch runtime.GOOS {
+	case "linux":
+		err = resolverManager.applyLinux(interfaceName, servers, searchDomains, routeAll)
+	case "darwin":
+		err = resolverManager.applyDarwin(servers, searchDomains)
+	default:
+		err = fmt.Errorf("DNS configuration is not supported on %s", runtime.GOOS)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("    [DNS] Using tunnel DNS servers %v (search %v)", servers, searchDomains)
+	resolverManager.applied = true
+	return nil
+}
+
+// Restore puts back the resolver configuration that was in place before Apply
+func (resolverManager *ResolverManager) Restore() error {
+	resolverManager.mutex.Lock()
+	defer resolverManager.mutex.Unlock()
+
+	if !resolverManager.applied {
+		return nil
+	}
+
+	var err error
+	switch runtime.GOOS {
+	case "linux":
+		err = resolverManager.restoreLinux()
+	case "darwin":
+		err = resolverManager.restoreDarwin()
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("    [DNS] Restored original DNS configuration")
+	resolverManager.applied = false
+	return nil
+}
+
+// Recover undoes what a run that crashed with its DNS configuration applied
+// left behind: the systemd-resolved settings of interfaceName, when given,
+// and a rewritten resolv.conf whose backup is still on disk on Linux, and the
+// overridden DNS setting of the network service in the backup on macOS
+func (resolverManager *ResolverManager) Recover(interfaceName string) error {
+	resolverManager.mutex.Lock()
+	defer resolverManager.mutex.Unlock()
+
+	if resolverManager.applied {
+		return nil
+	}
+
+	switch runtime.GOOS {
+	case "linux":
+		return resolverManager.recoverLinux(interfaceName)
+	case "darwin":
+		return resolverManager.recoverDarwin()
+	}
+	return nil
+}
+
+// recoverLinux reverts the link of a previous run and restores the resolv.conf backup
+func (resolverManager *ResolverManager) recoverLinux(interfaceName string) error {
+	if interfaceName != "" && resolverManager.resolvedActive() {
+		// The link is usually gone together with the interface
+		if err := resolverManager.run("resolvectl", "revert", interfaceName); err != nil {
+			log.Printf("    [DNS] Could not revert link %s of a previous run: %v", interfaceName, err)
+		}
+	}
+
+	original, link, err := resolverManager.readBackup()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("    [DNS] Found %s from a previous run, restoring %s", resolverManager.backupPath, resolverManager.resolvConfPath)
+	resolverManager.resolvConf = original
+	resolverManager.resolvConfLink = link
+	resolverManager.resolvConfIsSet = true
+	return resolverManager.restoreLinux()
+}
+
+// recoverDarwin writes back the network service setting kept in the backup
+func (resolverManager *ResolverManager) recoverDarwin() error {
+	backup, err := resolverManager.readServiceBackup()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("    [DNS] Found %s from a previous run, restoring %s", resolverManager.serviceBackupPath, backup.ServiceKey)
+	resolverManager.serviceKey = backup.ServiceKey
+	resolverManager.originalDNS = backup.Original
+	return resolverManager.restoreDarwin()
+}
+
+// applyLinux configures systemd-resolved for the link, or rewrites resolv.conf without it
+func (resolverManager *ResolverManager) applyLinux(interfaceName string, servers, searchDomains []string, routeAll bool) error {
+	if resolverManager.resolvedActive() {
+		run := resolverManager.run
+		if err := run("resolvectl", append([]string{"dns", interfaceName}, servers...)...); err != nil {
+			return err
+		}
+
+		// "~." makes the link the route for every name, not just its search domains
+		domains := append([]string{}, searchDomains...)
+		if routeAll {
+			domains = append(domains, "~.")
+		}
+		if len(domains) > 0 {
+			if err := run("resolvectl", append([]string{"domain", interfaceName}, domains...)...); err != nil {
+				run("resolvectl", "revert", interfaceName)
+				return err
+			}
+		}
+		if routeAll {
+			if err := run("resolvectl", "default-route", interfaceName, "true"); err != nil {
+				run("resolvectl", "revert", interfaceName)
+				return err
+			}
+		}
+
+		resolverManager.resolved = true
+		resolverManager.interfaceName = interfaceName
+		return nil
+	}
+
+	path := resolverManager.resolvConfPath
+
+	// A backup left by a crashed run holds the original, the current file
+	// is what that run wrote
+	original, link, err := resolverManager.readBackup()
+	if errors.Is(err, os.ErrNotExist) {
+		if original, err = os.ReadFile(path); err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		link, _ = os.Readlink(path)
+
+		if err := resolverManager.writeBackup(original, link); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", path, err)
+		}
+	} else if err != nil {
+		return err
+	} else {
+		log.Printf("    [DNS] Keeping %s from a previous run as the original", resolverManager.backupPath)
+	}
+
+	var content strings.Builder
+	content.WriteString("# Generated by thinkpol-vpn, original saved in " + resolverManager.backupPath + "\n")
+	for _, server := range servers {
+		fmt.Fprintf(&content, "nameserver %s\n", server)
+	}
+	if len(searchDomains) > 0 {
+		fmt.Fprintf(&content, "search %s\n", strings.Join(searchDomains, " "))
+	}
+
+	// Replace a symlink instead of writing through it into someone else's file
+	if current, _ := os.Readlink(path); current != "" {
+		os.Remove(path)
+	}
+	if err := os.WriteFile(path, []byte(content.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	resolverManager.resolvConf = original
+	resolverManager.resolvConfLink = link
+	resolverManager.resolvConfIsSet = true
+	return nil
+}
+
+// readBackup returns the original resolv.conf kept in the backup, and the
+// target of the link when it was a symlink
+func (resolverManager *ResolverManager) readBackup() ([]byte, string, error) {
+	link, err := os.Readlink(resolverManager.backupPath)
+	if err == nil {
+		return nil, link, nil
+	}
+
+	original, err := os.ReadFile(resolverManager.backupPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", err
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read %s: %w", resolverManager.backupPath, err)
+	}
+	return original, "", nil
+}
+
+// writeBackup saves the original resolv.conf, or the link it was. The backup
+// is renamed into place so a crash never leaves half of it behind.
+func (resolverManager *ResolverManager) writeBackup(original []byte, link string) error {
+	temporary := resolverManager.backupPath + ".tmp"
+	os.Remove(temporary)
+
+	var err error
+	if link != "" {
+		err = os.Symlink(link, temporary)
+	} else {
+		err = os.WriteFile(temporary, original, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(temporary, resolverManager.backupPath)
+}
+
+// restoreLinux reverts the link in systemd-resolved or writes back the original resolv.conf
+func (resolverManager *ResolverManager) restoreLinux() error {
+	if resolverManager.resolved {
+		// The link may already be gone together with the interface
+		if err := resolverManager.run("resolvectl", "revert", resolverManager.interfaceName); err != nil {
+			log.Printf("    [DNS] Warning: could not revert link %s: %v", resolverManager.interfaceName, err)
+		}
+		resolverManager.resolved = false
+		return nil
+	}
+
+	if !resolverManager.resolvConfIsSet {
+		return nil
+	}
+
+	path := resolverManager.resolvConfPath
+	os.Remove(path)
+	if resolverManager.resolvConfLink != "" {
+		if err := os.Symlink(resolverManager.resolvConfLink, path); err != nil {
+			return fmt.Errorf("failed to restore %s link: %w", path, err)
+		}
+	} else if err := os.WriteFile(path, resolverManager.resolvConf, 0644); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", path, err)
+	}
+
+	// The backup only goes once the original is back
+	os.Remove(resolverManager.backupPath)
+	resolverManager.resolvConfIsSet = false
+	return nil
+}
+
+// applyDarwin overrides the DNS settings of the primary network service.
+// The original setting is saved on disk first so it survives a crash.
+func (resolverManager *ResolverManager) applyDarwin(servers, searchDomains []string) error {
+	// A backup left by a crashed run goes back first, the service it names
+	// still has that run's servers
+	if err := resolverManager.recoverDarwin(); err != nil {
+		return err
+	}
+
+	globalIPv4, err := resolverManager.scutilShow("State:/Network/Global/IPv4")
+	if err != nil {
+		return err
+	}
+	if globalIPv4 == nil || globalIPv4.Scalars["PrimaryService"] == "" {
+		return fmt.Errorf("could not find the primary network service")
+	}
+	serviceID := globalIPv4.Scalars["PrimaryService"]
+
+	serviceKey := "State:/Network/Service/" + serviceID + "/DNS"
+	original, err := resolverManager.scutilShow(serviceKey)
+	if err != nil {
+		return err
+	}
+
+	if err := resolverManager.writeServiceBackup(serviceDNSBackup{ServiceKey: serviceKey, Original: original}); err != nil {
+		return fmt.Errorf("failed to back up DNS setting of %s: %w", serviceKey, err)
+	}
+
+	dict := &scutilDict{Scalars: map[string]string{}, Arrays: map[string][]string{}}
+	dict.Arrays["ServerAddresses"] = servers
+	if len(searchDomains) > 0 {
+		dict.Arrays["SearchDomains"] = searchDomains
+	}
+	if err := resolverManager.scutilSet(serviceKey, dict); err != nil {
+		os.Remove(resolverManager.serviceBackupPath)
+		return err
+	}
+
+	resolverManager.serviceKey = serviceKey
+	resolverManager.originalDNS = original
+	return nil
+}
+
+// restoreDarwin writes back the DNS settings of the primary network service
+// and drops the backup once they are back
+func (resolverManager *ResolverManager) restoreDarwin() error {
+	var err error
+	if resolverManager.originalDNS == nil {
+		_, err = resolverManager.scutil("remove " + resolverManager.serviceKey + "\n")
+	} else {
+		err = resolverManager.scutilSet(resolverManager.serviceKey, resolverManager.originalDNS)
+	}
+	if err != nil {
+		return err
+	}
+
+	os.Remove(resolverManager.serviceBackupPath)
+	return nil
+}
+
+// readServiceBackup reads the network service setting saved by applyDarwin
+func (resolverManager *ResolverManager) readServiceBackup() (serviceDNSBackup, error) {
+	var backup serviceDNSBackup
+
+	data, err := os.ReadFile(resolverManager.serviceBackupPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return backup, err
+	}
+	if err != nil {
+		return backup, fmt.Errorf("failed to read %s: %w", resolverManager.serviceBackupPath, err)
+	}
+
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return backup, fmt.Errorf("failed to parse %s: %w", resolverManager.serviceBackupPath, err)
+	}
+	if backup.ServiceKey == "" {
+		return backup, fmt.Errorf("%s names no network service", resolverManager.serviceBackupPath)
+	}
+	return backup, nil
+}
+
+// writeServiceBackup saves the network service setting, renamed into place
+// like the resolv.conf backup
+func (resolverManager *ResolverManager) writeServiceBackup(backup serviceDNSBackup) error {
+	data, err := json.Marshal(backup)
+	if err != nil {
+		return err
+	}
+
+	temporary := resolverManager.serviceBackupPath + ".tmp"
+	if err := os.WriteFile(temporary, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporary, resolverManager.serviceBackupPath)
+}
+
+// scutilDict is a dictionary from the macOS dynamic store
+type scutilDict struct {
+	Scalars map[string]string   `json:"scalars,omitempty"`
+	Arrays  map[string][]string `json:"arrays,omitempty"`
+}
+
+// scutilShow reads a key from the dynamic store, returning nil if it does not exist
+func (resolverManager *ResolverManager) scutilShow(key string) (*scutilDict, error) {
+	output, err := resolverManager.scutil("show " + key + "\n")
+	if err != nil {
+		return nil, fmt.Errorf("scutil show %s failed: %w", key, err)
+	}
+
+	if strings.Contains(output, "No such key") {
+		return nil, nil
+	}
+
+	return parseScutilDict(output), nil
+}
+
+// parseScutilDict parses the `show` output of scutil:
+//
+//	<dictionary> {
+//	  SearchDomains : <array> {
+//	    0 : example.com
+//	  }
+//	  ServerAddresses : <array> {
+//	    0 : 192.168.1.1
+//	  }
+//	}
+func parseScutilDict(output string) *scutilDict {
+	dict := &scutilDict{Scalars: map[string]string{}, Arrays: map[string][]string{}}
+
+	var array string
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "}" {
+			array = ""
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, " : ")
+		if !ok {
+			continue
+		}
+
+		switch {
+		case array != "":
+			dict.Arrays[array] = append(dict.Arrays[array], value)
+		case value == "<array> {":
+			array = key
+		case !strings.HasPrefix(value, "<"):
+			dict.Scalars[key] = value
+		}
+	}
+
+	return dict
+}
+
+// scutilSet replaces a key in the dynamic store with the dictionary
+func (resolverManager *ResolverManager) scutilSet(key string, dict *scutilDict) error {
+	var script strings.Builder
+	script.WriteString("d.init\n")
+	for name, value := range dict.Scalars {
+		fmt.Fprintf(&script, "d.add %s %s\n", name, value)
+	}
+	for name, values := range dict.Arrays {
+		fmt.Fprintf(&script, "d.add %s * %s\n", name, strings.Join(values, " "))
+	}
+	fmt.Fprintf(&script, "set %s\n", key)
+
+	_, err := resolverManager.scutil(script.String())
+	return err
+}
+
+// runScutil feeds a script to scutil and returns its output
+func runScutil(script string) (string, error) {
+	cmd := exec.Command("scutil")
+	cmd.Stdin = strings.NewReader(script)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("scutil failed: %s, %w", string(output), err)
+	}
+	return string(output), nil
+}
+
+// systemdResolvedActive reports whether systemd-resolved manages DNS
+func systemdResolvedActive() bool {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return false
+	}
+	return exec.Command("resolvectl", "status").Run() == nil
+}
+
+// run executes a command and wraps its output into the error
+func run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %s, %w", name, strings.Join(args, " "), string(output), err)
+	}
+	return nil
+}
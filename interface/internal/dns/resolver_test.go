@@ -0,0 +1,280 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const originalResolvConf = "nameserver 192.168.1.1\n"
+
+// newTestResolverManager returns a manager rewriting a resolv.conf in a
+// temporary directory, or driving a recorded resolvectl when resolved
+func newTestResolverManager(t *testing.T, dir string, resolved bool) (*ResolverManager, *[]string) {
+	t.Helper()
+	if runtime.GOOS != "linux" {
+		t.Skip("the resolv.conf and resolvectl paths are Linux only")
+	}
+
+	var commands []string
+	resolverManager := NewResolverManager()
+	resolverManager.resolvConfPath = filepath.Join(dir, "resolv.conf")
+	resolverManager.backupPath = filepath.Join(dir, "resolv.conf.thinkpol-vpn")
+	resolverManager.resolvedActive = func() bool { return resolved }
+	resolverManager.run = func(name string, args ...string) error {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		return nil
+	}
+	return resolverManager, &commands
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	return string(data)
+}
+
+func TestResolvConf(t *testing.T) {
+	dir := t.TempDir()
+	resolverManager, _ := newTestResolverManager(t, dir, false)
+	os.WriteFile(resolverManager.resolvConfPath, []byte(originalResolvConf), 0644)
+
+	if err := resolverManager.Apply("utun9", []string{"10.0.0.1"}, []string{"corp.example"}, true); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	content := readFile(t, resolverManager.resolvConfPath)
+	if !strings.Contains(content, "nameserver 10.0.0.1\n") || !strings.Contains(content, "search corp.example\n") {
+		t.Errorf("resolv.conf = %q, want the tunnel server and search domain", content)
+	}
+	if backup := readFile(t, resolverManager.backupPath); backup != originalResolvConf {
+		t.Errorf("backup = %q, want the original", backup)
+	}
+
+	if err := resolverManager.Restore(); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if content := readFile(t, resolverManager.resolvConfPath); content != originalResolvConf {
+		t.Errorf("restored resolv.conf = %q, want the original", content)
+	}
+	if _, err := os.Lstat(resolverManager.backupPath); !os.IsNotExist(err) {
+		t.Errorf("backup still exists after Restore: %v", err)
+	}
+}
+
+func TestResolvConfSymlink(t *testing.T) {
+	dir := t.TempDir()
+	resolverManager, _ := newTestResolverManager(t, dir, false)
+	target := filepath.Join(dir, "stub-resolv.conf")
+	os.WriteFile(target, []byte(originalResolvConf), 0644)
+	os.Symlink(target, resolverManager.resolvConfPath)
+
+	if err := resolverManager.Apply("utun9", []string{"10.0.0.1"}, nil, true); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if content := readFile(t, target); content != originalResolvConf {
+		t.Errorf("link target = %q, Apply wrote through the link", content)
+	}
+
+	if err := resolverManager.Restore(); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if link, err := os.Readlink(resolverManager.resolvConfPath); err != nil || link != target {
+		t.Errorf("restored resolv.conf links to %q (%v), want %q", link, err, target)
+	}
+}
+
+func TestResolvConfAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	crashed, _ := newTestResolverManager(t, dir, false)
+	os.WriteFile(crashed.resolvConfPath, []byte(originalResolvConf), 0644)
+
+	// The first run applies its servers and never restores them
+	if err := crashed.Apply("utun9", []string{"10.0.0.1"}, nil, true); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	// The next run must not mistake the rewritten file for the original
+	next, _ := newTestResolverManager(t, dir, false)
+	if err := next.Apply("utun9", []string{"10.0.0.2"}, nil, true); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if backup := readFile(t, next.backupPath); backup != originalResolvConf {
+		t.Errorf("backup = %q, want the original of before the crash", backup)
+	}
+	if err := next.Restore(); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if content := readFile(t, next.resolvConfPath); content != originalResolvConf {
+		t.Errorf("restored resolv.conf = %q, want the original of before the crash", content)
+	}
+}
+
+func TestRecoverResolvConf(t *testing.T) {
+	dir := t.TempDir()
+	crashed, _ := newTestResolverManager(t, dir, false)
+	os.WriteFile(crashed.resolvConfPath, []byte(originalResolvConf), 0644)
+	if err := crashed.Apply("utun9", []string{"10.0.0.1"}, nil, true); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	recovering, _ := newTestResolverManager(t, dir, false)
+	if err := recovering.Recover(""); err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	if content := readFile(t, recovering.resolvConfPath); content != originalResolvConf {
+		t.Errorf("recovered resolv.conf = %q, want the original", content)
+	}
+	if _, err := os.Lstat(recovering.backupPath); !os.IsNotExist(err) {
+		t.Errorf("backup still exists after Recover: %v", err)
+	}
+
+	// Without a backup there is nothing to recover
+	if err := recovering.Recover(""); err != nil {
+		t.Errorf("Recover without a backup: %v", err)
+	}
+	if content := readFile(t, recovering.resolvConfPath); content != originalResolvConf {
+		t.Errorf("resolv.conf = %q after a second Recover, want it left alone", content)
+	}
+}
+
+func TestResolvectl(t *testing.T) {
+	dir := t.TempDir()
+	resolverManager, commands := newTestResolverManager(t, dir, true)
+
+	if err := resolverManager.Apply("utun9", []string{"10.0.0.1", "10.0.0.2"}, []string{"corp.example"}, true); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if err := resolverManager.Restore(); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	want := []string{
+		"resolvectl dns utun9 10.0.0.1 10.0.0.2",
+		"resolvectl domain utun9 corp.example ~.",
+		"resolvectl default-route utun9 true",
+		"resolvectl revert utun9",
+	}
+	if !reflect.DeepEqual(*commands, want) {
+		t.Errorf("commands = %q, want %q", *commands, want)
+	}
+	if _, err := os.Lstat(resolverManager.resolvConfPath); !os.IsNotExist(err) {
+		t.Errorf("resolv.conf was written although systemd-resolved is in use: %v", err)
+	}
+}
+
+func TestResolvectlSplit(t *testing.T) {
+	dir := t.TempDir()
+	resolverManager, commands := newTestResolverManager(t, dir, true)
+
+	// Without routeAll only the search domains go to the tunnel servers
+	if err := resolverManager.Apply("utun9", []string{"10.0.0.1"}, []string{"corp.example"}, false); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	want := []string{
+		"resolvectl dns utun9 10.0.0.1",
+		"resolvectl domain utun9 corp.example",
+	}
+	if !reflect.DeepEqual(*commands, want) {
+		t.Errorf("commands = %q, want %q", *commands, want)
+	}
+}
+
+func TestRecoverResolvectl(t *testing.T) {
+	dir := t.TempDir()
+	resolverManager, commands := newTestResolverManager(t, dir, true)
+
+	if err := resolverManager.Recover("utun9"); err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	if want := []string{"resolvectl revert utun9"}; !reflect.DeepEqual(*commands, want) {
+		t.Errorf("commands = %q, want %q", *commands, want)
+	}
+}
+
+// newTestScutil returns a manager whose dynamic store is a fake scutil
+// knowing the keys in store, with the backup in dir
+func newTestScutil(dir string, store map[string]string) (*ResolverManager, *[]string) {
+	var scripts []string
+	resolverManager := NewResolverManager()
+	resolverManager.serviceBackupPath = filepath.Join(dir, "thinkpol-vpn.dns.json")
+	resolverManager.scutil = func(script string) (string, error) {
+		scripts = append(scripts, script)
+		if key, ok := strings.CutPrefix(strings.TrimSpace(script), "show "); ok {
+			if output, ok := store[key]; ok {
+				return output, nil
+			}
+			return "  No such key\n", nil
+		}
+		return "", nil
+	}
+	return resolverManager, &scripts
+}
+
+func TestRecoverScutil(t *testing.T) {
+	const serviceKey = "State:/Network/Service/ABC/DNS"
+	store := map[string]string{
+		"State:/Network/Global/IPv4": "<dictionary> {\n  PrimaryInterface : en0\n  PrimaryService : ABC\n}\n",
+		serviceKey:                   "<dictionary> {\n  ServerAddresses : <array> {\n    0 : 192.168.1.1\n  }\n}\n",
+	}
+
+	dir := t.TempDir()
+	crashed, scripts := newTestScutil(dir, store)
+	if err := crashed.applyDarwin([]string{"10.0.0.1"}, nil); err != nil {
+		t.Fatalf("applyDarwin: %v", err)
+	}
+	if last := (*scripts)[len(*scripts)-1]; last != "d.init\nd.add ServerAddresses * 10.0.0.1\nset "+serviceKey+"\n" {
+		t.Errorf("override = %q, want the tunnel server", last)
+	}
+	if _, err := os.Stat(crashed.serviceBackupPath); err != nil {
+		t.Fatalf("backup missing after applyDarwin: %v", err)
+	}
+
+	recovering, scripts := newTestScutil(dir, store)
+	if err := recovering.recoverDarwin(); err != nil {
+		t.Fatalf("recoverDarwin: %v", err)
+	}
+	want := []string{"d.init\nd.add ServerAddresses * 192.168.1.1\nset " + serviceKey + "\n"}
+	if !reflect.DeepEqual(*scripts, want) {
+		t.Errorf("scripts = %q, want %q", *scripts, want)
+	}
+	if _, err := os.Stat(recovering.serviceBackupPath); !os.IsNotExist(err) {
+		t.Errorf("backup still exists after recoverDarwin: %v", err)
+	}
+
+	// Without a backup there is nothing to recover
+	*scripts = nil
+	if err := recovering.recoverDarwin(); err != nil {
+		t.Errorf("recoverDarwin without a backup: %v", err)
+	}
+	if len(*scripts) != 0 {
+		t.Errorf("scripts = %q after a second recoverDarwin, want none", *scripts)
+	}
+}
+
+func TestRecoverScutilWithoutOriginal(t *testing.T) {
+	store := map[string]string{
+		"State:/Network/Global/IPv4": "<dictionary> {\n  PrimaryService : ABC\n}\n",
+	}
+
+	dir := t.TempDir()
+	crashed, _ := newTestScutil(dir, store)
+	if err := crashed.applyDarwin([]string{"10.0.0.1"}, nil); err != nil {
+		t.Fatalf("applyDarwin: %v", err)
+	}
+
+	// A service that had no DNS setting gets it removed again
+	recovering, scripts := newTestScutil(dir, store)
+	if err := recovering.recoverDarwin(); err != nil {
+		t.Fatalf("recoverDarwin: %v", err)
+	}
+	if want := []string{"remove State:/Network/Service/ABC/DNS\n"}; !reflect.DeepEqual(*scripts, want) {
+		t.Errorf("scripts = %q, want %q", *scripts, want)
+	}
+}
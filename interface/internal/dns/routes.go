@@ -0,0 +1,149 @@
+package dns
+
+import (
+	"log"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RouteManager installs and removes routes on the host
+type RouteManager interface {
+	AddRoute(interfaceName, destination, gateway string) error
+	DeleteRoute(interfaceName, destination, gateway string) error
+}
+
+// hostRoutes tracks the host routes installed for resolved names and
+// removes them once the TTL of the records that produced them runs out
+type hostRoutes struct {
+	routeManager  RouteManager
+	interfaceName func() string
+	minTTL        time.Duration
+
+	mutex   sync.Mutex
+	expires map[netip.Addr]time.Time
+}
+
+// newHostRoutes creates an empty host route table
+func newHostRoutes(routeManager RouteManager, interfaceName func() string, minTTL time.Duration) *hostRoutes {
+	return &hostRoutes{
+		routeManager:  routeManager,
+		interfaceName: interfaceName,
+		minTTL:        minTTL,
+		expires:       make(map[netip.Addr]time.Time),
+	}
+}
+
+// add installs a host route for addr or extends the lifetime of an existing one
+func (routes *hostRoutes) add(addr netip.Addr, ttl time.Duration, name string) {
+	if ttl < routes.minTTL {
+		ttl = routes.minTTL
+	}
+	expires := time.Now().Add(ttl)
+
+	routes.mutex.Lock()
+	defer routes.mutex.Unlock()
+
+	if current, ok := routes.expires[addr]; ok {
+		if expires.After(current) {
+			routes.expires[addr] = expires
+		}
+		return
+	}
+
+	destination := netip.PrefixFrom(addr, addr.BitLen()).String()
+	if err := routes.routeManager.AddRoute(routes.interfaceName(), destination, ""); err != nil {
+		log.Printf("    [DNS] Failed to add host route %s for %s: %v", destination, name, err)
+		return
+	}
+
+	log.Printf("    [DNS] Added host route %s for %s (ttl %s)", destination, name, ttl)
+	routes.expires[addr] = expires
+}
+
+// expire removes the routes whose TTL ran out
+func (routes *hostRoutes) expire(now time.Time) {
+	routes.mutex.Lock()
+	defer routes.mutex.Unlock()
+
+	for addr, expires := range routes.expires {
+		if now.Before(expires) {
+			continue
+		}
+		routes.delete(addr)
+	}
+}
+
+// flush removes every installed route
+func (routes *hostRoutes) flush() {
+	routes.mutex.Lock()
+	defer routes.mutex.Unlock()
+
+	for addr := range routes.expires {
+		routes.delete(addr)
+	}
+}
+
+// delete removes a single route, callers must hold the mutex
+func (routes *hostRoutes) delete(addr netip.Addr) {
+	destination := netip.PrefixFrom(addr, addr.BitLen()).String()
+	if err := routes.routeManager.DeleteRoute(routes.interfaceName(), destination, ""); err != nil {
+		log.Printf("    [DNS] Warning: could not delete host route %s: %v", destination, err)
+	} else {
+		log.Printf("    [DNS] Removed host route %s", destination)
+	}
+	delete(routes.expires, addr)
+}
+
+// count returns the number of installed routes
+func (routes *hostRoutes) count() int {
+	routes.mutex.Lock()
+	defer routes.mutex.Unlock()
+
+	return len(routes.expires)
+}
+
+// domainMatcher decides which names get routed through the tunnel.
+// "corp.example" matches that name only, "*.corp.example" matches its subdomains.
+type domainMatcher struct {
+	exact    map[string]bool
+	suffixes []string
+}
+
+// newDomainMatcher builds a matcher from the configured domain patterns
+func newDomainMatcher(patterns []string) *domainMatcher {
+	matcher := &domainMatcher{exact: make(map[string]bool)}
+
+	for _, pattern := range patterns {
+		pattern = canonicalName(pattern)
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			matcher.suffixes = append(matcher.suffixes, "."+suffix)
+			continue
+		}
+		matcher.exact[pattern] = true
+	}
+
+	return matcher
+}
+
+// matches reports whether the name is covered by one of the patterns
+func (matcher *domainMatcher) matches(name string) bool {
+	name = canonicalName(name)
+	if matcher.exact[name] {
+		return true
+	}
+
+	for _, suffix := range matcher.suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// canonicalName lowercases a name and strips the trailing root dot
+func canonicalName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
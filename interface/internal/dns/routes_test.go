@@ -0,0 +1,137 @@
+package dns
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRouteManager records the host routes added and deleted
+type fakeRouteManager struct {
+	mutex    sync.Mutex
+	commands []string
+	failAdd  bool
+}
+
+func (routeManager *fakeRouteManager) AddRoute(interfaceName, destination, gateway string) error {
+	routeManager.mutex.Lock()
+	defer routeManager.mutex.Unlock()
+
+	if routeManager.failAdd {
+		return errors.New("route add failed")
+	}
+	routeManager.commands = append(routeManager.commands, "add "+destination+" dev "+interfaceName)
+	return nil
+}
+
+func (routeManager *fakeRouteManager) DeleteRoute(interfaceName, destination, gateway string) error {
+	routeManager.mutex.Lock()
+	defer routeManager.mutex.Unlock()
+
+	routeManager.commands = append(routeManager.commands, "delete "+destination+" dev "+interfaceName)
+	return nil
+}
+
+func (routeManager *fakeRouteManager) recorded() []string {
+	routeManager.mutex.Lock()
+	defer routeManager.mutex.Unlock()
+
+	return append([]string(nil), routeManager.commands...)
+}
+
+// discardLogs silences the log output for the duration of the test
+func discardLogs(t *testing.T) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(output) })
+}
+
+func TestDomainMatcher(t *testing.T) {
+	matcher := newDomainMatcher([]string{"corp.example", "*.Internal.Example.", " vpn.example "})
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"corp.example", true},
+		{"corp.example.", true},
+		{"CORP.example", true},
+		{"www.corp.example", false},
+		{"vpn.example", true},
+		{"internal.example", false},
+		{"git.internal.example.", true},
+		{"a.b.internal.example", true},
+		{"notinternal.example", false},
+		{"example", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if got := matcher.matches(test.name); got != test.want {
+			t.Errorf("matches(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHostRoutesExpire(t *testing.T) {
+	discardLogs(t)
+
+	routeManager := &fakeRouteManager{}
+	routes := newHostRoutes(routeManager, func() string { return "utun9" }, 30*time.Second)
+
+	short := netip.MustParseAddr("192.0.2.1")
+	long := netip.MustParseAddr("2001:db8::1")
+	start := time.Now()
+	routes.add(short, time.Second, "short.corp.example")
+	routes.add(long, 5*time.Minute, "long.corp.example")
+
+	// A second answer for the same address only extends its lifetime
+	routes.add(short, 0, "short.corp.example")
+
+	if count := routes.count(); count != 2 {
+		t.Fatalf("count() = %d, want 2", count)
+	}
+
+	// The one second TTL is raised to the 30 second minimum
+	routes.expire(start.Add(10 * time.Second))
+	if count := routes.count(); count != 2 {
+		t.Errorf("count() after 10s = %d, want 2", count)
+	}
+
+	routes.expire(start.Add(time.Minute))
+	if count := routes.count(); count != 1 {
+		t.Errorf("count() after 1m = %d, want 1", count)
+	}
+
+	routes.flush()
+	if count := routes.count(); count != 0 {
+		t.Errorf("count() after flush = %d, want 0", count)
+	}
+
+	want := []string{
+		"add 192.0.2.1/32 dev utun9",
+		"add 2001:db8::1/128 dev utun9",
+		"delete 192.0.2.1/32 dev utun9",
+		"delete 2001:db8::1/128 dev utun9",
+	}
+	if got := routeManager.recorded(); !reflect.DeepEqual(got, want) {
+		t.Errorf("routes = %q, want %q", got, want)
+	}
+}
+
+func TestHostRoutesAddFailure(t *testing.T) {
+	discardLogs(t)
+
+	routeManager := &fakeRouteManager{failAdd: true}
+	routes := newHostRoutes(routeManager, func() string { return "utun9" }, 0)
+
+	routes.add(netip.MustParseAddr("192.0.2.1"), time.Minute, "corp.example")
+	if count := routes.count(); count != 0 {
+		t.Errorf("count() = %d, want 0 after a failed add", count)
+	}
+}
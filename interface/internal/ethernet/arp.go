@@ -0,0 +1,84 @@
+package ethernet
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+// ARP (RFC 826) operations
+const (
+	ARPRequest = 1
+	ARPReply   = 2
+)
+
+const (
+	// arpLength is the length of an ARP packet for IPv4 over Ethernet
+	arpLength = 28
+
+	arpHardwareEthernet = 1
+)
+
+// ErrNotARP is returned for ARP packets that do not map IPv4 addresses to
+// Ethernet addresses
+var ErrNotARP = errors.New("not an IPv4 over Ethernet ARP packet")
+
+// ARP is a parsed ARP packet mapping an IPv4 address to an Ethernet address
+type ARP struct {
+	Operation uint16
+	SenderMAC MAC
+	SenderIP  netip.Addr
+	TargetMAC MAC
+	TargetIP  netip.Addr
+}
+
+// ParseARP parses the payload of an ARP frame
+func ParseARP(payload []byte) (ARP, error) {
+	if len(payload) < arpLength {
+		return ARP{}, ErrTruncated
+	}
+	if binary.BigEndian.Uint16(payload[0:2]) != arpHardwareEthernet ||
+		Type(binary.BigEndian.Uint16(payload[2:4])) != TypeIPv4 ||
+		payload[4] != 6 || payload[5] != 4 {
+		return ARP{}, ErrNotARP
+	}
+
+	return ARP{
+		Operation: binary.BigEndian.Uint16(payload[6:8]),
+		SenderMAC: MAC(payload[8:14]),
+		SenderIP:  netip.AddrFrom4([4]byte(payload[14:18])),
+		TargetMAC: MAC(payload[18:24]),
+		TargetIP:  netip.AddrFrom4([4]byte(payload[24:28])),
+	}, nil
+}
+
+// IsProbe reports whether the request only checks that nobody else uses an
+// address, as a host does before taking it (RFC 5227). Probes and
+// announcements must not be answered on behalf of others.
+func (arp ARP) IsProbe() bool {
+	return !arp.SenderIP.IsValid() || arp.SenderIP.IsUnspecified() || arp.SenderIP == arp.TargetIP
+}
+
+// Append appends the ARP packet to b
+func (arp ARP) Append(b []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, arpHardwareEthernet)
+	b = binary.BigEndian.AppendUint16(b, uint16(TypeIPv4))
+	b = append(b, 6, 4)
+	b = binary.BigEndian.AppendUint16(b, arp.Operation)
+	b = append(b, arp.SenderMAC[:]...)
+	b = append(b, arp.SenderIP.AsSlice()...)
+	b = append(b, arp.TargetMAC[:]...)
+	return append(b, arp.TargetIP.AsSlice()...)
+}
+
+// Answer returns the reply telling the sender of the request that its
+// target is at mac
+func (arp ARP) Answer(mac MAC) ARP {
+	return ARP{
+		Operation: ARPReply,
+		SenderMAC: mac,
+		SenderIP:  arp.TargetIP,
+		TargetMAC: arp.SenderMAC,
+		TargetIP:  arp.SenderIP,
+	}
+}
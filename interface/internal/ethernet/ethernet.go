@@ -0,0 +1,173 @@
+// Package ethernet parses and builds the Ethernet frames TAP mode carries
+// through the tunnel instead of IP packets, and the ARP and neighbor
+// discovery messages answered for them
+package ethernet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/obfuscate"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// LayerHeader asks for Ethernet frames instead of IP packets in the
+	// handshake and confirms them in the response
+	LayerHeader = "X-Tunnel-Layer"
+
+	// LayerEthernet is the value of LayerHeader asking for Ethernet frames
+	LayerEthernet = "ethernet"
+)
+
+// HeaderLength is the length of an Ethernet header without a VLAN tag
+const HeaderLength = 14
+
+// Type is the EtherType of a frame, the protocol of its payload
+type Type uint16
+
+// EtherTypes of the payloads TAP mode looks into
+const (
+	TypeIPv4 Type = 0x0800
+	TypeARP  Type = 0x0806
+	TypeIPv6 Type = 0x86dd
+)
+
+func (etherType Type) String() string {
+	switch etherType {
+	case TypeIPv4:
+		return "ipv4"
+	case TypeARP:
+		return "arp"
+	case TypeIPv6:
+		return "ipv6"
+	default:
+		return fmt.Sprintf("ethertype-0x%04x", uint16(etherType))
+	}
+}
+
+// ErrTruncated is returned for frames shorter than an Ethernet header
+var ErrTruncated = errors.New("frame is truncated")
+
+// MAC is an Ethernet address
+type MAC [6]byte
+
+// Broadcast is the address of every station on the link
+var Broadcast = MAC{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// ParseMAC parses an Ethernet address such as 02:00:00:00:00:01
+func ParseMAC(s string) (MAC, error) {
+	hardwareAddr, err := net.ParseMAC(s)
+	if err != nil {
+		return MAC{}, err
+	}
+	if len(hardwareAddr) != len(MAC{}) {
+		return MAC{}, fmt.Errorf("%s is not an Ethernet address", s)
+	}
+	return MAC(hardwareAddr), nil
+}
+
+// IsMulticast reports whether the address names a group of stations, the
+// broadcast address included
+func (mac MAC) IsMulticast() bool {
+	return mac[0]&1 == 1
+}
+
+func (mac MAC) String() string {
+	return net.HardwareAddr(mac[:]).String()
+}
+
+// Frame is a parsed Ethernet frame. The payload points into the parsed buffer.
+type Frame struct {
+	Destination MAC
+	Source      MAC
+	Type        Type
+	Payload     []byte
+}
+
+// Parse parses the header of an Ethernet frame. VLAN tags are not looked
+// into, tagged frames have the 802.1Q EtherType.
+func Parse(data []byte) (Frame, error) {
+	if len(data) < HeaderLength {
+		return Frame{}, ErrTruncated
+	}
+
+	return Frame{
+		Destination: MAC(data[0:6]),
+		Source:      MAC(data[6:12]),
+		Type:        Type(binary.BigEndian.Uint16(data[12:14])),
+		Payload:     data[HeaderLength:],
+	}, nil
+}
+
+// IsIP reports whether the frame carries an IPv4 or IPv6 packet
+func (frame Frame) IsIP() bool {
+	return frame.Type == TypeIPv4 || frame.Type == TypeIPv6
+}
+
+// Append appends the frame to b
+func (frame Frame) Append(b []byte) []byte {
+	b = append(b, frame.Destination[:]...)
+	b = append(b, frame.Source[:]...)
+	b = binary.BigEndian.AppendUint16(b, uint16(frame.Type))
+	return append(b, frame.Payload...)
+}
+
+// Reply returns a frame carrying payload back to the sender of the frame
+func (frame Frame) Reply(etherType Type, payload []byte) []byte {
+	return Frame{
+		Destination: frame.Source,
+		Source:      frame.Destination,
+		Type:        etherType,
+		Payload:     payload,
+	}.Append(make([]byte, 0, HeaderLength+len(payload)))
+}
+
+// Packet returns the IP packet a frame carries, nil for malformed frames
+// and frames carrying anything else, such as ARP
+func Packet(data []byte) []byte {
+	frame, err := Parse(data)
+	if err != nil || !frame.IsIP() {
+		return nil
+	}
+	return frame.Payload
+}
+
+// TypeOf returns the EtherType of an IP packet, 0 when it is neither IPv4
+// nor IPv6
+func TypeOf(packet []byte) Type {
+	if len(packet) == 0 {
+		return 0
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		return TypeIPv4
+	case 6:
+		return TypeIPv6
+	default:
+		return 0
+	}
+}
+
+// Marshal wraps a frame in the message carried on the wire, with padding
+// when obfuscation asks for it
+func Marshal(frame []byte, obfuscation obfuscate.Settings) ([]byte, error) {
+	return proto.Marshal(obfuscation.PadFrame(&protobuf.EthernetFrame{Frame: frame}))
+}
+
+// Unmarshal returns the frame a message from the wire carries, as a packet
+// whose buffer holds the frame so it travels the packet channels of the
+// transports
+func Unmarshal(message []byte) (*protobuf.PacketV4, error) {
+	received := &protobuf.EthernetFrame{}
+	if err := proto.Unmarshal(message, received); err != nil {
+		return nil, err
+	}
+
+	length := int32(len(received.GetFrame()))
+	return &protobuf.PacketV4{Length: &length, Buffer: received.GetFrame()}, nil
+}
@@ -0,0 +1,156 @@
+package ethernet
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/config"
+	"thinkpol-vpn/interface/internal/obfuscate"
+
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	hostMAC    = MAC{0x02, 0, 0, 0, 0, 0x02}
+	gatewayMAC = MAC{0x02, 0, 0, 0, 0, 0x01}
+)
+
+func TestFrame(t *testing.T) {
+	packet := []byte{0x45, 0, 0, 20}
+	data := Frame{Destination: gatewayMAC, Source: hostMAC, Type: TypeOf(packet), Payload: packet}.Append(nil)
+
+	frame, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if frame.Destination != gatewayMAC || frame.Source != hostMAC || frame.Type != TypeIPv4 || !frame.IsIP() {
+		t.Errorf("Parse = %+v, want an IPv4 frame from %s to %s", frame, hostMAC, gatewayMAC)
+	}
+	if !bytes.Equal(frame.Payload, packet) {
+		t.Errorf("payload = %v, want %v", frame.Payload, packet)
+	}
+
+	reply, _ := Parse(frame.Reply(TypeIPv6, []byte{0x60}))
+	if reply.Destination != hostMAC || reply.Source != gatewayMAC || reply.Type != TypeIPv6 {
+		t.Errorf("Reply = %+v, want an IPv6 frame back to %s", reply, hostMAC)
+	}
+
+	if _, err := Parse(data[:HeaderLength-1]); err != ErrTruncated {
+		t.Errorf("Parse of a short frame = %v, want %v", err, ErrTruncated)
+	}
+}
+
+func TestMAC(t *testing.T) {
+	mac, err := ParseMAC("02:00:00:00:00:02")
+	if err != nil || mac != hostMAC {
+		t.Errorf("ParseMAC = %s, %v, want %s", mac, err, hostMAC)
+	}
+	if _, err := ParseMAC("00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01"); err == nil {
+		t.Error("ParseMAC accepted an InfiniBand address")
+	}
+	if !Broadcast.IsMulticast() || hostMAC.IsMulticast() {
+		t.Error("IsMulticast is wrong for the broadcast or a unicast address")
+	}
+}
+
+func TestARP(t *testing.T) {
+	request := ARP{
+		Operation: ARPRequest,
+		SenderMAC: hostMAC,
+		SenderIP:  netip.MustParseAddr("10.0.0.2"),
+		TargetIP:  netip.MustParseAddr("10.0.0.1"),
+	}
+	parsed, err := ParseARP(request.Append(nil))
+	if err != nil || parsed != request {
+		t.Fatalf("ParseARP = %+v, %v, want %+v", parsed, err, request)
+	}
+	if parsed.IsProbe() {
+		t.Error("a request for another address counts as a probe")
+	}
+
+	answer := parsed.Answer(gatewayMAC)
+	if answer.Operation != ARPReply || answer.SenderMAC != gatewayMAC || answer.SenderIP != request.TargetIP ||
+		answer.TargetMAC != hostMAC || answer.TargetIP != request.SenderIP {
+		t.Errorf("Answer = %+v, want 10.0.0.1 at %s told to the sender", answer, gatewayMAC)
+	}
+
+	probe := ARP{Operation: ARPRequest, SenderMAC: hostMAC, SenderIP: netip.IPv4Unspecified(), TargetIP: request.SenderIP}
+	announcement := ARP{Operation: ARPRequest, SenderMAC: hostMAC, SenderIP: request.SenderIP, TargetIP: request.SenderIP}
+	if !probe.IsProbe() || !announcement.IsProbe() {
+		t.Error("probes and announcements are not recognized")
+	}
+
+	if _, err := ParseARP(make([]byte, 10)); err != ErrTruncated {
+		t.Errorf("ParseARP of a short packet = %v, want %v", err, ErrTruncated)
+	}
+	if _, err := ParseARP(make([]byte, 28)); err != ErrNotARP {
+		t.Errorf("ParseARP of a zeroed packet = %v, want %v", err, ErrNotARP)
+	}
+}
+
+func TestNDP(t *testing.T) {
+	solicitation := NDP{
+		Type:        NeighborSolicitation,
+		Source:      netip.MustParseAddr("fd00::2"),
+		Destination: netip.MustParseAddr("ff02::1:ff00:1"),
+		Target:      netip.MustParseAddr("fd00::1"),
+		LinkAddr:    hostMAC,
+	}
+	data := solicitation.Append(nil)
+	parsed, err := ParseNDP(data)
+	if err != nil || parsed != solicitation {
+		t.Fatalf("ParseNDP = %+v, %v, want %+v", parsed, err, solicitation)
+	}
+	if parsed.IsProbe() {
+		t.Error("a solicitation for another address counts as a probe")
+	}
+
+	answer := parsed.Answer(gatewayMAC)
+	parsed, err = ParseNDP(answer.Append(nil))
+	if err != nil || parsed != answer {
+		t.Fatalf("ParseNDP of the answer = %+v, %v, want %+v", parsed, err, answer)
+	}
+	if answer.Type != NeighborAdvertisement || answer.Source != solicitation.Target || answer.Destination != solicitation.Source ||
+		answer.Target != solicitation.Target || answer.LinkAddr != gatewayMAC || answer.Flags&FlagSolicited == 0 {
+		t.Errorf("Answer = %+v, want fd00::1 at %s told to the sender", answer, gatewayMAC)
+	}
+
+	probe := NDP{Type: NeighborSolicitation, Source: netip.IPv6Unspecified(), Target: solicitation.Source}
+	if !probe.IsProbe() {
+		t.Error("duplicate address detection is not recognized")
+	}
+
+	corrupted := bytes.Clone(data)
+	corrupted[len(corrupted)-1] ^= 0xff
+	routed := bytes.Clone(data)
+	routed[7] = 64
+	for name, data := range map[string][]byte{"corrupted": corrupted, "routed": routed, "short": data[:50]} {
+		if _, err := ParseNDP(data); err != ErrNotNDP {
+			t.Errorf("ParseNDP of a %s packet = %v, want %v", name, err, ErrNotNDP)
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	obfuscation, err := obfuscate.New(config.ObfuscationConfig{MaxPadding: 64})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	frame := Frame{Destination: Broadcast, Source: hostMAC, Type: TypeARP}.Append(nil)
+	message, err := Marshal(frame, obfuscation)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	received, err := Unmarshal(message)
+	if err != nil || !bytes.Equal(received.GetBuffer(), frame) || int(received.GetLength()) != len(frame) {
+		t.Errorf("Unmarshal = %v, %v, want the frame back", received, err)
+	}
+
+	// A peer expecting IP packets must not take frames for packets
+	if err := proto.Unmarshal(message, &protobuf.PacketV4{}); err == nil {
+		t.Error("a frame parsed as a packet")
+	}
+}
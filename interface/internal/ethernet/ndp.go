@@ -0,0 +1,159 @@
+package ethernet
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+
+	"thinkpol-vpn/interface/internal/packet"
+)
+
+// Neighbor discovery (RFC 4861) messages, the ICMPv6 types that take the
+// place of ARP for IPv6
+const (
+	NeighborSolicitation  = 135
+	NeighborAdvertisement = 136
+)
+
+// Neighbor advertisement flags
+const (
+	FlagRouter    = 0x80
+	FlagSolicited = 0x40
+	FlagOverride  = 0x20
+)
+
+const (
+	// ipv6HeaderLength is the length of an IPv6 header without extensions
+	ipv6HeaderLength = 40
+	// ndpLength is the length of a solicitation or advertisement without
+	// options
+	ndpLength = 24
+
+	// Link-layer address options
+	optionSourceLinkAddr = 1
+	optionTargetLinkAddr = 2
+
+	// ndpHopLimit is the only hop limit neighbor discovery accepts, proof
+	// that the message did not cross a router
+	ndpHopLimit = 255
+)
+
+// ErrNotNDP is returned for IPv6 packets that are not a valid neighbor
+// solicitation or advertisement
+var ErrNotNDP = errors.New("not a neighbor discovery packet")
+
+// NDP is a parsed neighbor solicitation or advertisement
+type NDP struct {
+	Type uint8
+	// Flags are those of an advertisement
+	Flags uint8
+	// Source and Destination are the addresses of the IPv6 packet
+	Source      netip.Addr
+	Destination netip.Addr
+	// Target is the address resolved
+	Target netip.Addr
+	// LinkAddr is the source link-layer address of a solicitation or the
+	// target link-layer address of an advertisement, zero when absent
+	LinkAddr MAC
+}
+
+// ParseNDP parses the payload of an IPv6 frame carrying a neighbor
+// solicitation or advertisement. Packets with extension headers are not
+// neighbor discovery as far as TAP mode is concerned.
+func ParseNDP(payload []byte) (NDP, error) {
+	if len(payload) < ipv6HeaderLength+ndpLength {
+		return NDP{}, ErrNotNDP
+	}
+	if payload[0]>>4 != 6 || payload[6] != byte(packet.ICMPv6) || payload[7] != ndpHopLimit {
+		return NDP{}, ErrNotNDP
+	}
+	length := int(binary.BigEndian.Uint16(payload[4:6]))
+	if length < ndpLength || ipv6HeaderLength+length > len(payload) {
+		return NDP{}, ErrNotNDP
+	}
+
+	ndp := NDP{
+		Source:      netip.AddrFrom16([16]byte(payload[8:24])),
+		Destination: netip.AddrFrom16([16]byte(payload[24:40])),
+	}
+	message := payload[ipv6HeaderLength : ipv6HeaderLength+length]
+	ndp.Type = message[0]
+	if (ndp.Type != NeighborSolicitation && ndp.Type != NeighborAdvertisement) || message[1] != 0 {
+		return NDP{}, ErrNotNDP
+	}
+	sum := packet.PseudoHeaderSum(ndp.Source, ndp.Destination, packet.ICMPv6, len(message))
+	if packet.Checksum(packet.Sum(message, sum)) != 0 {
+		return NDP{}, ErrNotNDP
+	}
+	if ndp.Type == NeighborAdvertisement {
+		ndp.Flags = message[4]
+	}
+	ndp.Target = netip.AddrFrom16([16]byte(message[8:24]))
+	if ndp.Target.IsMulticast() {
+		return NDP{}, ErrNotNDP
+	}
+
+	option := optionSourceLinkAddr
+	if ndp.Type == NeighborAdvertisement {
+		option = optionTargetLinkAddr
+	}
+	for options := message[ndpLength:]; len(options) > 0; {
+		// Options are sized in units of 8 bytes, none is empty
+		if len(options) < 2 || options[1] == 0 || int(options[1])*8 > len(options) {
+			return NDP{}, ErrNotNDP
+		}
+		size := int(options[1]) * 8
+		if int(options[0]) == option && size == 8 {
+			ndp.LinkAddr = MAC(options[2:8])
+		}
+		options = options[size:]
+	}
+	return ndp, nil
+}
+
+// IsProbe reports whether the solicitation comes from a host checking that
+// nobody else uses an address before taking it (duplicate address
+// detection). Probes must not be answered on behalf of others.
+func (ndp NDP) IsProbe() bool {
+	return !ndp.Source.IsValid() || ndp.Source.IsUnspecified()
+}
+
+// Append appends the IPv6 packet carrying the message to b
+func (ndp NDP) Append(b []byte) []byte {
+	option := byte(optionSourceLinkAddr)
+	if ndp.Type == NeighborAdvertisement {
+		option = optionTargetLinkAddr
+	}
+	message := make([]byte, ndpLength, ndpLength+8)
+	message[0] = ndp.Type
+	if ndp.Type == NeighborAdvertisement {
+		message[4] = ndp.Flags
+	}
+	copy(message[8:24], ndp.Target.AsSlice())
+	if ndp.LinkAddr != (MAC{}) {
+		message = append(message, option, 1)
+		message = append(message, ndp.LinkAddr[:]...)
+	}
+	sum := packet.PseudoHeaderSum(ndp.Source, ndp.Destination, packet.ICMPv6, len(message))
+	binary.BigEndian.PutUint16(message[2:4], packet.Checksum(packet.Sum(message, sum)))
+
+	b = append(b, 0x60, 0, 0, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(message)))
+	b = append(b, byte(packet.ICMPv6), ndpHopLimit)
+	b = append(b, ndp.Source.AsSlice()...)
+	b = append(b, ndp.Destination.AsSlice()...)
+	return append(b, message...)
+}
+
+// Answer returns the advertisement telling the sender of the solicitation
+// that its target is at mac, from a router
+func (ndp NDP) Answer(mac MAC) NDP {
+	return NDP{
+		Type:        NeighborAdvertisement,
+		Flags:       FlagRouter | FlagSolicited | FlagOverride,
+		Source:      ndp.Target,
+		Destination: ndp.Source,
+		Target:      ndp.Target,
+		LinkAddr:    mac,
+	}
+}
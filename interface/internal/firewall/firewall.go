@@ -0,0 +1,386 @@
+package firewall
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Action is what happens to a packet matching a rule
+type Action int
+
+const (
+	// Allow lets the packet through
+	Allow Action = iota
+	// Block silently drops the packet
+	Block
+)
+
+// Rule matches outgoing packets. Zero fields match anything.
+// Rules of a rule set are evaluated in order and the first match wins.
+type Rule struct {
+	Action Action
+	// Interface is the outgoing interface
+	Interface string
+	// Protocols restricts the rule to these transport protocols, e.g. "tcp", "udp"
+	Protocols []string
+	// Destination restricts the rule to a destination prefix
+	Destination netip.Prefix
+	// Port restricts the rule to a destination port, requires Protocols
+	Port int
+	// SourcePort restricts the rule to a source port, requires Protocols
+	SourcePort int
+	// Established restricts the rule to connections peers opened to
+	// SourcePort, so only their replies leave from it
+	Established bool
+}
+
+// pfAnchorPrefix places our anchors under the one the stock macOS pf.conf
+// already evaluates, so no change to the main ruleset is needed
+const pfAnchorPrefix = "com.apple/thinkpol-vpn."
+
+// pfTokenPattern extracts the reference token printed by `pfctl -E`
+var pfTokenPattern = regexp.MustCompile(`Token : (\d+)`)
+
+// Firewall installs named rule sets of outgoing packet filter rules,
+// using nftables on Linux and pf anchors on macOS
+type Firewall struct {
+	mutex sync.Mutex
+	// installed maps rule set names to the pf enable token held for them
+	installed map[string]string
+}
+
+// NewFirewall creates a new firewall manager
+func NewFirewall() *Firewall {
+	return &Firewall{
+		installed: make(map[string]string),
+	}
+}
+
+// LoopbackInterface returns the name of the loopback interface
+func LoopbackInterface() string {
+	if runtime.GOOS == "darwin" {
+		return "lo0"
+	}
+	return "lo"
+}
+
+// Install atomically installs or replaces the named rule set
+func (firewall *Firewall) Install(name string, rules []Rule) error {
+	firewall.mutex.Lock()
+	defer firewall.mutex.Unlock()
+
+	switch runtime.GOOS {
+	case "linux":
+		if err := runWithInput(renderNftables(name, rules), "nft", "-f", "-"); err != nil {
+			return fmt.Errorf("failed to install nftables rule set %s: %w", name, err)
+		}
+		firewall.installed[name] = ""
+	case "darwin":
+		anchor := pfAnchorPrefix + name
+		if err := runWithInput(renderPf(rules), "pfctl", "-a", anchor, "-f", "-"); err != nil {
+			return fmt.Errorf("failed to load pf anchor %s: %w", anchor, err)
+		}
+
+		// Hold a reference on pf being enabled for as long as the rules are in place
+		if _, ok := firewall.installed[name]; !ok {
+			token, err := enablePf()
+			if err != nil {
+				runWithInput("", "pfctl", "-a", anchor, "-F", "all")
+				return err
+			}
+			firewall.installed[name] = token
+		}
+	default:
+		return fmt.Errorf("firewall is not supported on %s", runtime.GOOS)
+	}
+
+	log.Printf("    [FIREWALL] Installed rule set %s (%d rules)", name, len(rules))
+	return nil
+}
+
+// Remove removes the named rule set, doing nothing if it is not installed
+func (firewall *Firewall) Remove(name string) error {
+	firewall.mutex.Lock()
+	defer firewall.mutex.Unlock()
+
+	token, ok := firewall.installed[name]
+	if !ok {
+		return nil
+	}
+
+	switch runtime.GOOS {
+	case "linux":
+		if err := runWithInput("", "nft", "delete", "table", "inet", nftablesTable(name)); err != nil {
+			return fmt.Errorf("failed to remove nftables rule set %s: %w", name, err)
+		}
+	case "darwin":
+		anchor := pfAnchorPrefix + name
+		if err := runWithInput("", "pfctl", "-a", anchor, "-F", "all"); err != nil {
+			return fmt.Errorf("failed to flush pf anchor %s: %w", anchor, err)
+		}
+		if token != "" {
+			if err := runWithInput("", "pfctl", "-X", token); err != nil {
+				log.Printf("    [FIREWALL] Warning: could not release pf token %s: %v", token, err)
+			}
+		}
+	}
+
+	delete(firewall.installed, name)
+	log.Printf("    [FIREWALL] Removed rule set %s", name)
+	return nil
+}
+
+// RemoveLeftover removes a rule set another run installed and never removed.
+// The pf enable reference that run held cannot be released, pf stays on.
+func RemoveLeftover(name string) error {
+	switch runtime.GOOS {
+	case "linux":
+		// Deleting a table that does not exist fails, so it is created first
+		table := nftablesTable(name)
+		script := fmt.Sprintf("table inet %s\ndelete table inet %s\n", table, table)
+		if err := runWithInput(script, "nft", "-f", "-"); err != nil {
+			return fmt.Errorf("failed to remove nftables rule set %s: %w", name, err)
+		}
+	case "darwin":
+		anchor := pfAnchorPrefix + name
+		if err := runWithInput("", "pfctl", "-a", anchor, "-F", "all"); err != nil {
+			return fmt.Errorf("failed to flush pf anchor %s: %w", anchor, err)
+		}
+	default:
+		return nil
+	}
+
+	log.Printf("    [FIREWALL] Removed rule set %s left by a previous run", name)
+	return nil
+}
+
+// IsInstalled reports whether the named rule set is in place
+func (firewall *Firewall) IsInstalled(name string) bool {
+	firewall.mutex.Lock()
+	defer firewall.mutex.Unlock()
+
+	_, ok := firewall.installed[name]
+	return ok
+}
+
+// nftablesTable returns the table holding the named rule set
+func nftablesTable(name string) string {
+	return "thinkpol_" + strings.ReplaceAll(name, "-", "_")
+}
+
+// renderNftables renders a rule set as an nft script. The table is created,
+// deleted and recreated in one transaction so replacing it is atomic.
+func renderNftables(name string, rules []Rule) string {
+	table := nftablesTable(name)
+
+	var script strings.Builder
+	fmt.Fprintf(&script, "table inet %s\n", table)
+	fmt.Fprintf(&script, "delete table inet %s\n", table)
+	fmt.Fprintf(&script, "table inet %s {\n", table)
+	fmt.Fprintf(&script, "\tchain output {\n")
+	fmt.Fprintf(&script, "\t\ttype filter hook output priority 0; policy accept;\n")
+
+	for _, rule := range rules {
+		var match []string
+		if rule.Interface != "" {
+			match = append(match, fmt.Sprintf("oifname %q", rule.Interface))
+		}
+		if rule.Destination.IsValid() {
+			family := "ip"
+			if rule.Destination.Addr().Is6() {
+				family = "ip6"
+			}
+			match = append(match, fmt.Sprintf("%s daddr %s", family, rule.Destination))
+		}
+		if len(rule.Protocols) > 0 {
+			match = append(match, fmt.Sprintf("meta l4proto { %s }", strings.Join(rule.Protocols, ", ")))
+			if rule.SourcePort != 0 {
+				match = append(match, fmt.Sprintf("th sport %d", rule.SourcePort))
+			}
+			if rule.Port != 0 {
+				match = append(match, fmt.Sprintf("th dport %d", rule.Port))
+			}
+		}
+		if rule.Established {
+			match = append(match, "ct state established,related")
+		}
+
+		verdict := "accept"
+		if rule.Action == Block {
+			verdict = "drop"
+		}
+		match = append(match, verdict)
+
+		fmt.Fprintf(&script, "\t\t%s\n", strings.Join(match, " "))
+	}
+
+	fmt.Fprintf(&script, "\t}\n}\n")
+	return script.String()
+}
+
+// renderPf renders a rule set as pf rules. Every rule is quick so the first
+// match wins, like it does with nftables.
+func renderPf(rules []Rule) string {
+	var script strings.Builder
+
+	for _, rule := range rules {
+		if rule.Established {
+			script.WriteString(renderPfEstablished(rule))
+			continue
+		}
+
+		verdict := "pass"
+		if rule.Action == Block {
+			verdict = "block drop"
+		}
+
+		line := []string{verdict, "out", "quick"}
+		if rule.Interface != "" {
+			line = append(line, "on", rule.Interface)
+		}
+		if len(rule.Protocols) > 0 {
+			line = append(line, "proto", "{", strings.Join(rule.Protocols, " "), "}")
+		}
+
+		destination := "any"
+		if rule.Destination.IsValid() {
+			destination = rule.Destination.String()
+		}
+		line = append(line, "from", "any")
+		if len(rule.Protocols) > 0 && rule.SourcePort != 0 {
+			line = append(line, "port", fmt.Sprintf("%d", rule.SourcePort))
+		}
+		line = append(line, "to", destination)
+		if len(rule.Protocols) > 0 && rule.Port != 0 {
+			line = append(line, "port", fmt.Sprintf("%d", rule.Port))
+		}
+
+		fmt.Fprintf(&script, "%s\n", strings.Join(line, " "))
+	}
+
+	return script.String()
+}
+
+// renderPfEstablished renders a rule limited to connections opened by peers.
+// Replies match the state the incoming connection creates and skip the
+// rules, so it is the incoming side that is passed with state.
+func renderPfEstablished(rule Rule) string {
+	line := []string{"pass", "in", "quick"}
+	if rule.Interface != "" {
+		line = append(line, "on", rule.Interface)
+	}
+	if len(rule.Protocols) > 0 {
+		line = append(line, "proto", "{", strings.Join(rule.Protocols, " "), "}")
+	}
+	line = append(line, "from", "any", "to", "any")
+	if len(rule.Protocols) > 0 && rule.SourcePort != 0 {
+		line = append(line, "port", fmt.Sprintf("%d", rule.SourcePort))
+	}
+	line = append(line, "keep", "state")
+
+	return strings.Join(line, " ") + "\n"
+}
+
+// enablePf enables pf and returns the reference token to release later
+func enablePf() (string, error) {
+	cmd := exec.Command("pfctl", "-E")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to enable pf: %s, %w", string(output), err)
+	}
+
+	match := pfTokenPattern.FindSubmatch(output)
+	if match == nil {
+		return "", nil
+	}
+	return string(match[1]), nil
+}
+
+// runWithInput runs a command with the given standard input
+func runWithInput(input string, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(input)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %s, %w", name, string(output), err)
+	}
+	return nil
+}
+
+// DNSLeakRules blocks DNS queries that would leave outside the tunnel.
+// Loopback stays open for local stub resolvers such as systemd-resolved,
+// and so do the resolvers in allowed, which a local forwarder relays to.
+func DNSLeakRules(tunnelInterface string, allowed []netip.AddrPort) []Rule {
+	dnsProtocols := []string{"tcp", "udp"}
+
+	rules := []Rule{
+		{Action: Allow, Interface: LoopbackInterface()},
+		{Action: Allow, Interface: tunnelInterface, Protocols: dnsProtocols, Port: 53},
+	}
+
+	for _, resolver := range allowed {
+		rules = append(rules, Rule{
+			Action:      Allow,
+			Protocols:   dnsProtocols,
+			Destination: netip.PrefixFrom(resolver.Addr(), resolver.Addr().BitLen()),
+			Port:        int(resolver.Port()),
+		})
+	}
+
+	return append(rules, Rule{Action: Block, Protocols: dnsProtocols, Port: 53})
+}
+
+// lanPrefixes are the private ranges that stay reachable when the kill switch allows the LAN
+var lanPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("fc00::/7"),
+}
+
+// KillSwitchRules block all outgoing traffic except through the tunnel, to
+// the gateway endpoints that carry it, replies from the listenPorts peers
+// connect to and, with allowLAN, to the local network. A transport that
+// accepts its peer answers from its listen port, nothing else may use it.
+func KillSwitchRules(tunnelInterface string, gateways []netip.AddrPort, listenPorts []int, allowLAN bool) []Rule {
+	rules := []Rule{
+		{Action: Allow, Interface: LoopbackInterface()},
+		{Action: Allow, Interface: tunnelInterface},
+	}
+
+	for _, gateway := range gateways {
+		rules = append(rules, Rule{
+			Action:      Allow,
+			Protocols:   []string{"tcp", "udp"},
+			Destination: netip.PrefixFrom(gateway.Addr(), gateway.Addr().BitLen()),
+			Port:        int(gateway.Port()),
+		})
+	}
+
+	for _, port := range listenPorts {
+		rules = append(rules, Rule{
+			Action:      Allow,
+			Protocols:   []string{"tcp", "udp"},
+			SourcePort:  port,
+			Established: true,
+		})
+	}
+
+	if allowLAN {
+		for _, prefix := range lanPrefixes {
+			rules = append(rules, Rule{Action: Allow, Destination: prefix})
+		}
+		// DHCP renewals are broadcast, so no LAN prefix covers them
+		rules = append(rules, Rule{Action: Allow, Protocols: []string{"udp"}, Port: 67})
+	}
+
+	return append(rules, Rule{Action: Block})
+}
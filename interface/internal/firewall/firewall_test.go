@@ -0,0 +1,100 @@
+package firewall
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestKillSwitchRules(t *testing.T) {
+	gateways := []netip.AddrPort{netip.MustParseAddrPort("203.0.113.7:443")}
+	rules := KillSwitchRules("utun9", gateways, []int{8888}, false)
+
+	nftables := renderNftables("killswitch", rules)
+	for _, want := range []string{
+		`oifname "utun9" accept`,
+		"ip daddr 203.0.113.7/32 meta l4proto { tcp, udp } th dport 443 accept",
+		// Replies of the serving transport leave from its listen port
+		"meta l4proto { tcp, udp } th sport 8888 ct state established,related accept",
+	} {
+		if !strings.Contains(nftables, want) {
+			t.Errorf("nftables rule set is missing %q:\n%s", want, nftables)
+		}
+	}
+	if !strings.HasSuffix(nftables, "\t\tdrop\n\t}\n}\n") {
+		t.Errorf("nftables rule set does not end in a drop:\n%s", nftables)
+	}
+
+	pf := renderPf(rules)
+	for _, want := range []string{
+		"pass out quick on utun9 from any to any\n",
+		"pass out quick proto { tcp udp } from any to 203.0.113.7/32 port 443\n",
+		// Replies match the state of the incoming connection
+		"pass in quick proto { tcp udp } from any to any port 8888 keep state\n",
+	} {
+		if !strings.Contains(pf, want) {
+			t.Errorf("pf rule set is missing %q:\n%s", want, pf)
+		}
+	}
+	if !strings.HasSuffix(pf, "block drop out quick from any to any\n") {
+		t.Errorf("pf rule set does not end in a block:\n%s", pf)
+	}
+
+	// New connections from the listen port stay blocked
+	if strings.Contains(nftables, "th sport 8888 accept") {
+		t.Errorf("nftables rule set lets new connections leave from the listen port:\n%s", nftables)
+	}
+	if strings.Contains(pf, "pass out quick proto { tcp udp } from any port 8888") {
+		t.Errorf("pf rule set lets new connections leave from the listen port:\n%s", pf)
+	}
+}
+
+func TestKillSwitchRulesAllowLAN(t *testing.T) {
+	rules := KillSwitchRules("utun9", nil, nil, true)
+
+	nftables := renderNftables("killswitch", rules)
+	for _, want := range []string{
+		"ip daddr 192.168.0.0/16 accept",
+		"ip6 daddr fe80::/10 accept",
+		"meta l4proto { udp } th dport 67 accept",
+	} {
+		if !strings.Contains(nftables, want) {
+			t.Errorf("nftables rule set is missing %q:\n%s", want, nftables)
+		}
+	}
+}
+
+func TestDNSLeakRulesAllowForwarderUpstream(t *testing.T) {
+	upstreams := []netip.AddrPort{netip.MustParseAddrPort("1.1.1.1:53"), netip.MustParseAddrPort("[2606:4700::1111]:53")}
+	rules := DNSLeakRules("utun9", upstreams)
+
+	// The upstream queries of the forwarder have to match before the block
+	nftables := renderNftables("dns", rules)
+	block := strings.Index(nftables, "meta l4proto { tcp, udp } th dport 53 drop")
+	if block < 0 {
+		t.Fatalf("nftables rule set does not block DNS:\n%s", nftables)
+	}
+	for _, want := range []string{
+		`oifname "utun9" meta l4proto { tcp, udp } th dport 53 accept`,
+		"ip daddr 1.1.1.1/32 meta l4proto { tcp, udp } th dport 53 accept",
+		"ip6 daddr 2606:4700::1111/128 meta l4proto { tcp, udp } th dport 53 accept",
+	} {
+		if index := strings.Index(nftables, want); index < 0 || index > block {
+			t.Errorf("nftables rule set does not have %q before the block:\n%s", want, nftables)
+		}
+	}
+
+	pf := renderPf(rules)
+	block = strings.Index(pf, "block drop out quick proto { tcp udp } from any to any port 53\n")
+	if block < 0 {
+		t.Fatalf("pf rule set does not block DNS:\n%s", pf)
+	}
+	for _, want := range []string{
+		"pass out quick proto { tcp udp } from any to 1.1.1.1/32 port 53\n",
+		"pass out quick proto { tcp udp } from any to 2606:4700::1111/128 port 53\n",
+	} {
+		if index := strings.Index(pf, want); index < 0 || index > block {
+			t.Errorf("pf rule set does not have %q before the block:\n%s", want, pf)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+
+	"thinkpol-vpn/interface/internal/acl"
+	"thinkpol-vpn/interface/internal/config"
+	"thinkpol-vpn/interface/internal/packet"
+	"thinkpol-vpn/interface/internal/ratelimit"
+)
+
+// client is a configured identity and the policy its sessions are held to
+type client struct {
+	name string
+	// tokenHash is compared instead of the token so the comparison takes the
+	// same time whatever the token length
+	tokenHash [sha256.Size]byte
+	// address is the static tunnel address, invalid when leased from the pool
+	address    netip.Addr
+	allowedIPs []netip.Prefix
+	aclEngine  *acl.Engine
+	shaper     *ratelimit.Shaper
+	stats      clientStats
+}
+
+// clientStats are the counters of a client, kept across its sessions
+type clientStats struct {
+	packetsReceived atomic.Uint64
+	packetsSent     atomic.Uint64
+	bytesReceived   atomic.Uint64
+	bytesSent       atomic.Uint64
+	// spoofed counts packets from the client with a source other than its address
+	spoofed atomic.Uint64
+	// deniedInbound counts packets from the client outside its allowed IPs or ACL
+	deniedInbound atomic.Uint64
+	// deniedOutbound counts packets to the client its ACL denied
+	deniedOutbound atomic.Uint64
+	// dropped counts packets to the client that did not fit its send queue
+	dropped   atomic.Uint64
+	malformed atomic.Uint64
+	sessions  atomic.Uint64
+	// deadPeers counts sessions closed because the client stopped answering
+	deadPeers atomic.Uint64
+}
+
+// ClientStats is a snapshot of the counters of a client
+type ClientStats struct {
+	PacketsReceived uint64 `json:"packets_received"`
+	PacketsSent     uint64 `json:"packets_sent"`
+	BytesReceived   uint64 `json:"bytes_received"`
+	BytesSent       uint64 `json:"bytes_sent"`
+	Spoofed         uint64 `json:"spoofed"`
+	DeniedInbound   uint64 `json:"denied_inbound"`
+	DeniedOutbound  uint64 `json:"denied_outbound"`
+	Dropped         uint64 `json:"dropped"`
+	Malformed       uint64 `json:"malformed"`
+	Sessions        uint64 `json:"sessions"`
+	DeadPeers       uint64 `json:"dead_peers"`
+}
+
+func (stats *clientStats) snapshot() ClientStats {
+	return ClientStats{
+		PacketsReceived: stats.packetsReceived.Load(),
+		PacketsSent:     stats.packetsSent.Load(),
+		BytesReceived:   stats.bytesReceived.Load(),
+		BytesSent:       stats.bytesSent.Load(),
+		Spoofed:         stats.spoofed.Load(),
+		DeniedInbound:   stats.deniedInbound.Load(),
+		DeniedOutbound:  stats.deniedOutbound.Load(),
+		Dropped:         stats.dropped.Load(),
+		Malformed:       stats.malformed.Load(),
+		Sessions:        stats.sessions.Load(),
+		DeadPeers:       stats.deadPeers.Load(),
+	}
+}
+
+// newClient converts a client from the configuration, rateLimit applies
+// unless the client has its own limits
+func newClient(clientConfig config.GatewayClientConfig, rateLimit config.RateLimitConfig) (*client, error) {
+	if clientConfig.Name == "" {
+		return nil, fmt.Errorf("client without a name")
+	}
+	if clientConfig.Token == "" {
+		return nil, fmt.Errorf("client %s has no token", clientConfig.Name)
+	}
+
+	c := &client{
+		name:      clientConfig.Name,
+		tokenHash: sha256.Sum256([]byte(clientConfig.Token)),
+		aclEngine: acl.NewEngine(),
+	}
+
+	if clientConfig.Address != "" {
+		address, err := netip.ParseAddr(clientConfig.Address)
+		if err != nil {
+			return nil, fmt.Errorf("client %s: invalid address: %w", c.name, err)
+		}
+		c.address = address.Unmap()
+	}
+
+	for _, value := range clientConfig.AllowedIPs {
+		prefix, err := packet.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("client %s: invalid allowed IP: %w", c.name, err)
+		}
+		c.allowedIPs = append(c.allowedIPs, prefix)
+	}
+
+	ruleSet, err := acl.FromConfig(clientConfig.ACL)
+	if err != nil {
+		return nil, fmt.Errorf("client %s: %w", c.name, err)
+	}
+	c.aclEngine.Load(ruleSet)
+
+	if clientConfig.RateLimit != nil {
+		rateLimit = *clientConfig.RateLimit
+	}
+	if c.shaper, err = ratelimit.NewShaper(rateLimit); err != nil {
+		return nil, fmt.Errorf("client %s: invalid rate limit: %w", c.name, err)
+	}
+
+	return c, nil
+}
+
+// allowedDestination reports whether the client may send to addr
+func (client *client) allowedDestination(addr netip.Addr) bool {
+	if len(client.allowedIPs) == 0 {
+		return true
+	}
+	for _, prefix := range client.allowedIPs {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowFrom checks a packet a session of the client forwards into the gateway
+func (client *client) allowFrom(address netip.Addr, parsed *packet.Packet) bool {
+	if parsed.Src != address {
+		client.stats.spoofed.Add(1)
+		return false
+	}
+	if !client.allowedDestination(parsed.Dst) || !client.aclEngine.Allow(acl.Inbound, parsed) {
+		client.stats.deniedInbound.Add(1)
+		return false
+	}
+	return true
+}
+
+// allowTo checks a packet the gateway routes to a session of the client.
+// Only replies from allowed destinations get back to the client.
+func (client *client) allowTo(parsed *packet.Packet) bool {
+	if !client.allowedDestination(parsed.Src) || !client.aclEngine.Allow(acl.Outbound, parsed) {
+		client.stats.deniedOutbound.Add(1)
+		return false
+	}
+	return true
+}
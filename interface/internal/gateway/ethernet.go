@@ -0,0 +1,216 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+
+	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/ethernet"
+)
+
+// gatewayMAC is the Ethernet address the gateway answers ARP and neighbor
+// solicitations with, so TAP clients send it every IP packet. It is locally
+// administered and the same on every run, so clients keep their neighbor
+// entries across restarts.
+var gatewayMAC = ethernet.MAC{0x02, 0x74, 0x70, 0x00, 0x00, 0x01}
+
+const (
+	// macAge is how long an Ethernet address stays with the session it was
+	// last seen on
+	macAge = 5 * time.Minute
+
+	// maxMACsPerSession bounds the addresses learned on a session, so a
+	// client making up addresses cannot grow the table without end
+	maxMACsPerSession = 64
+)
+
+// macTable remembers which session every Ethernet address was seen on
+type macTable struct {
+	mutex   sync.Mutex
+	entries map[ethernet.MAC]macEntry
+	counts  map[*session]int
+}
+
+// macEntry is where an Ethernet address was last seen, and when
+type macEntry struct {
+	session *session
+	seen    time.Time
+}
+
+func newMACTable() *macTable {
+	return &macTable{
+		entries: make(map[ethernet.MAC]macEntry),
+		counts:  make(map[*session]int),
+	}
+}
+
+// learn records that session sent from mac. It reports false when mac is
+// taken by another live session or session learned too many addresses, the
+// frame is then dropped so no client takes over the address of another.
+func (table *macTable) learn(mac ethernet.MAC, session *session) bool {
+	now := time.Now()
+
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	entry, found := table.entries[mac]
+	if found && entry.session == session {
+		table.entries[mac] = macEntry{session: session, seen: now}
+		return true
+	}
+	if found && entry.session.ctx.Err() == nil && now.Sub(entry.seen) < macAge {
+		return false
+	}
+	if table.counts[session] >= maxMACsPerSession {
+		return false
+	}
+
+	if found {
+		table.counts[entry.session]--
+	}
+	table.entries[mac] = macEntry{session: session, seen: now}
+	table.counts[session]++
+	return true
+}
+
+// forget drops the addresses learned on a session once it ended
+func (table *macTable) forget(session *session) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	for mac, entry := range table.entries {
+		if entry.session == session {
+			delete(table.entries, mac)
+		}
+	}
+	delete(table.counts, session)
+}
+
+// addresses returns the Ethernet addresses learned on a session
+func (table *macTable) addresses(session *session) []string {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	var addresses []string
+	for mac, entry := range table.entries {
+		if entry.session == session {
+			addresses = append(addresses, mac.String())
+		}
+	}
+	return addresses
+}
+
+// receiveFrame handles a frame from a TAP client. It learns the address the
+// frame came from, answers ARP and neighbor discovery and returns the IP packet the frame carries
+// to the gateway with the address of its sender, nil when there is nothing
+// to forward.
+func (session *session) receiveFrame(message []byte) (*protobuf.PacketV4, ethernet.MAC) {
+	client := session.client
+
+	wrapped, err := ethernet.Unmarshal(message)
+	if err != nil {
+		client.stats.malformed.Add(1)
+		return nil, ethernet.MAC{}
+	}
+	frame, err := ethernet.Parse(wrapped.GetBuffer())
+	if err != nil || frame.Source.IsMulticast() {
+		client.stats.malformed.Add(1)
+		return nil, ethernet.MAC{}
+	}
+
+	if !session.gateway.macs.learn(frame.Source, session) {
+		client.stats.spoofed.Add(1)
+		return nil, ethernet.MAC{}
+	}
+
+	switch {
+	case frame.Type == ethernet.TypeARP:
+		session.answerARP(frame)
+		return nil, ethernet.MAC{}
+	case frame.Type == ethernet.TypeIPv6 && session.answerNDP(frame):
+		return nil, ethernet.MAC{}
+	case frame.IsIP() && (frame.Destination == gatewayMAC || frame.Destination.IsMulticast()):
+		length := int32(len(frame.Payload))
+		return &protobuf.PacketV4{Length: &length, Buffer: frame.Payload}, frame.Source
+	default:
+		// Frames for other stations or of other protocols have nowhere to go
+		return nil, ethernet.MAC{}
+	}
+}
+
+// answerARP answers the requests of the client for every address but its
+// own with the gateway's address, so all its IP traffic goes through the
+// gateway and is held to its policy. Requests from other addresses, such as
+// hosts bridged behind the client, are left alone.
+func (session *session) answerARP(frame ethernet.Frame) {
+	request, err := ethernet.ParseARP(frame.Payload)
+	if err != nil {
+		session.client.stats.malformed.Add(1)
+		return
+	}
+	if request.SenderIP != session.address {
+		return
+	}
+	session.hardwareAddr.Store(&request.SenderMAC)
+
+	if request.Operation != ethernet.ARPRequest || request.IsProbe() || request.TargetIP == session.address {
+		return
+	}
+
+	reply := ethernet.Frame{
+		Destination: request.SenderMAC,
+		Source:      gatewayMAC,
+		Type:        ethernet.TypeARP,
+		Payload:     request.Answer(gatewayMAC).Append(nil),
+	}.Append(nil)
+	length := int32(len(reply))
+	session.send(&protobuf.PacketV4{Length: &length, Buffer: reply})
+}
+
+// answerNDP is answerARP for IPv6: it answers the neighbor solicitations of
+// the client for every address but its own with the gateway's address. It
+// reports whether the frame was neighbor discovery, which goes no further.
+func (session *session) answerNDP(frame ethernet.Frame) bool {
+	request, err := ethernet.ParseNDP(frame.Payload)
+	if err != nil {
+		return false
+	}
+	if request.Source != session.address {
+		return true
+	}
+	hardwareAddr := frame.Source
+	if request.LinkAddr != (ethernet.MAC{}) {
+		hardwareAddr = request.LinkAddr
+	}
+	session.hardwareAddr.Store(&hardwareAddr)
+
+	if request.Type != ethernet.NeighborSolicitation || request.IsProbe() || request.Target == session.address {
+		return true
+	}
+
+	reply := ethernet.Frame{
+		Destination: hardwareAddr,
+		Source:      gatewayMAC,
+		Type:        ethernet.TypeIPv6,
+		Payload:     request.Answer(gatewayMAC).Append(nil),
+	}.Append(nil)
+	length := int32(len(reply))
+	session.send(&protobuf.PacketV4{Length: &length, Buffer: reply})
+	return true
+}
+
+// frame wraps a packet routed to a TAP client in a frame from the gateway,
+// broadcast until the address of the client was learned
+func (session *session) frame(packet []byte) []byte {
+	destination := ethernet.Broadcast
+	if mac := session.hardwareAddr.Load(); mac != nil {
+		destination = *mac
+	}
+
+	return ethernet.Frame{
+		Destination: destination,
+		Source:      gatewayMAC,
+		Type:        ethernet.TypeOf(packet),
+		Payload:     packet,
+	}.Append(make([]byte, 0, ethernet.HeaderLength+len(packet)))
+}
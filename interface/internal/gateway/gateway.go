@@ -0,0 +1,484 @@
+// Package gateway serves many tunnel clients at once and holds each of them to
+// the policy attached to its identity
+package gateway
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/acl"
+	"thinkpol-vpn/interface/internal/capture"
+	"thinkpol-vpn/interface/internal/config"
+	"thinkpol-vpn/interface/internal/ethernet"
+	"thinkpol-vpn/interface/internal/keepalive"
+	"thinkpol-vpn/interface/internal/obfuscate"
+	"thinkpol-vpn/interface/internal/packet"
+	"thinkpol-vpn/interface/internal/ratelimit"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// AddressHeader carries the tunnel address leased to the client in the
+	// handshake response
+	AddressHeader = "X-Tunnel-Address"
+
+	// sendQueueSize is the number of packets queued for each session before
+	// packets to it are dropped
+	sendQueueSize = 64
+
+	// receiveQueueSize is the number of packets from all sessions queued for
+	// the stack behind the gateway
+	receiveQueueSize = 64
+)
+
+// Gateway accepts authenticated websocket sessions, merges the packets they
+// forward into one stream and routes packets back by destination address
+type Gateway struct {
+	upgrader websocket.Upgrader
+	clients  []*client
+	// pool is invalid when every client has a static address
+	pool netip.Prefix
+
+	receiveChan chan *protobuf.PacketV4
+	capturer    *capture.Capturer
+	keepalive   keepalive.Settings
+	obfuscation obfuscate.Settings
+
+	mutex sync.RWMutex
+	// sessions are keyed by client name, routes by leased address
+	sessions map[string]*session
+	routes   map[netip.Addr]*session
+	// macs are the Ethernet addresses TAP clients send from
+	macs *macTable
+
+	handshakesAccepted     atomic.Uint64
+	handshakesUnauthorized atomic.Uint64
+	handshakesFailed       atomic.Uint64
+	unrouted               atomic.Uint64
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	isRunning bool
+}
+
+// NewGateway creates a gateway for the clients in the configuration. Clients
+// without their own rate limits get rateLimit.
+func NewGateway(gatewayConfig config.GatewayConfig, rateLimit config.RateLimitConfig) (*Gateway, error) {
+	keepaliveSettings, _ := keepalive.New(config.Default().Keepalive)
+
+	gateway := &Gateway{
+		receiveChan: make(chan *protobuf.PacketV4, receiveQueueSize),
+		keepalive:   keepaliveSettings,
+		sessions:    make(map[string]*session),
+		routes:      make(map[netip.Addr]*session),
+		macs:        newMACTable(),
+	}
+
+	if gatewayConfig.AddressPool != "" {
+		pool, err := netip.ParsePrefix(gatewayConfig.AddressPool)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address pool: %w", err)
+		}
+		gateway.pool = pool.Masked()
+	}
+
+	names := make(map[string]bool)
+	tokens := make(map[[sha256.Size]byte]bool)
+	addresses := make(map[netip.Addr]bool)
+	for _, clientConfig := range gatewayConfig.Clients {
+		client, err := newClient(clientConfig, rateLimit)
+		if err != nil {
+			return nil, err
+		}
+
+		if names[client.name] {
+			return nil, fmt.Errorf("duplicate client name %q", client.name)
+		}
+		if tokens[client.tokenHash] {
+			return nil, fmt.Errorf("client %s reuses the token of another client", client.name)
+		}
+		if client.address.IsValid() && addresses[client.address] {
+			return nil, fmt.Errorf("client %s reuses address %s", client.name, client.address)
+		}
+		if !client.address.IsValid() && !gateway.pool.IsValid() {
+			return nil, fmt.Errorf("client %s has no address and there is no address pool", client.name)
+		}
+
+		names[client.name] = true
+		tokens[client.tokenHash] = true
+		addresses[client.address] = true
+		gateway.clients = append(gateway.clients, client)
+	}
+
+	return gateway, nil
+}
+
+// SetCapturer makes the gateway record the packets its sessions carry. It
+// must be called before Start.
+func (gateway *Gateway) SetCapturer(capturer *capture.Capturer) {
+	gateway.capturer = capturer
+}
+
+// SetKeepalive changes how clients are checked for liveness. It must be
+// called before Start.
+func (gateway *Gateway) SetKeepalive(settings keepalive.Settings) {
+	gateway.keepalive = settings
+}
+
+// SetObfuscation sets how sessions disguise their traffic. It must be called
+// before Start.
+func (gateway *Gateway) SetObfuscation(settings obfuscate.Settings) {
+	gateway.obfuscation = settings
+}
+
+// Start begins accepting sessions
+func (gateway *Gateway) Start() error {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+
+	if gateway.isRunning {
+		return fmt.Errorf("gateway is already running")
+	}
+
+	gateway.ctx, gateway.cancel = context.WithCancel(context.Background())
+	gateway.isRunning = true
+
+	log.Printf("    [GATEWAY] Serving %d clients", len(gateway.clients))
+	return nil
+}
+
+// Stop closes every session and stops accepting new ones
+func (gateway *Gateway) Stop() error {
+	gateway.mutex.Lock()
+	if !gateway.isRunning {
+		gateway.mutex.Unlock()
+		return fmt.Errorf("gateway is not running")
+	}
+	gateway.isRunning = false
+	gateway.cancel()
+
+	sessions := make([]*session, 0, len(gateway.sessions))
+	for _, session := range gateway.sessions {
+		sessions = append(sessions, session)
+	}
+	gateway.mutex.Unlock()
+
+	for _, session := range sessions {
+		session.close()
+	}
+
+	log.Printf("    [GATEWAY] Stopped, closed %d sessions", len(sessions))
+	return nil
+}
+
+// UpgradeConnection authenticates a client and turns the request into a session
+func (gateway *Gateway) UpgradeConnection(w http.ResponseWriter, r *http.Request) {
+	client := gateway.authenticate(r)
+	if client == nil {
+		gateway.handshakesUnauthorized.Add(1)
+		log.Printf("    [GATEWAY] Rejected unauthenticated handshake from %s", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	gateway.mutex.Lock()
+	if !gateway.isRunning {
+		gateway.mutex.Unlock()
+		http.Error(w, "gateway is not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	// A client that reconnects replaces its old session and keeps its address
+	var address netip.Addr
+	previous := gateway.sessions[client.name]
+	if previous != nil {
+		address = previous.address
+		gateway.removeLocked(previous)
+	} else {
+		address = gateway.leaseLocked(client)
+	}
+	if !address.IsValid() {
+		gateway.mutex.Unlock()
+		gateway.handshakesFailed.Add(1)
+		log.Printf("    [GATEWAY] No free address for client %s", client.name)
+		http.Error(w, "no free tunnel address", http.StatusServiceUnavailable)
+		return
+	}
+
+	// The session holds the address from here on so no other client gets it
+	ctx, cancel := context.WithCancel(gateway.ctx)
+	session := &session{
+		gateway:     gateway,
+		client:      client,
+		address:     address,
+		remote:      r.RemoteAddr,
+		connectedAt: time.Now(),
+		sendChan:    make(chan *protobuf.PacketV4, sendQueueSize),
+		monitor:     gateway.keepalive.NewMonitor(),
+		ethernet:    r.Header.Get(ethernet.LayerHeader) == ethernet.LayerEthernet,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	gateway.sessions[client.name] = session
+	gateway.routes[address] = session
+	gateway.mutex.Unlock()
+
+	if previous != nil {
+		log.Printf("    [GATEWAY] Client %s reconnected, replacing its session from %s", client.name, previous.remote)
+		previous.close()
+	}
+
+	responseHeader := gateway.obfuscation.Header()
+	responseHeader.Set(AddressHeader, address.String())
+	if session.ethernet {
+		responseHeader.Set(ethernet.LayerHeader, ethernet.LayerEthernet)
+	}
+	conn, err := gateway.upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		log.Printf("    [GATEWAY] Upgrade for client %s failed: %v", client.name, err)
+		gateway.handshakesFailed.Add(1)
+		session.close()
+		return
+	}
+
+	gateway.handshakesAccepted.Add(1)
+	client.stats.sessions.Add(1)
+	if session.ethernet {
+		log.Printf("    [GATEWAY] Client %s connected from %s with address %s, carrying Ethernet frames", client.name, r.RemoteAddr, address)
+	} else {
+		log.Printf("    [GATEWAY] Client %s connected from %s with address %s", client.name, r.RemoteAddr, address)
+	}
+
+	session.run(conn)
+}
+
+// authenticate returns the client whose token the request carries, or nil
+func (gateway *Gateway) authenticate(r *http.Request) *client {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(token))
+
+	// Every client is compared so the time taken does not tell which matched
+	var match *client
+	for _, client := range gateway.clients {
+		if subtle.ConstantTimeCompare(hash[:], client.tokenHash[:]) == 1 {
+			match = client
+		}
+	}
+	return match
+}
+
+// leaseLocked picks the client's tunnel address. The caller holds the mutex.
+func (gateway *Gateway) leaseLocked(client *client) netip.Addr {
+	if client.address.IsValid() {
+		return client.address
+	}
+
+	// Skip the network address and the gateway's own address
+	candidate := gateway.pool.Addr().Next().Next()
+	for ; candidate.IsValid() && gateway.pool.Contains(candidate); candidate = candidate.Next() {
+		// The last IPv4 address is the broadcast address
+		if candidate.Is4() && !gateway.pool.Contains(candidate.Next()) {
+			break
+		}
+		if _, taken := gateway.routes[candidate]; taken || gateway.isStatic(candidate) {
+			continue
+		}
+		return candidate
+	}
+	return netip.Addr{}
+}
+
+// isStatic reports whether a client has addr as its static address
+func (gateway *Gateway) isStatic(addr netip.Addr) bool {
+	for _, client := range gateway.clients {
+		if client.address == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// remove forgets a session, which releases its address
+func (gateway *Gateway) remove(session *session) {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	gateway.removeLocked(session)
+}
+
+// removeLocked forgets a session unless it was already replaced. The caller
+// holds the mutex.
+func (gateway *Gateway) removeLocked(session *session) {
+	if gateway.sessions[session.client.name] == session {
+		delete(gateway.sessions, session.client.name)
+	}
+	if gateway.routes[session.address] == session {
+		delete(gateway.routes, session.address)
+	}
+	gateway.macs.forget(session)
+}
+
+// SendToTransport routes a packet to the session its destination is leased to
+func (gateway *Gateway) SendToTransport(len int, buf []byte) {
+	parsed, err := packet.Parse(buf[:len])
+	if err != nil {
+		gateway.unrouted.Add(1)
+		return
+	}
+
+	gateway.mutex.RLock()
+	session := gateway.routes[parsed.Dst]
+	gateway.mutex.RUnlock()
+
+	if session == nil {
+		gateway.unrouted.Add(1)
+		return
+	}
+	if !session.client.allowTo(parsed) {
+		return
+	}
+
+	var length int32 = int32(len)
+	buffer := buf[:len]
+	if session.ethernet {
+		buffer = session.frame(buffer)
+		length += ethernet.HeaderLength
+	}
+	session.send(&protobuf.PacketV4{
+		Length: &length,
+		Buffer: buffer,
+	})
+}
+
+// ReceiveFromTransport returns the packets every session forwarded
+func (gateway *Gateway) ReceiveFromTransport() <-chan *protobuf.PacketV4 {
+	return gateway.receiveChan
+}
+
+// LoadACLs replaces the ACL rules of the configured clients. Nothing is loaded
+// when the rules of any client are invalid. Clients and their tokens,
+// addresses and allowed IPs only change on restart.
+func (gateway *Gateway) LoadACLs(gatewayConfig config.GatewayConfig) error {
+	ruleSets := make(map[*client]*acl.RuleSet)
+	for _, clientConfig := range gatewayConfig.Clients {
+		var match *client
+		for _, client := range gateway.clients {
+			if client.name == clientConfig.Name {
+				match = client
+			}
+		}
+		if match == nil {
+			log.Printf("    [GATEWAY] Client %s is new, restart the gateway to add it", clientConfig.Name)
+			continue
+		}
+
+		ruleSet, err := acl.FromConfig(clientConfig.ACL)
+		if err != nil {
+			return fmt.Errorf("client %s: %w", match.name, err)
+		}
+		ruleSets[match] = ruleSet
+	}
+
+	for client, ruleSet := range ruleSets {
+		client.aclEngine.Load(ruleSet)
+	}
+	return nil
+}
+
+// RateLimit returns the shaper of a client, nil when there is no such client
+func (gateway *Gateway) RateLimit(name string) *ratelimit.Shaper {
+	for _, client := range gateway.clients {
+		if client.name == name {
+			return client.shaper
+		}
+	}
+	return nil
+}
+
+// ClientStatus is the state of a client for the control API
+type ClientStatus struct {
+	Name string `json:"name"`
+	// Address is the static or currently leased tunnel address
+	Address     string            `json:"address,omitempty"`
+	AllowedIPs  []string          `json:"allowed_ips,omitempty"`
+	Connected   bool              `json:"connected"`
+	Remote      string            `json:"remote,omitempty"`
+	ConnectedAt *time.Time        `json:"connected_at,omitempty"`
+	Keepalive   *keepalive.Status `json:"keepalive,omitempty"`
+	// HardwareAddrs are the Ethernet addresses learned from a TAP client
+	HardwareAddrs []string         `json:"hardware_addrs,omitempty"`
+	Stats         ClientStats      `json:"stats"`
+	ACL           acl.Status       `json:"acl"`
+	RateLimit     ratelimit.Status `json:"rate_limit"`
+}
+
+// Status is the state of the gateway for the control API
+type Status struct {
+	Running                bool           `json:"running"`
+	Sessions               int            `json:"sessions"`
+	HandshakesAccepted     uint64         `json:"handshakes_accepted"`
+	HandshakesUnauthorized uint64         `json:"handshakes_unauthorized"`
+	HandshakesFailed       uint64         `json:"handshakes_failed"`
+	Unrouted               uint64         `json:"unrouted"`
+	Clients                []ClientStatus `json:"clients"`
+}
+
+// Status returns the clients, their sessions and their counters
+func (gateway *Gateway) Status() Status {
+	gateway.mutex.RLock()
+	defer gateway.mutex.RUnlock()
+
+	status := Status{
+		Running:                gateway.isRunning,
+		Sessions:               len(gateway.sessions),
+		HandshakesAccepted:     gateway.handshakesAccepted.Load(),
+		HandshakesUnauthorized: gateway.handshakesUnauthorized.Load(),
+		HandshakesFailed:       gateway.handshakesFailed.Load(),
+		Unrouted:               gateway.unrouted.Load(),
+		Clients:                []ClientStatus{},
+	}
+
+	for _, client := range gateway.clients {
+		clientStatus := ClientStatus{
+			Name:      client.name,
+			Stats:     client.stats.snapshot(),
+			ACL:       client.aclEngine.Status(),
+			RateLimit: client.shaper.Status(),
+		}
+		if client.address.IsValid() {
+			clientStatus.Address = client.address.String()
+		}
+		for _, prefix := range client.allowedIPs {
+			clientStatus.AllowedIPs = append(clientStatus.AllowedIPs, prefix.String())
+		}
+		if session := gateway.sessions[client.name]; session != nil {
+			connectedAt := session.connectedAt
+			clientStatus.Connected = true
+			clientStatus.Address = session.address.String()
+			clientStatus.Remote = session.remote
+			clientStatus.ConnectedAt = &connectedAt
+			peer := session.monitor.Status()
+			clientStatus.Keepalive = &peer
+			if session.ethernet {
+				clientStatus.HardwareAddrs = gateway.macs.addresses(session)
+			}
+		}
+		status.Clients = append(status.Clients, clientStatus)
+	}
+
+	return status
+}
@@ -0,0 +1,295 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/config"
+	"thinkpol-vpn/interface/internal/ethernet"
+	"thinkpol-vpn/interface/internal/obfuscate"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+// startGateway serves a gateway for the clients over httptest
+func startGateway(t *testing.T, clients ...config.GatewayClientConfig) (*Gateway, string) {
+	t.Helper()
+
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(output) })
+
+	gateway, err := NewGateway(config.GatewayConfig{AddressPool: "10.0.0.0/24", Clients: clients}, config.RateLimitConfig{})
+	if err != nil {
+		t.Fatalf("NewGateway: %v", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(gateway.UpgradeConnection))
+	t.Cleanup(func() {
+		gateway.Stop()
+		server.Close()
+	})
+
+	return gateway, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// connect opens a session with the token and returns the leased address
+func connect(t *testing.T, url string, token string) (*websocket.Conn, netip.Addr) {
+	t.Helper()
+
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	conn, response, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	address, err := netip.ParseAddr(response.Header.Get(AddressHeader))
+	if err != nil {
+		t.Fatalf("invalid %s header: %v", AddressHeader, err)
+	}
+	return conn, address
+}
+
+// udpPacket builds an IPv4 UDP packet with an empty payload
+func udpPacket(src, dst string) []byte {
+	data := make([]byte, 28)
+	data[0] = 0x45
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)))
+	data[8] = 64
+	data[9] = 17
+	copy(data[12:16], netip.MustParseAddr(src).AsSlice())
+	copy(data[16:20], netip.MustParseAddr(dst).AsSlice())
+	binary.BigEndian.PutUint16(data[20:22], 40000)
+	binary.BigEndian.PutUint16(data[22:24], 53)
+	binary.BigEndian.PutUint16(data[24:26], 8)
+	return data
+}
+
+// sendPacket sends a packet over a session like a client does
+func sendPacket(t *testing.T, conn *websocket.Conn, data []byte) {
+	t.Helper()
+
+	length := int32(len(data))
+	message, err := proto.Marshal(&protobuf.PacketV4{Length: &length, Buffer: data})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+}
+
+// forwarded returns the next packet the sessions handed to the gateway, nil
+// when there is none within a short time
+func forwarded(gateway *Gateway) []byte {
+	select {
+	case received := <-gateway.ReceiveFromTransport():
+		return received.GetBuffer()
+	case <-time.After(200 * time.Millisecond):
+		return nil
+	}
+}
+
+// delivered returns the next packet a client receives, nil when there is
+// none within a short time
+func delivered(t *testing.T, conn *websocket.Conn) []byte {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		return nil
+	}
+	received := &protobuf.PacketV4{}
+	if err := proto.Unmarshal(message, received); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	return received.GetBuffer()
+}
+
+func TestBadTokenIsRejected(t *testing.T) {
+	gateway, url := startGateway(t, config.GatewayClientConfig{Name: "alice", Token: "alice-token"})
+
+	for _, header := range []http.Header{
+		nil,
+		{"Authorization": {"Bearer wrong-token"}},
+		{"Authorization": {"alice-token"}},
+	} {
+		_, response, err := websocket.DefaultDialer.Dial(url, header)
+		if err == nil {
+			t.Fatalf("Dial with %v succeeded", header)
+		}
+		if response == nil || response.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Dial with %v = %v, want 401", header, response)
+		}
+	}
+
+	if status := gateway.Status(); status.HandshakesUnauthorized != 3 || status.Sessions != 0 {
+		t.Errorf("unauthorized = %d, sessions = %d, want 3 and 0", status.HandshakesUnauthorized, status.Sessions)
+	}
+}
+
+func TestSpoofedSourceIsDropped(t *testing.T) {
+	gateway, url := startGateway(t,
+		config.GatewayClientConfig{Name: "alice", Token: "alice-token"},
+		config.GatewayClientConfig{Name: "bob", Token: "bob-token"},
+	)
+	alice, aliceAddress := connect(t, url, "alice-token")
+	_, bobAddress := connect(t, url, "bob-token")
+	if aliceAddress == bobAddress {
+		t.Fatalf("alice and bob both got %s", aliceAddress)
+	}
+
+	// Alice claims to be bob
+	sendPacket(t, alice, udpPacket(bobAddress.String(), "1.1.1.1"))
+	if data := forwarded(gateway); data != nil {
+		t.Errorf("spoofed packet was forwarded")
+	}
+
+	sendPacket(t, alice, udpPacket(aliceAddress.String(), "1.1.1.1"))
+	if data := forwarded(gateway); data == nil {
+		t.Errorf("packet from alice's own address was dropped")
+	}
+
+	stats := gateway.Status().Clients[0].Stats
+	if stats.Spoofed != 1 || stats.PacketsReceived != 1 {
+		t.Errorf("spoofed = %d, received = %d, want 1 and 1", stats.Spoofed, stats.PacketsReceived)
+	}
+}
+
+func TestCrossClientAllowedIPs(t *testing.T) {
+	gateway, url := startGateway(t,
+		// alice may only reach bob
+		config.GatewayClientConfig{Name: "alice", Token: "alice-token", Address: "10.0.0.2", AllowedIPs: []string{"10.0.0.3"}},
+		config.GatewayClientConfig{Name: "bob", Token: "bob-token", Address: "10.0.0.3"},
+		// carol only takes packets from alice
+		config.GatewayClientConfig{Name: "carol", Token: "carol-token", Address: "10.0.0.4", AllowedIPs: []string{"10.0.0.2/32"}},
+	)
+	alice, _ := connect(t, url, "alice-token")
+	bob, _ := connect(t, url, "bob-token")
+	carol, _ := connect(t, url, "carol-token")
+
+	// relay routes a forwarded packet back out like the stack behind the
+	// gateway does
+	relay := func() []byte {
+		data := forwarded(gateway)
+		if data != nil {
+			gateway.SendToTransport(len(data), data)
+		}
+		return data
+	}
+
+	sendPacket(t, alice, udpPacket("10.0.0.2", "10.0.0.3"))
+	if relay() == nil {
+		t.Fatalf("packet from alice to bob was not forwarded")
+	}
+	if data := delivered(t, bob); data == nil {
+		t.Errorf("bob did not get alice's packet")
+	}
+
+	// carol is outside alice's allowed IPs
+	sendPacket(t, alice, udpPacket("10.0.0.2", "10.0.0.4"))
+	if relay() != nil {
+		t.Errorf("packet from alice to carol was forwarded")
+	}
+
+	// bob may send anywhere, but carol only takes packets from alice
+	sendPacket(t, bob, udpPacket("10.0.0.3", "10.0.0.4"))
+	if relay() == nil {
+		t.Fatalf("packet from bob to carol was not forwarded")
+	}
+	if data := delivered(t, carol); data != nil {
+		t.Errorf("carol got bob's packet")
+	}
+
+	clients := gateway.Status().Clients
+	if denied := clients[0].Stats.DeniedInbound; denied != 1 {
+		t.Errorf("alice denied inbound = %d, want 1", denied)
+	}
+	if denied := clients[2].Stats.DeniedOutbound; denied != 1 {
+		t.Errorf("carol denied outbound = %d, want 1", denied)
+	}
+}
+
+func TestTAPNeighborSolicitation(t *testing.T) {
+	_, url := startGateway(t, config.GatewayClientConfig{Name: "alice", Token: "alice-token", Address: "fd00::2"})
+
+	header := http.Header{"Authorization": {"Bearer alice-token"}, ethernet.LayerHeader: {ethernet.LayerEthernet}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	aliceMAC := ethernet.MAC{0x02, 0, 0, 0, 0, 0x02}
+	solicit := func(source, target string) {
+		request := ethernet.NDP{
+			Type:        ethernet.NeighborSolicitation,
+			Source:      netip.MustParseAddr(source),
+			Destination: netip.MustParseAddr("ff02::1:ff00:1"),
+			Target:      netip.MustParseAddr(target),
+			LinkAddr:    aliceMAC,
+		}
+		frame := ethernet.Frame{
+			Destination: ethernet.MAC{0x33, 0x33, 0xff, 0, 0, 0x01},
+			Source:      aliceMAC,
+			Type:        ethernet.TypeIPv6,
+			Payload:     request.Append(nil),
+		}.Append(nil)
+		message, err := ethernet.Marshal(frame, obfuscate.Settings{})
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+			t.Fatalf("WriteMessage: %v", err)
+		}
+	}
+
+	// Duplicate address detection and solicitations for its own address are
+	// left unanswered, the next message is the answer for the gateway
+	solicit("::", "fd00::2")
+	solicit("fd00::2", "fd00::2")
+	solicit("fd00::2", "fd00::1")
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("no neighbor advertisement: %v", err)
+	}
+	wrapped, err := ethernet.Unmarshal(message)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	frame, err := ethernet.Parse(wrapped.GetBuffer())
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if frame.Destination != aliceMAC || frame.Source != gatewayMAC || frame.Type != ethernet.TypeIPv6 {
+		t.Errorf("frame = %s -> %s %s, want an IPv6 frame from the gateway to alice", frame.Source, frame.Destination, frame.Type)
+	}
+	advertisement, err := ethernet.ParseNDP(frame.Payload)
+	if err != nil {
+		t.Fatalf("ParseNDP: %v", err)
+	}
+	if advertisement.Type != ethernet.NeighborAdvertisement || advertisement.Target != netip.MustParseAddr("fd00::1") ||
+		advertisement.Destination != netip.MustParseAddr("fd00::2") || advertisement.LinkAddr != gatewayMAC {
+		t.Errorf("advertisement = %+v, want fd00::1 at %s", advertisement, gatewayMAC)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("got more than one answer")
+	}
+}
@@ -0,0 +1,116 @@
+package gateway
+
+import (
+	"thinkpol-vpn/interface/internal/ratelimit"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	gatewaySessionsDesc = prometheus.NewDesc(
+		"thinkpol_vpn_gateway_sessions",
+		"Clients currently connected to the gateway.",
+		nil, nil,
+	)
+	gatewayHandshakesDesc = prometheus.NewDesc(
+		"thinkpol_vpn_gateway_handshakes_total",
+		"Websocket handshakes by outcome.",
+		[]string{"outcome"}, nil,
+	)
+	gatewayUnroutedDesc = prometheus.NewDesc(
+		"thinkpol_vpn_gateway_unrouted_packets_total",
+		"Packets to an address no connected client holds.",
+		nil, nil,
+	)
+	gatewayClientPacketsDesc = prometheus.NewDesc(
+		"thinkpol_vpn_gateway_client_packets_total",
+		"Packets forwarded from and delivered to each client.",
+		[]string{"client", "direction"}, nil,
+	)
+	gatewayClientBytesDesc = prometheus.NewDesc(
+		"thinkpol_vpn_gateway_client_bytes_total",
+		"Bytes forwarded from and delivered to each client.",
+		[]string{"client", "direction"}, nil,
+	)
+	gatewayClientDroppedDesc = prometheus.NewDesc(
+		"thinkpol_vpn_gateway_client_dropped_packets_total",
+		"Packets from or to each client that were dropped, by reason.",
+		[]string{"client", "reason"}, nil,
+	)
+	gatewayClientDeadPeersDesc = prometheus.NewDesc(
+		"thinkpol_vpn_gateway_client_dead_peers_total",
+		"Sessions of each client closed because it stopped answering keepalives.",
+		[]string{"client"}, nil,
+	)
+	gatewayClientThrottledPacketsDesc = prometheus.NewDesc(
+		"thinkpol_vpn_gateway_client_throttled_packets_total",
+		"Packets from or to each client held back or dropped by its rate limit.",
+		[]string{"client", "direction", "action"}, nil,
+	)
+	gatewayClientThrottledBytesDesc = prometheus.NewDesc(
+		"thinkpol_vpn_gateway_client_throttled_bytes_total",
+		"Bytes from or to each client held back or dropped by its rate limit.",
+		[]string{"client", "direction", "action"}, nil,
+	)
+)
+
+// gatewayCollector exports the gateway and client counters as Prometheus metrics
+type gatewayCollector struct {
+	gateway *Gateway
+}
+
+// Collector returns a Prometheus collector for the gateway metrics
+func (gateway *Gateway) Collector() prometheus.Collector {
+	return &gatewayCollector{gateway: gateway}
+}
+
+// Describe implements prometheus.Collector
+func (collector *gatewayCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- gatewaySessionsDesc
+	descs <- gatewayHandshakesDesc
+	descs <- gatewayUnroutedDesc
+	descs <- gatewayClientPacketsDesc
+	descs <- gatewayClientBytesDesc
+	descs <- gatewayClientDroppedDesc
+	descs <- gatewayClientDeadPeersDesc
+	descs <- gatewayClientThrottledPacketsDesc
+	descs <- gatewayClientThrottledBytesDesc
+}
+
+// Collect implements prometheus.Collector
+func (collector *gatewayCollector) Collect(metrics chan<- prometheus.Metric) {
+	status := collector.gateway.Status()
+
+	counter := func(desc *prometheus.Desc, value uint64, labels ...string) {
+		metrics <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), labels...)
+	}
+
+	metrics <- prometheus.MustNewConstMetric(gatewaySessionsDesc, prometheus.GaugeValue, float64(status.Sessions))
+	counter(gatewayHandshakesDesc, status.HandshakesAccepted, "accepted")
+	counter(gatewayHandshakesDesc, status.HandshakesUnauthorized, "unauthorized")
+	counter(gatewayHandshakesDesc, status.HandshakesFailed, "failed")
+	counter(gatewayUnroutedDesc, status.Unrouted)
+
+	for _, client := range status.Clients {
+		stats := client.Stats
+		counter(gatewayClientPacketsDesc, stats.PacketsReceived, client.Name, "received")
+		counter(gatewayClientPacketsDesc, stats.PacketsSent, client.Name, "sent")
+		counter(gatewayClientBytesDesc, stats.BytesReceived, client.Name, "received")
+		counter(gatewayClientBytesDesc, stats.BytesSent, client.Name, "sent")
+		counter(gatewayClientDroppedDesc, stats.Spoofed, client.Name, "spoofed")
+		counter(gatewayClientDroppedDesc, stats.DeniedInbound, client.Name, "denied_in")
+		counter(gatewayClientDroppedDesc, stats.DeniedOutbound, client.Name, "denied_out")
+		counter(gatewayClientDroppedDesc, stats.Dropped, client.Name, "queue_full")
+		counter(gatewayClientDroppedDesc, stats.Malformed, client.Name, "malformed")
+		counter(gatewayClientDeadPeersDesc, stats.DeadPeers, client.Name)
+
+		throttled := func(direction string, bucket ratelimit.BucketStatus) {
+			counter(gatewayClientThrottledPacketsDesc, bucket.DelayedPackets, client.Name, direction, "delayed")
+			counter(gatewayClientThrottledPacketsDesc, bucket.DroppedPackets, client.Name, direction, "dropped")
+			counter(gatewayClientThrottledBytesDesc, bucket.DelayedBytes, client.Name, direction, "delayed")
+			counter(gatewayClientThrottledBytesDesc, bucket.DroppedBytes, client.Name, direction, "dropped")
+		}
+		throttled("sent", client.RateLimit.Send)
+		throttled("received", client.RateLimit.Receive)
+	}
+}
@@ -0,0 +1,241 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/capture"
+	"thinkpol-vpn/interface/internal/ethernet"
+	"thinkpol-vpn/interface/internal/keepalive"
+	"thinkpol-vpn/interface/internal/packet"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+// session is the websocket connection of an authenticated client
+type session struct {
+	gateway     *Gateway
+	client      *client
+	address     netip.Addr
+	remote      string
+	connectedAt time.Time
+
+	conn     *websocket.Conn
+	sendChan chan *protobuf.PacketV4
+	monitor  *keepalive.Monitor
+
+	// ethernet sessions carry the Ethernet frames of a TAP client,
+	// hardwareAddr is the Ethernet address of its tunnel address once learned
+	ethernet     bool
+	hardwareAddr atomic.Pointer[ethernet.MAC]
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	// spoofLogged limits spoofing warnings to one per session
+	spoofLogged bool
+}
+
+// run exchanges packets over the connection until either side closes it
+func (session *session) run(conn *websocket.Conn) {
+	session.conn = conn
+
+	// Reads give up once the client has been silent for the keepalive
+	// timeout, every pong pushes the deadline back
+	conn.SetPongHandler(func(payload string) error {
+		session.monitor.Pong([]byte(payload))
+		return conn.SetReadDeadline(session.monitor.ReadDeadline())
+	})
+
+	go session.writeLoop()
+	go func() {
+		if err := session.monitor.Run(session.ctx, keepalive.WebSocket(conn)); err != nil {
+			session.fail(err)
+		}
+	}()
+	go func() {
+		session.readLoop()
+		session.close()
+	}()
+
+	// The connection is closed once the session ends for any reason: the
+	// client left, it reconnected or the gateway stopped
+	go func() {
+		<-session.ctx.Done()
+		conn.Close()
+	}()
+}
+
+// readLoop checks every packet the client sends against its policy before
+// handing it to the gateway
+func (session *session) readLoop() {
+	client := session.client
+
+	for {
+		session.conn.SetReadDeadline(session.monitor.ReadDeadline())
+		mt, message, err := session.conn.ReadMessage()
+		if err != nil {
+			if session.ctx.Err() == nil {
+				log.Printf("    [GATEWAY] Client %s read error: %v", client.name, err)
+			}
+			session.fail(err)
+			return
+		}
+		session.monitor.Seen()
+		if mt != websocket.BinaryMessage {
+			client.stats.malformed.Add(1)
+			continue
+		}
+
+		var received *protobuf.PacketV4
+		var source ethernet.MAC
+		if session.ethernet {
+			if received, source = session.receiveFrame(message); received == nil {
+				continue
+			}
+		} else {
+			received = &protobuf.PacketV4{}
+			if err := proto.Unmarshal(message, received); err != nil {
+				client.stats.malformed.Add(1)
+				continue
+			}
+		}
+
+		data := received.GetBuffer()
+		session.gateway.capturer.Capture(capture.Point{Source: capture.SourceTransport, Direction: capture.Inbound}, data)
+
+		parsed, err := packet.Parse(data)
+		if err != nil {
+			client.stats.malformed.Add(1)
+			continue
+		}
+		if !client.allowFrom(session.address, parsed) {
+			if parsed.Src != session.address && !session.spoofLogged {
+				session.spoofLogged = true
+				log.Printf("    [GATEWAY] Client %s sent from %s instead of %s, dropping spoofed packets", client.name, parsed.Src, session.address)
+			}
+			continue
+		}
+
+		// Packets to the client go where it sends its own packets from
+		if session.ethernet {
+			if learned := session.hardwareAddr.Load(); learned == nil || *learned != source {
+				session.hardwareAddr.Store(&source)
+			}
+		}
+
+		client.stats.packetsReceived.Add(1)
+		client.stats.bytesReceived.Add(uint64(len(data)))
+
+		if !client.shaper.Receive.Wait(session.ctx, len(data)) {
+			continue
+		}
+
+		select {
+		case <-session.ctx.Done():
+			return
+		case session.gateway.receiveChan <- received:
+		}
+	}
+}
+
+// writeLoop sends the packets routed to the client
+func (session *session) writeLoop() {
+	client := session.client
+
+	for {
+		var queued *protobuf.PacketV4
+
+		select {
+		case <-session.ctx.Done():
+			return
+		case queued = <-session.sendChan:
+		}
+
+		if !client.shaper.Send.Wait(session.ctx, len(queued.GetBuffer())) {
+			continue
+		}
+
+		if !session.gateway.obfuscation.Delay(session.ctx) {
+			return
+		}
+
+		message, err := session.marshal(queued)
+		if err != nil {
+			client.stats.dropped.Add(1)
+			continue
+		}
+
+		session.conn.SetWriteDeadline(session.monitor.WriteDeadline())
+		if err := session.conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+			log.Printf("    [GATEWAY] Client %s write error: %v", client.name, err)
+			session.fail(err)
+			return
+		}
+
+		client.stats.packetsSent.Add(1)
+		client.stats.bytesSent.Add(uint64(len(queued.GetBuffer())))
+		if captured := session.packetOf(queued.GetBuffer()); captured != nil {
+			session.gateway.capturer.Capture(capture.Point{Source: capture.SourceTransport, Direction: capture.Outbound}, captured)
+		}
+	}
+}
+
+// marshal turns a packet, or a frame for a TAP client, into a message for the wire
+func (session *session) marshal(queued *protobuf.PacketV4) ([]byte, error) {
+	if session.ethernet {
+		return ethernet.Marshal(queued.GetBuffer(), session.gateway.obfuscation)
+	}
+	return proto.Marshal(session.gateway.obfuscation.Pad(queued))
+}
+
+// packetOf returns the IP packet sent to the client, the one inside the frame
+// for a TAP client and nil for frames carrying anything else
+func (session *session) packetOf(buffer []byte) []byte {
+	if session.ethernet {
+		return ethernet.Packet(buffer)
+	}
+	return buffer
+}
+
+// send queues a packet for the client, dropping it when the queue is full so
+// one slow client cannot stall the others
+func (session *session) send(queued *protobuf.PacketV4) {
+	select {
+	case session.sendChan <- queued:
+	default:
+		session.client.stats.dropped.Add(1)
+	}
+}
+
+// fail closes the session after its connection failed. A client that went
+// silent or stopped taking data counts as a dead peer, failures after the
+// session ended are ignored.
+func (session *session) fail(err error) {
+	if session.ctx.Err() != nil {
+		return
+	}
+	if errors.Is(err, keepalive.ErrDeadPeer) || keepalive.IsTimeout(err) {
+		log.Printf("    [KEEPALIVE] Client %s is dead (%v), closing its session", session.client.name, err)
+		session.client.stats.deadPeers.Add(1)
+		session.monitor.MarkDead()
+	}
+	session.close()
+}
+
+// close ends the session and releases its address. It may be called before
+// run, the connection is then closed as soon as run gets it.
+func (session *session) close() {
+	session.closeOnce.Do(func() {
+		session.cancel()
+		session.gateway.remove(session)
+		log.Printf("    [GATEWAY] Client %s disconnected, session from %s closed", session.client.name, session.remote)
+	})
+}
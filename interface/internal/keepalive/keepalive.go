@@ -0,0 +1,193 @@
+// Package keepalive pings the peer of a transport connection and declares it
+// dead when it goes silent, so half-open connections do not hang forever
+package keepalive
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"thinkpol-vpn/interface/internal/config"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrDeadPeer is returned by Run when the peer stayed silent for the timeout
+var ErrDeadPeer = errors.New("peer stopped answering keepalives")
+
+// Peer states reported in Status
+const (
+	StateAlive = "alive"
+	// StateUnresponsive means a keepalive went unanswered but the timeout
+	// has not passed yet
+	StateUnresponsive = "unresponsive"
+	StateDead         = "dead"
+)
+
+// Pinger sends a keepalive that the peer echoes back with the same payload.
+// WebSocket transports send a ping frame, other transports the keepalive of
+// their own protocol.
+type Pinger interface {
+	Ping(payload []byte, deadline time.Time) error
+}
+
+// PingFunc adapts a function to the Pinger interface
+type PingFunc func(payload []byte, deadline time.Time) error
+
+// Ping calls the function
+func (ping PingFunc) Ping(payload []byte, deadline time.Time) error {
+	return ping(payload, deadline)
+}
+
+// WebSocket returns a pinger sending ping frames over conn. The pong handler
+// of conn should hand the payload to Monitor.Pong.
+func WebSocket(conn *websocket.Conn) Pinger {
+	return PingFunc(func(payload []byte, deadline time.Time) error {
+		return conn.WriteControl(websocket.PingMessage, payload, deadline)
+	})
+}
+
+// Settings are the keepalive intervals and deadlines of a transport
+type Settings struct {
+	// Interval is how often a keepalive is sent
+	Interval time.Duration
+	// Timeout is how long the peer may stay silent before it is dead
+	Timeout time.Duration
+	// WriteTimeout is how long a single write to the peer may take
+	WriteTimeout time.Duration
+}
+
+// New validates the keepalive configuration
+func New(keepaliveConfig config.KeepaliveConfig) (Settings, error) {
+	settings := Settings{
+		Interval:     time.Duration(keepaliveConfig.IntervalMS) * time.Millisecond,
+		Timeout:      time.Duration(keepaliveConfig.TimeoutMS) * time.Millisecond,
+		WriteTimeout: time.Duration(keepaliveConfig.WriteTimeoutMS) * time.Millisecond,
+	}
+
+	if settings.Interval <= 0 {
+		return Settings{}, fmt.Errorf("keepalive interval must be positive")
+	}
+	if settings.Timeout <= settings.Interval {
+		return Settings{}, fmt.Errorf("keepalive timeout must be longer than the interval")
+	}
+	if settings.WriteTimeout <= 0 {
+		return Settings{}, fmt.Errorf("write timeout must be positive")
+	}
+
+	return settings, nil
+}
+
+// Monitor tracks whether the peer of one connection is alive. Every message
+// received from the peer counts, not only answered keepalives.
+type Monitor struct {
+	settings Settings
+	// lastSeen is when the peer was last heard from, in Unix nanoseconds
+	lastSeen atomic.Int64
+	dead     atomic.Bool
+}
+
+// NewMonitor starts tracking a connection that was just established
+func (settings Settings) NewMonitor() *Monitor {
+	monitor := &Monitor{settings: settings}
+	monitor.Seen()
+	return monitor
+}
+
+// Seen records that the peer was heard from
+func (monitor *Monitor) Seen() {
+	monitor.lastSeen.Store(time.Now().UnixNano())
+}
+
+// Pong records an answered keepalive and returns the round trip time it
+// measured. The payload carries the send time, anything else is ignored.
+func (monitor *Monitor) Pong(payload []byte) (time.Duration, bool) {
+	monitor.Seen()
+	if len(payload) != 8 {
+		return 0, false
+	}
+	sent := int64(binary.BigEndian.Uint64(payload))
+	return time.Duration(time.Now().UnixNano() - sent), true
+}
+
+// ReadDeadline is when a read has to give up because the peer would have
+// been silent for the timeout
+func (monitor *Monitor) ReadDeadline() time.Time {
+	return time.Unix(0, monitor.lastSeen.Load()).Add(monitor.settings.Timeout)
+}
+
+// WriteDeadline is when a write started now has to give up
+func (monitor *Monitor) WriteDeadline() time.Time {
+	return time.Now().Add(monitor.settings.WriteTimeout)
+}
+
+// Run sends a keepalive every interval until ctx ends. It returns
+// ErrDeadPeer once the peer has been silent for the timeout and the error of
+// a keepalive that could not be sent.
+func (monitor *Monitor) Run(ctx context.Context, pinger Pinger) error {
+	ticker := time.NewTicker(monitor.settings.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		if time.Since(monitor.LastSeen()) >= monitor.settings.Timeout {
+			monitor.dead.Store(true)
+			return ErrDeadPeer
+		}
+
+		// The peer echoes the payload back, so it carries the send time
+		payload := make([]byte, 8)
+		binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+		if err := pinger.Ping(payload, monitor.WriteDeadline()); err != nil {
+			monitor.dead.Store(true)
+			return fmt.Errorf("failed to send keepalive: %w", err)
+		}
+	}
+}
+
+// MarkDead records that the transport found the peer dead itself, e.g.
+// because a read or write ran into its deadline
+func (monitor *Monitor) MarkDead() {
+	monitor.dead.Store(true)
+}
+
+// IsTimeout reports whether err is a read or write that ran into its deadline
+func IsTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// LastSeen returns when the peer was last heard from
+func (monitor *Monitor) LastSeen() time.Time {
+	return time.Unix(0, monitor.lastSeen.Load())
+}
+
+// Status is the liveness of a peer for the control API
+type Status struct {
+	State    string    `json:"state"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Status returns the state of the peer
+func (monitor *Monitor) Status() Status {
+	status := Status{State: StateAlive, LastSeen: monitor.LastSeen()}
+
+	switch {
+	case monitor.dead.Load():
+		status.State = StateDead
+	// Answers arrive about an interval apart, silence for two means a
+	// keepalive went unanswered
+	case time.Since(status.LastSeen) > 2*monitor.settings.Interval:
+		status.State = StateUnresponsive
+	}
+	return status
+}
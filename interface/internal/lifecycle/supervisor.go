@@ -0,0 +1,156 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Stage is a component the supervisor brings up and tears down
+type Stage struct {
+	Name string
+	// Start brings the component up. It must not block once the component is running.
+	Start func(ctx context.Context) error
+	// Stop tears the component down, it may be nil
+	Stop func(ctx context.Context) error
+	// Timeout bounds Start and Stop each, zero uses the supervisor default
+	Timeout time.Duration
+}
+
+// Supervisor starts stages in the order they were added and stops the
+// started ones in reverse order when the root context is done, a stage
+// fails to start or a running component reports a failure
+type Supervisor struct {
+	stages         []Stage
+	defaultTimeout time.Duration
+
+	mutex   sync.Mutex
+	cancel  context.CancelFunc
+	failure error
+	// startErr is why starting a stage failed
+	startErr error
+}
+
+// NewSupervisor creates a supervisor with the given default stage timeout
+func NewSupervisor(defaultTimeout time.Duration) *Supervisor {
+	return &Supervisor{defaultTimeout: defaultTimeout}
+}
+
+// Add appends a stage, stages are started in the order they are added
+func (supervisor *Supervisor) Add(stage Stage) {
+	supervisor.stages = append(supervisor.stages, stage)
+}
+
+// Fail reports that a running component broke and triggers shutdown
+func (supervisor *Supervisor) Fail(err error) {
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+
+	if supervisor.failure == nil {
+		supervisor.failure = err
+	}
+	if supervisor.cancel != nil {
+		supervisor.cancel()
+	}
+}
+
+// Err returns why the stages are shut down: the startup error or the
+// reported failure, nil while running and for a clean shutdown. Stop steps
+// use it to tell an explicit shutdown from a failure.
+func (supervisor *Supervisor) Err() error {
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+
+	return errors.Join(supervisor.startErr, supervisor.failure)
+}
+
+// Run starts every stage, waits until ctx is done or a component fails and
+// then stops the started stages in reverse order. It returns the startup
+// error or the reported failure, nil for a clean shutdown.
+func (supervisor *Supervisor) Run(ctx context.Context) error {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	supervisor.mutex.Lock()
+	supervisor.cancel = cancel
+	failure := supervisor.failure
+	supervisor.mutex.Unlock()
+
+	var startErr error
+	started := 0
+
+	if failure == nil {
+		for _, stage := range supervisor.stages {
+			if runCtx.Err() != nil {
+				break
+			}
+
+			// A stage that failed may have come up halfway, so it is stopped too
+			log.Printf("    [LIFECYCLE] Starting %s...", stage.Name)
+			started++
+			if err := supervisor.runStep(stage, stage.Start); err != nil {
+				startErr = fmt.Errorf("failed to start %s: %w", stage.Name, err)
+				log.Printf("    [LIFECYCLE] %v", startErr)
+
+				supervisor.mutex.Lock()
+				supervisor.startErr = startErr
+				supervisor.mutex.Unlock()
+				break
+			}
+		}
+	}
+
+	if startErr == nil && runCtx.Err() == nil {
+		log.Printf("    [LIFECYCLE] ✅ Started %d stages successfully", started)
+		<-runCtx.Done()
+	}
+
+	log.Printf("    [LIFECYCLE] Shutting down...")
+
+	for i := started - 1; i >= 0; i-- {
+		stage := supervisor.stages[i]
+		if stage.Stop == nil {
+			continue
+		}
+
+		log.Printf("    [LIFECYCLE] Stopping %s...", stage.Name)
+		if err := supervisor.runStep(stage, stage.Stop); err != nil {
+			log.Printf("    [LIFECYCLE] Warning: failed to stop %s: %v", stage.Name, err)
+		}
+	}
+
+	supervisor.mutex.Lock()
+	failure = supervisor.failure
+	supervisor.cancel = nil
+	supervisor.mutex.Unlock()
+
+	return errors.Join(startErr, failure)
+}
+
+// runStep runs a start or stop step of a stage within its timeout. Steps are
+// not interrupted by the root context so a stage is never left half done by a
+// signal, but a step that overruns is abandoned so it cannot hang the rest.
+func (supervisor *Supervisor) runStep(stage Stage, step func(context.Context) error) error {
+	timeout := stage.Timeout
+	if timeout == 0 {
+		timeout = supervisor.defaultTimeout
+	}
+
+	stepCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- step(stepCtx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-stepCtx.Done():
+		return fmt.Errorf("%s timed out after %s", stage.Name, timeout)
+	}
+}
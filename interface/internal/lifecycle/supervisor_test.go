@@ -0,0 +1,159 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder logs the start and stop steps of test stages in the order they run
+type recorder struct {
+	mutex sync.Mutex
+	steps []string
+}
+
+func (recorder *recorder) record(step string) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	recorder.steps = append(recorder.steps, step)
+}
+
+func (recorder *recorder) stage(name string, startErr error) Stage {
+	return Stage{
+		Name: name,
+		Start: func(ctx context.Context) error {
+			recorder.record("start " + name)
+			return startErr
+		},
+		Stop: func(ctx context.Context) error {
+			recorder.record("stop " + name)
+			return nil
+		},
+	}
+}
+
+func TestStopInReverseOrder(t *testing.T) {
+	recorder := &recorder{}
+	supervisor := NewSupervisor(time.Second)
+	supervisor.Add(recorder.stage("transport", nil))
+	supervisor.Add(recorder.stage("interface", nil))
+	supervisor.Add(recorder.stage("forwarder", nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- supervisor.Run(ctx)
+	}()
+
+	// Give the stages time to start before the shutdown
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Run = %v, want nil for a clean shutdown", err)
+	}
+	if err := supervisor.Err(); err != nil {
+		t.Errorf("Err = %v, want nil for a clean shutdown", err)
+	}
+
+	want := []string{
+		"start transport", "start interface", "start forwarder",
+		"stop forwarder", "stop interface", "stop transport",
+	}
+	if !reflect.DeepEqual(recorder.steps, want) {
+		t.Errorf("steps = %q, want %q", recorder.steps, want)
+	}
+}
+
+func TestStopStageThatFailedToStart(t *testing.T) {
+	recorder := &recorder{}
+	errBroken := errors.New("broken")
+	supervisor := NewSupervisor(time.Second)
+	supervisor.Add(recorder.stage("transport", nil))
+	supervisor.Add(recorder.stage("interface", errBroken))
+	supervisor.Add(recorder.stage("forwarder", nil))
+
+	err := supervisor.Run(context.Background())
+	if !errors.Is(err, errBroken) {
+		t.Errorf("Run = %v, want the start error", err)
+	}
+	if !errors.Is(supervisor.Err(), errBroken) {
+		t.Errorf("Err = %v, want the start error", supervisor.Err())
+	}
+
+	// The failed stage may have come up halfway so it is stopped too, the
+	// stages after it never started
+	want := []string{
+		"start transport", "start interface",
+		"stop interface", "stop transport",
+	}
+	if !reflect.DeepEqual(recorder.steps, want) {
+		t.Errorf("steps = %q, want %q", recorder.steps, want)
+	}
+}
+
+func TestFailStopsStages(t *testing.T) {
+	recorder := &recorder{}
+	errLost := errors.New("connection lost")
+	supervisor := NewSupervisor(time.Second)
+	supervisor.Add(recorder.stage("transport", nil))
+	supervisor.Add(Stage{
+		Name: "interface",
+		Start: func(ctx context.Context) error {
+			go supervisor.Fail(errLost)
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			// Stop steps see the failure, e.g. to keep the kill switch
+			if !errors.Is(supervisor.Err(), errLost) {
+				t.Errorf("Err during stop = %v, want the failure", supervisor.Err())
+			}
+			return nil
+		},
+	})
+
+	if err := supervisor.Run(context.Background()); !errors.Is(err, errLost) {
+		t.Errorf("Run = %v, want the failure", err)
+	}
+	if want := []string{"start transport", "stop transport"}; !reflect.DeepEqual(recorder.steps, want) {
+		t.Errorf("steps = %q, want %q", recorder.steps, want)
+	}
+}
+
+func TestStepTimeout(t *testing.T) {
+	recorder := &recorder{}
+	release := make(chan struct{})
+	defer close(release)
+
+	supervisor := NewSupervisor(time.Second)
+	supervisor.Add(recorder.stage("transport", nil))
+	supervisor.Add(Stage{
+		Name:    "stuck",
+		Timeout: 50 * time.Millisecond,
+		Start: func(ctx context.Context) error {
+			<-release
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			<-release
+			return nil
+		},
+	})
+
+	began := time.Now()
+	err := supervisor.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "stuck timed out after 50ms") {
+		t.Errorf("Run = %v, want the start timeout", err)
+	}
+	// The stuck start and stop are both abandoned, the rest still stops
+	if elapsed := time.Since(began); elapsed > 500*time.Millisecond {
+		t.Errorf("Run took %s, want the stuck steps abandoned", elapsed)
+	}
+	if want := []string{"start transport", "stop transport"}; !reflect.DeepEqual(recorder.steps, want) {
+		t.Errorf("steps = %q, want %q", recorder.steps, want)
+	}
+}
@@ -0,0 +1,73 @@
+package localproxy
+
+import (
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"thinkpol-vpn/interface/internal/netstack"
+	"thinkpol-vpn/interface/internal/util"
+)
+
+// ServeHTTP serves HTTP proxy requests: CONNECT tunnels through the tunnel,
+// and plain http:// requests forwarded through it
+func (localProxy *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, _ := proxyBasicAuth(r)
+	if !localProxy.authorized(username, password) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="thinkpol-vpn"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		localProxy.connect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() || r.URL.Scheme != "http" {
+		http.Error(w, "not a proxy request", http.StatusBadRequest)
+		return
+	}
+	localProxy.forward.ServeHTTP(w, r)
+}
+
+// connect tunnels the connection of the client to the host it asked for
+func (localProxy *Proxy) connect(w http.ResponseWriter, r *http.Request) {
+	upstream, err := localProxy.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		log.Printf("    [LOCAL PROXY] Failed to connect to %s: %v", r.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		upstream.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	buffered.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+	if err := buffered.Flush(); err != nil {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+
+	netstack.Relay(&util.BufferedConn{Conn: conn, Reader: buffered.Reader}, upstream, idleTimeout)
+}
+
+// proxyBasicAuth returns the credentials in the Proxy-Authorization header
+func proxyBasicAuth(r *http.Request) (string, string, bool) {
+	encoded, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
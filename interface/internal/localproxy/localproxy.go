@@ -0,0 +1,182 @@
+// Package localproxy carries the connections of applications through the
+// tunnel without a TUN interface. Applications connect to a local SOCKS5 or
+// HTTP proxy, which dials their destinations on a userspace TCP/IP stack
+// whose packets go through the transport, so no root privileges are needed.
+package localproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"sync"
+	"time"
+
+	"thinkpol-vpn/interface/internal/acl"
+	"thinkpol-vpn/interface/internal/config"
+	"thinkpol-vpn/interface/internal/netstack"
+)
+
+const (
+	// handshakeTimeout bounds how long a client takes to say where it
+	// wants to connect
+	handshakeTimeout = 10 * time.Second
+
+	// dialTimeout bounds how long a connection through the tunnel takes
+	dialTimeout = 10 * time.Second
+
+	// idleTimeout closes proxied connections that saw no traffic either
+	// way for this long
+	idleTimeout = 10 * time.Minute
+)
+
+// Proxy serves the SOCKS5 and HTTP proxies on top of the stack
+type Proxy struct {
+	stack     *Stack
+	socksAddr string
+	httpAddr  string
+	username  string
+	password  string
+
+	socksListener net.Listener
+	httpServer    *http.Server
+	forward       *httputil.ReverseProxy
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New validates the local proxy configuration. mtu is the tunnel MTU and
+// transport carries the packets of the stack.
+func New(proxyConfig config.LocalProxyConfig, mtu int, transport netstack.Transport) (*Proxy, error) {
+	address, err := netip.ParseAddr(proxyConfig.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tunnel address: %w", err)
+	}
+	// The resolver is reached through the stack, so it cannot need one
+	if _, err := netip.ParseAddrPort(proxyConfig.DNS); err != nil {
+		return nil, fmt.Errorf("invalid DNS server %q, expected an IP address and port", proxyConfig.DNS)
+	}
+	if proxyConfig.SOCKS5 == "" && proxyConfig.HTTP == "" {
+		return nil, errors.New("neither the SOCKS5 nor the HTTP proxy is enabled")
+	}
+	if (proxyConfig.Username == "") != (proxyConfig.Password == "") {
+		return nil, errors.New("username and password must be set together")
+	}
+	if len(proxyConfig.Username) > 255 || len(proxyConfig.Password) > 255 {
+		return nil, errors.New("SOCKS5 credentials are at most 255 bytes")
+	}
+
+	localProxy := &Proxy{
+		stack:     NewStack(mtu, address, proxyConfig.DNS, transport),
+		socksAddr: proxyConfig.SOCKS5,
+		httpAddr:  proxyConfig.HTTP,
+		username:  proxyConfig.Username,
+		password:  proxyConfig.Password,
+	}
+	localProxy.forward = &httputil.ReverseProxy{
+		// The request already names the server, only hop-by-hop headers
+		// such as Proxy-Authorization are dropped
+		Rewrite:   func(*httputil.ProxyRequest) {},
+		Transport: &http.Transport{DialContext: localProxy.dial},
+	}
+	return localProxy, nil
+}
+
+// SetACL makes the stack filter packets in both directions through the
+// engine. It must be called before Start.
+func (localProxy *Proxy) SetACL(engine *acl.Engine) {
+	localProxy.stack.SetACL(engine)
+}
+
+// Start brings up the stack and the proxies. When it fails halfway, Stop
+// tears down what came up.
+func (localProxy *Proxy) Start() error {
+	if err := localProxy.stack.Start(); err != nil {
+		return err
+	}
+	localProxy.ctx, localProxy.cancel = context.WithCancel(context.Background())
+
+	if localProxy.socksAddr != "" {
+		listener, err := net.Listen("tcp", localProxy.socksAddr)
+		if err != nil {
+			return err
+		}
+		localProxy.socksListener = listener
+		localProxy.socksAddr = listener.Addr().String()
+		log.Printf("    [LOCAL PROXY] SOCKS5 proxy listening on %s", localProxy.socksAddr)
+
+		localProxy.wg.Add(1)
+		go localProxy.acceptSOCKS()
+	}
+
+	if localProxy.httpAddr != "" {
+		listener, err := net.Listen("tcp", localProxy.httpAddr)
+		if err != nil {
+			return err
+		}
+		localProxy.httpAddr = listener.Addr().String()
+		localProxy.httpServer = &http.Server{Handler: localProxy, ReadHeaderTimeout: handshakeTimeout}
+		log.Printf("    [LOCAL PROXY] HTTP proxy listening on %s", localProxy.httpAddr)
+
+		localProxy.wg.Add(1)
+		go func() {
+			defer localProxy.wg.Done()
+			if err := localProxy.httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("    [LOCAL PROXY] HTTP proxy failed: %v", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// SOCKS5Addr returns the address of the SOCKS5 proxy, with the port picked
+// once started
+func (localProxy *Proxy) SOCKS5Addr() string {
+	return localProxy.socksAddr
+}
+
+// HTTPAddr returns the address of the HTTP proxy, with the port picked once
+// started
+func (localProxy *Proxy) HTTPAddr() string {
+	return localProxy.httpAddr
+}
+
+// dial connects to address through the tunnel
+func (localProxy *Proxy) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	return localProxy.stack.DialContext(ctx, network, address)
+}
+
+// authorized checks the credentials a client sent
+func (localProxy *Proxy) authorized(username, password string) bool {
+	if localProxy.username == "" {
+		return true
+	}
+	usernameMatches := subtle.ConstantTimeCompare([]byte(username), []byte(localProxy.username))
+	passwordMatches := subtle.ConstantTimeCompare([]byte(password), []byte(localProxy.password))
+	return usernameMatches&passwordMatches == 1
+}
+
+// Stop closes the proxies and the stack, ending every connection through them
+func (localProxy *Proxy) Stop() error {
+	if localProxy.cancel != nil {
+		localProxy.cancel()
+	}
+	if localProxy.socksListener != nil {
+		localProxy.socksListener.Close()
+	}
+	if localProxy.httpServer != nil {
+		localProxy.httpServer.Close()
+	}
+	localProxy.wg.Wait()
+
+	return localProxy.stack.Stop()
+}
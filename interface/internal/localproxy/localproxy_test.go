@@ -0,0 +1,292 @@
+package localproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/config"
+	"thinkpol-vpn/interface/internal/netstack"
+	"thinkpol-vpn/interface/internal/util"
+
+	"golang.org/x/net/proxy"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+// pipe is one end of a transport that hands packets to the other end
+type pipe struct {
+	receive chan *protobuf.PacketV4
+	peer    *pipe
+}
+
+func newPipe() (*pipe, *pipe) {
+	a := &pipe{receive: make(chan *protobuf.PacketV4, 512)}
+	b := &pipe{receive: make(chan *protobuf.PacketV4, 512), peer: a}
+	a.peer = b
+	return a, b
+}
+
+func (p *pipe) SendToTransport(len int, buf []byte) {
+	length := int32(len)
+	select {
+	case p.peer.receive <- &protobuf.PacketV4{Length: &length, Buffer: buf[:len]}:
+	default:
+	}
+}
+
+func (p *pipe) ReceiveFromTransport() <-chan *protobuf.PacketV4 {
+	return p.receive
+}
+
+// serverAddr is the far end of the tunnel, where the test servers run
+var serverAddr = netip.MustParseAddr("10.0.0.9")
+
+// startProxy starts a proxy whose tunnel ends in a stack at serverAddr
+// running a TCP and UDP echo server on port 7 and an HTTP server on port 80
+func startProxy(t *testing.T) *Proxy {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(output) })
+
+	near, far := newPipe()
+
+	server := NewStack(1400, serverAddr, "10.0.0.9:53", far)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { server.Stop() })
+
+	echoAddr := tcpip.FullAddress{NIC: netstack.NICID, Addr: tcpip.AddrFromSlice(serverAddr.AsSlice()), Port: 7}
+	echo, err := gonet.ListenTCP(server.core.Stack(), echoAddr, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("ListenTCP: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	udpEcho, err := gonet.DialUDP(server.core.Stack(), &echoAddr, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("DialUDP: %v", err)
+	}
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, from, err := udpEcho.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			udpEcho.WriteTo(buffer[:n], from)
+		}
+	}()
+
+	web, err := gonet.ListenTCP(server.core.Stack(), tcpip.FullAddress{NIC: netstack.NICID, Addr: echoAddr.Addr, Port: 80}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("ListenTCP: %v", err)
+	}
+	go http.Serve(web, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s from %s", r.URL.Path, r.RemoteAddr)
+	}))
+
+	localProxy, err := New(config.LocalProxyConfig{
+		Address:  "10.0.0.1",
+		SOCKS5:   "127.0.0.1:0",
+		HTTP:     "127.0.0.1:0",
+		Username: "user",
+		Password: "secret",
+		DNS:      "10.0.0.9:53",
+	}, 1400, near)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := localProxy.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { localProxy.Stop() })
+	return localProxy
+}
+
+// checkEcho writes through conn and expects the same bytes back
+func checkEcho(t *testing.T, conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	message := strings.Repeat("through the tunnel ", 500)
+	go conn.Write([]byte(message))
+
+	echoed := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatalf("reading the echo: %v", err)
+	}
+	if string(echoed) != message {
+		t.Error("the echo differs from what was sent")
+	}
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	localProxy := startProxy(t)
+
+	dialer, err := proxy.SOCKS5("tcp", localProxy.SOCKS5Addr(), &proxy.Auth{User: "user", Password: "secret"}, proxy.Direct)
+	if err != nil {
+		t.Fatalf("SOCKS5: %v", err)
+	}
+	conn, err := dialer.Dial("tcp", "10.0.0.9:7")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn)
+
+	dialer, _ = proxy.SOCKS5("tcp", localProxy.SOCKS5Addr(), &proxy.Auth{User: "user", Password: "wrong"}, proxy.Direct)
+	if conn, err := dialer.Dial("tcp", "10.0.0.9:7"); err == nil {
+		conn.Close()
+		t.Error("connected with the wrong password")
+	}
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	localProxy := startProxy(t)
+
+	conn, err := net.Dial("tcp", localProxy.SOCKS5Addr())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	conn.Write([]byte{5, 1, socksUserPass})
+	conn.Write([]byte{1, 4, 'u', 's', 'e', 'r', 6, 's', 'e', 'c', 'r', 'e', 't'})
+	conn.Write([]byte{5, socksUDPAssociate, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+
+	answers := make([]byte, 4+3)
+	if _, err := io.ReadFull(reader, answers); err != nil {
+		t.Fatalf("reading the answers: %v", err)
+	}
+	if answers[1] != socksUserPass || answers[3] != 0 || answers[5] != socksSucceeded {
+		t.Fatalf("answers = %v, want the association granted", answers)
+	}
+	relayAddr, err := readAddress(reader)
+	if err != nil {
+		t.Fatalf("readAddress: %v", err)
+	}
+
+	relay, err := net.Dial("udp", relayAddr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer relay.Close()
+	relay.SetDeadline(time.Now().Add(5 * time.Second))
+
+	datagram := []byte{0, 0, 0, socksIPv4, 10, 0, 0, 9, 0, 7}
+	datagram = append(datagram, "ping"...)
+	if _, err := relay.Write(datagram); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	reply := make([]byte, 2048)
+	n, err := relay.Read(reply)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	from, err := readAddress(strings.NewReader(string(reply[3:n])))
+	if err != nil || from != "10.0.0.9:7" {
+		t.Errorf("reply from %q (%v), want 10.0.0.9:7", from, err)
+	}
+	if payload := string(reply[n-4 : n]); payload != "ping" {
+		t.Errorf("payload = %q, want ping", payload)
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	localProxy := startProxy(t)
+
+	conn, err := net.Dial("tcp", localProxy.HTTPAddr())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprint(conn, "CONNECT 10.0.0.9:7 HTTP/1.1\r\nHost: 10.0.0.9:7\r\nProxy-Authorization: Basic dXNlcjpzZWNyZXQ=\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse: %v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %s, want 200", response.Status)
+	}
+	checkEcho(t, &util.BufferedConn{Conn: conn, Reader: reader})
+}
+
+func TestHTTPForward(t *testing.T) {
+	localProxy := startProxy(t)
+
+	proxyURL := &url.URL{Scheme: "http", User: url.UserPassword("user", "secret"), Host: localProxy.HTTPAddr()}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+
+	response, err := client.Get("http://10.0.0.9/page")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if !strings.HasPrefix(string(body), "hello /page from 10.0.0.1:") {
+		t.Errorf("body = %q, want the page served to the tunnel address", body)
+	}
+
+	proxyURL.User = nil
+	client.Transport = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	response, err = client.Get("http://10.0.0.9/page")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("status without credentials = %s, want 407", response.Status)
+	}
+}
+
+func TestReadAddress(t *testing.T) {
+	for _, test := range []struct {
+		encoded []byte
+		want    string
+	}{
+		{[]byte{socksIPv4, 192, 0, 2, 1, 0x01, 0xbb}, "192.0.2.1:443"},
+		{append(append([]byte{socksDomain, 11}, "example.org"...), 0, 80), "example.org:80"},
+		{append(append([]byte{socksIPv6}, netip.MustParseAddr("2001:db8::1").AsSlice()...), 0, 53), "[2001:db8::1]:53"},
+	} {
+		got, err := readAddress(strings.NewReader(string(test.encoded)))
+		if err != nil || got != test.want {
+			t.Errorf("readAddress(%v) = %q, %v, want %q", test.encoded, got, err, test.want)
+		}
+	}
+
+	if _, err := readAddress(strings.NewReader("\x05")); err != errAddressType {
+		t.Errorf("readAddress of type 5 = %v, want %v", err, errAddressType)
+	}
+
+	encoded := appendAddress(nil, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 7})
+	if want := []byte{socksIPv4, 10, 0, 0, 9, 0, 7}; string(encoded) != string(want) {
+		t.Errorf("appendAddress = %v, want %v", encoded, want)
+	}
+}
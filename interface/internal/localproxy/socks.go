@@ -0,0 +1,337 @@
+package localproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"thinkpol-vpn/interface/internal/netstack"
+	"thinkpol-vpn/interface/internal/util"
+)
+
+// SOCKS5 (RFC 1928) methods, commands, address types and replies
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0x00
+	socksUserPass     = 0x02
+	socksNoAcceptable = 0xff
+
+	socksConnect      = 0x01
+	socksUDPAssociate = 0x03
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksGeneralFailure      = 0x01
+	socksHostUnreachable     = 0x04
+	socksCommandNotSupported = 0x07
+	socksAddressNotSupported = 0x08
+)
+
+// maxDatagramSize is the largest UDP datagram relayed, header included
+const maxDatagramSize = 64 * 1024
+
+// errAddressType is returned for addresses of an unknown type
+var errAddressType = errors.New("unsupported address type")
+
+// acceptSOCKS serves every connection to the SOCKS5 proxy
+func (localProxy *Proxy) acceptSOCKS() {
+	defer localProxy.wg.Done()
+
+	for {
+		conn, err := localProxy.socksListener.Accept()
+		if err != nil {
+			return
+		}
+		go localProxy.serveSOCKS(conn)
+	}
+}
+
+// serveSOCKS negotiates with a client and carries out its request
+func (localProxy *Proxy) serveSOCKS(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	reader := bufio.NewReader(conn)
+
+	if err := localProxy.authenticateSOCKS(reader, conn); err != nil {
+		log.Printf("    [LOCAL PROXY] SOCKS5 client %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return
+	}
+	if request[0] != socksVersion {
+		return
+	}
+	target, err := readAddress(reader)
+	if err != nil {
+		if errors.Is(err, errAddressType) {
+			writeReply(conn, socksAddressNotSupported, nil)
+		}
+		return
+	}
+
+	switch request[1] {
+	case socksConnect:
+		localProxy.connectSOCKS(&util.BufferedConn{Conn: conn, Reader: reader}, target)
+	case socksUDPAssociate:
+		localProxy.associateSOCKS(conn, reader)
+	default:
+		writeReply(conn, socksCommandNotSupported, nil)
+	}
+}
+
+// authenticateSOCKS picks the authentication method and, with username and
+// password authentication (RFC 1929), checks the credentials
+func (localProxy *Proxy) authenticateSOCKS(reader *bufio.Reader, conn net.Conn) error {
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(reader, greeting); err != nil {
+		return err
+	}
+	if greeting[0] != socksVersion {
+		return fmt.Errorf("unsupported SOCKS version %d", greeting[0])
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return err
+	}
+
+	method := byte(socksNoAuth)
+	if localProxy.username != "" {
+		method = socksUserPass
+	}
+	if !bytes.Contains(methods, []byte{method}) {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return errors.New("no acceptable authentication method offered")
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return err
+	}
+	if method == socksNoAuth {
+		return nil
+	}
+
+	readString := func() (string, error) {
+		size, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		value := make([]byte, size)
+		_, err = io.ReadFull(reader, value)
+		return string(value), err
+	}
+	if _, err := reader.ReadByte(); err != nil {
+		return err
+	}
+	username, err := readString()
+	if err != nil {
+		return err
+	}
+	password, err := readString()
+	if err != nil {
+		return err
+	}
+
+	if !localProxy.authorized(username, password) {
+		conn.Write([]byte{1, 1})
+		return errors.New("wrong username or password")
+	}
+	_, err = conn.Write([]byte{1, 0})
+	return err
+}
+
+// connectSOCKS connects the client to target through the tunnel
+func (localProxy *Proxy) connectSOCKS(conn net.Conn, target string) {
+	upstream, err := localProxy.dial(localProxy.ctx, "tcp", target)
+	if err != nil {
+		log.Printf("    [LOCAL PROXY] Failed to connect to %s: %v", target, err)
+		reply := byte(socksGeneralFailure)
+		var dnsError *net.DNSError
+		if errors.As(err, &dnsError) {
+			reply = socksHostUnreachable
+		}
+		writeReply(conn, reply, nil)
+		return
+	}
+
+	if err := writeReply(conn, socksSucceeded, upstream.LocalAddr()); err != nil {
+		upstream.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	netstack.Relay(conn, upstream, idleTimeout)
+}
+
+// associateSOCKS relays the UDP datagrams of the client through the tunnel
+// for as long as its connection stays open. Datagrams are only accepted
+// from the address the client connected from.
+func (localProxy *Proxy) associateSOCKS(conn net.Conn, reader *bufio.Reader) {
+	// The relay listens where the client reached the proxy
+	localAddr, _ := conn.LocalAddr().(*net.TCPAddr)
+	clientAddr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if localAddr == nil || clientAddr == nil {
+		writeReply(conn, socksGeneralFailure, nil)
+		return
+	}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP})
+	if err != nil {
+		writeReply(conn, socksGeneralFailure, nil)
+		return
+	}
+	defer client.Close()
+	tunnel, err := localProxy.stack.ListenUDP()
+	if err != nil {
+		writeReply(conn, socksGeneralFailure, nil)
+		return
+	}
+	defer tunnel.Close()
+
+	if err := writeReply(conn, socksSucceeded, client.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// The association ends with the connection
+	go func() {
+		io.Copy(io.Discard, reader)
+		client.Close()
+		tunnel.Close()
+	}()
+
+	// Replies go to where the client last sent from
+	var clientPort atomic.Pointer[net.UDPAddr]
+	go func() {
+		buffer := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := tunnel.ReadFrom(buffer)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			to := clientPort.Load()
+			if to == nil {
+				continue
+			}
+			datagram := appendAddress([]byte{0, 0, 0}, from)
+			client.WriteToUDP(append(datagram, buffer[:n]...), to)
+		}
+	}()
+
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := client.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(clientAddr.IP) {
+			continue
+		}
+
+		// Fragments are not supported and dropped, as RFC 1928 allows
+		datagram := bytes.NewReader(buffer[:n])
+		header := make([]byte, 3)
+		if _, err := io.ReadFull(datagram, header); err != nil || header[2] != 0 {
+			continue
+		}
+		target, err := readAddress(datagram)
+		if err != nil {
+			continue
+		}
+		addrs, port, err := localProxy.stack.resolve(localProxy.ctx, target)
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
+
+		clientPort.Store(from)
+		payload := buffer[n-datagram.Len() : n]
+		tunnel.WriteTo(payload, &net.UDPAddr{IP: addrs[0].AsSlice(), Port: int(port)})
+	}
+}
+
+// readAddress reads an address in SOCKS5 form and returns it as host:port
+func readAddress(reader io.Reader) (string, error) {
+	addressType := make([]byte, 1)
+	if _, err := io.ReadFull(reader, addressType); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch addressType[0] {
+	case socksIPv4, socksIPv6:
+		size := 4
+		if addressType[0] == socksIPv6 {
+			size = 16
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		host = addr.String()
+	case socksDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(reader, size); err != nil {
+			return "", err
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", errAddressType
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// appendAddress appends addr in SOCKS5 form, the unspecified IPv4 address
+// when it is not an IP address
+func appendAddress(b []byte, addr net.Addr) []byte {
+	var addrPort netip.AddrPort
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		addrPort = addr.AddrPort()
+	case *net.UDPAddr:
+		addrPort = addr.AddrPort()
+	}
+
+	ip := addrPort.Addr().Unmap()
+	switch {
+	case ip.Is4():
+		b = append(b, socksIPv4)
+	case ip.Is6():
+		b = append(b, socksIPv6)
+	default:
+		b = append(b, socksIPv4)
+		ip = netip.IPv4Unspecified()
+	}
+	b = append(b, ip.AsSlice()...)
+	return binary.BigEndian.AppendUint16(b, addrPort.Port())
+}
+
+// writeReply answers a request with the address bound for it
+func writeReply(conn net.Conn, reply byte, bound net.Addr) error {
+	_, err := conn.Write(appendAddress([]byte{socksVersion, reply, 0}, bound))
+	return err
+}
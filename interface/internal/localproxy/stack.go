@@ -0,0 +1,192 @@
+package localproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+
+	"thinkpol-vpn/interface/internal/acl"
+	"thinkpol-vpn/interface/internal/netstack"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// Stack is a userspace TCP/IP stack holding the tunnel address of this end.
+// Connections dialed on it leave as packets through the transport, the
+// replies coming back through the transport are delivered to them.
+type Stack struct {
+	core      *netstack.Core
+	transport netstack.Transport
+	mtu       int
+	address   netip.Addr
+	resolver  *net.Resolver
+	aclEngine *acl.Engine
+
+	// Cleanup management
+	controlMutex sync.Mutex
+	isRunning    bool
+}
+
+// NewStack creates a stack with the tunnel address, fed by the transport.
+// Host names are looked up with the DNS server at dns, through the tunnel.
+func NewStack(mtu int, address netip.Addr, dns string, transport netstack.Transport) *Stack {
+	netStack := &Stack{
+		mtu:       mtu,
+		address:   address.Unmap(),
+		transport: transport,
+		aclEngine: acl.NewEngine(),
+	}
+	netStack.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return netStack.DialContext(ctx, network, dns)
+		},
+	}
+	return netStack
+}
+
+// SetACL makes the stack filter packets in both directions through the
+// engine. It must be called before Start.
+func (netStack *Stack) SetACL(engine *acl.Engine) {
+	netStack.aclEngine = engine
+}
+
+// Start creates the stack and begins exchanging packets with the transport
+func (netStack *Stack) Start() error {
+	netStack.controlMutex.Lock()
+	defer netStack.controlMutex.Unlock()
+
+	if netStack.isRunning {
+		return fmt.Errorf("local proxy stack is already running")
+	}
+
+	core, err := netstack.NewCore(netStack.mtu, netStack.transport, netStack.aclEngine)
+	if err != nil {
+		return err
+	}
+	gvisorStack := core.Stack()
+
+	// Everything goes through the tunnel, from the tunnel address
+	protocolAddress := tcpip.ProtocolAddress{
+		Protocol:          netStack.protocol(),
+		AddressWithPrefix: tcpip.AddrFromSlice(netStack.address.AsSlice()).WithPrefix(),
+	}
+	if err := gvisorStack.AddProtocolAddress(netstack.NICID, protocolAddress, stack.AddressProperties{}); err != nil {
+		core.Close()
+		return fmt.Errorf("failed to add address %s: %s", netStack.address, err)
+	}
+	defaultRoute := header.IPv4EmptySubnet
+	if netStack.address.Is6() {
+		defaultRoute = header.IPv6EmptySubnet
+	}
+	gvisorStack.SetRouteTable([]tcpip.Route{{Destination: defaultRoute, NIC: netstack.NICID}})
+
+	log.Printf("    [LOCAL PROXY] Starting userspace stack on %s with MTU %d", netStack.address, netStack.mtu)
+
+	netStack.core = core
+	netStack.isRunning = true
+	core.Start()
+
+	return nil
+}
+
+// protocol returns the network protocol of the tunnel address
+func (netStack *Stack) protocol() tcpip.NetworkProtocolNumber {
+	if netStack.address.Is4() {
+		return ipv4.ProtocolNumber
+	}
+	return ipv6.ProtocolNumber
+}
+
+// DialContext connects to address through the tunnel. network is tcp or
+// udp, host names are looked up through the tunnel.
+func (netStack *Stack) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	addrs, port, err := netStack.resolve(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, addr := range addrs {
+		remote := tcpip.FullAddress{NIC: netstack.NICID, Addr: tcpip.AddrFromSlice(addr.AsSlice()), Port: port}
+		var conn net.Conn
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			conn, err = gonet.DialContextTCP(ctx, netStack.core.Stack(), remote, netStack.protocol())
+		case "udp", "udp4", "udp6":
+			conn, err = gonet.DialUDP(netStack.core.Stack(), nil, &remote, netStack.protocol())
+		default:
+			return nil, fmt.Errorf("unsupported network %q", network)
+		}
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// ListenUDP opens an unconnected UDP socket on the tunnel address, sending
+// to and receiving from any host through the tunnel
+func (netStack *Stack) ListenUDP() (net.PacketConn, error) {
+	return gonet.DialUDP(netStack.core.Stack(), &tcpip.FullAddress{NIC: netstack.NICID}, nil, netStack.protocol())
+}
+
+// resolve returns the addresses of the host in address that the tunnel
+// address can reach, and its port
+func (netStack *Stack) resolve(ctx context.Context, address string) ([]netip.Addr, uint16, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port %q", portString)
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		if addr.Is4() != netStack.address.Is4() {
+			return nil, 0, fmt.Errorf("%s is unreachable from %s", addr, netStack.address)
+		}
+		return []netip.Addr{addr}, uint16(port), nil
+	}
+
+	family := "ip4"
+	if netStack.address.Is6() {
+		family = "ip6"
+	}
+	addrs, err := netStack.resolver.LookupNetIP(ctx, family, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	return addrs, uint16(port), nil
+}
+
+// Stop tears down the stack and every connection dialed on it
+func (netStack *Stack) Stop() error {
+	netStack.controlMutex.Lock()
+	defer netStack.controlMutex.Unlock()
+
+	if !netStack.isRunning {
+		return fmt.Errorf("local proxy stack is not running")
+	}
+
+	netStack.core.Close()
+
+	netStack.isRunning = false
+	return nil
+}
@@ -0,0 +1,93 @@
+// Package mtu works out how large the packets inside the tunnel may be so
+// that they still fit the path to the peer once the transport wrapped them
+package mtu
+
+import (
+	"fmt"
+
+	"thinkpol-vpn/interface/internal/config"
+)
+
+const (
+	// DefaultPath is the path MTU assumed when none is configured, Ethernet
+	DefaultPath = 1500
+
+	// MinIPv4 is the smallest tunnel MTU accepted, every IPv4 host has to
+	// take datagrams of this size
+	MinIPv4 = 576
+	// MinIPv6 is the smallest MTU of a link carrying IPv6
+	MinIPv6 = 1280
+)
+
+// What the websocket transport puts around every packet. The larger variant
+// is counted where there are several.
+const (
+	// outerIP is the IPv6 header of the connection to the peer
+	outerIP = 40
+	// tcpHeader includes the timestamp option
+	tcpHeader = 32
+	// tlsRecord is a TLS 1.3 record header, the inner content type and the
+	// AEAD tag
+	tlsRecord = 22
+	// webSocketFrame is the header of a masked frame of up to 64 KiB
+	webSocketFrame = 8
+	// protobufFraming is the tags and lengths of a PacketV4 message of up
+	// to 64 KiB
+	protobufFraming = 8
+	// compressionFlag tells whether a message is compressed, compressed
+	// messages are only sent when smaller than the message itself
+	compressionFlag = 1
+)
+
+// WebSocketOverhead is the bytes the websocket transport adds to a packet on
+// its way to the peer
+const WebSocketOverhead = outerIP + tcpHeader + tlsRecord + webSocketFrame + protobufFraming + compressionFlag
+
+// What the CONNECT-IP transport puts around every packet besides the outer
+// IP, TCP and TLS headers, over HTTP/2 which adds more than HTTP/3 does
+const (
+	// http2Frame is the header of a DATA frame
+	http2Frame = 9
+	// datagramCapsule is the type and length of a DATAGRAM capsule of up to
+	// 16 KiB and the context ID of the datagram
+	datagramCapsule = 4
+)
+
+// ConnectIPOverhead is the bytes the CONNECT-IP transport adds to a packet on
+// its way to the peer
+const ConnectIPOverhead = outerIP + tcpHeader + tlsRecord + http2Frame + datagramCapsule
+
+// EthernetOverhead is the header TAP mode puts in front of every packet, the
+// frame carrying it. VLAN tags do not fit.
+const EthernetOverhead = 14
+
+// Resolve returns the tunnel MTU of the configuration: the configured one,
+// or the path MTU less the transport overhead
+func Resolve(mtuConfig config.MTUConfig, overhead int) (int, error) {
+	if mtuConfig.Tunnel != 0 {
+		if mtuConfig.Tunnel < MinIPv4 {
+			return 0, fmt.Errorf("tunnel MTU %d is below the minimum of %d", mtuConfig.Tunnel, MinIPv4)
+		}
+		return mtuConfig.Tunnel, nil
+	}
+
+	path := mtuConfig.Path
+	if path == 0 {
+		path = DefaultPath
+	}
+
+	tunnel := path - overhead
+	if tunnel < MinIPv4 {
+		return 0, fmt.Errorf("path MTU %d leaves %d bytes for tunnel packets, below the minimum of %d", path, tunnel, MinIPv4)
+	}
+	return tunnel, nil
+}
+
+// MSS returns the largest TCP segment that fits a packet of the MTU without
+// IP or TCP options
+func MSS(mtu int, ipVersion int) int {
+	if ipVersion == 6 {
+		return mtu - 60
+	}
+	return mtu - 40
+}
@@ -0,0 +1,173 @@
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/acl"
+	"thinkpol-vpn/interface/internal/packet"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+const (
+	// NICID is the identifier of the single NIC a core owns
+	NICID tcpip.NICID = 1
+
+	// outboundQueueSize is the number of packets the link endpoint buffers
+	// before the stack starts dropping them
+	outboundQueueSize = 512
+)
+
+// Core is a gVisor stack with a single NIC whose packets are exchanged with
+// the transport and filtered through the ACL. The forwarding Stack and the
+// local proxy stack build on it, each setting up its own addresses, routes
+// and protocol handlers.
+type Core struct {
+	stack     *stack.Stack
+	endpoint  *channel.Endpoint
+	transport Transport
+	aclEngine *acl.Engine
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewCore creates the stack and its NIC. Nothing is exchanged with the
+// transport until Start.
+func NewCore(mtu int, transport Transport, aclEngine *acl.Engine) (*Core, error) {
+	core := &Core{
+		transport: transport,
+		aclEngine: aclEngine,
+	}
+
+	core.stack = stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+	})
+	core.endpoint = channel.New(outboundQueueSize, uint32(mtu), "")
+
+	if err := core.stack.CreateNIC(NICID, core.endpoint); err != nil {
+		core.stack.Close()
+		return nil, fmt.Errorf("failed to create NIC: %s", err)
+	}
+
+	return core, nil
+}
+
+// Stack returns the gVisor stack, to set up and to dial or listen on
+func (core *Core) Stack() *stack.Stack {
+	return core.stack
+}
+
+// Start begins exchanging packets with the transport
+func (core *Core) Start() {
+	core.ctx, core.cancel = context.WithCancel(context.Background())
+
+	core.wg.Add(2)
+	go core.processIncomingPackets()
+	go core.processOutgoingPackets()
+}
+
+// Close stops exchanging packets and tears down the stack with every
+// connection on it
+func (core *Core) Close() {
+	if core.cancel != nil {
+		core.cancel()
+		core.wg.Wait()
+	}
+
+	core.stack.Close()
+	core.endpoint.Close()
+	core.stack.Wait()
+}
+
+// processIncomingPackets injects packets received from the transport into the stack
+func (core *Core) processIncomingPackets() {
+	defer core.wg.Done()
+
+	for {
+		var packet *protobuf.PacketV4
+
+		select {
+		case <-core.ctx.Done():
+			log.Println("    [NETSTACK] Stopping incoming packet processing")
+			return
+		case packet = <-core.transport.ReceiveFromTransport():
+		}
+
+		data := packet.GetBuffer()
+		if len(data) == 0 {
+			continue
+		}
+
+		if !core.allow(acl.Inbound, data) {
+			continue
+		}
+
+		var protocol tcpip.NetworkProtocolNumber
+		switch header.IPVersion(data) {
+		case header.IPv4Version:
+			protocol = header.IPv4ProtocolNumber
+		case header.IPv6Version:
+			protocol = header.IPv6ProtocolNumber
+		default:
+			log.Printf("    [NETSTACK] Dropping packet with unknown IP version")
+			continue
+		}
+
+		packetBuffer := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Payload: buffer.MakeWithData(data),
+		})
+		core.endpoint.InjectInbound(protocol, packetBuffer)
+		packetBuffer.DecRef()
+	}
+}
+
+// processOutgoingPackets sends packets produced by the stack to the transport
+func (core *Core) processOutgoingPackets() {
+	defer core.wg.Done()
+
+	for {
+		packetBuffer := core.endpoint.ReadContext(core.ctx)
+		if packetBuffer == nil {
+			log.Println("    [NETSTACK] Stopping outgoing packet processing")
+			return
+		}
+
+		// The transport keeps a reference to the buffer it is given, so copy
+		// the packet out of the stack-owned view before releasing it
+		view := packetBuffer.ToView()
+		data := make([]byte, view.Size())
+		copy(data, view.AsSlice())
+		view.Release()
+		packetBuffer.DecRef()
+
+		if !core.allow(acl.Outbound, data) {
+			continue
+		}
+
+		core.transport.SendToTransport(len(data), data)
+	}
+}
+
+// allow runs a packet through the ACL. Packets leaving through the tunnel
+// are outbound, as on the TUN interface.
+func (core *Core) allow(direction acl.Direction, data []byte) bool {
+	// Packets that do not parse are left to the default action
+	parsed, _ := packet.Parse(data)
+	return core.aclEngine.Allow(direction, parsed)
+}
@@ -0,0 +1,189 @@
+package netstack
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	// dialTimeout bounds how long a forwarded flow waits for the real socket
+	dialTimeout = 10 * time.Second
+
+	// udpIdleTimeout closes forwarded UDP flows that saw no traffic for this long
+	udpIdleTimeout = 60 * time.Second
+)
+
+// forwardTCP re-originates a TCP connection accepted by the stack as a host socket
+func (netStack *Stack) forwardTCP(request *tcp.ForwarderRequest) {
+	id := request.ID()
+	destination := endpointAddress(id)
+
+	if !allowedDestination(id) {
+		log.Printf("    [NETSTACK] Refusing tcp %s:%d -> %s, the host's own networks are not reachable", id.RemoteAddress, id.RemotePort, destination)
+		request.Complete(true)
+		return
+	}
+
+	upstream, err := netStack.dial("tcp", destination)
+	if err != nil {
+		log.Printf("    [NETSTACK] Failed to dial tcp %s: %v", destination, err)
+		request.Complete(true)
+		return
+	}
+
+	var waitQueue waiter.Queue
+	endpoint, tcpErr := request.CreateEndpoint(&waitQueue)
+	if tcpErr != nil {
+		log.Printf("    [NETSTACK] Failed to create tcp endpoint for %s: %s", destination, tcpErr)
+		upstream.Close()
+		request.Complete(true)
+		return
+	}
+	request.Complete(false)
+
+	log.Printf("    [NETSTACK] Forwarding tcp %s:%d -> %s", id.RemoteAddress, id.RemotePort, destination)
+
+	Relay(gonet.NewTCPConn(&waitQueue, endpoint), upstream, 0)
+}
+
+// forwardUDP re-originates a UDP flow seen by the stack as a host socket
+func (netStack *Stack) forwardUDP(request *udp.ForwarderRequest) {
+	id := request.ID()
+	destination := endpointAddress(id)
+
+	if !allowedDestination(id) {
+		log.Printf("    [NETSTACK] Refusing udp %s:%d -> %s, the host's own networks are not reachable", id.RemoteAddress, id.RemotePort, destination)
+		return
+	}
+
+	var waitQueue waiter.Queue
+	endpoint, tcpErr := request.CreateEndpoint(&waitQueue)
+	if tcpErr != nil {
+		log.Printf("    [NETSTACK] Failed to create udp endpoint for %s: %s", destination, tcpErr)
+		return
+	}
+	local := gonet.NewUDPConn(&waitQueue, endpoint)
+
+	// The UDP forwarder calls us synchronously from the packet path,
+	// so the dial and the relay must not block it
+	go func() {
+		upstream, err := netStack.dial("udp", destination)
+		if err != nil {
+			log.Printf("    [NETSTACK] Failed to dial udp %s: %v", destination, err)
+			local.Close()
+			return
+		}
+
+		log.Printf("    [NETSTACK] Forwarding udp %s:%d -> %s", id.RemoteAddress, id.RemotePort, destination)
+
+		Relay(local, upstream, udpIdleTimeout)
+	}()
+}
+
+// dial opens a host socket, giving up early if the stack is stopped
+func (netStack *Stack) dial(network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(netStack.ctx, dialTimeout)
+	defer cancel()
+
+	return netStack.dialer.DialContext(ctx, network, address)
+}
+
+// endpointAddress returns the address the tunnel client was trying to reach.
+// From the stack's point of view that is the local end of the flow.
+func endpointAddress(id stack.TransportEndpointID) string {
+	return net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort)))
+}
+
+// allowedDestination reports whether a flow may be re-originated on the host.
+// Loopback, link-local (cloud metadata services among them), unspecified and
+// multicast destinations would reach the host itself or its local link
+// rather than the internet, so tunnel peers are kept away from them.
+func allowedDestination(id stack.TransportEndpointID) bool {
+	addr, ok := netip.AddrFromSlice(id.LocalAddress.AsSlice())
+	if !ok {
+		return false
+	}
+	return destinationAllowed(addr.Unmap())
+}
+
+// destinationAllowed is allowedDestination for an address
+func destinationAllowed(addr netip.Addr) bool {
+	switch {
+	case addr.IsLoopback(),
+		addr.IsUnspecified(),
+		addr.IsMulticast(),
+		addr.IsLinkLocalUnicast(),
+		addr.IsInterfaceLocalMulticast(),
+		addr.IsLinkLocalMulticast():
+		return false
+	case addr == netip.AddrFrom4([4]byte{255, 255, 255, 255}):
+		return false
+	}
+	return true
+}
+
+// Relay copies data between both connections until either side is done.
+// A non-zero idleTimeout closes the pair once no data flowed either way for
+// that long, a flow that only goes one way is not idle.
+func Relay(local, upstream net.Conn, idleTimeout time.Duration) {
+	var once sync.Once
+	closeBoth := func() {
+		local.Close()
+		upstream.Close()
+	}
+
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		defer once.Do(closeBoth)
+
+		if idleTimeout == 0 {
+			io.Copy(dst, src)
+			return
+		}
+
+		buffer := make([]byte, 64*1024)
+		for {
+			src.SetReadDeadline(time.Now().Add(idleTimeout))
+			n, err := src.Read(buffer)
+			if n > 0 {
+				lastActive.Store(time.Now().UnixNano())
+				if _, err := dst.Write(buffer[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				// The other direction may have kept the pair busy
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() && time.Since(time.Unix(0, lastActive.Load())) < idleTimeout {
+					continue
+				}
+				return
+			}
+		}
+	}
+
+	go pipe(upstream, local)
+	go pipe(local, upstream)
+
+	wg.Wait()
+}
@@ -0,0 +1,175 @@
+package netstack
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"thinkpol-vpn/interface/api/protobuf"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// fakeTransport hands the stack the packets a test injects and collects the
+// packets it sends back
+type fakeTransport struct {
+	receive chan *protobuf.PacketV4
+	sent    chan []byte
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{
+		receive: make(chan *protobuf.PacketV4, 16),
+		sent:    make(chan []byte, 16),
+	}
+}
+
+func (transport *fakeTransport) SendToTransport(len int, buf []byte) {
+	transport.sent <- buf[:len]
+}
+
+func (transport *fakeTransport) ReceiveFromTransport() <-chan *protobuf.PacketV4 {
+	return transport.receive
+}
+
+// tcpSYN builds an IPv4 TCP SYN from 10.0.0.2:40000 to destination
+func tcpSYN(destination netip.AddrPort) []byte {
+	source := tcpip.AddrFrom4([4]byte{10, 0, 0, 2})
+	target := tcpip.AddrFrom4(destination.Addr().As4())
+
+	data := make([]byte, header.IPv4MinimumSize+header.TCPMinimumSize)
+	ip := header.IPv4(data)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(data)),
+		TTL:         64,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     source,
+		DstAddr:     target,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	segment := header.TCP(data[header.IPv4MinimumSize:])
+	segment.Encode(&header.TCPFields{
+		SrcPort:    40000,
+		DstPort:    destination.Port(),
+		SeqNum:     1,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      header.TCPFlagSyn,
+		WindowSize: 65535,
+	})
+	sum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, source, target, uint16(len(segment)))
+	segment.SetChecksum(^checksum.Checksum(segment, sum))
+	return data
+}
+
+func TestDestinationAllowed(t *testing.T) {
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"1.1.1.1", true},
+		{"10.1.2.3", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"127.8.8.8", false},
+		{"::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.251", false},
+		{"ff02::1", false},
+		{"255.255.255.255", false},
+	}
+
+	for _, test := range tests {
+		if allowed := destinationAllowed(netip.MustParseAddr(test.addr)); allowed != test.allowed {
+			t.Errorf("destinationAllowed(%s) = %v, want %v", test.addr, allowed, test.allowed)
+		}
+	}
+}
+
+func TestLinkLocalIsRefused(t *testing.T) {
+	transport := newFakeTransport()
+	netStack := NewStack(1500, transport)
+
+	// Every socket the stack opens on the host is reported instead of opened
+	dialed := make(chan string, 1)
+	netStack.dialer.Control = func(network, address string, conn syscall.RawConn) error {
+		dialed <- address
+		return errors.New("dialing is not allowed in tests")
+	}
+
+	if err := netStack.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer netStack.Stop()
+
+	transport.receive <- &protobuf.PacketV4{Buffer: tcpSYN(netip.MustParseAddrPort("169.254.169.254:80"))}
+
+	select {
+	case reply := <-transport.sent:
+		segment := header.TCP(header.IPv4(reply).Payload())
+		if segment.Flags()&header.TCPFlagRst == 0 {
+			t.Errorf("reply flags = %s, want a reset", segment.Flags())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply to a SYN for a link-local address")
+	}
+
+	select {
+	case address := <-dialed:
+		t.Errorf("the stack dialed %s for a tunnel peer", address)
+	default:
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	client, local := net.Pipe()
+	upstream, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		Relay(local, upstream, 100*time.Millisecond)
+		close(done)
+	}()
+
+	// Data flowing one way only keeps the pair open past the timeout
+	go func() {
+		buffer := make([]byte, 16)
+		for {
+			if _, err := server.Read(buffer); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatalf("Write after %d pings: %v", i, err)
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	select {
+	case <-done:
+		t.Fatal("Relay returned while data was flowing")
+	default:
+	}
+
+	// With nothing flowing either way the pair is closed
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Relay did not return after the idle timeout")
+	}
+	if _, err := client.Write([]byte("ping")); err == nil {
+		t.Error("Write after the idle timeout succeeded, want a closed connection")
+	}
+}
@@ -0,0 +1,131 @@
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/acl"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+const (
+	// tcpReceiveWindow is the receive window of forwarded TCP connections,
+	// zero picks the stack default
+	tcpReceiveWindow = 0
+
+	// tcpMaxInFlight caps the number of half-open forwarded connections
+	tcpMaxInFlight = 2048
+)
+
+// Transport carries tunnel packets to and from the peers, either the
+// websocket transport of a single peer or the gateway serving many clients
+type Transport interface {
+	SendToTransport(len int, buf []byte)
+	ReceiveFromTransport() <-chan *protobuf.PacketV4
+}
+
+// Stack terminates tunnel packets in a userspace TCP/IP stack and
+// re-originates the flows they carry as ordinary sockets on the host.
+// It needs no TUN device, routes or NAT rules, so it can run unprivileged.
+type Stack struct {
+	core      *Core
+	transport Transport
+	mtu       int
+	dialer    net.Dialer
+	aclEngine *acl.Engine
+
+	// Cleanup management, ctx ends the dials of forwarded flows
+	ctx          context.Context
+	cancel       context.CancelFunc
+	controlMutex sync.Mutex
+	isRunning    bool
+}
+
+// NewStack creates a new userspace stack fed by the transport
+func NewStack(mtu int, transport Transport) *Stack {
+	return &Stack{
+		mtu:       mtu,
+		transport: transport,
+		aclEngine: acl.NewEngine(),
+	}
+}
+
+// SetACL makes the stack filter packets in both directions through the
+// engine. It must be called before Start.
+func (netStack *Stack) SetACL(engine *acl.Engine) {
+	netStack.aclEngine = engine
+}
+
+// Start creates the stack and begins exchanging packets with the transport
+func (netStack *Stack) Start() error {
+	netStack.controlMutex.Lock()
+	defer netStack.controlMutex.Unlock()
+
+	if netStack.isRunning {
+		return fmt.Errorf("netstack is already running")
+	}
+
+	core, err := NewCore(netStack.mtu, netStack.transport, netStack.aclEngine)
+	if err != nil {
+		return err
+	}
+	gvisorStack := core.Stack()
+
+	// Accept packets for any destination and answer from any source so the
+	// stack can impersonate every remote host the tunnel talks to
+	if err := gvisorStack.SetPromiscuousMode(NICID, true); err != nil {
+		core.Close()
+		return fmt.Errorf("failed to enable promiscuous mode: %s", err)
+	}
+	if err := gvisorStack.SetSpoofing(NICID, true); err != nil {
+		core.Close()
+		return fmt.Errorf("failed to enable spoofing: %s", err)
+	}
+
+	gvisorStack.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: NICID},
+		{Destination: header.IPv6EmptySubnet, NIC: NICID},
+	})
+
+	tcpForwarder := tcp.NewForwarder(gvisorStack, tcpReceiveWindow, tcpMaxInFlight, netStack.forwardTCP)
+	gvisorStack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+
+	udpForwarder := udp.NewForwarder(gvisorStack, netStack.forwardUDP)
+	gvisorStack.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
+	netStack.ctx, netStack.cancel = context.WithCancel(context.Background())
+	netStack.core = core
+
+	log.Printf("    [NETSTACK] Starting userspace stack with MTU %d", netStack.mtu)
+
+	netStack.isRunning = true
+	core.Start()
+
+	return nil
+}
+
+// Stop tears down the stack and every connection it forwards
+func (netStack *Stack) Stop() error {
+	netStack.controlMutex.Lock()
+	defer netStack.controlMutex.Unlock()
+
+	if !netStack.isRunning {
+		return fmt.Errorf("netstack is not running")
+	}
+
+	log.Println("    [NETSTACK] Stopping userspace stack")
+
+	netStack.cancel()
+	netStack.core.Close()
+
+	netStack.isRunning = false
+	return nil
+}
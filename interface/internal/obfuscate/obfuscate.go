@@ -0,0 +1,199 @@
+// Package obfuscate makes the websocket transport harder to tell apart from
+// ordinary web traffic: random padding hides packet sizes, jitter hides their
+// timing, and the path, headers and hosts are those of a regular site
+package obfuscate
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	mathrand "math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/config"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultPath is where the transport is served when no path is configured
+const DefaultPath = "/transport"
+
+// MaxPadding bounds the configured padding, it comes off the tunnel MTU
+const MaxPadding = 1024
+
+// Settings are how the transport disguises itself. The zero value serves the
+// default path and changes nothing else.
+type Settings struct {
+	path       string
+	headers    http.Header
+	maxPadding int
+	jitter     time.Duration
+
+	// host is the only Host the transport answers on when fronted, sni is
+	// the front domain clients name in the TLS handshake
+	host string
+	sni  string
+}
+
+// New validates the obfuscation configuration
+func New(obfuscationConfig config.ObfuscationConfig) (Settings, error) {
+	settings := Settings{
+		path:       obfuscationConfig.Path,
+		headers:    make(http.Header),
+		maxPadding: obfuscationConfig.MaxPadding,
+		jitter:     time.Duration(obfuscationConfig.JitterMS) * time.Millisecond,
+		host:       strings.ToLower(obfuscationConfig.Fronting.Host),
+		sni:        obfuscationConfig.Fronting.SNI,
+	}
+
+	if settings.path == "" {
+		settings.path = DefaultPath
+	}
+	if !strings.HasPrefix(settings.path, "/") {
+		return Settings{}, fmt.Errorf("transport path %q must start with /", settings.path)
+	}
+	if settings.maxPadding < 0 || settings.maxPadding > MaxPadding {
+		return Settings{}, fmt.Errorf("max padding must be between 0 and %d bytes", MaxPadding)
+	}
+	if settings.jitter < 0 {
+		return Settings{}, fmt.Errorf("jitter must not be negative")
+	}
+	if settings.sni != "" && settings.host == "" {
+		return Settings{}, fmt.Errorf("fronting needs the host behind the front")
+	}
+
+	for name, value := range obfuscationConfig.Headers {
+		settings.headers.Set(name, value)
+	}
+
+	return settings, nil
+}
+
+// Path returns where the transport is served
+func (settings Settings) Path() string {
+	if settings.path == "" {
+		return DefaultPath
+	}
+	return settings.path
+}
+
+// Header returns a copy of the headers every response carries, to add the
+// handshake's own headers to
+func (settings Settings) Header() http.Header {
+	if settings.headers == nil {
+		return make(http.Header)
+	}
+	return settings.headers.Clone()
+}
+
+// Overhead is the most bytes padding adds to a packet: the padding, its tag
+// and its length
+func (settings Settings) Overhead() int {
+	if settings.maxPadding == 0 {
+		return 0
+	}
+	return settings.maxPadding + 3
+}
+
+// Pad returns a copy of the packet carrying up to the maximum padding of
+// random bytes, or the packet itself when padding is off. Random bytes do not
+// compress, so compression cannot give the real size away.
+func (settings Settings) Pad(packet *protobuf.PacketV4) *protobuf.PacketV4 {
+	if settings.maxPadding == 0 {
+		return packet
+	}
+
+	padding := make([]byte, mathrand.IntN(settings.maxPadding+1))
+	rand.Read(padding)
+	return &protobuf.PacketV4{
+		Length:  packet.Length,
+		Buffer:  packet.Buffer,
+		Padding: padding,
+	}
+}
+
+// PadFrame is Pad for the Ethernet frames of TAP mode
+func (settings Settings) PadFrame(frame *protobuf.EthernetFrame) *protobuf.EthernetFrame {
+	if settings.maxPadding == 0 {
+		return frame
+	}
+
+	padding := make([]byte, mathrand.IntN(settings.maxPadding+1))
+	rand.Read(padding)
+	return &protobuf.EthernetFrame{
+		Frame:   frame.Frame,
+		Padding: padding,
+	}
+}
+
+// Delay waits a random time up to the jitter before a packet is sent. It
+// returns false when ctx ended first.
+func (settings Settings) Delay(ctx context.Context) bool {
+	if settings.jitter <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(mathrand.N(settings.jitter + 1))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Handler serves the transport. Requests that are not websocket upgrades, or
+// that name another host when fronted, get the same 404 as any unknown page
+// so probing the server does not reveal the transport.
+func (settings Settings) Handler(transport http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range settings.headers {
+			w.Header()[name] = values
+		}
+
+		if !websocket.IsWebSocketUpgrade(r) || !settings.hostMatches(r.Host) {
+			http.NotFound(w, r)
+			return
+		}
+		transport(w, r)
+	})
+}
+
+// hostMatches reports whether a request for host is meant for the transport
+func (settings Settings) hostMatches(host string) bool {
+	if settings.host == "" {
+		return true
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return strings.EqualFold(host, settings.host)
+}
+
+// Dialer returns a copy of base and the handshake header a client connects
+// with. When fronted the TLS handshake names the front domain and the Host
+// header this server, so the CDN in between passes the request on to it.
+func (settings Settings) Dialer(base *websocket.Dialer) (*websocket.Dialer, http.Header) {
+	dialer := *base
+	header := make(http.Header)
+
+	if settings.sni != "" {
+		tlsConfig := &tls.Config{}
+		if base.TLSClientConfig != nil {
+			tlsConfig = base.TLSClientConfig.Clone()
+		}
+		tlsConfig.ServerName = settings.sni
+		dialer.TLSClientConfig = tlsConfig
+	}
+	if settings.host != "" {
+		header.Set("Host", settings.host)
+	}
+
+	return &dialer, header
+}
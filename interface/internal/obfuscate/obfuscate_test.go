@@ -0,0 +1,108 @@
+package obfuscate
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/config"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestPad(t *testing.T) {
+	settings, err := New(config.ObfuscationConfig{MaxPadding: 64})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	length := int32(4)
+	packet := &protobuf.PacketV4{Length: &length, Buffer: []byte{1, 2, 3, 4}}
+	sizes := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		message, err := proto.Marshal(settings.Pad(packet))
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		if overhead := len(message) - proto.Size(packet); overhead > settings.Overhead() {
+			t.Fatalf("padding added %d bytes, more than the overhead of %d", overhead, settings.Overhead())
+		}
+		sizes[len(message)] = true
+
+		received := &protobuf.PacketV4{}
+		if err := proto.Unmarshal(message, received); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if string(received.GetBuffer()) != string(packet.GetBuffer()) {
+			t.Fatal("padding changed the packet")
+		}
+	}
+	if len(sizes) < 10 {
+		t.Errorf("only %d different message sizes in 100 packets", len(sizes))
+	}
+	if packet.Padding != nil {
+		t.Error("Pad modified the original packet")
+	}
+}
+
+// TestFronting connects through TLS naming the front domain while the Host
+// header names the server, and checks that probes get a plain 404
+func TestFronting(t *testing.T) {
+	settings, err := New(config.ObfuscationConfig{
+		Path:     "/api/v1/stream",
+		Headers:  map[string]string{"Server": "nginx"},
+		Fronting: config.FrontingConfig{Host: "hidden.example", SNI: "example.com"},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	var serverName, host string
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewTLSServer(settings.Handler(func(w http.ResponseWriter, r *http.Request) {
+		serverName, host = r.TLS.ServerName, r.Host
+		conn, err := upgrader.Upgrade(w, r, settings.Header())
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer server.Close()
+
+	// The test certificate is valid for example.com, the front domain
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	dialer, header := settings.Dialer(&websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: roots}})
+
+	url := "wss" + strings.TrimPrefix(server.URL, "https") + settings.Path()
+	conn, response, err := dialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.Close()
+	if serverName != "example.com" || host != "hidden.example" {
+		t.Errorf("SNI %q and Host %q, want example.com and hidden.example", serverName, host)
+	}
+	if response.Header.Get("Server") != "nginx" {
+		t.Errorf("handshake Server header = %q, want nginx", response.Header.Get("Server"))
+	}
+
+	// Another host behind the same front does not get the transport
+	if _, response, err := dialer.Dial(url, nil); err == nil || response.StatusCode != http.StatusNotFound {
+		t.Errorf("dialing without the fronted host was not refused with a 404")
+	}
+
+	probe, err := server.Client().Get(server.URL + settings.Path())
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	probe.Body.Close()
+	if probe.StatusCode != http.StatusNotFound || probe.Header.Get("Server") != "nginx" {
+		t.Errorf("probe got %d from %q, want a 404 from nginx", probe.StatusCode, probe.Header.Get("Server"))
+	}
+}
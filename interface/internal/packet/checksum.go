@@ -0,0 +1,83 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// ErrChecksum is returned for a packet whose checksum does not match its contents
+var ErrChecksum = errors.New("bad checksum")
+
+// Sum adds data to a running ones' complement sum
+func Sum(data []byte, initial uint32) uint32 {
+	sum := initial
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	return sum
+}
+
+// Checksum folds a running sum into the Internet checksum of RFC 1071
+func Checksum(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// PseudoHeaderSum returns the sum of the pseudo header TCP, UDP and ICMPv6
+// checksums cover, for a transport segment of length bytes
+func PseudoHeaderSum(src, dst netip.Addr, protocol Protocol, length int) uint32 {
+	sum := Sum(src.AsSlice(), 0)
+	sum = Sum(dst.AsSlice(), sum)
+	sum += uint32(protocol)
+	sum += uint32(length>>16) + uint32(length&0xffff)
+	return sum
+}
+
+// VerifyChecksums checks the IPv4 header checksum and the TCP, UDP or ICMP
+// checksum. Transport checksums of fragments cannot be checked on their own
+// and are skipped, as are IPv4 UDP datagrams sent without a checksum.
+func (packet *Packet) VerifyChecksums() error {
+	if packet.Version == 4 {
+		if Checksum(Sum(packet.data[:packet.HeaderLength], 0)) != 0 {
+			return fmt.Errorf("IPv4 header: %w", ErrChecksum)
+		}
+	}
+
+	if packet.IsFragment() {
+		return nil
+	}
+
+	var sum uint32
+	switch {
+	case packet.TCP != nil:
+		sum = PseudoHeaderSum(packet.Src, packet.Dst, TCP, len(packet.Payload))
+	case packet.UDP != nil:
+		if packet.Version == 4 && packet.UDP.Checksum == 0 {
+			return nil
+		}
+		sum = PseudoHeaderSum(packet.Src, packet.Dst, UDP, int(packet.UDP.Length))
+		if Checksum(Sum(packet.Payload[:packet.UDP.Length], sum)) != 0 {
+			return fmt.Errorf("%s: %w", packet.Protocol, ErrChecksum)
+		}
+		return nil
+	case packet.ICMP != nil && packet.Version == 6:
+		sum = PseudoHeaderSum(packet.Src, packet.Dst, ICMPv6, len(packet.Payload))
+	case packet.ICMP != nil:
+		sum = 0
+	default:
+		return nil
+	}
+
+	if Checksum(Sum(packet.Payload, sum)) != 0 {
+		return fmt.Errorf("%s: %w", packet.Protocol, ErrChecksum)
+	}
+	return nil
+}
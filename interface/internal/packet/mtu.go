@@ -0,0 +1,165 @@
+package packet
+
+import "encoding/binary"
+
+const (
+	tcpOptionEnd = 0
+	tcpOptionNOP = 1
+	tcpOptionMSS = 2
+
+	// ICMP types of the errors sent for packets too big for the tunnel
+	icmpDestinationUnreachable = 3
+	icmpFragmentationNeeded    = 4
+	icmpv6PacketTooBig         = 2
+
+	// ICMP errors are kept within the datagram size every host takes, RFC
+	// 1812 section 4.3.2.3 and RFC 4443 section 2.4
+	maxICMPv4Error = 576
+	maxICMPv6Error = 1280
+
+	// errorTTL is the TTL or hop limit of generated ICMP errors
+	errorTTL = 64
+)
+
+// ClampMSS lowers the MSS option of a TCP SYN to mss and fixes the checksum.
+// It reports whether the packet was changed, the packet is modified in place.
+func (packet *Packet) ClampMSS(mss int) bool {
+	if packet.TCP == nil || !packet.TCP.Flags.Has(SYN) || packet.IsFragment() {
+		return false
+	}
+
+	options := packet.TCP.Options
+	for i := 0; i < len(options); {
+		kind := options[i]
+		if kind == tcpOptionEnd {
+			return false
+		}
+		if kind == tcpOptionNOP {
+			i++
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			return false
+		}
+		length := int(options[i+1])
+
+		if kind == tcpOptionMSS && length == 4 {
+			if int(binary.BigEndian.Uint16(options[i+2:i+4])) <= mss {
+				return false
+			}
+			binary.BigEndian.PutUint16(options[i+2:i+4], uint16(mss))
+			packet.updateTCPChecksum()
+			return true
+		}
+		i += length
+	}
+	return false
+}
+
+// updateTCPChecksum recomputes the checksum of the TCP segment
+func (packet *Packet) updateTCPChecksum() {
+	segment := packet.Payload
+	binary.BigEndian.PutUint16(segment[16:18], 0)
+	sum := PseudoHeaderSum(packet.Src, packet.Dst, TCP, len(segment))
+	checksum := Checksum(Sum(segment, sum))
+	binary.BigEndian.PutUint16(segment[16:18], checksum)
+	packet.TCP.Checksum = checksum
+}
+
+// TooBig builds the ICMP error telling the sender of the packet to send
+// packets of at most mtu bytes: "fragmentation needed" for IPv4 and "Packet
+// Too Big" for IPv6. The error appears to come from the destination. It
+// returns nil for packets that must not get an error, IPv4 packets that may
+// be fragmented, non-first fragments and ICMP errors.
+func (packet *Packet) TooBig(mtu int) []byte {
+	if packet.FragmentOffset != 0 || packet.isICMPError() {
+		return nil
+	}
+
+	if packet.Version == 6 {
+		if mtu < maxICMPv6Error {
+			// IPv6 links carry at least 1280 bytes, nothing smaller can be asked for
+			return nil
+		}
+		return packet.packetTooBig(mtu)
+	}
+	if !packet.DontFragment {
+		return nil
+	}
+	return packet.fragmentationNeeded(mtu)
+}
+
+// isICMPError reports whether the packet is an ICMP error message, which
+// never gets an error in response
+func (packet *Packet) isICMPError() bool {
+	if packet.ICMP == nil {
+		return false
+	}
+	if packet.Version == 6 {
+		return packet.ICMP.Type < 128
+	}
+	switch packet.ICMP.Type {
+	case 0, 8, 13, 14:
+		// Echo and timestamp messages
+		return false
+	}
+	return true
+}
+
+// quote returns as much of the packet as an ICMP error of limit bytes with
+// headers bytes of headers can carry
+func (packet *Packet) quote(limit, headers int) []byte {
+	quoted := packet.data
+	if len(quoted) > limit-headers {
+		quoted = quoted[:limit-headers]
+	}
+	return quoted
+}
+
+// fragmentationNeeded builds an ICMP destination unreachable message with
+// the next-hop MTU, RFC 1191 section 4
+func (packet *Packet) fragmentationNeeded(mtu int) []byte {
+	quoted := packet.quote(maxICMPv4Error, ipv4MinHeaderLength+icmpHeaderLength)
+	reply := make([]byte, ipv4MinHeaderLength+icmpHeaderLength+len(quoted))
+
+	header := reply[:ipv4MinHeaderLength]
+	header[0] = 0x45
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(reply)))
+	header[8] = errorTTL
+	header[9] = byte(ICMP)
+	copy(header[12:16], packet.Dst.AsSlice())
+	copy(header[16:20], packet.Src.AsSlice())
+	binary.BigEndian.PutUint16(header[10:12], Checksum(Sum(header, 0)))
+
+	message := reply[ipv4MinHeaderLength:]
+	message[0] = icmpDestinationUnreachable
+	message[1] = icmpFragmentationNeeded
+	binary.BigEndian.PutUint16(message[6:8], uint16(mtu))
+	copy(message[icmpHeaderLength:], quoted)
+	binary.BigEndian.PutUint16(message[2:4], Checksum(Sum(message, 0)))
+
+	return reply
+}
+
+// packetTooBig builds an ICMPv6 Packet Too Big message, RFC 4443 section 3.2
+func (packet *Packet) packetTooBig(mtu int) []byte {
+	quoted := packet.quote(maxICMPv6Error, ipv6HeaderLength+icmpHeaderLength)
+	reply := make([]byte, ipv6HeaderLength+icmpHeaderLength+len(quoted))
+
+	header := reply[:ipv6HeaderLength]
+	header[0] = 0x60
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(reply)-ipv6HeaderLength))
+	header[6] = byte(ICMPv6)
+	header[7] = errorTTL
+	copy(header[8:24], packet.Dst.AsSlice())
+	copy(header[24:40], packet.Src.AsSlice())
+
+	message := reply[ipv6HeaderLength:]
+	message[0] = icmpv6PacketTooBig
+	binary.BigEndian.PutUint32(message[4:8], uint32(mtu))
+	copy(message[icmpHeaderLength:], quoted)
+	sum := PseudoHeaderSum(packet.Dst, packet.Src, ICMPv6, len(message))
+	binary.BigEndian.PutUint16(message[2:4], Checksum(Sum(message, sum)))
+
+	return reply
+}
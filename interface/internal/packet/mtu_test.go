@@ -0,0 +1,114 @@
+package packet
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// mssOption is an MSS option after a NOP, so its value is not 16-bit aligned
+func mssOption(mss uint16) []byte {
+	option := []byte{tcpOptionNOP, tcpOptionMSS, 4, 0, 0, tcpOptionNOP, tcpOptionNOP, tcpOptionNOP}
+	binary.BigEndian.PutUint16(option[3:5], mss)
+	return option
+}
+
+// dontFragment sets the DF bit of an IPv4 packet
+func dontFragment(data []byte) []byte {
+	data[6] |= 0x40
+	binary.BigEndian.PutUint16(data[10:12], 0)
+	binary.BigEndian.PutUint16(data[10:12], Checksum(Sum(data[:ipv4MinHeaderLength], 0)))
+	return data
+}
+
+func TestClampMSS(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		changed bool
+		want    uint16
+	}{
+		{"IPv4 SYN", buildIPv4(TCP, nil, tcpSegment(SYN, mssOption(1460), "")), true, 1350},
+		{"IPv6 SYN-ACK", buildIPv6(TCP, nil, TCP, tcpSegment(SYN|ACK, mssOption(1440), "")), true, 1350},
+		{"MSS already small", buildIPv4(TCP, nil, tcpSegment(SYN, mssOption(1200), "")), false, 1200},
+		{"not a SYN", buildIPv4(TCP, nil, tcpSegment(ACK, mssOption(1460), "")), false, 1460},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := Parse(test.data)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if changed := parsed.ClampMSS(1350); changed != test.changed {
+				t.Errorf("ClampMSS() = %v, want %v", changed, test.changed)
+			}
+
+			reparsed, err := Parse(test.data)
+			if err != nil {
+				t.Fatalf("Parse after clamping: %v", err)
+			}
+			if got := binary.BigEndian.Uint16(reparsed.TCP.Options[3:5]); got != test.want {
+				t.Errorf("MSS = %d, want %d", got, test.want)
+			}
+			if err := reparsed.VerifyChecksums(); err != nil {
+				t.Errorf("VerifyChecksums after clamping: %v", err)
+			}
+		})
+	}
+}
+
+func TestTooBig(t *testing.T) {
+	payload := string(make([]byte, 1400))
+
+	t.Run("IPv4 don't fragment", func(t *testing.T) {
+		original := dontFragment(buildIPv4(UDP, nil, udpSegment(payload)))
+		parsed, _ := Parse(original)
+
+		reply, err := Parse(parsed.TooBig(1390))
+		if err != nil {
+			t.Fatalf("Parse reply: %v", err)
+		}
+		if err := reply.VerifyChecksums(); err != nil {
+			t.Errorf("VerifyChecksums: %v", err)
+		}
+		if reply.Src != parsed.Dst || reply.Dst != parsed.Src {
+			t.Errorf("reply goes %s -> %s, want %s -> %s", reply.Src, reply.Dst, parsed.Dst, parsed.Src)
+		}
+		if reply.ICMP.Type != icmpDestinationUnreachable || reply.ICMP.Code != icmpFragmentationNeeded || reply.ICMP.Rest&0xffff != 1390 {
+			t.Errorf("ICMP %+v, want fragmentation needed with MTU 1390", reply.ICMP)
+		}
+		if reply.TotalLength > maxICMPv4Error {
+			t.Errorf("reply is %d bytes, more than %d", reply.TotalLength, maxICMPv4Error)
+		}
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		parsed, _ := Parse(buildIPv6(UDP, nil, UDP, udpSegment(payload)))
+
+		reply, err := Parse(parsed.TooBig(1390))
+		if err != nil {
+			t.Fatalf("Parse reply: %v", err)
+		}
+		if err := reply.VerifyChecksums(); err != nil {
+			t.Errorf("VerifyChecksums: %v", err)
+		}
+		if reply.ICMP.Type != icmpv6PacketTooBig || reply.ICMP.Rest != 1390 {
+			t.Errorf("ICMPv6 %+v, want Packet Too Big with MTU 1390", reply.ICMP)
+		}
+		if reply.TotalLength > maxICMPv6Error {
+			t.Errorf("reply is %d bytes, more than %d", reply.TotalLength, maxICMPv6Error)
+		}
+	})
+
+	t.Run("no error", func(t *testing.T) {
+		for name, data := range map[string][]byte{
+			"IPv4 may fragment": buildIPv4(UDP, nil, udpSegment(payload)),
+			"ICMP error":        dontFragment(buildIPv4(ICMP, nil, []byte{3, 1, 0, 0, 0, 0, 0, 0})),
+		} {
+			parsed, _ := Parse(data)
+			if reply := parsed.TooBig(1390); reply != nil {
+				t.Errorf("%s: got an ICMP error, want none", name)
+			}
+		}
+	})
+}
@@ -0,0 +1,269 @@
+// Package packet parses the IPv4 and IPv6 packets that go through the tunnel
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// Parse errors
+var (
+	ErrTruncated    = errors.New("packet is truncated")
+	ErrVersion      = errors.New("not an IPv4 or IPv6 packet")
+	ErrHeaderLength = errors.New("invalid header length")
+)
+
+const (
+	ipv4MinHeaderLength = 20
+	ipv6HeaderLength    = 40
+)
+
+// Packet is a parsed IP packet. The byte slices point into the parsed buffer.
+type Packet struct {
+	Version int
+	Src     netip.Addr
+	Dst     netip.Addr
+	// Protocol is the upper layer protocol, after any IPv6 extension headers
+	Protocol Protocol
+	// TTL is the IPv4 time to live or the IPv6 hop limit
+	TTL uint8
+	// TrafficClass is the IPv4 type of service or the IPv6 traffic class
+	TrafficClass uint8
+	// TotalLength is the length of the packet according to its header
+	TotalLength int
+	// HeaderLength covers the IP header with options and extension headers
+	HeaderLength int
+
+	// IPv4 header fields
+	ID             uint16
+	DontFragment   bool
+	HeaderChecksum uint16
+	Options        []byte
+
+	// ExtensionHeaders lists the IPv6 extension headers in order
+	ExtensionHeaders []Protocol
+
+	// MoreFragments and FragmentOffset describe fragments, the offset is in bytes
+	MoreFragments  bool
+	FragmentOffset int
+
+	// Payload is everything after HeaderLength, up to TotalLength
+	Payload []byte
+
+	// At most one of the transport headers is set. They are only parsed
+	// from unfragmented packets and first fragments.
+	TCP  *TCPHeader
+	UDP  *UDPHeader
+	ICMP *ICMPHeader
+
+	// data is the packet trimmed to TotalLength
+	data []byte
+}
+
+// Parse parses an IP packet. Bytes past the total length in the header are
+// ignored. A transport header that cannot be parsed is an error, except in
+// fragments that do not carry it.
+func Parse(data []byte) (*Packet, error) {
+	if len(data) < 1 {
+		return nil, ErrTruncated
+	}
+
+	var packet *Packet
+	var err error
+
+	switch data[0] >> 4 {
+	case 4:
+		packet, err = parseIPv4(data)
+	case 6:
+		packet, err = parseIPv6(data)
+	default:
+		return nil, ErrVersion
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := packet.parseTransport(); err != nil {
+		return nil, fmt.Errorf("%s header: %w", packet.Protocol, err)
+	}
+	return packet, nil
+}
+
+// parseIPv4 parses the IPv4 header and its options
+func parseIPv4(data []byte) (*Packet, error) {
+	if len(data) < ipv4MinHeaderLength {
+		return nil, ErrTruncated
+	}
+
+	headerLength := int(data[0]&0x0f) * 4
+	totalLength := int(binary.BigEndian.Uint16(data[2:4]))
+	if headerLength < ipv4MinHeaderLength || headerLength > totalLength {
+		return nil, ErrHeaderLength
+	}
+	if totalLength > len(data) {
+		return nil, ErrTruncated
+	}
+
+	flagsAndOffset := binary.BigEndian.Uint16(data[6:8])
+	data = data[:totalLength]
+
+	return &Packet{
+		Version:        4,
+		Src:            netip.AddrFrom4([4]byte(data[12:16])),
+		Dst:            netip.AddrFrom4([4]byte(data[16:20])),
+		Protocol:       Protocol(data[9]),
+		TTL:            data[8],
+		TrafficClass:   data[1],
+		TotalLength:    totalLength,
+		HeaderLength:   headerLength,
+		ID:             binary.BigEndian.Uint16(data[4:6]),
+		DontFragment:   flagsAndOffset&0x4000 != 0,
+		MoreFragments:  flagsAndOffset&0x2000 != 0,
+		FragmentOffset: int(flagsAndOffset&0x1fff) * 8,
+		HeaderChecksum: binary.BigEndian.Uint16(data[10:12]),
+		Options:        data[ipv4MinHeaderLength:headerLength],
+		Payload:        data[headerLength:],
+		data:           data,
+	}, nil
+}
+
+// parseIPv6 parses the fixed IPv6 header and walks the extension header chain
+func parseIPv6(data []byte) (*Packet, error) {
+	if len(data) < ipv6HeaderLength {
+		return nil, ErrTruncated
+	}
+
+	totalLength := ipv6HeaderLength + int(binary.BigEndian.Uint16(data[4:6]))
+	if totalLength > len(data) {
+		return nil, ErrTruncated
+	}
+	data = data[:totalLength]
+
+	packet := &Packet{
+		Version:      6,
+		Src:          netip.AddrFrom16([16]byte(data[8:24])),
+		Dst:          netip.AddrFrom16([16]byte(data[24:40])),
+		Protocol:     Protocol(data[6]),
+		TTL:          data[7],
+		TrafficClass: uint8(binary.BigEndian.Uint16(data[0:2]) >> 4),
+		TotalLength:  totalLength,
+		data:         data,
+	}
+
+	offset := ipv6HeaderLength
+	for packet.Protocol.isIPv6Extension() {
+		if offset+8 > len(data) {
+			return nil, ErrTruncated
+		}
+
+		header := packet.Protocol
+		next := Protocol(data[offset])
+
+		var length int
+		switch header {
+		case Fragment:
+			length = 8
+			fragment := binary.BigEndian.Uint16(data[offset+2 : offset+4])
+			packet.FragmentOffset = int(fragment & 0xfff8)
+			packet.MoreFragments = fragment&0x1 != 0
+		case AH:
+			length = (int(data[offset+1]) + 2) * 4
+		default:
+			length = (int(data[offset+1]) + 1) * 8
+		}
+		if offset+length > len(data) {
+			return nil, ErrTruncated
+		}
+
+		packet.ExtensionHeaders = append(packet.ExtensionHeaders, header)
+		packet.Protocol = next
+		offset += length
+
+		// The headers after a non-first fragment are in an earlier fragment
+		if header == Fragment && packet.FragmentOffset != 0 {
+			break
+		}
+	}
+
+	packet.HeaderLength = offset
+	packet.Payload = data[offset:]
+	return packet, nil
+}
+
+// parseTransport parses the TCP, UDP or ICMP header at the start of the payload
+func (packet *Packet) parseTransport() error {
+	if packet.FragmentOffset != 0 {
+		return nil
+	}
+
+	var err error
+	switch {
+	case packet.Protocol == TCP:
+		packet.TCP, err = parseTCP(packet.Payload)
+	case packet.Protocol == UDP:
+		if packet.MoreFragments {
+			// The UDP length covers all fragments
+			if len(packet.Payload) < udpHeaderLength {
+				return ErrTruncated
+			}
+			packet.UDP = &UDPHeader{
+				SrcPort:  binary.BigEndian.Uint16(packet.Payload[0:2]),
+				DstPort:  binary.BigEndian.Uint16(packet.Payload[2:4]),
+				Length:   binary.BigEndian.Uint16(packet.Payload[4:6]),
+				Checksum: binary.BigEndian.Uint16(packet.Payload[6:8]),
+			}
+			return nil
+		}
+		packet.UDP, err = parseUDP(packet.Payload)
+	case packet.Protocol == ICMP && packet.Version == 4,
+		packet.Protocol == ICMPv6 && packet.Version == 6:
+		packet.ICMP, err = parseICMP(packet.Payload)
+	}
+	return err
+}
+
+// IsFragment reports whether the packet is part of a fragmented packet
+func (packet *Packet) IsFragment() bool {
+	return packet.MoreFragments || packet.FragmentOffset != 0
+}
+
+// Ports returns the TCP or UDP ports, ok is false for other packets
+func (packet *Packet) Ports() (src uint16, dst uint16, ok bool) {
+	switch {
+	case packet.TCP != nil:
+		return packet.TCP.SrcPort, packet.TCP.DstPort, true
+	case packet.UDP != nil:
+		return packet.UDP.SrcPort, packet.UDP.DstPort, true
+	}
+	return 0, 0, false
+}
+
+// Bytes returns the packet trimmed to its total length
+func (packet *Packet) Bytes() []byte {
+	return packet.data
+}
+
+// String summarises the packet for logging, e.g.
+// "IPv4: 10.0.0.2:51000 -> 1.1.1.1:443 (TCP SYN)"
+func (packet *Packet) String() string {
+	src, dst := packet.Src.String(), packet.Dst.String()
+	if srcPort, dstPort, ok := packet.Ports(); ok {
+		src = netip.AddrPortFrom(packet.Src, srcPort).String()
+		dst = netip.AddrPortFrom(packet.Dst, dstPort).String()
+	}
+
+	detail := packet.Protocol.String()
+	switch {
+	case packet.TCP != nil && packet.TCP.Flags != 0:
+		detail += " " + packet.TCP.Flags.String()
+	case packet.ICMP != nil:
+		detail += fmt.Sprintf(" type %d code %d", packet.ICMP.Type, packet.ICMP.Code)
+	}
+	if packet.IsFragment() {
+		detail += fmt.Sprintf(" fragment offset %d", packet.FragmentOffset)
+	}
+
+	return fmt.Sprintf("IPv%d: %s -> %s (%s)", packet.Version, src, dst, detail)
+}
@@ -0,0 +1,277 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+// buildIPv4 builds an IPv4 packet around a transport segment with valid checksums
+func buildIPv4(protocol Protocol, options []byte, segment []byte) []byte {
+	headerLength := ipv4MinHeaderLength + len(options)
+	data := make([]byte, headerLength+len(segment))
+	data[0] = 0x40 | byte(headerLength/4)
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)))
+	data[8] = 64
+	data[9] = byte(protocol)
+	copy(data[12:16], []byte{10, 0, 0, 2})
+	copy(data[16:20], []byte{1, 1, 1, 1})
+	copy(data[ipv4MinHeaderLength:], options)
+	copy(data[headerLength:], segment)
+
+	binary.BigEndian.PutUint16(data[10:12], Checksum(Sum(data[:headerLength], 0)))
+	setTransportChecksum(data[headerLength:], protocol, netip.AddrFrom4([4]byte{10, 0, 0, 2}), netip.AddrFrom4([4]byte{1, 1, 1, 1}))
+	return data
+}
+
+// buildIPv6 builds an IPv6 packet with the given extension headers before the segment
+func buildIPv6(protocol Protocol, extensions []byte, firstHeader Protocol, segment []byte) []byte {
+	data := make([]byte, ipv6HeaderLength+len(extensions)+len(segment))
+	data[0] = 0x60
+	binary.BigEndian.PutUint16(data[4:6], uint16(len(extensions)+len(segment)))
+	data[6] = byte(firstHeader)
+	data[7] = 64
+	src := netip.MustParseAddr("fd00::2")
+	dst := netip.MustParseAddr("2001:db8::1")
+	copy(data[8:24], src.AsSlice())
+	copy(data[24:40], dst.AsSlice())
+	copy(data[ipv6HeaderLength:], extensions)
+	copy(data[ipv6HeaderLength+len(extensions):], segment)
+
+	setTransportChecksum(data[ipv6HeaderLength+len(extensions):], protocol, src, dst)
+	return data
+}
+
+// setTransportChecksum fills in the checksum of a TCP, UDP or ICMP segment.
+// Segments too short for a header, such as later fragments, are left alone.
+func setTransportChecksum(segment []byte, protocol Protocol, src, dst netip.Addr) {
+	if len(segment) < tcpMinHeaderLength && protocol == TCP || len(segment) < udpHeaderLength {
+		return
+	}
+
+	var field []byte
+	var sum uint32
+	switch protocol {
+	case TCP:
+		field = segment[16:18]
+		sum = PseudoHeaderSum(src, dst, protocol, len(segment))
+	case UDP:
+		field = segment[6:8]
+		sum = PseudoHeaderSum(src, dst, protocol, len(segment))
+	case ICMPv6:
+		field = segment[2:4]
+		sum = PseudoHeaderSum(src, dst, protocol, len(segment))
+	case ICMP:
+		field = segment[2:4]
+	default:
+		return
+	}
+	binary.BigEndian.PutUint16(field, Checksum(Sum(segment, sum)))
+}
+
+func tcpSegment(flags TCPFlags, options []byte, payload string) []byte {
+	segment := make([]byte, tcpMinHeaderLength+len(options)+len(payload))
+	binary.BigEndian.PutUint16(segment[0:2], 51000)
+	binary.BigEndian.PutUint16(segment[2:4], 443)
+	segment[12] = byte((tcpMinHeaderLength+len(options))/4) << 4
+	segment[13] = byte(flags)
+	copy(segment[tcpMinHeaderLength:], options)
+	copy(segment[tcpMinHeaderLength+len(options):], payload)
+	return segment
+}
+
+func udpSegment(payload string) []byte {
+	segment := make([]byte, udpHeaderLength+len(payload))
+	binary.BigEndian.PutUint16(segment[0:2], 5353)
+	binary.BigEndian.PutUint16(segment[2:4], 53)
+	binary.BigEndian.PutUint16(segment[4:6], uint16(len(segment)))
+	copy(segment[udpHeaderLength:], payload)
+	return segment
+}
+
+func icmpEcho(echoType byte) []byte {
+	return []byte{echoType, 0, 0, 0, 0, 1, 0, 1, 'p', 'i', 'n', 'g'}
+}
+
+func TestParse(t *testing.T) {
+	// Hop-by-hop options with a PadN option, padded to 8 bytes
+	hopByHop := []byte{byte(UDP), 0, 1, 4, 0, 0, 0, 0}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		protocol Protocol
+		srcPort  uint16
+		dstPort  uint16
+		summary  string
+	}{
+		{
+			name:     "IPv4 TCP with options",
+			data:     buildIPv4(TCP, []byte{1, 1, 1, 0}, tcpSegment(SYN|ACK, []byte{2, 4, 5, 180}, "")),
+			protocol: TCP, srcPort: 51000, dstPort: 443,
+			summary: "IPv4: 10.0.0.2:51000 -> 1.1.1.1:443 (TCP SYN|ACK)",
+		},
+		{
+			name:     "IPv4 UDP",
+			data:     buildIPv4(UDP, nil, udpSegment("query")),
+			protocol: UDP, srcPort: 5353, dstPort: 53,
+			summary: "IPv4: 10.0.0.2:5353 -> 1.1.1.1:53 (UDP)",
+		},
+		{
+			name:     "IPv4 ICMP",
+			data:     buildIPv4(ICMP, nil, icmpEcho(8)),
+			protocol: ICMP,
+			summary:  "IPv4: 10.0.0.2 -> 1.1.1.1 (ICMP type 8 code 0)",
+		},
+		{
+			name:     "IPv6 UDP after hop-by-hop options",
+			data:     buildIPv6(UDP, hopByHop, HopByHop, udpSegment("query")),
+			protocol: UDP, srcPort: 5353, dstPort: 53,
+			summary: "IPv6: [fd00::2]:5353 -> [2001:db8::1]:53 (UDP)",
+		},
+		{
+			name:     "IPv6 ICMPv6",
+			data:     buildIPv6(ICMPv6, nil, ICMPv6, icmpEcho(128)),
+			protocol: ICMPv6,
+			summary:  "IPv6: fd00::2 -> 2001:db8::1 (ICMPv6 type 128 code 0)",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Trailing bytes past the total length are ignored
+			packet, err := Parse(append(test.data, 0xff, 0xff))
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if packet.Protocol != test.protocol {
+				t.Errorf("protocol = %s, want %s", packet.Protocol, test.protocol)
+			}
+			srcPort, dstPort, _ := packet.Ports()
+			if srcPort != test.srcPort || dstPort != test.dstPort {
+				t.Errorf("ports = %d -> %d, want %d -> %d", srcPort, dstPort, test.srcPort, test.dstPort)
+			}
+			if packet.String() != test.summary {
+				t.Errorf("String() = %q, want %q", packet.String(), test.summary)
+			}
+			if len(packet.Bytes()) != len(test.data) {
+				t.Errorf("Bytes() has %d bytes, want %d", len(packet.Bytes()), len(test.data))
+			}
+			if err := packet.VerifyChecksums(); err != nil {
+				t.Errorf("VerifyChecksums: %v", err)
+			}
+
+			// Flipping a payload bit must break a checksum
+			corrupted := append([]byte(nil), test.data...)
+			corrupted[len(corrupted)-1] ^= 0x01
+			packet, err = Parse(corrupted)
+			if err != nil {
+				t.Fatalf("Parse corrupted: %v", err)
+			}
+			if err := packet.VerifyChecksums(); !errors.Is(err, ErrChecksum) {
+				t.Errorf("VerifyChecksums on corrupted packet = %v, want ErrChecksum", err)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	valid := buildIPv4(TCP, nil, tcpSegment(SYN, nil, ""))
+
+	badIHL := append([]byte(nil), valid...)
+	badIHL[0] = 0x44
+
+	badTotalLength := append([]byte(nil), valid...)
+	binary.BigEndian.PutUint16(badTotalLength[2:4], uint16(len(valid)+1))
+
+	badDataOffset := append([]byte(nil), valid...)
+	badDataOffset[ipv4MinHeaderLength+12] = 0x10
+
+	truncatedExtension := buildIPv6(UDP, []byte{byte(UDP), 1, 0, 0, 0, 0, 0, 0}, DestOptions, udpSegment(""))
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrTruncated},
+		{"version", []byte{0x50, 0, 0, 0}, ErrVersion},
+		{"short IPv4", valid[:19], ErrTruncated},
+		{"IHL below minimum", badIHL, ErrHeaderLength},
+		{"total length past the buffer", badTotalLength, ErrTruncated},
+		{"TCP data offset below minimum", badDataOffset, ErrHeaderLength},
+		{"IPv6 extension header past the packet", truncatedExtension, ErrTruncated},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Parse(test.data); !errors.Is(err, test.want) {
+				t.Errorf("Parse = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestParseFragments(t *testing.T) {
+	first := buildIPv4(UDP, nil, udpSegment("first fragment"))
+	binary.BigEndian.PutUint16(first[6:8], 0x2000)
+
+	packet, err := Parse(first)
+	if err != nil {
+		t.Fatalf("Parse first fragment: %v", err)
+	}
+	if packet.UDP == nil || !packet.IsFragment() {
+		t.Errorf("first fragment should carry the UDP header and be a fragment")
+	}
+
+	later := buildIPv4(UDP, nil, []byte("later"))
+	binary.BigEndian.PutUint16(later[6:8], 0x0003)
+
+	packet, err = Parse(later)
+	if err != nil {
+		t.Fatalf("Parse later fragment: %v", err)
+	}
+	if packet.UDP != nil || packet.FragmentOffset != 24 {
+		t.Errorf("later fragment: UDP = %v, offset = %d", packet.UDP, packet.FragmentOffset)
+	}
+
+	fragmentHeader := []byte{byte(TCP), 0, 0, 8, 0, 0, 0, 1}
+	packet, err = Parse(buildIPv6(TCP, fragmentHeader, Fragment, []byte("not a TCP header")))
+	if err != nil {
+		t.Fatalf("Parse IPv6 fragment: %v", err)
+	}
+	if packet.Protocol != TCP || packet.TCP != nil || packet.FragmentOffset != 8 {
+		t.Errorf("IPv6 fragment: protocol = %s, TCP = %v, offset = %d", packet.Protocol, packet.TCP, packet.FragmentOffset)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add(buildIPv4(TCP, []byte{1, 1, 1, 0}, tcpSegment(SYN, []byte{2, 4, 5, 180}, "data")))
+	f.Add(buildIPv4(UDP, nil, udpSegment("query")))
+	f.Add(buildIPv4(ICMP, nil, icmpEcho(8)))
+	f.Add(buildIPv6(UDP, []byte{byte(UDP), 0, 1, 4, 0, 0, 0, 0}, HopByHop, udpSegment("query")))
+	f.Add(buildIPv6(TCP, []byte{byte(TCP), 0, 0, 0, 0, 0, 0, 1}, Fragment, tcpSegment(ACK, nil, "")))
+	f.Add(buildIPv6(ICMPv6, nil, ICMPv6, icmpEcho(128)))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet, err := Parse(data)
+		if err != nil {
+			return
+		}
+
+		if packet.TotalLength > len(data) || packet.HeaderLength > packet.TotalLength {
+			t.Fatalf("lengths out of range: header %d, total %d, buffer %d", packet.HeaderLength, packet.TotalLength, len(data))
+		}
+		if packet.HeaderLength+len(packet.Payload) != packet.TotalLength {
+			t.Fatalf("payload of %d bytes after a %d byte header does not add up to %d", len(packet.Payload), packet.HeaderLength, packet.TotalLength)
+		}
+		if packet.TCP != nil && packet.TCP.HeaderLength > len(packet.Payload) {
+			t.Fatalf("TCP header of %d bytes in a %d byte payload", packet.TCP.HeaderLength, len(packet.Payload))
+		}
+
+		// These must not panic on anything Parse accepts
+		_ = packet.String()
+		_ = packet.VerifyChecksums()
+	})
+}
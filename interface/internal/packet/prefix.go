@@ -0,0 +1,29 @@
+package packet
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// ParsePrefix parses a CIDR prefix, a bare address is a single host.
+// IPv4-mapped IPv6 addresses are unmapped since parsed IPv4 packets carry
+// plain IPv4 addresses, which a mapped prefix would never contain.
+func ParsePrefix(value string) (netip.Prefix, error) {
+	if !strings.Contains(value, "/") {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
@@ -0,0 +1,65 @@
+package packet
+
+import "fmt"
+
+// Protocol is an IP protocol number, also used for IPv6 next headers
+type Protocol uint8
+
+// Protocols and IPv6 extension headers the parser knows about
+const (
+	HopByHop    Protocol = 0
+	ICMP        Protocol = 1
+	IGMP        Protocol = 2
+	IPIP        Protocol = 4
+	TCP         Protocol = 6
+	UDP         Protocol = 17
+	IPv6Encap   Protocol = 41
+	Routing     Protocol = 43
+	Fragment    Protocol = 44
+	GRE         Protocol = 47
+	ESP         Protocol = 50
+	AH          Protocol = 51
+	ICMPv6      Protocol = 58
+	NoNext      Protocol = 59
+	DestOptions Protocol = 60
+	SCTP        Protocol = 132
+	UDPLite     Protocol = 136
+)
+
+var protocolNames = map[Protocol]string{
+	HopByHop:    "HopByHop",
+	ICMP:        "ICMP",
+	IGMP:        "IGMP",
+	IPIP:        "IPIP",
+	TCP:         "TCP",
+	UDP:         "UDP",
+	IPv6Encap:   "IPv6",
+	Routing:     "Routing",
+	Fragment:    "Fragment",
+	GRE:         "GRE",
+	ESP:         "ESP",
+	AH:          "AH",
+	ICMPv6:      "ICMPv6",
+	NoNext:      "NoNext",
+	DestOptions: "DestOptions",
+	SCTP:        "SCTP",
+	UDPLite:     "UDPLite",
+}
+
+// String returns the protocol name, e.g. "TCP" or "Unknown(253)"
+func (protocol Protocol) String() string {
+	if name, ok := protocolNames[protocol]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown(%d)", uint8(protocol))
+}
+
+// isIPv6Extension reports whether the next header is an IPv6 extension
+// header the parser walks over to find the upper layer protocol
+func (protocol Protocol) isIPv6Extension() bool {
+	switch protocol {
+	case HopByHop, Routing, Fragment, DestOptions, AH:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package packet
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// TCPFlags are the control bits of a TCP header
+type TCPFlags uint16
+
+// TCP control bits
+const (
+	FIN TCPFlags = 1 << iota
+	SYN
+	RST
+	PSH
+	ACK
+	URG
+	ECE
+	CWR
+)
+
+var tcpFlagNames = []struct {
+	flag TCPFlags
+	name string
+}{
+	{SYN, "SYN"}, {ACK, "ACK"}, {FIN, "FIN"}, {RST, "RST"},
+	{PSH, "PSH"}, {URG, "URG"}, {ECE, "ECE"}, {CWR, "CWR"},
+}
+
+// Has reports whether every flag in flags is set
+func (set TCPFlags) Has(flags TCPFlags) bool {
+	return set&flags == flags
+}
+
+// String returns the set flags, e.g. "SYN|ACK"
+func (set TCPFlags) String() string {
+	var names []string
+	for _, flag := range tcpFlagNames {
+		if set.Has(flag.flag) {
+			names = append(names, flag.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// TCPHeader is a parsed TCP header
+type TCPHeader struct {
+	SrcPort  uint16
+	DstPort  uint16
+	Seq      uint32
+	Ack      uint32
+	Flags    TCPFlags
+	Window   uint16
+	Checksum uint16
+	Urgent   uint16
+	// HeaderLength is the data offset in bytes, including options
+	HeaderLength int
+	Options      []byte
+}
+
+// UDPHeader is a parsed UDP header
+type UDPHeader struct {
+	SrcPort  uint16
+	DstPort  uint16
+	Length   uint16
+	Checksum uint16
+}
+
+// ICMPHeader is a parsed ICMP or ICMPv6 header
+type ICMPHeader struct {
+	Type     uint8
+	Code     uint8
+	Checksum uint16
+	// Rest is the four bytes after the checksum, e.g. identifier and sequence of an echo
+	Rest uint32
+}
+
+const (
+	tcpMinHeaderLength = 20
+	udpHeaderLength    = 8
+	icmpHeaderLength   = 8
+)
+
+// parseTCP parses the TCP header at the start of segment
+func parseTCP(segment []byte) (*TCPHeader, error) {
+	if len(segment) < tcpMinHeaderLength {
+		return nil, ErrTruncated
+	}
+
+	headerLength := int(segment[12]>>4) * 4
+	if headerLength < tcpMinHeaderLength {
+		return nil, ErrHeaderLength
+	}
+	if headerLength > len(segment) {
+		return nil, ErrTruncated
+	}
+
+	return &TCPHeader{
+		SrcPort:      binary.BigEndian.Uint16(segment[0:2]),
+		DstPort:      binary.BigEndian.Uint16(segment[2:4]),
+		Seq:          binary.BigEndian.Uint32(segment[4:8]),
+		Ack:          binary.BigEndian.Uint32(segment[8:12]),
+		Flags:        TCPFlags(segment[13]),
+		Window:       binary.BigEndian.Uint16(segment[14:16]),
+		Checksum:     binary.BigEndian.Uint16(segment[16:18]),
+		Urgent:       binary.BigEndian.Uint16(segment[18:20]),
+		HeaderLength: headerLength,
+		Options:      segment[tcpMinHeaderLength:headerLength],
+	}, nil
+}
+
+// parseUDP parses the UDP header at the start of datagram
+func parseUDP(datagram []byte) (*UDPHeader, error) {
+	if len(datagram) < udpHeaderLength {
+		return nil, ErrTruncated
+	}
+
+	header := &UDPHeader{
+		SrcPort:  binary.BigEndian.Uint16(datagram[0:2]),
+		DstPort:  binary.BigEndian.Uint16(datagram[2:4]),
+		Length:   binary.BigEndian.Uint16(datagram[4:6]),
+		Checksum: binary.BigEndian.Uint16(datagram[6:8]),
+	}
+	if int(header.Length) < udpHeaderLength || int(header.Length) > len(datagram) {
+		return nil, ErrHeaderLength
+	}
+	return header, nil
+}
+
+// parseICMP parses the ICMP header at the start of message
+func parseICMP(message []byte) (*ICMPHeader, error) {
+	if len(message) < icmpHeaderLength {
+		return nil, ErrTruncated
+	}
+
+	return &ICMPHeader{
+		Type:     message[0],
+		Code:     message[1],
+		Checksum: binary.BigEndian.Uint16(message[2:4]),
+		Rest:     binary.BigEndian.Uint32(message[4:8]),
+	}, nil
+}
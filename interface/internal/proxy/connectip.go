@@ -0,0 +1,557 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/capture"
+	"thinkpol-vpn/interface/internal/config"
+	"thinkpol-vpn/interface/internal/keepalive"
+	"thinkpol-vpn/interface/internal/ratelimit"
+	"thinkpol-vpn/interface/internal/scheduler"
+	"thinkpol-vpn/interface/internal/upstream"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Redials of a MASQUE server back off from the first to the longest delay
+const (
+	redialDelay    = time.Second
+	maxRedialDelay = 30 * time.Second
+)
+
+// ConnectIPProxy carries tunnel packets in a CONNECT-IP request (RFC 9484),
+// as HTTP/3 datagrams or, over HTTP/2, as capsules on the request stream.
+// It either serves a single peer or connects to a MASQUE server itself.
+type ConnectIPProxy struct {
+	listen      string
+	path        string
+	tlsConfig   *tls.Config
+	peerAddress []netip.Prefix
+	routes      []netip.Prefix
+
+	// server is the MASQUE server to connect to, nil when serving a peer
+	server        *url.URL
+	http2Fallback bool
+	// pathMTU sizes the QUIC packets so that tunnel packets fit a datagram
+	pathMTU int
+
+	sendQueue   *scheduler.Scheduler
+	receiveChan chan *protobuf.PacketV4
+
+	// mutex guards the session, which comes and goes while the loops run
+	mutex   sync.Mutex
+	session *ipSession
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	http3Server *http3.Server
+	http2Server *http.Server
+
+	stats     *Stats
+	capturer  *capture.Capturer
+	shaper    *ratelimit.Shaper
+	keepalive keepalive.Settings
+	upstream  upstream.Settings
+}
+
+// ConnectIPStatus describes the CONNECT-IP session in the transport status
+type ConnectIPStatus struct {
+	// Protocol is "h3" or "h2", empty while there is no session
+	Protocol string `json:"protocol,omitempty"`
+	// Assigned and Routes are what the MASQUE server sent
+	Assigned []netip.Prefix `json:"assigned,omitempty"`
+	Routes   []IPRoute      `json:"routes,omitempty"`
+}
+
+// NewConnectIPProxy validates the CONNECT-IP configuration. pathMTU is the
+// MTU of the path to the peer.
+func NewConnectIPProxy(connectIPConfig config.ConnectIPConfig, pathMTU int) (*ConnectIPProxy, error) {
+	shaper, _ := ratelimit.NewShaper(config.RateLimitConfig{})
+	sendQueue, _ := scheduler.New(config.Default().Scheduler)
+	keepaliveSettings, _ := keepalive.New(config.Default().Keepalive)
+
+	transport := &ConnectIPProxy{
+		listen:        connectIPConfig.Listen,
+		path:          connectIPConfig.Path,
+		http2Fallback: connectIPConfig.HTTP2Fallback,
+		pathMTU:       pathMTU,
+		sendQueue:     sendQueue,
+		receiveChan:   make(chan *protobuf.PacketV4, 1),
+		stats:         newStats(),
+		shaper:        shaper,
+		keepalive:     keepaliveSettings,
+		tlsConfig: &tls.Config{
+			InsecureSkipVerify: connectIPConfig.InsecureSkipVerify,
+		},
+	}
+
+	if connectIPConfig.Server != "" {
+		server, err := url.Parse(connectIPConfig.Server)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MASQUE server: %w", err)
+		}
+		if server.Scheme != "https" {
+			return nil, fmt.Errorf("MASQUE server %q is not an https URL", connectIPConfig.Server)
+		}
+		transport.server = server
+		transport.tlsConfig.ServerName = server.Hostname()
+		return transport, nil
+	}
+
+	if transport.path == "" {
+		return nil, errors.New("connect-ip path is empty")
+	}
+	certificate, err := tls.LoadX509KeyPair(connectIPConfig.CertFile, connectIPConfig.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load connect-ip certificate: %w", err)
+	}
+	transport.tlsConfig.Certificates = []tls.Certificate{certificate}
+
+	if connectIPConfig.PeerAddress != "" {
+		prefix, err := netip.ParsePrefix(connectIPConfig.PeerAddress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer address: %w", err)
+		}
+		transport.peerAddress = []netip.Prefix{prefix}
+	}
+	for _, route := range connectIPConfig.Routes {
+		prefix, err := netip.ParsePrefix(route)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route: %w", err)
+		}
+		transport.routes = append(transport.routes, prefix)
+	}
+	return transport, nil
+}
+
+// SetKeepalive changes how the peer is checked for liveness, with QUIC
+// keepalives. It must be called before Start.
+func (transport *ConnectIPProxy) SetKeepalive(settings keepalive.Settings) {
+	transport.keepalive = settings
+}
+
+// SetScheduler replaces the queue of packets waiting to be sent. It must be
+// called before Start.
+func (transport *ConnectIPProxy) SetScheduler(sendQueue *scheduler.Scheduler) {
+	transport.sendQueue = sendQueue
+}
+
+// SetCapturer makes the transport record the packets it carries. It must be
+// called before Start.
+func (transport *ConnectIPProxy) SetCapturer(capturer *capture.Capturer) {
+	transport.capturer = capturer
+}
+
+// SetTLSConfig replaces the TLS configuration, e.g. to trust another CA. It
+// must be called before Start.
+func (transport *ConnectIPProxy) SetTLSConfig(tlsConfig *tls.Config) {
+	transport.tlsConfig = tlsConfig
+}
+
+// SetUpstreamProxy makes the connections to the MASQUE server go through a
+// proxy. Proxies only carry TCP, so the transport connects over HTTP/2 when
+// there is one. It must be called before Start.
+func (transport *ConnectIPProxy) SetUpstreamProxy(settings upstream.Settings) {
+	transport.upstream = settings
+}
+
+// quicConfig returns the QUIC parameters of the connection to the peer.
+// Packets start out as large as the path allows, so that tunnel packets fit
+// a datagram before path MTU discovery caught up.
+func (transport *ConnectIPProxy) quicConfig() *quic.Config {
+	quicConfig := &quic.Config{
+		EnableDatagrams: true,
+		KeepAlivePeriod: transport.keepalive.Interval,
+		MaxIdleTimeout:  transport.keepalive.Timeout,
+	}
+	// Less the IPv6 and UDP headers
+	if size := transport.pathMTU - 48; size > 0 {
+		quicConfig.InitialPacketSize = uint16(size)
+	}
+	return quicConfig
+}
+
+// Listen starts serving CONNECT-IP over HTTP/3 on UDP and over HTTP/2 on TCP,
+// both on the listen address. It does nothing when connecting to a server.
+func (transport *ConnectIPProxy) Listen() error {
+	if transport.server != nil {
+		return nil
+	}
+
+	// HTTP/3 takes the port HTTP/2 got, which matters when it was picked
+	tcpListener, err := net.Listen("tcp", transport.listen)
+	if err != nil {
+		return err
+	}
+	udpConn, err := net.ListenPacket("udp", tcpListener.Addr().String())
+	if err != nil {
+		tcpListener.Close()
+		return err
+	}
+	transport.listen = tcpListener.Addr().String()
+
+	http3TLS := http3.ConfigureTLSConfig(transport.tlsConfig.Clone())
+	transport.http3Server = &http3.Server{
+		Handler:         transport,
+		TLSConfig:       http3TLS,
+		QUICConfig:      transport.quicConfig(),
+		EnableDatagrams: true,
+	}
+	http2TLS := transport.tlsConfig.Clone()
+	http2TLS.NextProtos = []string{"h2"}
+	transport.http2Server = &http.Server{Handler: transport, TLSConfig: http2TLS}
+
+	log.Printf("    [CONNECT-IP] Serving %s over HTTP/3 and HTTP/2 on %s", transport.path, transport.listen)
+	go func() {
+		if err := transport.http3Server.Serve(udpConn); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, quic.ErrServerClosed) {
+			log.Printf("    [CONNECT-IP] HTTP/3 server failed: %v", err)
+		}
+	}()
+	go func() {
+		if err := transport.http2Server.ServeTLS(tcpListener, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("    [CONNECT-IP] HTTP/2 server failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the transport serves on, with the port picked
+// once listening
+func (transport *ConnectIPProxy) Addr() string {
+	return transport.listen
+}
+
+func (transport *ConnectIPProxy) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	transport.mutex.Lock()
+	transport.ctx = ctx
+	transport.cancel = cancel
+	transport.mutex.Unlock()
+
+	transport.wg.Add(1)
+	go func() {
+		defer transport.wg.Done()
+		transport.writeLoop(ctx)
+	}()
+
+	if transport.server != nil {
+		transport.wg.Add(1)
+		go func() {
+			defer transport.wg.Done()
+			transport.dialLoop(ctx)
+		}()
+	}
+}
+
+func (transport *ConnectIPProxy) Stop() {
+	transport.mutex.Lock()
+	if transport.cancel != nil {
+		transport.cancel()
+	}
+	session := transport.session
+	transport.session = nil
+	transport.ctx = nil
+	transport.cancel = nil
+	transport.mutex.Unlock()
+
+	if session != nil {
+		session.Close()
+	}
+	if transport.http3Server != nil {
+		transport.http3Server.Close()
+	}
+	if transport.http2Server != nil {
+		transport.http2Server.Close()
+	}
+	transport.wg.Wait()
+}
+
+// writeLoop sends the queued packets to the session of the moment
+func (transport *ConnectIPProxy) writeLoop(ctx context.Context) {
+	for {
+		packet := transport.sendQueue.Dequeue(ctx)
+		if packet == nil {
+			log.Println("connect-ip write handler stopped")
+			return
+		}
+
+		if !transport.shaper.Send.Wait(ctx, len(packet.GetBuffer())) {
+			continue
+		}
+
+		session := transport.current()
+		if session == nil {
+			transport.stats.dropped.Add(1)
+			continue
+		}
+
+		started := time.Now()
+		err := session.WritePacket(packet.GetBuffer())
+		transport.stats.writeDuration.Observe(time.Since(started).Seconds())
+
+		// A packet larger than a datagram is lost on its own, the session
+		// goes on
+		var tooLarge *quic.DatagramTooLargeError
+		if errors.As(err, &tooLarge) {
+			transport.stats.dropped.Add(1)
+			continue
+		}
+		if err != nil {
+			log.Printf("    [CONNECT-IP] Error sending packet: %v", err)
+			transport.stats.dropped.Add(1)
+			session.Close()
+			continue
+		}
+		transport.stats.recordSent(len(packet.GetBuffer()))
+		transport.capturer.Capture(capture.Point{Source: capture.SourceTransport, Direction: capture.Outbound}, packet.GetBuffer())
+	}
+}
+
+// serveSession makes session the current one and reads its packets until it
+// ends
+func (transport *ConnectIPProxy) serveSession(ctx context.Context, session *ipSession) {
+	defer func() {
+		session.Close()
+		transport.mutex.Lock()
+		if transport.session == session {
+			transport.session = nil
+		}
+		transport.mutex.Unlock()
+	}()
+
+	for {
+		buffer, err := session.ReadPacket()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("    [CONNECT-IP] Session ended: %v", err)
+			}
+			return
+		}
+
+		length := int32(len(buffer))
+		packet := &protobuf.PacketV4{Length: &length, Buffer: buffer}
+		transport.stats.recordReceived(len(buffer))
+		transport.capturer.Capture(capture.Point{Source: capture.SourceTransport, Direction: capture.Inbound}, buffer)
+
+		if !transport.shaper.Receive.Wait(ctx, len(buffer)) {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-session.Done():
+			return
+		case transport.receiveChan <- packet:
+		}
+	}
+}
+
+// ServeHTTP accepts the CONNECT-IP request of the peer, on HTTP/3 or on
+// HTTP/2 with extended CONNECT (RFC 8441)
+func (transport *ConnectIPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	protocol := r.Proto
+	if r.ProtoMajor == 2 {
+		protocol = r.Header.Get(":protocol")
+	}
+	if r.Method != http.MethodConnect || protocol != connectIPProtocol || r.URL.Path != transport.path {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get(http3.CapsuleProtocolHeader) != "?1" {
+		transport.stats.handshakesFailed.Add(1)
+		http.Error(w, "capsule protocol required", http.StatusBadRequest)
+		return
+	}
+
+	// Held until the session is in place so a second peer cannot take the
+	// slot as well
+	transport.mutex.Lock()
+	ctx := transport.ctx
+	if ctx == nil {
+		transport.mutex.Unlock()
+		http.Error(w, "transport is not running", http.StatusServiceUnavailable)
+		return
+	}
+	if transport.session != nil {
+		transport.mutex.Unlock()
+		transport.stats.handshakesBusy.Add(1)
+		http.Error(w, "already taken", 418)
+		return
+	}
+
+	w.Header().Set(http3.CapsuleProtocolHeader, "?1")
+	w.WriteHeader(http.StatusOK)
+
+	var session *ipSession
+	if streamer, ok := w.(http3.HTTPStreamer); ok {
+		stream := streamer.HTTPStream()
+		session = newIPSession("h3", stream, stream, nil, func() {
+			stream.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+			stream.Close()
+		}, stream)
+	} else {
+		// Writes to the peer are flushed right away, and a write stuck on
+		// the peer gives up once the session is closed
+		controller := http.NewResponseController(w)
+		if err := controller.Flush(); err != nil {
+			transport.mutex.Unlock()
+			transport.stats.handshakesFailed.Add(1)
+			return
+		}
+		session = newIPSession("h2", r.Body, w, controller.Flush, func() {
+			controller.SetWriteDeadline(time.Now())
+			controller.SetReadDeadline(time.Now())
+		}, nil)
+	}
+	transport.session = session
+	transport.mutex.Unlock()
+
+	transport.stats.handshakesAccepted.Add(1)
+	transport.stats.connections.Add(1)
+	log.Printf("    [CONNECT-IP] Peer %s connected over %s", r.RemoteAddr, session.protocol)
+
+	if err := session.Assign(transport.peerAddress, transport.routes); err != nil {
+		log.Printf("    [CONNECT-IP] Failed to assign addresses: %v", err)
+		session.Close()
+	}
+
+	// The request lasts as long as the session, HTTP/2 ends the stream when
+	// the handler returns
+	transport.serveSession(ctx, session)
+}
+
+// dialLoop keeps a session to the MASQUE server open, connecting again with
+// a growing delay when it fails or ends
+func (transport *ConnectIPProxy) dialLoop(ctx context.Context) {
+	delay := redialDelay
+	for {
+		session, err := transport.dial(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("    [CONNECT-IP] Failed to connect to %s: %v", transport.server.Host, err)
+			transport.stats.handshakesFailed.Add(1)
+		} else {
+			delay = redialDelay
+			transport.stats.handshakesAccepted.Add(1)
+			transport.stats.connections.Add(1)
+			log.Printf("    [CONNECT-IP] Connected to %s over %s", transport.server.Host, session.protocol)
+
+			transport.mutex.Lock()
+			transport.session = session
+			transport.mutex.Unlock()
+			transport.serveSession(ctx, session)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxRedialDelay)
+		transport.stats.reconnects.Add(1)
+	}
+}
+
+// dial sends a CONNECT-IP request to the MASQUE server over HTTP/3, and over
+// HTTP/2 when that fails and the fallback is on. Through an upstream proxy
+// it only tries HTTP/2.
+func (transport *ConnectIPProxy) dial(ctx context.Context) (*ipSession, error) {
+	proxyURL, err := transport.upstream.Proxy(hostPort(transport.server))
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL != nil {
+		return dialHTTP2(ctx, transport.keepalive.Timeout, transport.server, transport.tlsConfig, transport.upstream.DialContext)
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, transport.keepalive.Timeout)
+	defer cancel()
+
+	session, err := dialHTTP3(dialCtx, transport.server, transport.tlsConfig, transport.quicConfig())
+	if err == nil || !transport.http2Fallback {
+		return session, err
+	}
+	log.Printf("    [CONNECT-IP] HTTP/3 failed (%v), falling back to HTTP/2", err)
+	return dialHTTP2(ctx, transport.keepalive.Timeout, transport.server, transport.tlsConfig, transport.upstream.DialContext)
+}
+
+// current returns the session, nil while there is none
+func (transport *ConnectIPProxy) current() *ipSession {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	return transport.session
+}
+
+func (transport *ConnectIPProxy) SendToTransport(len int, buf []byte) {
+	if transport.current() == nil {
+		transport.stats.dropped.Add(1)
+		return
+	}
+
+	length := int32(len)
+	packet := &protobuf.PacketV4{Length: &length, Buffer: buf[:len]}
+	if !transport.sendQueue.Enqueue(packet) {
+		transport.stats.dropped.Add(1)
+	}
+}
+
+// ReceiveFromTransport returns the stream of packets read from the session
+func (transport *ConnectIPProxy) ReceiveFromTransport() <-chan *protobuf.PacketV4 {
+	return transport.receiveChan
+}
+
+// QueueDepths returns how many packets wait in the send and receive queues
+func (transport *ConnectIPProxy) QueueDepths() (send int, receive int) {
+	return transport.sendQueue.Len(), len(transport.receiveChan)
+}
+
+// RateLimit returns the shaper that limits the traffic of the peer
+func (transport *ConnectIPProxy) RateLimit() *ratelimit.Shaper {
+	return transport.shaper
+}
+
+// Stats returns a snapshot of the transport counters. QUIC and HTTP/2 check
+// the liveness of the peer themselves, so the peer is alive for as long as
+// the session lasts.
+func (transport *ConnectIPProxy) Stats() StatsSnapshot {
+	snapshot := transport.stats.Snapshot()
+	snapshot.RateLimit = transport.shaper.Status()
+	snapshot.Scheduler = transport.sendQueue.Stats()
+	snapshot.ConnectIP = &ConnectIPStatus{}
+
+	snapshot.Peer = peerDisconnected
+	if session := transport.current(); session != nil {
+		snapshot.Peer = keepalive.StateAlive
+		snapshot.ConnectIP.Protocol = session.protocol
+		snapshot.ConnectIP.Assigned, snapshot.ConnectIP.Routes = session.Assigned()
+	}
+	return snapshot
+}
+
+// Collector returns a Prometheus collector for the transport metrics
+func (transport *ConnectIPProxy) Collector() prometheus.Collector {
+	return &transportCollector{
+		transport:   transport,
+		stats:       transport.stats,
+		sendQueue:   transport.sendQueue,
+		receiveChan: transport.receiveChan,
+	}
+}
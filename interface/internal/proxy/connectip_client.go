@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+)
+
+// dialHTTP3 sends a CONNECT-IP request to server over a new QUIC connection.
+// ctx bounds the handshake.
+func dialHTTP3(ctx context.Context, server *url.URL, tlsConfig *tls.Config, quicConfig *quic.Config) (*ipSession, error) {
+	conn, err := quic.DialAddr(ctx, hostPort(server), http3.ConfigureTLSConfig(tlsConfig.Clone()), quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*ipSession, error) {
+		conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+		return nil, err
+	}
+
+	clientConn := (&http3.Transport{EnableDatagrams: true}).NewClientConn(conn)
+	select {
+	case <-ctx.Done():
+		return fail(ctx.Err())
+	case <-clientConn.ReceivedSettings():
+	}
+	if settings := clientConn.Settings(); !settings.EnableExtendedConnect || !settings.EnableDatagrams {
+		return fail(errors.New("server does not support extended CONNECT with datagrams"))
+	}
+
+	stream, err := clientConn.OpenRequestStream(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetReadDeadline(deadline)
+	}
+	err = stream.SendRequestHeader(&http.Request{
+		Method: http.MethodConnect,
+		Proto:  connectIPProtocol,
+		Host:   server.Host,
+		URL:    server,
+		Header: http.Header{http3.CapsuleProtocolHeader: {"?1"}},
+	})
+	if err != nil {
+		return fail(err)
+	}
+	response, err := stream.ReadResponse()
+	if err != nil {
+		return fail(err)
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fail(fmt.Errorf("server answered %s", response.Status))
+	}
+	stream.SetReadDeadline(time.Time{})
+
+	return newIPSession("h3", stream, stream, nil, func() {
+		stream.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+		stream.Close()
+		conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+	}, stream), nil
+}
+
+// dialHTTP2 sends a CONNECT-IP request to server with HTTP/2 extended
+// CONNECT, over a connection opened with dial. ctx bounds the session and
+// handshakeTimeout the handshake.
+func dialHTTP2(ctx context.Context, handshakeTimeout time.Duration, server *url.URL, tlsConfig *tls.Config, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (*ipSession, error) {
+	// Unlike net/http, the HTTP/2 transport passes the :protocol header on
+	client := &http2.Transport{
+		TLSClientConfig: tlsConfig.Clone(),
+		DialTLSContext: func(ctx context.Context, network, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, tlsConfig)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+	}
+
+	// The capsules to the server are the body of the request
+	reader, writer := io.Pipe()
+	requestCtx, cancel := context.WithCancel(ctx)
+	release := func() {
+		cancel()
+		writer.Close()
+		client.CloseIdleConnections()
+	}
+
+	request, err := http.NewRequestWithContext(requestCtx, http.MethodConnect, server.String(), reader)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	request.Header.Set(":protocol", connectIPProtocol)
+	request.Header.Set(http3.CapsuleProtocolHeader, "?1")
+
+	timer := time.AfterFunc(handshakeTimeout, cancel)
+	response, err := client.RoundTrip(request)
+	timer.Stop()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		response.Body.Close()
+		release()
+		return nil, fmt.Errorf("server answered %s", response.Status)
+	}
+
+	return newIPSession("h2", response.Body, writer, nil, func() {
+		release()
+		response.Body.Close()
+	}, nil), nil
+}
+
+// hostPort returns the host and port of server, 443 when it names none
+func hostPort(server *url.URL) string {
+	if server.Port() != "" {
+		return server.Host
+	}
+	return net.JoinHostPort(server.Hostname(), "443")
+}
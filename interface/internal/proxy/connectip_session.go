@@ -0,0 +1,388 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sync"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// connectIPProtocol is the :protocol of CONNECT-IP requests
+const connectIPProtocol = "connect-ip"
+
+// Capsule types of HTTP datagrams (RFC 9297) and CONNECT-IP (RFC 9484)
+const (
+	capsuleDatagram           http3.CapsuleType = 0x00
+	capsuleAddressAssign      http3.CapsuleType = 0x01
+	capsuleAddressRequest     http3.CapsuleType = 0x02
+	capsuleRouteAdvertisement http3.CapsuleType = 0x03
+)
+
+// maxCapsuleSize bounds the capsules read into memory, a DATAGRAM capsule
+// holds an IP packet of at most 64 KiB
+const maxCapsuleSize = 1 << 16
+
+// errSessionClosed is returned once a session was closed on this end
+var errSessionClosed = errors.New("connect-ip session closed")
+
+// datagramStream sends and receives the HTTP/3 datagrams of a request stream
+type datagramStream interface {
+	SendDatagram(b []byte) error
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+}
+
+// IPRoute is a range of addresses advertised as reachable through the peer
+type IPRoute struct {
+	Start netip.Addr `json:"start"`
+	End   netip.Addr `json:"end"`
+	// Protocol is the IP protocol the route is limited to, 0 for all
+	Protocol uint8 `json:"protocol"`
+}
+
+// ipSession is an established CONNECT-IP request. IP packets travel in HTTP
+// datagrams with context ID 0: QUIC DATAGRAM frames on HTTP/3 and DATAGRAM
+// capsules on the request stream on HTTP/2. The other capsules assign
+// addresses and advertise routes.
+type ipSession struct {
+	// protocol is "h3" or "h2"
+	protocol string
+
+	writer io.Writer
+	// flush pushes out what was written, nil when writes are not buffered
+	flush func() error
+	// release frees the request once the session is closed, may be nil
+	release func()
+	// datagrams is nil on HTTP/2, where packets arrive as capsules
+	datagrams datagramStream
+	packets   chan []byte
+
+	// writeMutex serializes capsules and keeps writes from racing Close
+	writeMutex sync.Mutex
+	closed     bool
+	closeOnce  sync.Once
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	err    error
+
+	mutex    sync.Mutex
+	assigned []netip.Prefix
+	routes   []IPRoute
+}
+
+// newIPSession starts reading the capsules of a request stream
+func newIPSession(protocol string, reader io.Reader, writer io.Writer, flush func() error, release func(), datagrams datagramStream) *ipSession {
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &ipSession{
+		protocol:  protocol,
+		writer:    writer,
+		flush:     flush,
+		release:   release,
+		datagrams: datagrams,
+		packets:   make(chan []byte, 16),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	go session.readCapsules(reader)
+	return session
+}
+
+// readCapsules handles the capsules of the peer until the stream ends
+func (session *ipSession) readCapsules(reader io.Reader) {
+	capsules := quicvarint.NewReader(bufio.NewReader(reader))
+	for {
+		capsuleType, capsule, err := http3.ParseCapsule(capsules)
+		if err != nil {
+			session.fail(fmt.Errorf("reading capsule: %w", err))
+			return
+		}
+
+		value, err := io.ReadAll(io.LimitReader(capsule, maxCapsuleSize+1))
+		if err != nil {
+			session.fail(fmt.Errorf("reading capsule: %w", err))
+			return
+		}
+		if len(value) > maxCapsuleSize {
+			session.fail(fmt.Errorf("capsule of type %#x is too large", capsuleType))
+			return
+		}
+
+		switch capsuleType {
+		case capsuleDatagram:
+			if session.datagrams != nil {
+				continue
+			}
+			select {
+			case session.packets <- value:
+			case <-session.ctx.Done():
+				return
+			}
+		case capsuleAddressAssign:
+			assigned, err := parseAddresses(value)
+			if err != nil {
+				session.fail(err)
+				return
+			}
+			session.mutex.Lock()
+			session.assigned = assigned
+			session.mutex.Unlock()
+		case capsuleRouteAdvertisement:
+			routes, err := parseRoutes(value)
+			if err != nil {
+				session.fail(err)
+				return
+			}
+			session.mutex.Lock()
+			session.routes = routes
+			session.mutex.Unlock()
+		}
+		// Address requests are answered by the assignment sent up front,
+		// unknown capsules are skipped as RFC 9297 asks
+	}
+}
+
+// ReadPacket returns the next IP packet from the peer. Datagrams of other
+// contexts are dropped.
+func (session *ipSession) ReadPacket() ([]byte, error) {
+	for {
+		var datagram []byte
+		if session.datagrams != nil {
+			var err error
+			if datagram, err = session.datagrams.ReceiveDatagram(session.ctx); err != nil {
+				session.fail(err)
+				return nil, session.Err()
+			}
+		} else {
+			select {
+			case datagram = <-session.packets:
+			case <-session.ctx.Done():
+				return nil, session.Err()
+			}
+		}
+
+		contextID, n, err := quicvarint.Parse(datagram)
+		if err != nil || contextID != 0 {
+			continue
+		}
+		return datagram[n:], nil
+	}
+}
+
+// WritePacket sends an IP packet to the peer
+func (session *ipSession) WritePacket(packet []byte) error {
+	datagram := make([]byte, 0, len(packet)+1)
+	datagram = quicvarint.Append(datagram, 0)
+	datagram = append(datagram, packet...)
+
+	if session.datagrams != nil {
+		if session.ctx.Err() != nil {
+			return session.Err()
+		}
+		return session.datagrams.SendDatagram(datagram)
+	}
+	return session.writeCapsule(capsuleDatagram, datagram)
+}
+
+// Assign sends the addresses assigned to the peer and the routes reachable
+// through this end
+func (session *ipSession) Assign(assigned []netip.Prefix, routes []netip.Prefix) error {
+	if len(assigned) > 0 {
+		var value []byte
+		for _, prefix := range assigned {
+			value = appendAddress(value, 0, prefix)
+		}
+		if err := session.writeCapsule(capsuleAddressAssign, value); err != nil {
+			return err
+		}
+	}
+
+	if len(routes) > 0 {
+		var value []byte
+		for _, prefix := range routes {
+			value = appendRoute(value, prefix)
+		}
+		if err := session.writeCapsule(capsuleRouteAdvertisement, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCapsule writes a capsule in a single write, so it is never split
+// around another one
+func (session *ipSession) writeCapsule(capsuleType http3.CapsuleType, value []byte) error {
+	session.writeMutex.Lock()
+	defer session.writeMutex.Unlock()
+
+	if session.closed {
+		return errSessionClosed
+	}
+
+	capsule := make([]byte, 0, len(value)+16)
+	capsule = quicvarint.Append(capsule, uint64(capsuleType))
+	capsule = quicvarint.Append(capsule, uint64(len(value)))
+	capsule = append(capsule, value...)
+	if _, err := session.writer.Write(capsule); err != nil {
+		return err
+	}
+	if session.flush != nil {
+		return session.flush()
+	}
+	return nil
+}
+
+// Assigned returns the addresses and routes the peer sent
+func (session *ipSession) Assigned() ([]netip.Prefix, []IPRoute) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.assigned, session.routes
+}
+
+// Done is closed once the session ended
+func (session *ipSession) Done() <-chan struct{} {
+	return session.ctx.Done()
+}
+
+// Err returns why the session ended
+func (session *ipSession) Err() error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.err == nil {
+		return errSessionClosed
+	}
+	return session.err
+}
+
+// fail ends the session because of err
+func (session *ipSession) fail(err error) {
+	session.mutex.Lock()
+	if session.err == nil && session.ctx.Err() == nil {
+		session.err = err
+	}
+	session.mutex.Unlock()
+	session.Close()
+}
+
+// Close ends the session, no write reaches the stream once it returned
+func (session *ipSession) Close() {
+	// Releasing the request first unblocks a write stuck on the peer
+	session.closeOnce.Do(func() {
+		session.cancel()
+		if session.release != nil {
+			session.release()
+		}
+	})
+
+	session.writeMutex.Lock()
+	session.closed = true
+	session.writeMutex.Unlock()
+}
+
+// appendAddress appends an assigned address: the request ID it answers, the
+// IP version, the address and the prefix length
+func appendAddress(b []byte, requestID uint64, prefix netip.Prefix) []byte {
+	b = quicvarint.Append(b, requestID)
+	b = append(b, ipVersion(prefix.Addr()))
+	b = append(b, prefix.Addr().AsSlice()...)
+	return append(b, byte(prefix.Bits()))
+}
+
+// parseAddresses parses the addresses of an ADDRESS_ASSIGN capsule
+func parseAddresses(value []byte) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for len(value) > 0 {
+		_, n, err := quicvarint.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("malformed address: %w", err)
+		}
+		addr, rest, err := parseAddr(value[n:])
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) < 1 {
+			return nil, errors.New("malformed address: no prefix length")
+		}
+		prefix, err := addr.Prefix(int(rest[0]))
+		if err != nil {
+			return nil, fmt.Errorf("malformed address: %w", err)
+		}
+		prefixes = append(prefixes, prefix)
+		value = rest[1:]
+	}
+	return prefixes, nil
+}
+
+// appendRoute appends a route for all protocols to the addresses of prefix
+func appendRoute(b []byte, prefix netip.Prefix) []byte {
+	prefix = prefix.Masked()
+	b = append(b, ipVersion(prefix.Addr()))
+	b = append(b, prefix.Addr().AsSlice()...)
+	b = append(b, lastAddr(prefix).AsSlice()...)
+	return append(b, 0)
+}
+
+// parseRoutes parses the routes of a ROUTE_ADVERTISEMENT capsule
+func parseRoutes(value []byte) ([]IPRoute, error) {
+	var routes []IPRoute
+	for len(value) > 0 {
+		start, rest, err := parseAddr(value)
+		if err != nil {
+			return nil, err
+		}
+		size := start.BitLen() / 8
+		if len(rest) < size+1 {
+			return nil, errors.New("malformed route: truncated")
+		}
+		end, _ := netip.AddrFromSlice(rest[:size])
+		if end.Less(start) {
+			return nil, errors.New("malformed route: ends before it starts")
+		}
+		routes = append(routes, IPRoute{Start: start, End: end, Protocol: rest[size]})
+		value = rest[size+1:]
+	}
+	return routes, nil
+}
+
+// parseAddr parses an IP version byte and the address that follows it
+func parseAddr(b []byte) (netip.Addr, []byte, error) {
+	if len(b) < 1 {
+		return netip.Addr{}, nil, errors.New("malformed address: truncated")
+	}
+	size := 4
+	switch b[0] {
+	case 4:
+	case 6:
+		size = 16
+	default:
+		return netip.Addr{}, nil, fmt.Errorf("malformed address: IP version %d", b[0])
+	}
+	if len(b) < 1+size {
+		return netip.Addr{}, nil, errors.New("malformed address: truncated")
+	}
+	addr, _ := netip.AddrFromSlice(b[1 : 1+size])
+	return addr, b[1+size:], nil
+}
+
+// ipVersion returns the IP version byte of addr
+func ipVersion(addr netip.Addr) byte {
+	if addr.Is4() {
+		return 4
+	}
+	return 6
+}
+
+// lastAddr returns the highest address of prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Masked().Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(addr)*8; bit++ {
+		addr[bit/8] |= 0x80 >> (bit % 8)
+	}
+	last, _ := netip.AddrFromSlice(addr)
+	return last
+}
@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"thinkpol-vpn/interface/internal/config"
+	"thinkpol-vpn/interface/internal/keepalive"
+	"thinkpol-vpn/interface/internal/upstream"
+)
+
+const connectIPPath = "/.well-known/masque/ip/*/*/"
+
+// writeCertificate writes a self-signed certificate for 127.0.0.1 and its
+// key to dir, returning their paths and a pool trusting the certificate
+func writeCertificate(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(certificate)
+	return certFile, keyFile, roots
+}
+
+// connectIPPair starts a server transport and a client transport connecting
+// to it. Without HTTP/3 on the server the client has to fall back to HTTP/2.
+func connectIPPair(t *testing.T, http3 bool, upstreamProxy upstream.Settings) (*ConnectIPProxy, *ConnectIPProxy) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(output) })
+
+	settings, err := keepalive.New(config.KeepaliveConfig{IntervalMS: 500, TimeoutMS: 2000, WriteTimeoutMS: 1000})
+	if err != nil {
+		t.Fatalf("keepalive.New: %v", err)
+	}
+
+	certFile, keyFile, roots := writeCertificate(t, t.TempDir())
+	server, err := NewConnectIPProxy(config.ConnectIPConfig{
+		Listen:      "127.0.0.1:0",
+		Path:        connectIPPath,
+		CertFile:    certFile,
+		KeyFile:     keyFile,
+		PeerAddress: "10.0.0.2/32",
+		Routes:      []string{"0.0.0.0/0", "2001:db8::/32"},
+	}, 1500)
+	if err != nil {
+		t.Fatalf("NewConnectIPProxy: %v", err)
+	}
+	server.SetKeepalive(settings)
+	if err := server.Listen(); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	if !http3 {
+		server.http3Server.Close()
+	}
+	server.Start()
+	t.Cleanup(server.Stop)
+
+	client, err := NewConnectIPProxy(config.ConnectIPConfig{
+		Server:        "https://" + server.Addr() + connectIPPath,
+		HTTP2Fallback: true,
+	}, 1500)
+	if err != nil {
+		t.Fatalf("NewConnectIPProxy: %v", err)
+	}
+	client.SetKeepalive(settings)
+	client.SetTLSConfig(&tls.Config{RootCAs: roots})
+	client.SetUpstreamProxy(upstreamProxy)
+	client.Start()
+	t.Cleanup(client.Stop)
+
+	return server, client
+}
+
+// exchangePackets sends a packet each way and checks that it arrives
+func exchangePackets(t *testing.T, server *ConnectIPProxy, client *ConnectIPProxy) {
+	// As large as a tunnel packet gets with the default MTU
+	packet := bytes.Repeat([]byte{0x45}, 1500-107)
+
+	for _, pair := range []struct {
+		name     string
+		from, to *ConnectIPProxy
+	}{
+		{"client to server", client, server},
+		{"server to client", server, client},
+	} {
+		pair.from.SendToTransport(len(packet), packet)
+		select {
+		case received := <-pair.to.ReceiveFromTransport():
+			if !bytes.Equal(received.GetBuffer(), packet) {
+				t.Errorf("%s: received a different packet than was sent", pair.name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the packet never arrived", pair.name)
+		}
+	}
+}
+
+// TestConnectIPHTTP3 connects over HTTP/3 and checks the assigned address
+// and routes the client got
+func TestConnectIPHTTP3(t *testing.T) {
+	server, client := connectIPPair(t, true, upstream.Settings{})
+
+	established := func() bool {
+		status := client.Stats().ConnectIP
+		return status.Protocol != "" && len(status.Routes) == 2 && server.Stats().Peer == keepalive.StateAlive
+	}
+	if !waitFor(10*time.Second, established) {
+		t.Fatalf("no session established, client status %+v", client.Stats().ConnectIP)
+	}
+
+	status := client.Stats().ConnectIP
+	if status.Protocol != "h3" {
+		t.Errorf("protocol = %q, want h3", status.Protocol)
+	}
+	if len(status.Assigned) != 1 || status.Assigned[0] != netip.MustParsePrefix("10.0.0.2/32") {
+		t.Errorf("assigned = %v, want 10.0.0.2/32", status.Assigned)
+	}
+	want := []IPRoute{
+		{Start: netip.MustParseAddr("0.0.0.0"), End: netip.MustParseAddr("255.255.255.255")},
+		{Start: netip.MustParseAddr("2001:db8::"), End: netip.MustParseAddr("2001:db8:ffff:ffff:ffff:ffff:ffff:ffff")},
+	}
+	for i, route := range status.Routes {
+		if route != want[i] {
+			t.Errorf("route %d = %+v, want %+v", i, route, want[i])
+		}
+	}
+
+	exchangePackets(t, server, client)
+}
+
+// TestConnectIPHTTP2 connects to a server without HTTP/3, so the client falls
+// back to HTTP/2 extended CONNECT
+func TestConnectIPHTTP2(t *testing.T) {
+	if !extendedConnect(t) {
+		return
+	}
+
+	server, client := connectIPPair(t, false, upstream.Settings{})
+
+	established := func() bool {
+		status := client.Stats().ConnectIP
+		return status.Protocol != "" && len(status.Assigned) == 1 && server.Stats().Peer == keepalive.StateAlive
+	}
+	if !waitFor(15*time.Second, established) {
+		t.Fatalf("no session established, client status %+v", client.Stats().ConnectIP)
+	}
+	if protocol := client.Stats().ConnectIP.Protocol; protocol != "h2" {
+		t.Errorf("protocol = %q, want h2", protocol)
+	}
+
+	exchangePackets(t, server, client)
+}
+
+// TestConnectIPUpstreamProxy connects through an HTTP proxy, which only
+// carries HTTP/2
+func TestConnectIPUpstreamProxy(t *testing.T) {
+	if !extendedConnect(t) {
+		return
+	}
+
+	var connects atomic.Int32
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpzZWNyZXQ=" {
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		conn, buffered, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		connects.Add(1)
+
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(upstream, buffered)
+		io.Copy(conn, upstream)
+	}))
+	defer proxyServer.Close()
+
+	settings, err := upstream.New(config.UpstreamProxyConfig{URL: proxyServer.URL, Username: "user", Password: "secret"})
+	if err != nil {
+		t.Fatalf("upstream.New: %v", err)
+	}
+	server, client := connectIPPair(t, true, settings)
+
+	established := func() bool {
+		return client.Stats().ConnectIP.Protocol != "" && server.Stats().Peer == keepalive.StateAlive
+	}
+	if !waitFor(10*time.Second, established) {
+		t.Fatalf("no session established, client status %+v", client.Stats().ConnectIP)
+	}
+	if protocol := client.Stats().ConnectIP.Protocol; protocol != "h2" {
+		t.Errorf("protocol = %q, want h2 through the proxy", protocol)
+	}
+	if connects.Load() != 1 {
+		t.Errorf("%d connections through the proxy, want 1", connects.Load())
+	}
+
+	exchangePackets(t, server, client)
+}
+
+// extendedConnect reports whether the HTTP/2 client sends extended CONNECT,
+// which it only does when GODEBUG has http2xconnect=1 at startup. Otherwise
+// it runs the test in a process that has it and returns false.
+func extendedConnect(t *testing.T) bool {
+	if strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		return true
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), "GODEBUG="+strings.TrimPrefix(os.Getenv("GODEBUG")+",http2xconnect=1", ","))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	return false
+}
+
+func TestCapsules(t *testing.T) {
+	prefixes := []netip.Prefix{netip.MustParsePrefix("10.0.0.2/32"), netip.MustParsePrefix("fd00::/64")}
+	var value []byte
+	for _, prefix := range prefixes {
+		value = appendAddress(value, 0, prefix)
+	}
+	parsed, err := parseAddresses(value)
+	if err != nil {
+		t.Fatalf("parseAddresses: %v", err)
+	}
+	if len(parsed) != 2 || parsed[0] != prefixes[0] || parsed[1] != prefixes[1] {
+		t.Errorf("parseAddresses = %v, want %v", parsed, prefixes)
+	}
+
+	routes, err := parseRoutes(appendRoute(nil, netip.MustParsePrefix("192.168.1.7/24")))
+	if err != nil {
+		t.Fatalf("parseRoutes: %v", err)
+	}
+	want := IPRoute{Start: netip.MustParseAddr("192.168.1.0"), End: netip.MustParseAddr("192.168.1.255")}
+	if len(routes) != 1 || routes[0] != want {
+		t.Errorf("parseRoutes = %+v, want %+v", routes, want)
+	}
+
+	if _, err := parseRoutes([]byte{4, 10, 0, 0, 9, 10, 0, 0, 1, 0}); err == nil {
+		t.Error("parseRoutes accepted a route ending before it starts")
+	}
+	if _, err := parseAddresses([]byte{0, 5, 1, 2, 3, 4, 32}); err == nil {
+		t.Error("parseAddresses accepted IP version 5")
+	}
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/compress"
+	"thinkpol-vpn/interface/internal/keepalive"
+	"thinkpol-vpn/interface/internal/ratelimit"
+	"thinkpol-vpn/interface/internal/scheduler"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	transportPacketsDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_packets_total",
+		"Packets carried over the websocket.",
+		[]string{"direction"}, nil,
+	)
+	transportBytesDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_bytes_total",
+		"Packet bytes carried over the websocket.",
+		[]string{"direction"}, nil,
+	)
+	transportDroppedDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_dropped_packets_total",
+		"Packets dropped because they could not be sent.",
+		nil, nil,
+	)
+	transportParseErrorsDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_parse_errors_total",
+		"Messages read from the websocket that were not valid packets.",
+		nil, nil,
+	)
+	transportHandshakesDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_handshakes_total",
+		"Websocket upgrade attempts by outcome.",
+		[]string{"outcome"}, nil,
+	)
+	transportReconnectsDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_reconnects_total",
+		"Restarts after a lost connection and retried dials to the peer.",
+		nil, nil,
+	)
+	transportRTTDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_rtt_seconds",
+		"Last round trip time measured with a keepalive ping.",
+		nil, nil,
+	)
+	transportDeadPeersDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_dead_peers_total",
+		"Connections dropped because the peer stopped answering keepalives.",
+		nil, nil,
+	)
+	transportPeerUpDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_peer_up",
+		"Whether a peer is connected and answering keepalives.",
+		nil, nil,
+	)
+	transportQueueDepthDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_queue_depth",
+		"Packets waiting in a transport queue.",
+		[]string{"queue"}, nil,
+	)
+	transportThrottledPacketsDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_throttled_packets_total",
+		"Packets held back or dropped by the rate limit.",
+		[]string{"direction", "action"}, nil,
+	)
+	transportThrottledBytesDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_throttled_bytes_total",
+		"Bytes held back or dropped by the rate limit.",
+		[]string{"direction", "action"}, nil,
+	)
+	transportClassPacketsDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_class_packets_total",
+		"Packets through each traffic class of the send queue, by outcome.",
+		[]string{"class", "outcome"}, nil,
+	)
+	transportClassBlockedDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_class_blocked_total",
+		"Packets whose sender waited for room in a full traffic class.",
+		[]string{"class"}, nil,
+	)
+	transportClassQueueDepthDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_class_queue_depth",
+		"Packets waiting in each traffic class of the send queue.",
+		[]string{"class"}, nil,
+	)
+	transportQueueCapacityDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_queue_capacity",
+		"Number of packets a transport queue holds.",
+		[]string{"queue"}, nil,
+	)
+	transportCompressionMessagesDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_compression_messages_total",
+		"Messages sent on a compressed connection, by whether they were compressed.",
+		[]string{"outcome"}, nil,
+	)
+	transportCompressionBytesDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_compression_bytes_total",
+		"Size of the compressed messages before and after compression.",
+		[]string{"direction", "size"}, nil,
+	)
+	transportCompressionRatioDesc = prometheus.NewDesc(
+		"thinkpol_vpn_transport_compression_ratio",
+		"Uncompressed over compressed size of the compressed messages.",
+		[]string{"direction"}, nil,
+	)
+)
+
+// transportCollector exports the transport counters as Prometheus metrics
+type transportCollector struct {
+	transport Transport
+	stats     *Stats
+	// sendQueue and receiveChan are the queues of the transport, for their
+	// capacity
+	sendQueue   *scheduler.Scheduler
+	receiveChan chan *protobuf.PacketV4
+}
+
+// Collector returns a Prometheus collector for the transport metrics
+func (transport *RawWebSocketVpnProxy) Collector() prometheus.Collector {
+	return &transportCollector{
+		transport:   transport,
+		stats:       transport.stats,
+		sendQueue:   transport.send_queue,
+		receiveChan: transport.recieve_chan,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (collector *transportCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- transportPacketsDesc
+	descs <- transportBytesDesc
+	descs <- transportDroppedDesc
+	descs <- transportParseErrorsDesc
+	descs <- transportHandshakesDesc
+	descs <- transportReconnectsDesc
+	descs <- transportRTTDesc
+	descs <- transportDeadPeersDesc
+	descs <- transportPeerUpDesc
+	descs <- transportQueueDepthDesc
+	descs <- transportQueueCapacityDesc
+	descs <- transportThrottledPacketsDesc
+	descs <- transportThrottledBytesDesc
+	descs <- transportClassPacketsDesc
+	descs <- transportClassBlockedDesc
+	descs <- transportClassQueueDepthDesc
+	descs <- transportCompressionMessagesDesc
+	descs <- transportCompressionBytesDesc
+	descs <- transportCompressionRatioDesc
+	collector.stats.writeDuration.Describe(descs)
+}
+
+// Collect implements prometheus.Collector
+func (collector *transportCollector) Collect(metrics chan<- prometheus.Metric) {
+	transport := collector.transport
+	stats := transport.Stats()
+
+	counter := func(desc *prometheus.Desc, value uint64, labels ...string) {
+		metrics <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), labels...)
+	}
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		metrics <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+	}
+
+	counter(transportPacketsDesc, stats.PacketsSent, "sent")
+	counter(transportPacketsDesc, stats.PacketsReceived, "received")
+	counter(transportBytesDesc, stats.BytesSent, "sent")
+	counter(transportBytesDesc, stats.BytesReceived, "received")
+	counter(transportDroppedDesc, stats.Dropped)
+	counter(transportParseErrorsDesc, stats.ParseErrors)
+	counter(transportHandshakesDesc, stats.HandshakesAccepted, "accepted")
+	counter(transportHandshakesDesc, stats.HandshakesBusy, "busy")
+	counter(transportHandshakesDesc, stats.HandshakesFailed, "failed")
+	counter(transportReconnectsDesc, stats.Reconnects)
+	gauge(transportRTTDesc, stats.RTT.Seconds())
+	counter(transportDeadPeersDesc, stats.DeadPeers)
+	if stats.Peer == keepalive.StateAlive {
+		gauge(transportPeerUpDesc, 1)
+	} else {
+		gauge(transportPeerUpDesc, 0)
+	}
+
+	send, receive := transport.QueueDepths()
+	gauge(transportQueueDepthDesc, float64(send), "send")
+	gauge(transportQueueDepthDesc, float64(receive), "receive")
+	gauge(transportQueueCapacityDesc, float64(collector.sendQueue.Capacity()), "send")
+	gauge(transportQueueCapacityDesc, float64(cap(collector.receiveChan)), "receive")
+
+	throttled := func(direction string, bucket ratelimit.BucketStatus) {
+		counter(transportThrottledPacketsDesc, bucket.DelayedPackets, direction, "delayed")
+		counter(transportThrottledPacketsDesc, bucket.DroppedPackets, direction, "dropped")
+		counter(transportThrottledBytesDesc, bucket.DelayedBytes, direction, "delayed")
+		counter(transportThrottledBytesDesc, bucket.DroppedBytes, direction, "dropped")
+	}
+	throttled("sent", stats.RateLimit.Send)
+	throttled("received", stats.RateLimit.Receive)
+
+	for _, class := range stats.Scheduler {
+		counter(transportClassPacketsDesc, class.Dequeued, class.Class, "dequeued")
+		counter(transportClassPacketsDesc, class.DroppedFull, class.Class, "dropped_full")
+		counter(transportClassPacketsDesc, class.DroppedHead, class.Class, "dropped_head")
+		counter(transportClassPacketsDesc, class.DroppedAQM, class.Class, "dropped_aqm")
+		counter(transportClassBlockedDesc, class.Blocked, class.Class)
+		gauge(transportClassQueueDepthDesc, float64(class.Queued), class.Class)
+	}
+
+	compression := stats.Compression
+	counter(transportCompressionMessagesDesc, compression.Sent.Messages, "compressed")
+	counter(transportCompressionMessagesDesc, compression.SkippedSmall, "skipped_small")
+	counter(transportCompressionMessagesDesc, compression.SkippedEntropy, "skipped_entropy")
+	counter(transportCompressionMessagesDesc, compression.Incompressible, "incompressible")
+	compressed := func(direction string, status compress.DirectionStatus) {
+		counter(transportCompressionBytesDesc, status.UncompressedBytes, direction, "uncompressed")
+		counter(transportCompressionBytesDesc, status.CompressedBytes, direction, "compressed")
+		gauge(transportCompressionRatioDesc, status.Ratio, direction)
+	}
+	compressed("sent", compression.Sent)
+	compressed("received", compression.Received)
+
+	collector.stats.writeDuration.Collect(metrics)
+}
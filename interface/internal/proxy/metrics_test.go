@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"thinkpol-vpn/interface/api/protobuf"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTransportCollector(t *testing.T) {
+	transport := NewRawWebSocketVpnProxy()
+	stats := transport.stats
+	stats.recordSent(100)
+	stats.recordSent(200)
+	stats.recordReceived(50)
+	stats.handshakesAccepted.Add(2)
+	stats.handshakesBusy.Add(1)
+	stats.handshakesFailed.Add(3)
+	stats.reconnects.Add(4)
+
+	transport.send_queue.Enqueue(&protobuf.PacketV4{Buffer: []byte{0x45, 0, 0, 20}})
+	transport.send_queue.Enqueue(&protobuf.PacketV4{Buffer: []byte{0x45, 0, 0, 20}})
+	transport.recieve_chan <- &protobuf.PacketV4{Buffer: []byte{0x45, 0, 0, 20}}
+
+	expected := fmt.Sprintf(`
+# HELP thinkpol_vpn_transport_packets_total Packets carried over the websocket.
+# TYPE thinkpol_vpn_transport_packets_total counter
+thinkpol_vpn_transport_packets_total{direction="received"} 1
+thinkpol_vpn_transport_packets_total{direction="sent"} 2
+# HELP thinkpol_vpn_transport_bytes_total Packet bytes carried over the websocket.
+# TYPE thinkpol_vpn_transport_bytes_total counter
+thinkpol_vpn_transport_bytes_total{direction="received"} 50
+thinkpol_vpn_transport_bytes_total{direction="sent"} 300
+# HELP thinkpol_vpn_transport_handshakes_total Websocket upgrade attempts by outcome.
+# TYPE thinkpol_vpn_transport_handshakes_total counter
+thinkpol_vpn_transport_handshakes_total{outcome="accepted"} 2
+thinkpol_vpn_transport_handshakes_total{outcome="busy"} 1
+thinkpol_vpn_transport_handshakes_total{outcome="failed"} 3
+# HELP thinkpol_vpn_transport_reconnects_total Restarts after a lost connection and retried dials to the peer.
+# TYPE thinkpol_vpn_transport_reconnects_total counter
+thinkpol_vpn_transport_reconnects_total 4
+# HELP thinkpol_vpn_transport_queue_depth Packets waiting in a transport queue.
+# TYPE thinkpol_vpn_transport_queue_depth gauge
+thinkpol_vpn_transport_queue_depth{queue="receive"} 1
+thinkpol_vpn_transport_queue_depth{queue="send"} 2
+# HELP thinkpol_vpn_transport_queue_capacity Number of packets a transport queue holds.
+# TYPE thinkpol_vpn_transport_queue_capacity gauge
+thinkpol_vpn_transport_queue_capacity{queue="receive"} 1
+thinkpol_vpn_transport_queue_capacity{queue="send"} %d
+`, transport.send_queue.Capacity())
+
+	if err := testutil.CollectAndCompare(transport.Collector(), strings.NewReader(expected),
+		"thinkpol_vpn_transport_packets_total",
+		"thinkpol_vpn_transport_bytes_total",
+		"thinkpol_vpn_transport_handshakes_total",
+		"thinkpol_vpn_transport_reconnects_total",
+		"thinkpol_vpn_transport_queue_depth",
+		"thinkpol_vpn_transport_queue_capacity",
+	); err != nil {
+		t.Error(err)
+	}
+}
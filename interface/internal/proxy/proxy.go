@@ -2,10 +2,27 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
 	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/capture"
+	"thinkpol-vpn/interface/internal/compress"
+	"thinkpol-vpn/interface/internal/config"
+	"thinkpol-vpn/interface/internal/ethernet"
+	"thinkpol-vpn/interface/internal/gateway"
+	"thinkpol-vpn/interface/internal/keepalive"
+	"thinkpol-vpn/interface/internal/obfuscate"
+	"thinkpol-vpn/interface/internal/ratelimit"
+	"thinkpol-vpn/interface/internal/scheduler"
+	"thinkpol-vpn/interface/internal/upstream"
 
 	"github.com/gorilla/websocket"
 
@@ -16,19 +33,67 @@ type RawWebSocketVpnProxy struct {
 	upgrader *websocket.Upgrader
 
 	// TODO: rethink
-	send_chan    chan *protobuf.PacketV4
+	send_queue   *scheduler.Scheduler
 	recieve_chan chan *protobuf.PacketV4
-	conn         *websocket.Conn
-	cancel       *context.CancelFunc
+
+	// mutex guards the connection, which comes and goes while the loops run
+	mutex  sync.Mutex
+	conn   *websocket.Conn
+	ctx    context.Context
+	cancel *context.CancelFunc
+	// connected is closed once the peer connects, every start serves a single
+	// connection
+	connected chan struct{}
+
+	stats    *Stats
+	capturer *capture.Capturer
+	shaper   *ratelimit.Shaper
+
+	keepalive keepalive.Settings
+	// monitor tracks the peer of the current connection, it is kept after
+	// the connection drops so the status tells why. Guarded by mutex.
+	monitor *keepalive.Monitor
+	// restartMutex makes only the first failure of a connection restart
+	restartMutex sync.Mutex
+
+	compression compress.Settings
+	// compressor compresses the messages of the current connection, nil when
+	// the peer did not negotiate compression. Guarded by mutex.
+	compressor *compress.Compressor
+
+	obfuscation obfuscate.Settings
+
+	// ethernet makes the transport carry the Ethernet frames of a TAP
+	// interface instead of IP packets
+	ethernet bool
+
+	// peer is the transport this end connects to, nil when the peer
+	// connects to this end. The handshake carries peerHeader.
+	peer       *url.URL
+	peerHeader http.Header
+	dialer     *websocket.Dialer
+	upstream   upstream.Settings
+	// pluggableTransport dials the peer through a client pluggable
+	// transport, nil to dial it directly or through the upstream proxy
+	pluggableTransport func(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
+// peerDisconnected is the peer state reported while no peer is connected
+const peerDisconnected = "disconnected"
+
 func NewRawWebSocketVpnProxy() *RawWebSocketVpnProxy {
 	upgrader := websocket.Upgrader{}
+	shaper, _ := ratelimit.NewShaper(config.RateLimitConfig{})
+	sendQueue, _ := scheduler.New(config.Default().Scheduler)
+	keepaliveSettings, _ := keepalive.New(config.Default().Keepalive)
 
 	transport := RawWebSocketVpnProxy{
 		upgrader:     &upgrader,
-		send_chan:    make(chan (*protobuf.PacketV4), 1),
+		send_queue:   sendQueue,
 		recieve_chan: make(chan (*protobuf.PacketV4), 1),
+		stats:        newStats(),
+		shaper:       shaper,
+		keepalive:    keepaliveSettings,
 	}
 
 	return &transport
@@ -36,9 +101,27 @@ func NewRawWebSocketVpnProxy() *RawWebSocketVpnProxy {
 
 func (transport *RawWebSocketVpnProxy) Start() {
 	ctx, cancel := context.WithCancel(context.Background())
+	connected := make(chan struct{})
+
+	transport.mutex.Lock()
+	transport.ctx = ctx
 	transport.cancel = &cancel
+	transport.connected = connected
+	transport.mutex.Unlock()
+
+	if transport.peer != nil {
+		go transport.dialLoop(ctx)
+	}
 
 	go func() {
+		select {
+		case <-ctx.Done():
+			log.Println("websocket read handler stopped")
+			return
+		case <-connected:
+		}
+		conn, monitor, compressor := transport.current()
+
 		for {
 			select {
 			case <-ctx.Done():
@@ -48,26 +131,50 @@ func (transport *RawWebSocketVpnProxy) Start() {
 				break
 			}
 
-			if transport.conn == nil {
-				continue
-			}
-
-			mt, message, err := transport.conn.ReadMessage()
+			conn.SetReadDeadline(monitor.ReadDeadline())
+			mt, message, err := conn.ReadMessage()
 			if err != nil {
 				log.Println("socket read error", err)
+				transport.restart(ctx, err)
 				return
 			}
+			monitor.Seen()
 			if mt != websocket.BinaryMessage {
+				// Packets only come in binary messages, anything else is dropped
 				log.Println("unsupported mt")
-				return
+				transport.stats.parseErrors.Add(1)
+				continue
 			}
 
-			var packet *protobuf.PacketV4
-			err = proto.Unmarshal(message, packet)
+			if compressor != nil {
+				if message, err = compressor.Decode(message); err != nil {
+					log.Println("error decompressing packet", err)
+					transport.stats.parseErrors.Add(1)
+					continue
+				}
+			}
+
+			packet, err := transport.unmarshal(message)
+			if err != nil {
+				log.Println("error unmarshaling packet", err)
+				transport.stats.parseErrors.Add(1)
+				continue
+			}
+			transport.stats.recordReceived(len(packet.GetBuffer()))
+			transport.capture(capture.Inbound, packet.GetBuffer())
 
 			log.Println("successfully unmarshaled packet")
 
-			transport.recieve_chan <- packet
+			if !transport.shaper.Receive.Wait(ctx, len(packet.GetBuffer())) {
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				log.Println("websocket read handler stopped")
+				return
+			case transport.recieve_chan <- packet:
+			}
 
 			log.Println("sent packet to recieve_chan")
 		}
@@ -75,36 +182,224 @@ func (transport *RawWebSocketVpnProxy) Start() {
 
 	go func() {
 		for {
-			var packet *protobuf.PacketV4
-
-			select {
-			case <-ctx.Done():
+			packet := transport.send_queue.Dequeue(ctx)
+			if packet == nil {
 				log.Println("websocket write handler stopped")
 				return
-			case packet = <-transport.send_chan:
 			}
 
-			message, err := proto.Marshal(packet)
+			if !transport.shaper.Send.Wait(ctx, len(packet.GetBuffer())) {
+				continue
+			}
+
+			if !transport.obfuscation.Delay(ctx) {
+				continue
+			}
+
+			// A packet that cannot be encoded is dropped, the connection is fine
+			message, err := transport.marshal(packet)
 			if err != nil {
 				log.Println("error marshaling packet", err)
-				return
+				transport.stats.dropped.Add(1)
+				continue
 			}
 
 			log.Println("successfully marshaled packet")
 
-			err = transport.conn.WriteMessage(websocket.BinaryMessage, message)
+			conn, monitor, compressor := transport.current()
+			if conn == nil {
+				transport.stats.dropped.Add(1)
+				continue
+			}
+			if compressor != nil {
+				message = compressor.Encode(message, packet.GetBuffer())
+			}
+
+			started := time.Now()
+			conn.SetWriteDeadline(monitor.WriteDeadline())
+			err = conn.WriteMessage(websocket.BinaryMessage, message)
+			transport.stats.writeDuration.Observe(time.Since(started).Seconds())
 
 			if err != nil {
 				log.Println("error sending message", err)
+				transport.stats.dropped.Add(1)
+				transport.restart(ctx, err)
 				return
 			}
+			transport.stats.recordSent(len(packet.GetBuffer()))
+			transport.capture(capture.Outbound, packet.GetBuffer())
 
 			log.Println("sent packet to transport")
 		}
 	}()
 }
 
+// restart drops a connection that failed so the peer can connect again. ctx
+// is the one the failing goroutine was started with, once it is done the
+// failure was already handled or caused by Stop.
+func (transport *RawWebSocketVpnProxy) restart(ctx context.Context, err error) {
+	transport.restartMutex.Lock()
+	defer transport.restartMutex.Unlock()
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	if errors.Is(err, keepalive.ErrDeadPeer) || keepalive.IsTimeout(err) {
+		log.Printf("    [KEEPALIVE] Peer is dead (%v), dropping the connection", err)
+		transport.stats.deadPeers.Add(1)
+		if _, monitor, _ := transport.current(); monitor != nil {
+			monitor.MarkDead()
+		}
+	}
+
+	transport.stats.reconnects.Add(1)
+	transport.Stop()
+	transport.Start()
+}
+
+// marshal turns a packet, or a frame in TAP mode, into a message for the wire
+func (transport *RawWebSocketVpnProxy) marshal(packet *protobuf.PacketV4) ([]byte, error) {
+	if transport.ethernet {
+		return ethernet.Marshal(packet.GetBuffer(), transport.obfuscation)
+	}
+	return proto.Marshal(transport.obfuscation.Pad(packet))
+}
+
+// unmarshal returns the packet, or the frame in TAP mode, a message carries
+func (transport *RawWebSocketVpnProxy) unmarshal(message []byte) (*protobuf.PacketV4, error) {
+	if transport.ethernet {
+		return ethernet.Unmarshal(message)
+	}
+	packet := &protobuf.PacketV4{}
+	if err := proto.Unmarshal(message, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// capture records a packet the transport carried. Captures hold IP packets,
+// so in TAP mode only the packets inside frames are recorded.
+func (transport *RawWebSocketVpnProxy) capture(direction capture.Direction, buffer []byte) {
+	if transport.ethernet {
+		if buffer = ethernet.Packet(buffer); buffer == nil {
+			return
+		}
+	}
+	transport.capturer.Capture(capture.Point{Source: capture.SourceTransport, Direction: direction}, buffer)
+}
+
+// current returns the connection, nil while no peer is connected, the
+// monitor of the last peer and the compressor of the connection
+func (transport *RawWebSocketVpnProxy) current() (*websocket.Conn, *keepalive.Monitor, *compress.Compressor) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	return transport.conn, transport.monitor, transport.compressor
+}
+
+// SetKeepalive changes how the peer is checked for liveness. It must be
+// called before Start.
+func (transport *RawWebSocketVpnProxy) SetKeepalive(settings keepalive.Settings) {
+	transport.keepalive = settings
+}
+
+// SetCompression sets the compression algorithms peers may negotiate. It
+// must be called before Start.
+func (transport *RawWebSocketVpnProxy) SetCompression(settings compress.Settings) {
+	transport.compression = settings
+}
+
+// SetObfuscation sets how the transport disguises its traffic. It must be
+// called before Start.
+func (transport *RawWebSocketVpnProxy) SetObfuscation(settings obfuscate.Settings) {
+	transport.obfuscation = settings
+}
+
+// SetEthernet makes the transport carry the Ethernet frames of a TAP
+// interface, only peers that ask for frames in the handshake are accepted.
+// It must be called before Start.
+func (transport *RawWebSocketVpnProxy) SetEthernet(enabled bool) {
+	transport.ethernet = enabled
+}
+
+// SetPeer makes the transport connect to the peer instead of waiting for it
+// to connect. It must be called before Start.
+func (transport *RawWebSocketVpnProxy) SetPeer(peerConfig config.PeerConfig) error {
+	peer, err := url.Parse(peerConfig.URL)
+	if err != nil {
+		return fmt.Errorf("invalid peer: %w", err)
+	}
+	if peer.Scheme != "ws" && peer.Scheme != "wss" {
+		return fmt.Errorf("peer %q is not a ws or wss URL", peerConfig.URL)
+	}
+
+	transport.peer = peer
+	transport.peerHeader = make(http.Header)
+	if peerConfig.Token != "" {
+		transport.peerHeader.Set("Authorization", "Bearer "+peerConfig.Token)
+	}
+	transport.dialer = &websocket.Dialer{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: peerConfig.InsecureSkipVerify},
+	}
+	return nil
+}
+
+// SetUpstreamProxy makes the connections to the peer go through a proxy. It
+// must be called before Start.
+func (transport *RawWebSocketVpnProxy) SetUpstreamProxy(settings upstream.Settings) {
+	transport.upstream = settings
+}
+
+// SetPluggableTransport makes the connections to the peer go through the
+// SOCKS5 proxy of a client pluggable transport, which connects through the
+// upstream proxy itself. It must be called before Start.
+func (transport *RawWebSocketVpnProxy) SetPluggableTransport(dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	transport.pluggableTransport = dial
+}
+
+// SetScheduler replaces the queue of packets waiting to be sent. It must be
+// called before Start.
+func (transport *RawWebSocketVpnProxy) SetScheduler(sendQueue *scheduler.Scheduler) {
+	transport.send_queue = sendQueue
+}
+
+// SetCapturer makes the transport record the packets it carries. It must be
+// called before Start.
+func (transport *RawWebSocketVpnProxy) SetCapturer(capturer *capture.Capturer) {
+	transport.capturer = capturer
+}
+
+// RateLimit returns the shaper that limits the traffic of the peer
+func (transport *RawWebSocketVpnProxy) RateLimit() *ratelimit.Shaper {
+	return transport.shaper
+}
+
+// Stats returns a snapshot of the transport counters
+func (transport *RawWebSocketVpnProxy) Stats() StatsSnapshot {
+	snapshot := transport.stats.Snapshot()
+	snapshot.RateLimit = transport.shaper.Status()
+	snapshot.Scheduler = transport.send_queue.Stats()
+
+	snapshot.Peer = peerDisconnected
+	conn, monitor, compressor := transport.current()
+	if conn != nil && compressor != nil {
+		snapshot.Compression.Algorithm = compressor.Algorithm()
+	}
+	if monitor != nil {
+		status := monitor.Status()
+		snapshot.LastSeen = &status.LastSeen
+		// A dead peer stays reported as such until it reconnects
+		if conn != nil || status.State == keepalive.StateDead {
+			snapshot.Peer = status.State
+		}
+	}
+	return snapshot
+}
+
 func (transport *RawWebSocketVpnProxy) Stop() {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
 	if transport.cancel != nil {
 		(*transport.cancel)()
 	}
@@ -114,31 +409,194 @@ func (transport *RawWebSocketVpnProxy) Stop() {
 	}
 
 	transport.conn = nil
+	transport.compressor = nil
+	transport.ctx = nil
 	transport.cancel = nil
+	transport.connected = nil
 }
 
 func (transport *RawWebSocketVpnProxy) UpgradeConnection(w http.ResponseWriter, r *http.Request) {
+	// Held through the upgrade so a second peer cannot take the slot as well
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	ctx := transport.ctx
+	if ctx == nil {
+		http.Error(w, "transport is not running", http.StatusServiceUnavailable)
+		return
+	}
 	if transport.conn != nil {
+		transport.stats.handshakesBusy.Add(1)
 		http.Error(w, "already taken", 418)
+		return
+	}
+
+	// Both ends have to agree on carrying frames or packets, a peer of the
+	// other kind would only send what cannot be parsed
+	if wantsFrames := r.Header.Get(ethernet.LayerHeader) == ethernet.LayerEthernet; wantsFrames != transport.ethernet {
+		transport.stats.handshakesFailed.Add(1)
+		if transport.ethernet {
+			http.Error(w, "this end carries Ethernet frames", http.StatusBadRequest)
+		} else {
+			http.Error(w, "this end carries IP packets", http.StatusBadRequest)
+		}
+		return
 	}
 
-	conn, err := transport.upgrader.Upgrade(w, r, nil)
+	// The peer offers compression algorithms in the handshake and gets the
+	// one picked back, peers that offer none or none accepted go uncompressed
+	var compressor *compress.Compressor
+	responseHeader := transport.obfuscation.Header()
+	if transport.ethernet {
+		responseHeader.Set(ethernet.LayerHeader, ethernet.LayerEthernet)
+	}
+	if algorithm := transport.compression.Negotiate(r.Header.Get(compress.Header)); algorithm != "" {
+		var err error
+		compressor, err = transport.compression.NewCompressor(algorithm, &transport.stats.compression)
+		if err != nil {
+			log.Print("compression:", err)
+			transport.stats.handshakesFailed.Add(1)
+			http.Error(w, "compression unavailable", http.StatusInternalServerError)
+			return
+		}
+		responseHeader.Set(compress.Header, algorithm)
+	}
+
+	conn, err := transport.upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		log.Print("upgrade:", err)
+		transport.stats.handshakesFailed.Add(1)
 		return
 	}
+	if compressor != nil {
+		log.Printf("    [COMPRESSION] Peer negotiated %s", compressor.Algorithm())
+	}
 
-	transport.conn = conn
-	transport.conn.SetCloseHandler(func(code int, text string) error {
-		transport.Stop()
-		transport.Start()
-		return nil
+	transport.attach(ctx, conn, compressor)
+}
+
+// attach makes conn the connection of the transport and wakes the loops up.
+// The mutex must be held.
+func (transport *RawWebSocketVpnProxy) attach(ctx context.Context, conn *websocket.Conn, compressor *compress.Compressor) {
+	transport.stats.handshakesAccepted.Add(1)
+	transport.stats.connections.Add(1)
+
+	// Reads give up once the peer has been silent for the keepalive timeout,
+	// every pong pushes the deadline back
+	monitor := transport.keepalive.NewMonitor()
+	conn.SetPongHandler(func(payload string) error {
+		if rtt, ok := monitor.Pong([]byte(payload)); ok {
+			transport.stats.rtt.Store(int64(rtt))
+		}
+		return conn.SetReadDeadline(monitor.ReadDeadline())
 	})
+
+	transport.monitor = monitor
+	transport.compressor = compressor
+	transport.conn = conn
+	close(transport.connected)
+
+	go func() {
+		if err := monitor.Run(ctx, keepalive.WebSocket(conn)); err != nil {
+			transport.restart(ctx, err)
+		}
+	}()
+}
+
+// dialLoop connects to the peer, trying again with a growing delay until it
+// succeeds or ctx ends
+func (transport *RawWebSocketVpnProxy) dialLoop(ctx context.Context) {
+	delay := redialDelay
+	for {
+		err := transport.dial(ctx)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		log.Printf("    [TRANSPORT] Failed to connect to %s: %v", transport.peer.Host, err)
+		transport.stats.handshakesFailed.Add(1)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxRedialDelay)
+		transport.stats.reconnects.Add(1)
+	}
+}
+
+// dial connects to the peer, offering what UpgradeConnection expects of a
+// peer, and attaches the connection
+func (transport *RawWebSocketVpnProxy) dial(ctx context.Context) error {
+	header := transport.peerHeader.Clone()
+	if offer := transport.compression.Offer(); offer != "" {
+		header.Set(compress.Header, offer)
+	}
+	if transport.ethernet {
+		header.Set(ethernet.LayerHeader, ethernet.LayerEthernet)
+	}
+
+	// When fronted the handshake names the front in TLS and the peer in Host
+	base := transport.upstream.Dialer(transport.dialer)
+	if transport.pluggableTransport != nil {
+		base.NetDialContext = transport.pluggableTransport
+	}
+	dialer, fronting := transport.obfuscation.Dialer(base)
+	for name, values := range fronting {
+		header[name] = values
+	}
+	dialer.HandshakeTimeout = transport.keepalive.Timeout
+
+	// Both ends share the obfuscation settings, a peer URL without a path
+	// means the path of the transport
+	peer := *transport.peer
+	if peer.Path == "" {
+		peer.Path = transport.obfuscation.Path()
+	}
+	conn, response, err := dialer.DialContext(ctx, peer.String(), header)
+	if err != nil {
+		return err
+	}
+
+	if carriesFrames := response.Header.Get(ethernet.LayerHeader) == ethernet.LayerEthernet; carriesFrames != transport.ethernet {
+		conn.Close()
+		if transport.ethernet {
+			return errors.New("peer carries IP packets, this end Ethernet frames")
+		}
+		return errors.New("peer carries Ethernet frames, this end IP packets")
+	}
+
+	var compressor *compress.Compressor
+	if algorithm := response.Header.Get(compress.Header); algorithm != "" {
+		compressor, err = transport.compression.NewCompressor(algorithm, &transport.stats.compression)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		log.Printf("    [COMPRESSION] Peer picked %s", compressor.Algorithm())
+	}
+
+	log.Printf("    [TRANSPORT] Connected to %s", transport.peer.Host)
+	if address := response.Header.Get(gateway.AddressHeader); address != "" {
+		log.Printf("    [TRANSPORT] Gateway leased %s to this end", address)
+	}
+
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	// Stop ran while dialing
+	if transport.ctx != ctx {
+		conn.Close()
+		return context.Canceled
+	}
+	transport.attach(ctx, conn, compressor)
+	return nil
 }
 
 func (transport *RawWebSocketVpnProxy) SendToTransport(len int, buf []byte) {
-	if transport.conn == nil {
+	if conn, _, _ := transport.current(); conn == nil {
 		log.Println("[WARN] nowhere to send new packets - dropping")
+		transport.stats.dropped.Add(1)
 		return
 	}
 
@@ -150,7 +608,20 @@ func (transport *RawWebSocketVpnProxy) SendToTransport(len int, buf []byte) {
 		Buffer: compactBuffer,
 	}
 
-	log.Println("add packet to send_chan")
+	log.Println("add packet to send_queue")
+
+	if !transport.send_queue.Enqueue(&packet) {
+		log.Println("[WARN] send queue full - dropping")
+		transport.stats.dropped.Add(1)
+	}
+}
+
+// QueueDepths returns how many packets wait in the send and receive queues
+func (transport *RawWebSocketVpnProxy) QueueDepths() (send int, receive int) {
+	return transport.send_queue.Len(), len(transport.recieve_chan)
+}
 
-	transport.send_chan <- &packet
+// ReceiveFromTransport returns the stream of packets read from the websocket
+func (transport *RawWebSocketVpnProxy) ReceiveFromTransport() <-chan *protobuf.PacketV4 {
+	return transport.recieve_chan
 }
@@ -0,0 +1,658 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/compress"
+	"thinkpol-vpn/interface/internal/config"
+	"thinkpol-vpn/interface/internal/ethernet"
+	"thinkpol-vpn/interface/internal/keepalive"
+	"thinkpol-vpn/interface/internal/obfuscate"
+	"thinkpol-vpn/interface/internal/scheduler"
+	"thinkpol-vpn/interface/internal/upstream"
+
+	"github.com/gorilla/websocket"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// waitFor polls condition until it holds or the timeout passes
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// TestSendToTransportWithStalledPeer connects a peer that never reads, so the
+// write loop ends up stuck on a full socket. Sending must keep returning and
+// account for the packets it drops instead of stalling the caller.
+func TestSendToTransportWithStalledPeer(t *testing.T) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(output)
+
+	transport := NewRawWebSocketVpnProxy()
+	sendQueue, err := scheduler.New(config.SchedulerConfig{Capacity: 8, Policy: "tail-drop"})
+	if err != nil {
+		t.Fatalf("scheduler.New: %v", err)
+	}
+	transport.SetScheduler(sendQueue)
+
+	server := httptest.NewServer(http.HandlerFunc(transport.UpgradeConnection))
+	defer server.Close()
+
+	transport.Start()
+	defer transport.Stop()
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer peer.Close()
+
+	if !waitFor(5*time.Second, func() bool { return transport.Stats().Peer == keepalive.StateAlive }) {
+		t.Fatal("the transport never got the connection")
+	}
+
+	// Far more than the socket buffers hold
+	const packets = 4000
+	buffer := make([]byte, 60000)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < packets; i++ {
+			transport.SendToTransport(len(buffer), buffer)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("SendToTransport stalled behind a peer that does not read")
+	}
+
+	stats := transport.Stats()
+	if stats.Dropped == 0 {
+		t.Fatal("no packets were dropped although the peer never read")
+	}
+
+	var queued, droppedFull uint64
+	for _, class := range stats.Scheduler {
+		queued += uint64(class.Queued)
+		droppedFull += class.DroppedFull
+	}
+	if droppedFull != stats.Dropped {
+		t.Errorf("the scheduler dropped %d packets, the transport counted %d", droppedFull, stats.Dropped)
+	}
+	if accounted := stats.PacketsSent + droppedFull + queued; accounted > packets || accounted < packets-1 {
+		// One packet may be in the middle of being written
+		t.Errorf("%d sent, %d dropped and %d queued do not add up to %d packets", stats.PacketsSent, droppedFull, queued, packets)
+	}
+}
+
+// TestDeadPeerIsDropped connects a peer that goes silent without closing the
+// connection. The transport has to notice, drop it and take the peer back
+// when it reconnects.
+func TestDeadPeerIsDropped(t *testing.T) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(output)
+
+	transport := NewRawWebSocketVpnProxy()
+	settings, err := keepalive.New(config.KeepaliveConfig{IntervalMS: 20, TimeoutMS: 100, WriteTimeoutMS: 100})
+	if err != nil {
+		t.Fatalf("keepalive.New: %v", err)
+	}
+	transport.SetKeepalive(settings)
+
+	server := httptest.NewServer(http.HandlerFunc(transport.UpgradeConnection))
+	defer server.Close()
+
+	transport.Start()
+	defer transport.Stop()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// Pings are only answered while reading, this peer never does
+	silent, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer silent.Close()
+
+	if !waitFor(5*time.Second, func() bool { return transport.Stats().DeadPeers == 1 }) {
+		t.Fatal("the silent peer was never declared dead")
+	}
+	if peer := transport.Stats().Peer; peer != keepalive.StateDead {
+		t.Errorf("peer state = %q, want %q", peer, keepalive.StateDead)
+	}
+
+	peer, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("reconnecting after the dead peer was dropped: %v", err)
+	}
+	defer peer.Close()
+	go func() {
+		for {
+			if _, _, err := peer.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Several timeouts pass while the peer answers pings
+	time.Sleep(300 * time.Millisecond)
+
+	stats := transport.Stats()
+	if stats.Peer != keepalive.StateAlive || stats.DeadPeers != 1 {
+		t.Errorf("peer state = %q with %d dead peers, want %q with 1", stats.Peer, stats.DeadPeers, keepalive.StateAlive)
+	}
+	if stats.RTT <= 0 {
+		t.Error("no round trip time measured from the keepalives")
+	}
+}
+
+// TestCompressionIsNegotiated connects a peer that offers compression and
+// checks that packets make it through compressed in both directions
+func TestCompressionIsNegotiated(t *testing.T) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(output)
+
+	settings, err := compress.New(config.CompressionConfig{Algorithms: []string{compress.Zstd, compress.LZ4}, MinSize: 64})
+	if err != nil {
+		t.Fatalf("compress.New: %v", err)
+	}
+	transport := NewRawWebSocketVpnProxy()
+	transport.SetCompression(settings)
+
+	server := httptest.NewServer(http.HandlerFunc(transport.UpgradeConnection))
+	defer server.Close()
+
+	transport.Start()
+	defer transport.Stop()
+
+	// The peer's preference wins among the algorithms the transport accepts
+	header := http.Header{compress.Header: {"brotli, lz4, zstd"}}
+	peer, response, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer peer.Close()
+	if algorithm := response.Header.Get(compress.Header); algorithm != compress.LZ4 {
+		t.Fatalf("negotiated %q, want %q", algorithm, compress.LZ4)
+	}
+	compressor, err := settings.NewCompressor(compress.LZ4, &compress.Stats{})
+	if err != nil {
+		t.Fatalf("NewCompressor: %v", err)
+	}
+
+	if !waitFor(5*time.Second, func() bool { return transport.Stats().Peer == keepalive.StateAlive }) {
+		t.Fatal("the transport never got the connection")
+	}
+
+	buffer := []byte(strings.Repeat("compressible ", 100))
+	transport.SendToTransport(len(buffer), buffer)
+
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, framed, err := peer.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	message, err := compressor.Decode(framed)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	sent := &protobuf.PacketV4{}
+	if err := proto.Unmarshal(message, sent); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if string(sent.GetBuffer()) != string(buffer) {
+		t.Error("the peer got a different packet than was sent")
+	}
+	if len(framed) >= len(message) {
+		t.Errorf("%d bytes on the wire for a %d byte message", len(framed), len(message))
+	}
+
+	length := int32(len(buffer))
+	message, err = proto.Marshal(&protobuf.PacketV4{Length: &length, Buffer: buffer})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if err := peer.WriteMessage(websocket.BinaryMessage, compressor.Encode(message, buffer)); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+
+	select {
+	case received := <-transport.ReceiveFromTransport():
+		if string(received.GetBuffer()) != string(buffer) {
+			t.Error("the transport received a different packet than the peer sent")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the transport never received the packet")
+	}
+
+	stats := transport.Stats()
+	if stats.Compression.Algorithm != compress.LZ4 {
+		t.Errorf("algorithm = %q, want %q", stats.Compression.Algorithm, compress.LZ4)
+	}
+	if stats.Compression.Sent.Messages != 1 || stats.Compression.Received.Messages != 1 {
+		t.Errorf("%d messages compressed and %d decompressed, want 1 each",
+			stats.Compression.Sent.Messages, stats.Compression.Received.Messages)
+	}
+}
+
+// TestEthernetFrames checks that a TAP transport only takes peers asking for
+// frames and carries frames in both directions
+func TestEthernetFrames(t *testing.T) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(output)
+
+	transport := NewRawWebSocketVpnProxy()
+	transport.SetEthernet(true)
+
+	server := httptest.NewServer(http.HandlerFunc(transport.UpgradeConnection))
+	defer server.Close()
+
+	transport.Start()
+	defer transport.Stop()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	if peer, response, err := websocket.DefaultDialer.Dial(url, nil); err == nil {
+		peer.Close()
+		t.Fatal("a peer carrying IP packets was accepted")
+	} else if response == nil || response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Dial without asking for frames = %v, want a 400", err)
+	}
+
+	peer, response, err := websocket.DefaultDialer.Dial(url, http.Header{ethernet.LayerHeader: {ethernet.LayerEthernet}})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer peer.Close()
+	if layer := response.Header.Get(ethernet.LayerHeader); layer != ethernet.LayerEthernet {
+		t.Fatalf("layer = %q, want %q", layer, ethernet.LayerEthernet)
+	}
+	if !waitFor(5*time.Second, func() bool { return transport.Stats().Peer == keepalive.StateAlive }) {
+		t.Fatal("the transport never got the connection")
+	}
+
+	frame := ethernet.Frame{Destination: ethernet.Broadcast, Source: ethernet.MAC{2, 0, 0, 0, 0, 2}, Type: ethernet.TypeARP}.Append(nil)
+	transport.SendToTransport(len(frame), frame)
+
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, message, err := peer.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	sent := &protobuf.EthernetFrame{}
+	if err := proto.Unmarshal(message, sent); err != nil || string(sent.GetFrame()) != string(frame) {
+		t.Fatalf("the peer got %v (%v), want the frame that was sent", sent, err)
+	}
+
+	if err := peer.WriteMessage(websocket.BinaryMessage, message); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	select {
+	case received := <-transport.ReceiveFromTransport():
+		if string(received.GetBuffer()) != string(frame) {
+			t.Error("the transport received a different frame than the peer sent")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the transport never received the frame")
+	}
+}
+
+// connectPeer starts a transport and connects a peer that is alive
+func connectPeer(t *testing.T) (*RawWebSocketVpnProxy, *websocket.Conn) {
+	t.Helper()
+
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(output) })
+
+	transport := NewRawWebSocketVpnProxy()
+	server := httptest.NewServer(http.HandlerFunc(transport.UpgradeConnection))
+	transport.Start()
+	t.Cleanup(func() {
+		transport.Stop()
+		server.Close()
+	})
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	if !waitFor(5*time.Second, func() bool { return transport.Stats().Peer == keepalive.StateAlive }) {
+		t.Fatal("the transport never got the connection")
+	}
+	return transport, peer
+}
+
+// TestTextMessageIsDropped checks that a message that is not binary is
+// dropped without ending the read loop
+func TestTextMessageIsDropped(t *testing.T) {
+	transport, peer := connectPeer(t)
+
+	if err := peer.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	length := int32(4)
+	message, _ := proto.Marshal(&protobuf.PacketV4{Length: &length, Buffer: []byte{0x45, 0, 0, 4}})
+	if err := peer.WriteMessage(websocket.BinaryMessage, message); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+
+	select {
+	case received := <-transport.ReceiveFromTransport():
+		if len(received.GetBuffer()) != 4 {
+			t.Errorf("received %x, want the packet after the text message", received.GetBuffer())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the packet after the text message never arrived")
+	}
+	if stats := transport.Stats(); stats.ParseErrors != 1 || stats.DeadPeers != 0 {
+		t.Errorf("parse errors = %d, dead peers = %d, want 1 and 0", stats.ParseErrors, stats.DeadPeers)
+	}
+}
+
+// TestUnencodablePacketIsDropped checks that a packet that cannot be
+// encoded is dropped without ending the write loop
+func TestUnencodablePacketIsDropped(t *testing.T) {
+	transport, peer := connectPeer(t)
+
+	// A packet without its required buffer cannot be marshaled
+	length := int32(4)
+	transport.send_queue.Enqueue(&protobuf.PacketV4{Length: &length})
+	transport.SendToTransport(4, []byte{0x45, 0, 0, 4})
+
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, message, err := peer.ReadMessage()
+	if err != nil {
+		t.Fatalf("the packet after the broken one never arrived: %v", err)
+	}
+	sent := &protobuf.PacketV4{}
+	if err := proto.Unmarshal(message, sent); err != nil || len(sent.GetBuffer()) != 4 {
+		t.Errorf("the peer got %v (%v), want the packet after the broken one", sent, err)
+	}
+	if stats := transport.Stats(); stats.Dropped != 1 {
+		t.Errorf("dropped = %d, want the broken packet", stats.Dropped)
+	}
+}
+
+// connectProxy is an HTTP proxy tunneling CONNECT requests, counting them
+func connectProxy(t *testing.T, connects *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT", http.StatusMethodNotAllowed)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		connects.Add(1)
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(target, conn)
+			target.Close()
+		}()
+		io.Copy(conn, target)
+		conn.Close()
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// TestDialPeer connects a transport to another one through an upstream
+// proxy, and again once the connection drops
+func TestDialPeer(t *testing.T) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(output)
+
+	settings, err := compress.New(config.CompressionConfig{Algorithms: []string{compress.LZ4}})
+	if err != nil {
+		t.Fatalf("compress.New: %v", err)
+	}
+
+	listener := NewRawWebSocketVpnProxy()
+	listener.SetCompression(settings)
+	server := httptest.NewServer(http.HandlerFunc(listener.UpgradeConnection))
+	defer server.Close()
+	listener.Start()
+	defer listener.Stop()
+
+	var connects atomic.Int32
+	upstreamProxy, err := upstream.New(config.UpstreamProxyConfig{URL: connectProxy(t, &connects).URL})
+	if err != nil {
+		t.Fatalf("upstream.New: %v", err)
+	}
+
+	dialer := NewRawWebSocketVpnProxy()
+	dialer.SetCompression(settings)
+	if err := dialer.SetPeer(config.PeerConfig{URL: "ws" + strings.TrimPrefix(server.URL, "http") + "/transport"}); err != nil {
+		t.Fatalf("SetPeer: %v", err)
+	}
+	dialer.SetUpstreamProxy(upstreamProxy)
+	dialer.Start()
+	defer dialer.Stop()
+
+	if !waitFor(5*time.Second, func() bool { return dialer.Stats().Peer == keepalive.StateAlive }) {
+		t.Fatal("the transport never connected to its peer")
+	}
+	if algorithm := dialer.Stats().Compression.Algorithm; algorithm != compress.LZ4 {
+		t.Errorf("negotiated %q, want %q", algorithm, compress.LZ4)
+	}
+
+	buffer := []byte{0x45, 0, 0, 4}
+	dialer.SendToTransport(len(buffer), buffer)
+	select {
+	case received := <-listener.ReceiveFromTransport():
+		if string(received.GetBuffer()) != string(buffer) {
+			t.Error("the peer received a different packet than was sent")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the peer never received the packet")
+	}
+
+	// The peer drops the connection and waits for the next one
+	listener.Stop()
+	listener.Start()
+	if !waitFor(5*time.Second, func() bool { return listener.Stats().Peer == keepalive.StateAlive }) {
+		t.Fatal("the transport never connected again")
+	}
+
+	listener.SendToTransport(len(buffer), buffer)
+	select {
+	case received := <-dialer.ReceiveFromTransport():
+		if string(received.GetBuffer()) != string(buffer) {
+			t.Error("the transport received a different packet than the peer sent")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the transport never received the packet")
+	}
+
+	if count := connects.Load(); count != 2 {
+		t.Errorf("%d connections went through the proxy, want 2", count)
+	}
+}
+
+// TestReconnectsAreCounted fails the first dial to the peer and drops the
+// first connection, each has to count as one reconnect
+func TestReconnectsAreCounted(t *testing.T) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(output)
+
+	var requests atomic.Int32
+	var upgrader websocket.Upgrader
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := requests.Add(1)
+		if request == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if request == 2 {
+			return
+		}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	transport := NewRawWebSocketVpnProxy()
+	if err := transport.SetPeer(config.PeerConfig{URL: "ws" + strings.TrimPrefix(server.URL, "http") + "/transport"}); err != nil {
+		t.Fatalf("SetPeer: %v", err)
+	}
+	transport.Start()
+	defer transport.Stop()
+
+	if !waitFor(5*time.Second, func() bool { return transport.Stats().Connections == 2 }) {
+		t.Fatalf("the transport made %d connections, want 2", transport.Stats().Connections)
+	}
+
+	stats := transport.Stats()
+	if stats.Reconnects != 2 || stats.HandshakesFailed != 1 {
+		t.Errorf("%d reconnects and %d failed handshakes, want 2 and 1", stats.Reconnects, stats.HandshakesFailed)
+	}
+}
+
+// TestDialPeerFronted connects a fronted transport, which names the front in
+// the TLS handshake and the peer in the Host header
+func TestDialPeerFronted(t *testing.T) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(output)
+
+	obfuscation, err := obfuscate.New(config.ObfuscationConfig{
+		Path:     "/api/v1/stream",
+		Fronting: config.FrontingConfig{Host: "vpn.example.org", SNI: "cdn.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("obfuscate.New: %v", err)
+	}
+
+	listener := NewRawWebSocketVpnProxy()
+	listener.SetObfuscation(obfuscation)
+	requests := make(chan *http.Request, 1)
+	handler := obfuscation.Handler(listener.UpgradeConnection)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requests <- r:
+		default:
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	listener.Start()
+	defer listener.Stop()
+
+	dialer := NewRawWebSocketVpnProxy()
+	dialer.SetObfuscation(obfuscation)
+	// Without a path the transport asks for the obfuscated one
+	if err := dialer.SetPeer(config.PeerConfig{URL: "wss" + strings.TrimPrefix(server.URL, "https"), InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("SetPeer: %v", err)
+	}
+	dialer.Start()
+	defer dialer.Stop()
+
+	if !waitFor(5*time.Second, func() bool { return listener.Stats().Peer == keepalive.StateAlive }) {
+		t.Fatal("the transport never connected to its peer")
+	}
+
+	request := <-requests
+	if request.TLS.ServerName != "cdn.example.com" {
+		t.Errorf("SNI = %q, want the front", request.TLS.ServerName)
+	}
+	if request.Host != "vpn.example.org" {
+		t.Errorf("Host = %q, want the peer behind the front", request.Host)
+	}
+	if request.URL.Path != "/api/v1/stream" {
+		t.Errorf("path = %q, want the obfuscated path", request.URL.Path)
+	}
+}
+
+// TestDialPeerThroughPluggableTransport checks that a pluggable transport
+// replaces the upstream proxy, which the transport binary uses itself
+func TestDialPeerThroughPluggableTransport(t *testing.T) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(output)
+
+	listener := NewRawWebSocketVpnProxy()
+	server := httptest.NewServer(http.HandlerFunc(listener.UpgradeConnection))
+	defer server.Close()
+	listener.Start()
+	defer listener.Stop()
+
+	var connects atomic.Int32
+	upstreamProxy, err := upstream.New(config.UpstreamProxyConfig{URL: connectProxy(t, &connects).URL})
+	if err != nil {
+		t.Fatalf("upstream.New: %v", err)
+	}
+
+	var dials atomic.Int32
+	dialer := NewRawWebSocketVpnProxy()
+	if err := dialer.SetPeer(config.PeerConfig{URL: "ws" + strings.TrimPrefix(server.URL, "http") + "/transport"}); err != nil {
+		t.Fatalf("SetPeer: %v", err)
+	}
+	dialer.SetUpstreamProxy(upstreamProxy)
+	dialer.SetPluggableTransport(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	})
+	dialer.Start()
+	defer dialer.Stop()
+
+	if !waitFor(5*time.Second, func() bool { return dialer.Stats().Peer == keepalive.StateAlive }) {
+		t.Fatal("the transport never connected to its peer")
+	}
+	if dials.Load() != 1 || connects.Load() != 0 {
+		t.Errorf("%d connections through the pluggable transport and %d through the proxy, want 1 and 0", dials.Load(), connects.Load())
+	}
+}
+
+func TestSetPeerRejectsOtherSchemes(t *testing.T) {
+	transport := NewRawWebSocketVpnProxy()
+	for _, peer := range []string{"https://vpn.example.org/transport", "vpn.example.org:443", "://"} {
+		if err := transport.SetPeer(config.PeerConfig{URL: peer}); err == nil {
+			t.Errorf("SetPeer(%q) succeeded", peer)
+		}
+	}
+}
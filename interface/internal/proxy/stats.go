@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"thinkpol-vpn/interface/internal/compress"
+	"thinkpol-vpn/interface/internal/ratelimit"
+	"thinkpol-vpn/interface/internal/scheduler"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stats are the runtime counters of a transport, safe for concurrent use
+type Stats struct {
+	packetsSent     atomic.Uint64
+	bytesSent       atomic.Uint64
+	packetsReceived atomic.Uint64
+	bytesReceived   atomic.Uint64
+	dropped         atomic.Uint64
+	parseErrors     atomic.Uint64
+	connections     atomic.Uint64
+	rtt             atomic.Int64
+	// deadPeers counts connections dropped because the peer stopped answering
+	deadPeers atomic.Uint64
+	// reconnects counts restarts after a lost connection and dials retried
+	// after a failure
+	reconnects atomic.Uint64
+
+	// Handshake outcomes of incoming websocket upgrades
+	handshakesAccepted atomic.Uint64
+	handshakesBusy     atomic.Uint64
+	handshakesFailed   atomic.Uint64
+
+	// compression counts how well negotiated compression works
+	compression compress.Stats
+
+	// writeDuration is how long writing a message to the websocket takes
+	writeDuration prometheus.Histogram
+}
+
+// newStats creates the transport counters
+func newStats() *Stats {
+	return &Stats{
+		writeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "thinkpol_vpn_transport_write_duration_seconds",
+			Help:    "Time taken to write a packet to the websocket.",
+			Buckets: prometheus.ExponentialBuckets(0.00005, 4, 8),
+		}),
+	}
+}
+
+// StatsSnapshot is a point in time copy of the transport counters
+type StatsSnapshot struct {
+	PacketsSent     uint64        `json:"packets_sent"`
+	BytesSent       uint64        `json:"bytes_sent"`
+	PacketsReceived uint64        `json:"packets_received"`
+	BytesReceived   uint64        `json:"bytes_received"`
+	Dropped         uint64        `json:"dropped"`
+	ParseErrors     uint64        `json:"parse_errors"`
+	Connections     uint64        `json:"connections"`
+	Reconnects      uint64        `json:"reconnects"`
+	RTT             time.Duration `json:"-"`
+	RTTMillis       float64       `json:"rtt_ms"`
+	DeadPeers       uint64        `json:"dead_peers"`
+
+	// Peer is "disconnected" or the keepalive state of the peer: "alive",
+	// "unresponsive" or "dead"
+	Peer     string     `json:"peer"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+
+	HandshakesAccepted uint64 `json:"handshakes_accepted"`
+	HandshakesBusy     uint64 `json:"handshakes_busy"`
+	HandshakesFailed   uint64 `json:"handshakes_failed"`
+
+	// RateLimit holds the limits and how much traffic they held back
+	RateLimit ratelimit.Status `json:"rate_limit"`
+	// Scheduler holds the counters of each traffic class of the send queue
+	Scheduler []scheduler.ClassStats `json:"scheduler"`
+	// Compression holds the negotiated algorithm and the compression ratio
+	Compression compress.Status `json:"compression"`
+	// ConnectIP describes the session of the CONNECT-IP transport, nil for
+	// the websocket transport
+	ConnectIP *ConnectIPStatus `json:"connect_ip,omitempty"`
+}
+
+// Snapshot returns the current value of every counter
+func (stats *Stats) Snapshot() StatsSnapshot {
+	snapshot := StatsSnapshot{
+		PacketsSent:     stats.packetsSent.Load(),
+		BytesSent:       stats.bytesSent.Load(),
+		PacketsReceived: stats.packetsReceived.Load(),
+		BytesReceived:   stats.bytesReceived.Load(),
+		Dropped:         stats.dropped.Load(),
+		ParseErrors:     stats.parseErrors.Load(),
+		Connections:     stats.connections.Load(),
+		RTT:             time.Duration(stats.rtt.Load()),
+		DeadPeers:       stats.deadPeers.Load(),
+		Reconnects:      stats.reconnects.Load(),
+
+		HandshakesAccepted: stats.handshakesAccepted.Load(),
+		HandshakesBusy:     stats.handshakesBusy.Load(),
+		HandshakesFailed:   stats.handshakesFailed.Load(),
+
+		Compression: stats.compression.Status(),
+	}
+
+	snapshot.RTTMillis = float64(snapshot.RTT) / float64(time.Millisecond)
+
+	return snapshot
+}
+
+// recordSent counts a packet written to the websocket
+func (stats *Stats) recordSent(bytes int) {
+	stats.packetsSent.Add(1)
+	stats.bytesSent.Add(uint64(bytes))
+}
+
+// recordReceived counts a packet read from the websocket
+func (stats *Stats) recordReceived(bytes int) {
+	stats.packetsReceived.Add(1)
+	stats.bytesReceived.Add(uint64(bytes))
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/ratelimit"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Transport carries tunnel packets between this end and its peer. It is
+// implemented by the websocket and the CONNECT-IP transports.
+type Transport interface {
+	Start()
+	Stop()
+	SendToTransport(len int, buf []byte)
+	ReceiveFromTransport() <-chan *protobuf.PacketV4
+	// QueueDepths returns how many packets wait in the send and receive queues
+	QueueDepths() (send int, receive int)
+	Stats() StatsSnapshot
+	RateLimit() *ratelimit.Shaper
+	Collector() prometheus.Collector
+}
+
+var (
+	_ Transport = (*RawWebSocketVpnProxy)(nil)
+	_ Transport = (*ConnectIPProxy)(nil)
+)
@@ -0,0 +1,113 @@
+package pt
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Args are the key=value parameters of a transport, such as the obfs4
+// certificate a client needs to reach a server
+type Args map[string]string
+
+// encode joins the arguments with sep, escaping sep, '=' and '\' in keys and
+// values. Keys are sorted so the result is stable.
+func (args Args) encode(sep byte) string {
+	keys := make([]string, 0, len(args))
+	for key := range args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	specials := string([]byte{sep, '=', '\\'})
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, escape(key, specials)+"="+escape(args[key], specials))
+	}
+	return strings.Join(pairs, string(sep))
+}
+
+// parseArgs splits the key=value pairs separated by sep, undoing the
+// escaping of encode
+func parseArgs(s string, sep byte) (Args, error) {
+	args := make(Args)
+	if s == "" {
+		return args, nil
+	}
+
+	var key, current strings.Builder
+	inValue := false
+	add := func() error {
+		if !inValue {
+			return fmt.Errorf("argument %q has no value", key.String()+current.String())
+		}
+		args[key.String()] = current.String()
+		key.Reset()
+		current.Reset()
+		inValue = false
+		return nil
+	}
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+			if i == len(s) {
+				return nil, fmt.Errorf("arguments %q end in an escape", s)
+			}
+			current.WriteByte(s[i])
+		case c == '=' && !inValue:
+			key.WriteString(current.String())
+			current.Reset()
+			inValue = true
+		case c == sep:
+			if err := add(); err != nil {
+				return nil, err
+			}
+		default:
+			current.WriteByte(c)
+		}
+	}
+	if err := add(); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// serverOptions formats the options of each transport for
+// TOR_PT_SERVER_TRANSPORT_OPTIONS, as transport:key=value pairs separated by
+// semicolons
+func serverOptions(options map[string]map[string]string) string {
+	transports := make([]string, 0, len(options))
+	for transport := range options {
+		transports = append(transports, transport)
+	}
+	sort.Strings(transports)
+
+	var pairs []string
+	for _, transport := range transports {
+		keys := make([]string, 0, len(options[transport]))
+		for key := range options[transport] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			pairs = append(pairs, escape(transport, `:;=\`)+":"+
+				escape(key, `:;=\`)+"="+escape(options[transport][key], `:;=\`))
+		}
+	}
+	return strings.Join(pairs, ";")
+}
+
+// escape prefixes the special characters in s with a backslash
+func escape(s string, specials string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(specials, s[i]) >= 0 {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteByte(s[i])
+	}
+	return escaped.String()
+}
@@ -0,0 +1,299 @@
+package pt
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestMain runs the test binary as the stand-in transport when the tests
+// start it as one
+func TestMain(m *testing.M) {
+	if os.Getenv("PT_STANDIN") != "" {
+		standIn()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// standIn is a pluggable transport named "standin" on loopback. The client
+// side opens every connection with the secret it got in the SOCKS5
+// credentials, the server side only forwards connections that open with its
+// own secret, so a connection only gets through with the args the server
+// reported.
+func standIn() {
+	if !strings.Contains(os.Getenv("TOR_PT_MANAGED_TRANSPORT_VER"), "1") {
+		fmt.Println("VERSION-ERROR no-version")
+		return
+	}
+	fmt.Println("VERSION 1")
+
+	if os.Getenv("PT_STANDIN") == "fail" {
+		fmt.Println("SMETHOD-ERROR standin no luck")
+		fmt.Println("SMETHODS DONE")
+		return
+	}
+
+	if transports := os.Getenv("TOR_PT_SERVER_TRANSPORTS"); transports != "" {
+		options, _ := parseArgs(os.Getenv("TOR_PT_SERVER_TRANSPORT_OPTIONS"), ';')
+		secret := options["standin:secret"]
+		orPort := os.Getenv("TOR_PT_ORPORT")
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fmt.Println("SMETHOD-ERROR standin", err)
+			fmt.Println("SMETHODS DONE")
+			return
+		}
+		fmt.Printf("SMETHOD standin %s ARGS:secret=%s\n", listener.Addr(), escape(secret, `,=\`))
+		fmt.Println("SMETHODS DONE")
+
+		go serve(listener, func(conn net.Conn) {
+			reader := bufio.NewReader(conn)
+			line, err := reader.ReadString('\n')
+			if err != nil || line != "secret="+secret+"\n" {
+				return
+			}
+			upstream, err := net.Dial("tcp", orPort)
+			if err != nil {
+				return
+			}
+			defer upstream.Close()
+			go io.Copy(upstream, reader)
+			io.Copy(conn, upstream)
+		})
+	} else {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fmt.Println("CMETHOD-ERROR standin", err)
+			fmt.Println("CMETHODS DONE")
+			return
+		}
+		fmt.Printf("CMETHOD standin socks5 %s\n", listener.Addr())
+		fmt.Println("CMETHODS DONE")
+
+		go serve(listener, func(conn net.Conn) {
+			args, target, err := acceptSOCKS5(conn)
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				return
+			}
+			defer upstream.Close()
+			fmt.Fprintf(upstream, "secret=%s\n", args["secret"])
+			conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			go io.Copy(upstream, conn)
+			io.Copy(conn, upstream)
+		})
+	}
+
+	fmt.Println("LOG SEVERITY=notice MESSAGE=\"ready\"")
+	io.Copy(io.Discard, os.Stdin)
+}
+
+// serve handles every connection of listener in its own goroutine
+func serve(listener net.Listener, handle func(conn net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			handle(conn)
+		}()
+	}
+}
+
+// acceptSOCKS5 reads the username/password negotiation and the CONNECT
+// request of a SOCKS5 client, returning the transport args in the
+// credentials and the address to connect to
+func acceptSOCKS5(conn net.Conn) (Args, string, error) {
+	reader := bufio.NewReader(conn)
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(reader, greeting); err != nil {
+		return nil, "", err
+	}
+	if _, err := io.ReadFull(reader, make([]byte, greeting[1])); err != nil {
+		return nil, "", err
+	}
+	conn.Write([]byte{5, 2})
+
+	readString := func() (string, error) {
+		size, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		value := make([]byte, size)
+		_, err = io.ReadFull(reader, value)
+		return string(value), err
+	}
+	if _, err := reader.ReadByte(); err != nil {
+		return nil, "", err
+	}
+	user, err := readString()
+	if err != nil {
+		return nil, "", err
+	}
+	password, err := readString()
+	if err != nil {
+		return nil, "", err
+	}
+	conn.Write([]byte{1, 0})
+
+	args, err := parseArgs(strings.TrimSuffix(user+password, "\x00"), ';')
+	if err != nil {
+		return nil, "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return nil, "", err
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return nil, "", err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		if host, err = readString(); err != nil {
+			return nil, "", err
+		}
+	default:
+		return nil, "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return nil, "", err
+	}
+	return args, net.JoinHostPort(host, fmt.Sprint(binary.BigEndian.Uint16(port))), nil
+}
+
+// TestManagedProxies carries a websocket through the stand-in client and
+// server transports
+func TestManagedProxies(t *testing.T) {
+	t.Setenv("PT_STANDIN", "1")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	upgrader := websocket.Upgrader{}
+	transport := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(messageType, message)
+	}))
+	defer transport.Close()
+
+	server, err := StartServer(ctx, ServerOptions{
+		Path:       os.Args[0],
+		Transports: []string{"standin"},
+		Options:    map[string]map[string]string{"standin": {"secret": "a;b=c"}},
+		ORPort:     transport.Listener.Addr().String(),
+		StateDir:   t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("StartServer: %v", err)
+	}
+	defer server.Stop()
+
+	methods := server.Methods()
+	if len(methods) != 1 || methods[0].Args["secret"] != "a;b=c" {
+		t.Fatalf("server methods = %+v, want standin with the secret", methods)
+	}
+
+	client, err := StartClient(ctx, ClientOptions{
+		Path:       os.Args[0],
+		Transports: []string{"standin"},
+		StateDir:   t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("StartClient: %v", err)
+	}
+	defer client.Stop()
+
+	dial := func(args Args) (*websocket.Conn, error) {
+		socks, err := client.Dialer("standin", args)
+		if err != nil {
+			t.Fatalf("Dialer: %v", err)
+		}
+		dialer := websocket.Dialer{NetDialContext: socks.DialContext, HandshakeTimeout: 5 * time.Second}
+		conn, _, err := dialer.DialContext(ctx, "ws://"+methods[0].Addr+"/transport", nil)
+		return conn, err
+	}
+
+	conn, err := dial(methods[0].Args)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("packet")); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != "packet" {
+		t.Fatalf("ReadMessage = %q, %v, want the packet echoed", message, err)
+	}
+
+	if conn, err := dial(Args{"secret": "wrong"}); err == nil {
+		conn.Close()
+		t.Error("connected through the server transport without its secret")
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Errorf("Stop: %v", err)
+	}
+	if err := server.Wait(); err != nil {
+		t.Errorf("Wait after Stop = %v, want nil", err)
+	}
+}
+
+func TestStartServerFails(t *testing.T) {
+	t.Setenv("PT_STANDIN", "fail")
+
+	_, err := StartServer(context.Background(), ServerOptions{
+		Path:       os.Args[0],
+		Transports: []string{"standin"},
+		ORPort:     "127.0.0.1:1",
+		StateDir:   t.TempDir(),
+	})
+	if err == nil || !strings.Contains(err.Error(), "no luck") {
+		t.Errorf("StartServer = %v, want the SMETHOD-ERROR", err)
+	}
+}
+
+func TestArgs(t *testing.T) {
+	args := Args{"cert": `a,b=c\d`, "iat-mode": "0"}
+	parsed, err := parseArgs(args.encode(','), ',')
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	if len(parsed) != 2 || parsed["cert"] != args["cert"] || parsed["iat-mode"] != "0" {
+		t.Errorf("parseArgs(encode) = %v, want %v", parsed, args)
+	}
+
+	if _, err := parseArgs("novalue", ','); err == nil {
+		t.Error("parseArgs accepted an argument without a value")
+	}
+}
@@ -0,0 +1,207 @@
+// Package ratelimit shapes the traffic of transport sessions with token buckets
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"thinkpol-vpn/interface/internal/config"
+
+	"golang.org/x/time/rate"
+)
+
+// minBurst is the smallest default burst, enough for a few full-size packets
+const minBurst = 64 << 10
+
+// Bucket shapes one direction of a session. Packets are held back until the
+// bucket has enough tokens, or dropped when that would take too long.
+type Bucket struct {
+	limiter  *rate.Limiter
+	maxDelay atomic.Int64
+
+	delayedPackets atomic.Uint64
+	delayedBytes   atomic.Uint64
+	droppedPackets atomic.Uint64
+	droppedBytes   atomic.Uint64
+}
+
+// newBucket creates an unlimited bucket
+func newBucket() *Bucket {
+	return &Bucket{limiter: rate.NewLimiter(rate.Inf, 0)}
+}
+
+// configure sets the rate and burst of the bucket
+func (bucket *Bucket) configure(bucketConfig config.BucketConfig, maxDelay time.Duration) {
+	bucket.maxDelay.Store(int64(maxDelay))
+
+	if bucketConfig.Rate == 0 {
+		bucket.limiter.SetLimit(rate.Inf)
+		return
+	}
+
+	burst := bucketConfig.Burst
+	if burst == 0 {
+		burst = max(bucketConfig.Rate/10, minBurst)
+	}
+	bucket.limiter.SetBurst(int(burst))
+	bucket.limiter.SetLimit(rate.Limit(bucketConfig.Rate))
+}
+
+// Wait holds a packet of n bytes back until it fits the rate. It reports
+// whether the packet may go, false means it was dropped or ctx ended.
+func (bucket *Bucket) Wait(ctx context.Context, n int) bool {
+	if bucket.limiter.Limit() == rate.Inf {
+		return true
+	}
+
+	// A packet larger than the burst would never fit at once, so it is charged
+	// in chunks of at most the burst, each one after the tokens of the last
+	now := time.Now()
+	burst := max(bucket.limiter.Burst(), 1)
+	var reservations []*rate.Reservation
+	// Reservations are given back newest first so the limiter restores all
+	// their tokens
+	cancel := func(at time.Time) {
+		for i := len(reservations) - 1; i >= 0; i-- {
+			reservations[i].CancelAt(at)
+		}
+	}
+
+	var delay time.Duration
+	for remaining := n; remaining > 0; remaining -= burst {
+		reservation := bucket.limiter.ReserveN(now, min(remaining, burst))
+		if !reservation.OK() {
+			cancel(now)
+			bucket.droppedPackets.Add(1)
+			bucket.droppedBytes.Add(uint64(n))
+			return false
+		}
+		reservations = append(reservations, reservation)
+		delay = reservation.DelayFrom(now)
+	}
+	if delay == 0 {
+		return true
+	}
+
+	if delay > time.Duration(bucket.maxDelay.Load()) {
+		cancel(now)
+		bucket.droppedPackets.Add(1)
+		bucket.droppedBytes.Add(uint64(n))
+		return false
+	}
+
+	bucket.delayedPackets.Add(1)
+	bucket.delayedBytes.Add(uint64(n))
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		cancel(time.Now())
+		return false
+	}
+}
+
+// BucketStatus is the state of a bucket for the control API
+type BucketStatus struct {
+	// Rate is in bytes per second, 0 when unlimited
+	Rate           int64  `json:"rate"`
+	Burst          int64  `json:"burst,omitempty"`
+	DelayedPackets uint64 `json:"delayed_packets"`
+	DelayedBytes   uint64 `json:"delayed_bytes"`
+	DroppedPackets uint64 `json:"dropped_packets"`
+	DroppedBytes   uint64 `json:"dropped_bytes"`
+}
+
+func (bucket *Bucket) status() BucketStatus {
+	status := BucketStatus{
+		DelayedPackets: bucket.delayedPackets.Load(),
+		DelayedBytes:   bucket.delayedBytes.Load(),
+		DroppedPackets: bucket.droppedPackets.Load(),
+		DroppedBytes:   bucket.droppedBytes.Load(),
+	}
+	if limit := bucket.limiter.Limit(); limit != rate.Inf {
+		status.Rate = int64(limit)
+		status.Burst = int64(bucket.limiter.Burst())
+	}
+	return status
+}
+
+// Shaper holds the buckets of both directions of a session
+type Shaper struct {
+	Send    *Bucket
+	Receive *Bucket
+
+	mutex  sync.Mutex
+	config config.RateLimitConfig
+}
+
+// NewShaper creates a shaper with the limits of the configuration
+func NewShaper(rateLimitConfig config.RateLimitConfig) (*Shaper, error) {
+	shaper := &Shaper{Send: newBucket(), Receive: newBucket()}
+	if err := shaper.Configure(rateLimitConfig); err != nil {
+		return nil, err
+	}
+	return shaper, nil
+}
+
+// Configure replaces the limits. Packets being held back keep their delay.
+func (shaper *Shaper) Configure(rateLimitConfig config.RateLimitConfig) error {
+	if err := validate(rateLimitConfig); err != nil {
+		return err
+	}
+
+	shaper.mutex.Lock()
+	defer shaper.mutex.Unlock()
+
+	maxDelay := time.Duration(rateLimitConfig.MaxDelayMS) * time.Millisecond
+	shaper.Send.configure(rateLimitConfig.Send, maxDelay)
+	shaper.Receive.configure(rateLimitConfig.Receive, maxDelay)
+	shaper.config = rateLimitConfig
+	return nil
+}
+
+// Config returns the current limits
+func (shaper *Shaper) Config() config.RateLimitConfig {
+	shaper.mutex.Lock()
+	defer shaper.mutex.Unlock()
+	return shaper.config
+}
+
+// validate rejects limits a bucket cannot be set to
+func validate(rateLimitConfig config.RateLimitConfig) error {
+	if rateLimitConfig.MaxDelayMS < 0 {
+		return fmt.Errorf("max_delay_ms must not be negative")
+	}
+	for name, bucketConfig := range map[string]config.BucketConfig{"send": rateLimitConfig.Send, "receive": rateLimitConfig.Receive} {
+		if bucketConfig.Rate < 0 || bucketConfig.Burst < 0 {
+			return fmt.Errorf("%s rate and burst must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// Status is the state of a shaper for the control API
+type Status struct {
+	MaxDelayMS int          `json:"max_delay_ms"`
+	Send       BucketStatus `json:"send"`
+	Receive    BucketStatus `json:"receive"`
+}
+
+// Status returns the limits and throttling counters of both directions
+func (shaper *Shaper) Status() Status {
+	shaper.mutex.Lock()
+	maxDelayMS := shaper.config.MaxDelayMS
+	shaper.mutex.Unlock()
+
+	return Status{
+		MaxDelayMS: maxDelayMS,
+		Send:       shaper.Send.status(),
+		Receive:    shaper.Receive.status(),
+	}
+}
@@ -0,0 +1,134 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"thinkpol-vpn/interface/internal/config"
+)
+
+// newTestShaper creates a shaper limiting the send direction
+func newTestShaper(t *testing.T, bucketConfig config.BucketConfig, maxDelayMS int) *Shaper {
+	t.Helper()
+
+	shaper, err := NewShaper(config.RateLimitConfig{Send: bucketConfig, MaxDelayMS: maxDelayMS})
+	if err != nil {
+		t.Fatalf("NewShaper: %v", err)
+	}
+	return shaper
+}
+
+func TestPacing(t *testing.T) {
+	// 1000 byte packets at 100000 bytes per second go out every 10ms once
+	// the burst is spent
+	shaper := newTestShaper(t, config.BucketConfig{Rate: 100000, Burst: 1000}, 1000)
+
+	began := time.Now()
+	for i := range 6 {
+		if !shaper.Send.Wait(context.Background(), 1000) {
+			t.Fatalf("packet %d was dropped", i)
+		}
+	}
+	if elapsed := time.Since(began); elapsed < 45*time.Millisecond {
+		t.Errorf("6 packets took %s, want at least 50ms", elapsed)
+	}
+
+	status := shaper.Status().Send
+	if status.DelayedPackets != 5 || status.DroppedPackets != 0 {
+		t.Errorf("delayed = %d, dropped = %d, want 5 and 0", status.DelayedPackets, status.DroppedPackets)
+	}
+
+	// The other direction is not limited
+	if !shaper.Receive.Wait(context.Background(), 1<<20) {
+		t.Errorf("unlimited direction dropped a packet")
+	}
+}
+
+func TestMaxDelayDrop(t *testing.T) {
+	// Refilling 1000 bytes takes a second, far more than max_delay
+	shaper := newTestShaper(t, config.BucketConfig{Rate: 1000, Burst: 1000}, 10)
+
+	if !shaper.Send.Wait(context.Background(), 1000) {
+		t.Fatalf("first packet was dropped although it fits the burst")
+	}
+
+	began := time.Now()
+	if shaper.Send.Wait(context.Background(), 500) {
+		t.Errorf("packet that would wait 500ms went out")
+	}
+	if elapsed := time.Since(began); elapsed > 100*time.Millisecond {
+		t.Errorf("dropping took %s, want no wait", elapsed)
+	}
+
+	status := shaper.Status().Send
+	if status.DroppedPackets != 1 || status.DroppedBytes != 500 {
+		t.Errorf("dropped = %d packets, %d bytes, want 1 and 500", status.DroppedPackets, status.DroppedBytes)
+	}
+}
+
+func TestOversizePacket(t *testing.T) {
+	shaper := newTestShaper(t, config.BucketConfig{Rate: 100000, Burst: 1000}, 1000)
+
+	// 3000 bytes with a burst of 1000 are charged in full: the burst now and
+	// 2000 bytes, 20ms, of refill
+	began := time.Now()
+	if !shaper.Send.Wait(context.Background(), 3000) {
+		t.Fatalf("oversize packet was dropped")
+	}
+	if elapsed := time.Since(began); elapsed < 15*time.Millisecond {
+		t.Errorf("oversize packet took %s, want it charged for all of its 3000 bytes", elapsed)
+	}
+
+	// Nothing is left over for the next packet
+	began = time.Now()
+	if !shaper.Send.Wait(context.Background(), 1000) {
+		t.Fatalf("packet after the oversize one was dropped")
+	}
+	if elapsed := time.Since(began); elapsed < 5*time.Millisecond {
+		t.Errorf("packet after the oversize one took %s, want it paced", elapsed)
+	}
+}
+
+func TestOversizePacketDrop(t *testing.T) {
+	// 3000 bytes need 2s of refill, more than max_delay
+	shaper := newTestShaper(t, config.BucketConfig{Rate: 1000, Burst: 1000}, 100)
+
+	if shaper.Send.Wait(context.Background(), 3000) {
+		t.Errorf("oversize packet that would wait 2s went out")
+	}
+
+	// The dropped packet gave its tokens back, the burst is still there
+	began := time.Now()
+	if !shaper.Send.Wait(context.Background(), 1000) {
+		t.Fatalf("packet within the burst was dropped")
+	}
+	if elapsed := time.Since(began); elapsed > 50*time.Millisecond {
+		t.Errorf("packet within the burst took %s, want no wait", elapsed)
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	shaper := newTestShaper(t, config.BucketConfig{Rate: 1000, Burst: 1000}, 10000)
+	shaper.Send.Wait(context.Background(), 1000)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if shaper.Send.Wait(ctx, 1000) {
+		t.Errorf("Wait = true after the context ended")
+	}
+}
+
+func TestConfigureRejectsNegative(t *testing.T) {
+	shaper := newTestShaper(t, config.BucketConfig{}, 0)
+
+	for _, rateLimitConfig := range []config.RateLimitConfig{
+		{MaxDelayMS: -1},
+		{Send: config.BucketConfig{Rate: -1}},
+		{Receive: config.BucketConfig{Burst: -1}},
+	} {
+		if err := shaper.Configure(rateLimitConfig); err == nil {
+			t.Errorf("Configure(%+v) succeeded", rateLimitConfig)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package scheduler
+
+import (
+	"fmt"
+
+	"thinkpol-vpn/interface/internal/packet"
+)
+
+// Class is the traffic class a packet is queued in
+type Class int
+
+const (
+	// Interactive traffic is latency sensitive: voice and video, control
+	// messages, DNS, ICMP, connection setup, TCP ACKs and small segments
+	Interactive Class = iota
+	// Default is everything else
+	Default
+	// Bulk is traffic marked as less than best effort
+	Bulk
+
+	numClasses
+)
+
+// String returns the class name used in statistics
+func (class Class) String() string {
+	switch class {
+	case Interactive:
+		return "interactive"
+	case Default:
+		return "default"
+	case Bulk:
+		return "bulk"
+	default:
+		return fmt.Sprintf("class(%d)", int(class))
+	}
+}
+
+// DSCP code points, see RFC 4594 and RFC 8622
+const (
+	dscpLE  = 1
+	dscpCS1 = 8
+	dscpCS4 = 32
+)
+
+// smallSegment is the largest TCP payload treated as interactive, enough for
+// keystrokes and terminal echo
+const smallSegment = 128
+
+// dnsPort is the port of DNS over UDP and TCP
+const dnsPort = 53
+
+// Classify picks the class of a packet. Packets that could not be parsed go
+// in the default class.
+func Classify(parsed *packet.Packet) Class {
+	if parsed == nil {
+		return Default
+	}
+
+	// An explicit marking wins, CS4 and above covers real-time and signalling
+	switch dscp := parsed.TrafficClass >> 2; {
+	case dscp == dscpLE || dscp == dscpCS1:
+		return Bulk
+	case dscp >= dscpCS4:
+		return Interactive
+	}
+
+	switch parsed.Protocol {
+	case packet.ICMP, packet.ICMPv6:
+		return Interactive
+	case packet.UDP:
+		if parsed.UDP != nil && (parsed.UDP.SrcPort == dnsPort || parsed.UDP.DstPort == dnsPort) {
+			return Interactive
+		}
+	case packet.TCP:
+		tcp := parsed.TCP
+		if tcp == nil {
+			return Default
+		}
+		if tcp.SrcPort == dnsPort || tcp.DstPort == dnsPort || tcp.Flags.Has(packet.SYN) {
+			return Interactive
+		}
+		// Pure ACKs keep the other direction moving, small segments are
+		// usually someone typing
+		if len(parsed.Payload)-tcp.HeaderLength <= smallSegment {
+			return Interactive
+		}
+	}
+
+	return Default
+}
@@ -0,0 +1,133 @@
+package scheduler
+
+import (
+	"math"
+	"time"
+
+	"thinkpol-vpn/interface/api/protobuf"
+)
+
+// maxPacket is the backlog below which CoDel never drops, one full packet
+const maxPacket = 1500
+
+// item is a queued packet and when it was queued
+type item struct {
+	packet   *protobuf.PacketV4
+	size     int
+	enqueued time.Time
+}
+
+// classQueue is the FIFO of one class with CoDel (RFC 8289) on dequeue
+type classQueue struct {
+	items    []item
+	capacity int
+	backlog  int
+	quantum  int
+	deficit  int
+
+	// CoDel state
+	firstAboveTime time.Time
+	dropNext       time.Time
+	count          int
+	lastCount      int
+	dropping       bool
+
+	enqueued    uint64
+	dequeued    uint64
+	droppedFull uint64
+	droppedHead uint64
+	droppedAQM  uint64
+	blocked     uint64
+}
+
+func (queue *classQueue) full() bool {
+	return len(queue.items) >= queue.capacity
+}
+
+func (queue *classQueue) push(entry item) {
+	queue.items = append(queue.items, entry)
+	queue.backlog += entry.size
+	queue.enqueued++
+}
+
+func (queue *classQueue) pop() (item, bool) {
+	if len(queue.items) == 0 {
+		return item{}, false
+	}
+	entry := queue.items[0]
+	queue.items[0] = item{}
+	queue.items = queue.items[1:]
+	queue.backlog -= entry.size
+	return entry, true
+}
+
+// shouldDrop tracks how long the sojourn time stayed above the target
+func (queue *classQueue) shouldDrop(entry item, now time.Time, aqm *aqm) bool {
+	if now.Sub(entry.enqueued) < aqm.target || queue.backlog <= maxPacket {
+		queue.firstAboveTime = time.Time{}
+		return false
+	}
+	if queue.firstAboveTime.IsZero() {
+		queue.firstAboveTime = now.Add(aqm.interval)
+		return false
+	}
+	return !now.Before(queue.firstAboveTime)
+}
+
+// controlLaw schedules the next drop, closer together the more were dropped
+func controlLaw(t time.Time, interval time.Duration, count int) time.Time {
+	return t.Add(time.Duration(float64(interval) / math.Sqrt(float64(count))))
+}
+
+// dequeue pops the next packet, dropping packets while the queue is
+// persistently above the target delay. Without AQM it is a plain pop.
+func (queue *classQueue) dequeue(now time.Time, aqm *aqm) (item, bool) {
+	entry, ok := queue.pop()
+	if !ok {
+		queue.firstAboveTime = time.Time{}
+		queue.dropping = false
+		return entry, false
+	}
+	if aqm == nil {
+		return entry, true
+	}
+
+	okToDrop := queue.shouldDrop(entry, now, aqm)
+	if queue.dropping {
+		if !okToDrop {
+			queue.dropping = false
+		}
+		for queue.dropping && !now.Before(queue.dropNext) {
+			queue.droppedAQM++
+			queue.count++
+			if entry, ok = queue.pop(); !ok {
+				queue.dropping = false
+				return entry, false
+			}
+			if queue.shouldDrop(entry, now, aqm) {
+				queue.dropNext = controlLaw(queue.dropNext, aqm.interval, queue.count)
+			} else {
+				queue.dropping = false
+			}
+		}
+	} else if okToDrop {
+		queue.droppedAQM++
+		if entry, ok = queue.pop(); !ok {
+			return entry, false
+		}
+		queue.shouldDrop(entry, now, aqm)
+		queue.dropping = true
+
+		// Start close to the previous drop rate when the last dropping state
+		// ended recently
+		delta := queue.count - queue.lastCount
+		queue.count = 1
+		if delta > 1 && now.Sub(queue.dropNext) < 16*aqm.interval {
+			queue.count = delta
+		}
+		queue.dropNext = controlLaw(now, aqm.interval, queue.count)
+		queue.lastCount = queue.count
+	}
+
+	return entry, true
+}
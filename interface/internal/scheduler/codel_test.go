@@ -0,0 +1,102 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"thinkpol-vpn/interface/internal/config"
+)
+
+// newCoDelScheduler creates a scheduler with a 5ms target and 100ms interval
+func newCoDelScheduler(t *testing.T) *Scheduler {
+	t.Helper()
+	scheduler, err := New(config.SchedulerConfig{
+		Capacity: 64,
+		AQM:      config.AQMConfig{Enabled: true, TargetMS: 5, IntervalMS: 100},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return scheduler
+}
+
+func TestCoDelDropsPersistentQueue(t *testing.T) {
+	scheduler := newCoDelScheduler(t)
+	for i := 0; i < 40; i++ {
+		scheduler.Enqueue(udpPacket(byte(i), 1000, 0))
+	}
+	start := time.Now()
+	queue := scheduler.classes[Default]
+
+	// dequeueAt dequeues one packet at start+offset and returns the AQM drops
+	dequeueAt := func(offset time.Duration) uint64 {
+		if scheduler.dequeueLocked(start.Add(offset)) == nil {
+			t.Fatalf("queue ran empty at %s", offset)
+		}
+		return queue.droppedAQM
+	}
+
+	// Above the target, but not for a whole interval yet
+	if drops := dequeueAt(50 * time.Millisecond); drops != 0 {
+		t.Errorf("dropped %d packets as soon as the delay went above the target", drops)
+	}
+	if drops := dequeueAt(100 * time.Millisecond); drops != 0 {
+		t.Errorf("dropped %d packets before the delay stayed above the target for an interval", drops)
+	}
+
+	// An interval later CoDel starts dropping
+	if drops := dequeueAt(160 * time.Millisecond); drops != 1 {
+		t.Errorf("dropped %d packets once the delay stayed above the target, want 1", drops)
+	}
+	if drops := dequeueAt(200 * time.Millisecond); drops != 1 {
+		t.Errorf("dropped %d packets before the next drop is due, want 1", drops)
+	}
+
+	// Drops come closer together, interval/sqrt(count) apart
+	if drops := dequeueAt(270 * time.Millisecond); drops != 2 {
+		t.Errorf("dropped %d packets an interval after the first drop, want 2", drops)
+	}
+	if drops := dequeueAt(340 * time.Millisecond); drops != 3 {
+		t.Errorf("dropped %d packets interval/sqrt(2) after the second drop, want 3", drops)
+	}
+	if !queue.dropping {
+		t.Errorf("CoDel left the dropping state while the delay stays above the target")
+	}
+}
+
+func TestCoDelKeepsShortQueue(t *testing.T) {
+	scheduler := newCoDelScheduler(t)
+	start := time.Now()
+
+	// Packets that leave within the target are never dropped however long
+	// the traffic lasts
+	for i := 0; i < 100; i++ {
+		scheduler.Enqueue(udpPacket(byte(i), 1000, 0))
+		scheduler.Enqueue(udpPacket(byte(i), 1000, 0))
+		now := start.Add(time.Duration(i) * 10 * time.Millisecond)
+		scheduler.classes[Default].items[0].enqueued = now
+		scheduler.classes[Default].items[1].enqueued = now
+		scheduler.dequeueLocked(now.Add(time.Millisecond))
+		scheduler.dequeueLocked(now.Add(time.Millisecond))
+	}
+
+	if drops := scheduler.Stats()[Default].DroppedAQM; drops != 0 {
+		t.Errorf("dropped %d packets from a queue below the target", drops)
+	}
+}
+
+func TestCoDelKeepsSinglePacket(t *testing.T) {
+	scheduler := newCoDelScheduler(t)
+	start := time.Now()
+
+	// A backlog of one packet is never dropped, however long it waited
+	for i := 0; i < 10; i++ {
+		scheduler.Enqueue(udpPacket(byte(i), 1000, 0))
+		if scheduler.dequeueLocked(start.Add(time.Duration(i+1)*time.Second)) == nil {
+			t.Fatalf("packet %d was dropped", i)
+		}
+	}
+	if drops := scheduler.Stats()[Default].DroppedAQM; drops != 0 {
+		t.Errorf("dropped %d lone packets", drops)
+	}
+}
@@ -0,0 +1,312 @@
+// Package scheduler queues packets for the transport by traffic class so
+// interactive flows are not stuck behind bulk transfers
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/config"
+	"thinkpol-vpn/interface/internal/packet"
+)
+
+// quanta are the bytes each class may send per deficit round robin turn.
+// Interactive traffic rarely uses its share, when it does it gets twice the
+// default class and bulk gets a quarter.
+var quanta = [numClasses]int{
+	Interactive: 6000,
+	Default:     3000,
+	Bulk:        750,
+}
+
+// Policy is what happens to a packet queued in a full class
+type Policy int
+
+const (
+	// TailDrop drops the new packet
+	TailDrop Policy = iota
+	// HeadDrop drops the oldest packet of the class to make room, which keeps
+	// the data that does get through fresh
+	HeadDrop
+	// Block holds the sender back until there is room or the block timeout
+	// passes, then drops the new packet
+	Block
+)
+
+// String returns the policy name used in the configuration
+func (policy Policy) String() string {
+	switch policy {
+	case TailDrop:
+		return "tail-drop"
+	case HeadDrop:
+		return "head-drop"
+	case Block:
+		return "block"
+	default:
+		return fmt.Sprintf("policy(%d)", int(policy))
+	}
+}
+
+// parsePolicy parses a policy name
+func parsePolicy(name string) (Policy, error) {
+	switch name {
+	case "", "tail-drop":
+		return TailDrop, nil
+	case "head-drop":
+		return HeadDrop, nil
+	case "block":
+		return Block, nil
+	default:
+		return 0, fmt.Errorf("unknown queue policy %q, expected tail-drop, head-drop or block", name)
+	}
+}
+
+// aqm holds the CoDel parameters
+type aqm struct {
+	target   time.Duration
+	interval time.Duration
+}
+
+// Scheduler is a multi-class packet queue. Classes are served by deficit
+// round robin and each class is kept short by CoDel.
+type Scheduler struct {
+	mutex   sync.Mutex
+	classes [numClasses]*classQueue
+	// turn is the class being served and visited whether it got its quantum
+	turn     Class
+	visited  bool
+	length   int
+	capacity int
+	aqm      *aqm
+
+	policy       Policy
+	blockTimeout time.Duration
+
+	// ready is signalled when a packet is queued
+	ready chan struct{}
+	// space is closed when packets leave the queue, it only exists while
+	// senders wait for room
+	space chan struct{}
+}
+
+// New creates a scheduler with the queue management of the configuration
+func New(schedulerConfig config.SchedulerConfig) (*Scheduler, error) {
+	if schedulerConfig.Capacity <= 0 {
+		return nil, fmt.Errorf("queue capacity must be positive")
+	}
+	policy, err := parsePolicy(schedulerConfig.Policy)
+	if err != nil {
+		return nil, err
+	}
+	if policy == Block && schedulerConfig.BlockTimeoutMS <= 0 {
+		return nil, fmt.Errorf("the block policy needs a positive block timeout")
+	}
+
+	scheduler := &Scheduler{
+		capacity:     schedulerConfig.Capacity,
+		policy:       policy,
+		blockTimeout: time.Duration(schedulerConfig.BlockTimeoutMS) * time.Millisecond,
+		ready:        make(chan struct{}, 1),
+	}
+	for class := range scheduler.classes {
+		scheduler.classes[class] = &classQueue{capacity: schedulerConfig.Capacity, quantum: quanta[class]}
+	}
+
+	if aqmConfig := schedulerConfig.AQM; aqmConfig.Enabled {
+		if aqmConfig.TargetMS <= 0 || aqmConfig.IntervalMS <= 0 {
+			return nil, fmt.Errorf("AQM target and interval must be positive")
+		}
+		scheduler.aqm = &aqm{
+			target:   time.Duration(aqmConfig.TargetMS) * time.Millisecond,
+			interval: time.Duration(aqmConfig.IntervalMS) * time.Millisecond,
+		}
+	}
+
+	return scheduler, nil
+}
+
+// Enqueue classifies a packet and queues it. When its class is full the
+// policy decides, Enqueue reports false when the packet was dropped.
+func (scheduler *Scheduler) Enqueue(queued *protobuf.PacketV4) bool {
+	// Packets that do not parse still go through, in the default class
+	parsed, _ := packet.Parse(queued.GetBuffer())
+	class := Classify(parsed)
+
+	var deadline <-chan time.Time
+	for {
+		scheduler.mutex.Lock()
+		queue := scheduler.classes[class]
+
+		if queue.full() {
+			switch scheduler.policy {
+			case HeadDrop:
+				queue.pop()
+				queue.droppedHead++
+				scheduler.length--
+			case Block:
+				if deadline == nil {
+					queue.blocked++
+					timer := time.NewTimer(scheduler.blockTimeout)
+					defer timer.Stop()
+					deadline = timer.C
+				}
+				space := scheduler.spaceLocked()
+				scheduler.mutex.Unlock()
+
+				select {
+				case <-space:
+					continue
+				case <-deadline:
+				}
+
+				scheduler.mutex.Lock()
+				queue.droppedFull++
+				scheduler.mutex.Unlock()
+				return false
+			default:
+				queue.droppedFull++
+				scheduler.mutex.Unlock()
+				return false
+			}
+		}
+
+		queue.push(item{
+			packet:   queued,
+			size:     len(queued.GetBuffer()),
+			enqueued: time.Now(),
+		})
+		scheduler.length++
+		scheduler.mutex.Unlock()
+
+		select {
+		case scheduler.ready <- struct{}{}:
+		default:
+		}
+		return true
+	}
+}
+
+// spaceLocked returns a channel that is closed once packets leave the queue.
+// The caller holds the mutex.
+func (scheduler *Scheduler) spaceLocked() <-chan struct{} {
+	if scheduler.space == nil {
+		scheduler.space = make(chan struct{})
+	}
+	return scheduler.space
+}
+
+// Dequeue waits for the next packet to send. It returns nil when ctx ends.
+func (scheduler *Scheduler) Dequeue(ctx context.Context) *protobuf.PacketV4 {
+	for {
+		scheduler.mutex.Lock()
+		next := scheduler.dequeueLocked(time.Now())
+		scheduler.mutex.Unlock()
+
+		if next != nil {
+			return next
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-scheduler.ready:
+		}
+	}
+}
+
+// dequeueLocked picks the next packet by deficit round robin. The caller
+// holds the mutex.
+func (scheduler *Scheduler) dequeueLocked(now time.Time) *protobuf.PacketV4 {
+	for scheduler.length > 0 {
+		queue := scheduler.classes[scheduler.turn]
+
+		if len(queue.items) == 0 {
+			queue.deficit = 0
+			scheduler.advance()
+			continue
+		}
+		if !scheduler.visited {
+			queue.deficit += queue.quantum
+			scheduler.visited = true
+		}
+		if queue.items[0].size > queue.deficit {
+			scheduler.advance()
+			continue
+		}
+
+		before := len(queue.items)
+		entry, ok := queue.dequeue(now, scheduler.aqm)
+		scheduler.length -= before - len(queue.items)
+		if scheduler.space != nil {
+			close(scheduler.space)
+			scheduler.space = nil
+		}
+		if !ok {
+			continue
+		}
+
+		queue.dequeued++
+		queue.deficit -= entry.size
+		if len(queue.items) == 0 {
+			queue.deficit = 0
+			scheduler.advance()
+		}
+		return entry.packet
+	}
+	return nil
+}
+
+// advance moves the turn to the next class
+func (scheduler *Scheduler) advance() {
+	scheduler.turn = (scheduler.turn + 1) % numClasses
+	scheduler.visited = false
+}
+
+// Len returns the number of queued packets
+func (scheduler *Scheduler) Len() int {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	return scheduler.length
+}
+
+// Capacity returns the number of packets all classes together can queue
+func (scheduler *Scheduler) Capacity() int {
+	return scheduler.capacity * int(numClasses)
+}
+
+// ClassStats are the counters of a traffic class
+type ClassStats struct {
+	Class       string `json:"class"`
+	Queued      int    `json:"queued"`
+	Enqueued    uint64 `json:"enqueued"`
+	Dequeued    uint64 `json:"dequeued"`
+	DroppedFull uint64 `json:"dropped_full"`
+	DroppedHead uint64 `json:"dropped_head"`
+	DroppedAQM  uint64 `json:"dropped_aqm"`
+	// Blocked counts packets whose sender had to wait for room
+	Blocked uint64 `json:"blocked"`
+}
+
+// Stats returns the counters of every class
+func (scheduler *Scheduler) Stats() []ClassStats {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	stats := make([]ClassStats, 0, numClasses)
+	for class, queue := range scheduler.classes {
+		stats = append(stats, ClassStats{
+			Class:       Class(class).String(),
+			Queued:      len(queue.items),
+			Enqueued:    queue.enqueued,
+			Dequeued:    queue.dequeued,
+			DroppedFull: queue.droppedFull,
+			DroppedHead: queue.droppedHead,
+			DroppedAQM:  queue.droppedAQM,
+			Blocked:     queue.blocked,
+		})
+	}
+	return stats
+}
@@ -0,0 +1,223 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/config"
+)
+
+// udpPacket builds an IPv4 UDP packet whose payload starts with id, so
+// tests can tell which packets got through
+func udpPacket(id byte, payloadLength int, tos byte) *protobuf.PacketV4 {
+	data := make([]byte, 28+payloadLength)
+	data[0] = 0x45
+	data[1] = tos
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)))
+	data[8] = 64
+	data[9] = 17
+	copy(data[12:16], []byte{10, 0, 0, 2})
+	copy(data[16:20], []byte{1, 1, 1, 1})
+	binary.BigEndian.PutUint16(data[20:22], 40000)
+	binary.BigEndian.PutUint16(data[22:24], 443)
+	binary.BigEndian.PutUint16(data[24:26], uint16(8+payloadLength))
+	if payloadLength > 0 {
+		data[28] = id
+	}
+
+	length := int32(len(data))
+	return &protobuf.PacketV4{Length: &length, Buffer: data}
+}
+
+func newScheduler(t *testing.T, capacity int, policy string, blockTimeoutMS int) *Scheduler {
+	t.Helper()
+	scheduler, err := New(config.SchedulerConfig{Capacity: capacity, Policy: policy, BlockTimeoutMS: blockTimeoutMS})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return scheduler
+}
+
+// drain dequeues everything queued and returns the packet ids in order
+func drain(scheduler *Scheduler) []byte {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var ids []byte
+	for {
+		next := scheduler.Dequeue(ctx)
+		if next == nil {
+			return ids
+		}
+		ids = append(ids, next.GetBuffer()[28])
+	}
+}
+
+func TestDropPoliciesWithStalledWriter(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    []byte
+		results []bool
+		stats   ClassStats
+	}{
+		{
+			policy:  "tail-drop",
+			want:    []byte{1, 2, 3},
+			results: []bool{true, true, true, false, false},
+			stats:   ClassStats{Class: "default", Enqueued: 3, Dequeued: 3, DroppedFull: 2},
+		},
+		{
+			policy:  "head-drop",
+			want:    []byte{3, 4, 5},
+			results: []bool{true, true, true, true, true},
+			stats:   ClassStats{Class: "default", Enqueued: 5, Dequeued: 3, DroppedHead: 2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			scheduler := newScheduler(t, 3, test.policy, 0)
+
+			// Nothing dequeues while the packets come in, like a writer stuck
+			// on a full socket
+			for i, want := range test.results {
+				if got := scheduler.Enqueue(udpPacket(byte(i+1), 1000, 0)); got != want {
+					t.Errorf("Enqueue(%d) = %v, want %v", i+1, got, want)
+				}
+			}
+			if scheduler.Len() != 3 {
+				t.Errorf("Len() = %d, want 3", scheduler.Len())
+			}
+
+			if got := drain(scheduler); string(got) != string(test.want) {
+				t.Errorf("dequeued %v, want %v", got, test.want)
+			}
+			if stats := scheduler.Stats()[Default]; stats != test.stats {
+				t.Errorf("stats = %+v, want %+v", stats, test.stats)
+			}
+		})
+	}
+}
+
+func TestBlockPolicyWaitsForStalledWriter(t *testing.T) {
+	scheduler := newScheduler(t, 1, "block", 1000)
+	scheduler.Enqueue(udpPacket(1, 1000, 0))
+
+	result := make(chan bool)
+	go func() {
+		result <- scheduler.Enqueue(udpPacket(2, 1000, 0))
+	}()
+
+	select {
+	case <-result:
+		t.Fatal("Enqueue into a full queue returned without waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The writer catching up lets the sender through
+	if next := scheduler.Dequeue(context.Background()); next.GetBuffer()[28] != 1 {
+		t.Fatalf("dequeued packet %d, want 1", next.GetBuffer()[28])
+	}
+	select {
+	case ok := <-result:
+		if !ok {
+			t.Fatal("blocked Enqueue dropped the packet after room was made")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked Enqueue did not return after room was made")
+	}
+
+	if stats := scheduler.Stats()[Default]; stats.Blocked != 1 || stats.DroppedFull != 0 {
+		t.Errorf("stats = %+v, want one blocked packet and no drops", stats)
+	}
+}
+
+func TestBlockPolicyGivesUpOnStalledWriter(t *testing.T) {
+	scheduler := newScheduler(t, 1, "block", 20)
+	scheduler.Enqueue(udpPacket(1, 1000, 0))
+
+	started := time.Now()
+	if scheduler.Enqueue(udpPacket(2, 1000, 0)) {
+		t.Fatal("Enqueue into a stalled queue succeeded")
+	}
+	if waited := time.Since(started); waited < 20*time.Millisecond || waited > time.Second {
+		t.Errorf("Enqueue waited %v, want about the 20ms block timeout", waited)
+	}
+
+	if stats := scheduler.Stats()[Default]; stats.Blocked != 1 || stats.DroppedFull != 1 {
+		t.Errorf("stats = %+v, want one blocked and dropped packet", stats)
+	}
+}
+
+func TestFullClassDoesNotStallOthers(t *testing.T) {
+	scheduler := newScheduler(t, 2, "tail-drop", 0)
+
+	for i := 0; i < 10; i++ {
+		scheduler.Enqueue(udpPacket(byte(i), 1000, 0))
+	}
+	// An EF marked packet is interactive and has a queue of its own
+	if !scheduler.Enqueue(udpPacket(99, 100, 46<<2)) {
+		t.Fatal("interactive packet dropped because the default class is full")
+	}
+
+	if next := scheduler.Dequeue(context.Background()); next.GetBuffer()[28] != 99 {
+		t.Errorf("dequeued packet %d first, want the interactive packet", next.GetBuffer()[28])
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	tests := []config.SchedulerConfig{
+		{Capacity: 0},
+		{Capacity: 1, Policy: "random-drop"},
+		{Capacity: 1, Policy: "block"},
+		{Capacity: 1, AQM: config.AQMConfig{Enabled: true}},
+	}
+
+	for _, schedulerConfig := range tests {
+		if _, err := New(schedulerConfig); err == nil {
+			t.Errorf("New(%+v) succeeded, want an error", schedulerConfig)
+		}
+	}
+}
+
+func TestDeficitRoundRobinShares(t *testing.T) {
+	scheduler := newScheduler(t, 64, "tail-drop", 0)
+
+	// Both classes stay backlogged, a CS1 marked packet is bulk
+	for i := 0; i < 60; i++ {
+		scheduler.Enqueue(udpPacket(0, 1000, 0))
+		scheduler.Enqueue(udpPacket(1, 1000, dscpCS1<<2))
+	}
+
+	bytes := map[byte]int{}
+	for i := 0; i < 50; i++ {
+		next := scheduler.dequeueLocked(time.Now())
+		bytes[next.GetBuffer()[28]] += len(next.GetBuffer())
+	}
+
+	// The default class gets four times the quantum of the bulk class
+	share := float64(bytes[0]) / float64(bytes[1])
+	if share < 3 || share > 5 {
+		t.Errorf("default sent %d bytes and bulk %d, a share of %.1f, want about 4", bytes[0], bytes[1], share)
+	}
+	if bytes[1] == 0 {
+		t.Errorf("bulk class was starved")
+	}
+}
+
+func TestDeficitCarriesOver(t *testing.T) {
+	scheduler := newScheduler(t, 8, "tail-drop", 0)
+
+	// A bulk packet larger than the bulk quantum goes out once the class
+	// saved up enough deficit over several turns
+	scheduler.Enqueue(udpPacket(1, 2000, dscpCS1<<2))
+	if next := scheduler.dequeueLocked(time.Now()); next == nil || next.GetBuffer()[28] != 1 {
+		t.Fatalf("bulk packet larger than its quantum was not sent")
+	}
+	if deficit := scheduler.classes[Bulk].deficit; deficit != 0 {
+		t.Errorf("deficit of the emptied class = %d, want 0", deficit)
+	}
+}
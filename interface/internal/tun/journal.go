@@ -0,0 +1,154 @@
+package tun
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Journal operations
+const (
+	journalAddInterface    = "add-interface"
+	journalDeleteInterface = "delete-interface"
+	journalAddRoute        = "add-route"
+	journalDeleteRoute     = "delete-route"
+	journalSetDNS          = "set-dns"
+	journalRestoreDNS      = "restore-dns"
+	journalAddFirewall     = "add-firewall"
+	journalRemoveFirewall  = "remove-firewall"
+)
+
+// journalEntry is a single system change
+type journalEntry struct {
+	Op          string    `json:"op"`
+	Interface   string    `json:"interface"`
+	Destination string    `json:"destination,omitempty"`
+	Gateway     string    `json:"gateway,omitempty"`
+	Metric      int       `json:"metric,omitempty"`
+	RuleSet     string    `json:"rule_set,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// key identifies the system object an entry is about
+func (entry journalEntry) key() string {
+	switch entry.Op {
+	case journalAddRoute, journalDeleteRoute:
+		return fmt.Sprintf("route|%s|%s|%s", entry.Interface, entry.Destination, entry.Gateway)
+	case journalSetDNS, journalRestoreDNS:
+		return "dns"
+	case journalAddFirewall, journalRemoveFirewall:
+		return "firewall|" + entry.RuleSet
+	default:
+		return "interface|" + entry.Interface
+	}
+}
+
+// Journal is an append-only on-disk log of the system changes SystemManager
+// makes. Every entry is synced before the change is made, so after a crash
+// the journal lists everything that may have been left behind.
+type Journal struct {
+	path  string
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// OpenJournal opens or creates the journal at path
+func OpenJournal(path string) (*Journal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+
+	return &Journal{path: path, file: file}, nil
+}
+
+// Close closes the journal file
+func (journal *Journal) Close() error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	return journal.file.Close()
+}
+
+// record appends an entry and syncs it to disk
+func (journal *Journal) record(entry journalEntry) error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	entry.Time = time.Now()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := journal.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	return journal.file.Sync()
+}
+
+// leftovers returns the changes that were made but never undone, oldest first
+func (journal *Journal) leftovers() ([]journalEntry, error) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	file, err := os.Open(journal.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+	defer file.Close()
+
+	var order []string
+	live := make(map[string]journalEntry)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn last line from a crash mid-write
+			log.Printf("    [JOURNAL] Skipping unreadable entry: %v", err)
+			continue
+		}
+
+		switch entry.Op {
+		case journalAddInterface, journalAddRoute, journalSetDNS, journalAddFirewall:
+			if _, ok := live[entry.key()]; !ok {
+				order = append(order, entry.key())
+			}
+			live[entry.key()] = entry
+		case journalDeleteInterface, journalDeleteRoute, journalRestoreDNS, journalRemoveFirewall:
+			delete(live, entry.key())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	var entries []journalEntry
+	for _, key := range order {
+		if entry, ok := live[key]; ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// truncate empties the journal once its leftovers are rolled back
+func (journal *Journal) truncate() error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	if err := journal.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate journal: %w", err)
+	}
+	return journal.file.Sync()
+}
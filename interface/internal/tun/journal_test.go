@@ -0,0 +1,134 @@
+package tun
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestJournalLeftovers(t *testing.T) {
+	journal, err := OpenJournal(filepath.Join(t.TempDir(), "journal"))
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	defer journal.Close()
+
+	for _, entry := range []journalEntry{
+		{Op: journalAddInterface, Interface: "utun9"},
+		{Op: journalSetDNS, Interface: "utun9"},
+		{Op: journalAddFirewall, Interface: "utun9", RuleSet: "dns"},
+		{Op: journalAddFirewall, Interface: "utun9", RuleSet: "killswitch"},
+		{Op: journalRemoveFirewall, Interface: "utun9", RuleSet: "dns"},
+		{Op: journalRestoreDNS, Interface: "utun9"},
+	} {
+		if err := journal.record(entry); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+
+	leftovers, err := journal.leftovers()
+	if err != nil {
+		t.Fatalf("leftovers: %v", err)
+	}
+	if len(leftovers) != 2 {
+		t.Fatalf("leftovers = %+v, want the interface and the kill switch", leftovers)
+	}
+	if leftovers[0].Op != journalAddInterface {
+		t.Errorf("leftovers[0] = %+v, want the interface", leftovers[0])
+	}
+	if leftovers[1].Op != journalAddFirewall || leftovers[1].RuleSet != "killswitch" {
+		t.Errorf("leftovers[1] = %+v, want the kill switch", leftovers[1])
+	}
+}
+
+// newTestJournal opens a journal in a temporary directory holding entries
+func newTestJournal(t *testing.T, entries ...journalEntry) *Journal {
+	journal, err := OpenJournal(filepath.Join(t.TempDir(), "journal"))
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	t.Cleanup(func() { journal.Close() })
+
+	for _, entry := range entries {
+		if err := journal.record(entry); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+	return journal
+}
+
+func TestRecoverFromJournal(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("system commands are checked in their iproute2 form")
+	}
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(output) })
+
+	journal := newTestJournal(t,
+		journalEntry{Op: journalAddInterface, Interface: "utun9"},
+		journalEntry{Op: journalAddFirewall, Interface: "utun9", RuleSet: "killswitch"},
+		journalEntry{Op: journalAddRoute, Destination: "203.0.113.0/24", Gateway: "192.168.1.1"},
+		journalEntry{Op: journalAddRoute, Interface: "utun9", Destination: "10.0.0.0/24", Metric: 10},
+		journalEntry{Op: journalAddRoute, Interface: "utun9", Destination: "10.1.0.0/16"},
+		journalEntry{Op: journalDeleteRoute, Interface: "utun9", Destination: "10.1.0.0/16"},
+	)
+
+	system := &fakeSystem{}
+	systemManager := &SystemManager{run: system.run}
+	systemManager.UseJournal(journal)
+
+	if err := systemManager.RecoverFromJournal("killswitch"); err != nil {
+		t.Fatalf("RecoverFromJournal: %v", err)
+	}
+
+	// Newest first, the route that was already deleted is left alone
+	want := []string{
+		"ip route delete 10.0.0.0/24 dev utun9 metric 10",
+		"ip route delete 203.0.113.0/24 via 192.168.1.1",
+		"ifconfig utun9 down",
+		"ifconfig utun9 destroy",
+	}
+	if !slices.Equal(system.commands, want) {
+		t.Errorf("commands = %q, want %q", system.commands, want)
+	}
+
+	// Only the kept kill switch remains in the journal
+	leftovers, err := journal.leftovers()
+	if err != nil {
+		t.Fatalf("leftovers: %v", err)
+	}
+	if len(leftovers) != 1 || leftovers[0].RuleSet != "killswitch" {
+		t.Errorf("leftovers = %+v, want the kill switch", leftovers)
+	}
+}
+
+func TestRecoverFromJournalTruncatesCleanJournal(t *testing.T) {
+	journal := newTestJournal(t,
+		journalEntry{Op: journalAddInterface, Interface: "utun9"},
+		journalEntry{Op: journalDeleteInterface, Interface: "utun9"},
+	)
+
+	system := &fakeSystem{}
+	systemManager := &SystemManager{run: system.run}
+	systemManager.UseJournal(journal)
+
+	if err := systemManager.RecoverFromJournal(); err != nil {
+		t.Fatalf("RecoverFromJournal: %v", err)
+	}
+	if len(system.commands) != 0 {
+		t.Errorf("commands = %q, want none", system.commands)
+	}
+
+	info, err := os.Stat(journal.path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("journal size = %d after recovering a clean run, want 0", info.Size())
+	}
+}
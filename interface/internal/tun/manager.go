@@ -5,11 +5,19 @@ import (
 	"io"
 	"log"
 	"net"
-	"os"
-	"os/signal"
+	"net/netip"
 	"strings"
 	"sync"
-	"syscall"
+	"time"
+
+	"thinkpol-vpn/interface/api/protobuf"
+	"thinkpol-vpn/interface/internal/acl"
+	"thinkpol-vpn/interface/internal/capture"
+	"thinkpol-vpn/interface/internal/dns"
+	"thinkpol-vpn/interface/internal/ethernet"
+	"thinkpol-vpn/interface/internal/firewall"
+	"thinkpol-vpn/interface/internal/mtu"
+	"thinkpol-vpn/interface/internal/packet"
 	"thinkpol-vpn/interface/internal/proxy"
 
 	"github.com/songgao/water"
@@ -24,7 +32,44 @@ type InterfaceManager struct {
 	address       net.IP
 	netmask       net.IP
 	systemManager *SystemManager
-	transport     *proxy.RawWebSocketVpnProxy
+	transport     proxy.Transport
+
+	// Routing management
+	routes          []Route
+	interceptAll    bool
+	installedRoutes []Route
+	routeGateways   routeGateways
+	// staleRoutes could not be deleted and are retried on the next removal
+	staleRoutes []staleRoute
+	routeMutex  sync.Mutex
+
+	// DNS management
+	dnsServers       []string
+	dnsSearchDomains []string
+	blockDNSLeaks    bool
+	dnsAllowed       []netip.AddrPort
+	resolverManager  *dns.ResolverManager
+	firewall         *firewall.Firewall
+
+	// Kill switch management
+	killSwitch            bool
+	killSwitchGateways    []netip.AddrPort
+	killSwitchListenPorts []int
+	killSwitchAllowLAN    bool
+
+	stats     *interfaceStats
+	capturer  *capture.Capturer
+	aclEngine *acl.Engine
+
+	// clampMSS lowers the MSS of TCP SYNs in both directions to fit mtu
+	clampMSS bool
+
+	// tap makes the interface a TAP interface carrying Ethernet frames,
+	// hardwareAddr is its Ethernet address and bridge the Linux bridge it
+	// joins, both optional
+	tap          bool
+	hardwareAddr string
+	bridge       string
 
 	// Cleanup management
 	stopChan     chan struct{}
@@ -33,8 +78,14 @@ type InterfaceManager struct {
 	isRunning    bool
 }
 
+// Names of the firewall rule sets the manager installs
+const (
+	killSwitchRuleSet = "killswitch"
+	dnsLeakRuleSet    = "dns"
+)
+
 // NewInterfaceManager creates a new TUN interface manager
-func NewInterfaceManager(name string, mtu int, addr, netmask string, transport *proxy.RawWebSocketVpnProxy) *InterfaceManager {
+func NewInterfaceManager(name string, mtu int, addr, netmask string, transport proxy.Transport) *InterfaceManager {
 	ipAddress := net.ParseIP(addr)
 	ipMask := net.ParseIP(addr)
 
@@ -44,24 +95,49 @@ func NewInterfaceManager(name string, mtu int, addr, netmask string, transport *
 	}
 
 	return &InterfaceManager{
-		name:          name,
-		mtu:           mtu,
-		address:       ipAddress,
-		netmask:       ipMask,
-		systemManager: NewSystemManager(),
-		stopChan:      make(chan struct{}),
-		transport:     transport,
+		name:            name,
+		mtu:             mtu,
+		address:         ipAddress,
+		netmask:         ipMask,
+		systemManager:   NewSystemManager(),
+		stopChan:        make(chan struct{}),
+		transport:       transport,
+		routes:          []Route{{Prefix: netip.MustParsePrefix("10.0.0.0/24")}},
+		resolverManager: dns.NewResolverManager(),
+		firewall:        firewall.NewFirewall(),
+		stats:           newInterfaceStats(),
+		aclEngine:       acl.NewEngine(),
 	}
 }
 
-// Create creates a new TUN interface
+// Create creates a new TUN interface, or a TAP interface in TAP mode
 func (interfaceManager *InterfaceManager) Create() error {
 	interfaceManager.controlMutex.Lock()
 	defer interfaceManager.controlMutex.Unlock()
 
-	// Configure the TUN interface
+	// Undo whatever a crashed or killed previous run left behind. A kill
+	// switch that is about to be installed again keeps blocking meanwhile.
+	var keep []string
+	if interfaceManager.killSwitch {
+		keep = append(keep, killSwitchRuleSet)
+	}
+	if err := interfaceManager.systemManager.RecoverFromJournal(keep...); err != nil {
+		log.Printf("    [MANAGER] Warning: failed to recover from journal: %v", err)
+	}
+
+	// A resolv.conf backup outlives a lost journal, it is only on disk while
+	// the original is replaced
+	if err := interfaceManager.resolverManager.Recover(""); err != nil {
+		log.Printf("    [MANAGER] Warning: failed to restore resolv.conf of a previous run: %v", err)
+	}
+
+	// Configure the TUN or TAP interface
+	deviceType, kind := water.DeviceType(water.TUN), "TUN"
+	if interfaceManager.tap {
+		deviceType, kind = water.TAP, "TAP"
+	}
 	interfaceManager.config = &water.Config{
-		DeviceType: water.TUN,
+		DeviceType: deviceType,
 		PlatformSpecificParams: water.PlatformSpecificParams{
 			Name: interfaceManager.name,
 		},
@@ -70,8 +146,8 @@ func (interfaceManager *InterfaceManager) Create() error {
 	// Create the interface
 	iface, err := water.New(*interfaceManager.config)
 	if err != nil {
-		log.Fatalf("    [MANAGER] failed to create TUN interface: %w", err)
-		return err
+		log.Printf("    [MANAGER] failed to create %s interface: %v", kind, err)
+		return fmt.Errorf("failed to create %s interface: %w", kind, err)
 	}
 
 	interfaceManager.iface = iface
@@ -79,91 +155,42 @@ func (interfaceManager *InterfaceManager) Create() error {
 	// Configure the interface
 	if err := interfaceManager.configure(); err != nil {
 		interfaceManager.iface.Close()
-		log.Fatalf("    [MANAGER] failed to configure interface: %w", err)
-		return err
+		interfaceManager.iface = nil
+		return fmt.Errorf("failed to configure interface: %w", err)
 	}
 
-	// Set up signal handling for cleanup
-	interfaceManager.setupSignalHandling()
-
-	return nil
-}
-
-// InterceptAllTraffic sets up routing to intercept all internet traffic
-// TODO: refactor
-func (interfaceManager *InterfaceManager) InterceptAllTraffic() error {
-	log.Fatalf("    [MANAGER] `InterceptAllTraffic` is not implemented (yet)")
 	return nil
 }
 
-// CreateRouteFor10Subnet creates a route for the 10.0.0.0/24 subnet through the TUN interface
-func (interfaceManager *InterfaceManager) CreateRouteFor10Subnet() error {
-	// Get the actual interface name from the water interface
-	actualName := interfaceManager.iface.Name()
-	log.Printf("    [MANAGER] Creating route for 10.0.0.0/24 subnet through interface %s (actual: %s)", interfaceManager.name, actualName)
-
-	// Get the default gateway
-	gateway, err := interfaceManager.systemManager.getDefaultGateway()
-	if err != nil {
-		log.Fatalf("    [MANAGER] failed to get default gateway: %w", err)
-		return err
-	}
-
-	// Try to add the route using the actual interface name
-	if err := interfaceManager.systemManager.AddRoute(actualName, "10.0.0.0/24", gateway); err != nil {
-		// If that fails, try without gateway (some systems don't need it for interface routes)
-		log.Printf("    [MANAGER] First route attempt failed, trying without gateway: %v", err)
-		if err := interfaceManager.systemManager.AddRoute(actualName, "10.0.0.0/24", ""); err != nil {
-			log.Fatalf("    [MANAGER] failed to add route for 10.0.0.0/24: %w", err)
+// configure sets up the interface with IP address, netmask, and MTU. A TAP
+// interface joining a bridge only gets the MTU.
+func (interfaceManager *InterfaceManager) configure() error {
+	if interfaceManager.hardwareAddr != "" {
+		if err := interfaceManager.systemManager.SetHardwareAddress(interfaceManager.name, interfaceManager.hardwareAddr); err != nil {
+			log.Printf("    [MANAGER] failed to set hardware address: %v", err)
 			return err
 		}
 	}
 
-	log.Printf("    [MANAGER] Successfully created route for 10.0.0.0/24 subnet through %s", actualName)
-	return nil
-}
+	if interfaceManager.bridge != "" {
+		if err := interfaceManager.systemManager.ConfigureBridgePort(
+			interfaceManager.name,
+			interfaceManager.bridge,
+			interfaceManager.mtu); err != nil {
 
-// RemoveRouteFor10Subnet removes the route for the 10.0.0.0/24 subnet
-func (interfaceManager *InterfaceManager) RemoveRouteFor10Subnet() error {
-	// Get the actual interface name from the water interface
-	actualName := interfaceManager.iface.Name()
-	log.Printf("    [MANAGER] Removing route for 10.0.0.0/24 subnet from interface %s", actualName)
-
-	// Try to delete the route using the system manager
-	if err := interfaceManager.systemManager.DeleteRoute(actualName, "10.0.0.0/24", ""); err != nil {
-		// If that fails, try with gateway
-		log.Printf("    [MANAGER] First delete attempt failed, trying with gateway: %v", err)
-		gateway, gatewayErr := interfaceManager.systemManager.getDefaultGateway()
-		if gatewayErr == nil {
-			if err := interfaceManager.systemManager.DeleteRoute(actualName, "10.0.0.0/24", gateway); err != nil {
-				log.Printf("    [MANAGER] Warning: could not delete route for 10.0.0.0/24: %v", err)
-				return nil // Don't treat route deletion failure as fatal
-			}
-		} else {
-			log.Printf("    [MANAGER] Warning: could not delete route for 10.0.0.0/24: %v", err)
-			return nil // Don't treat route deletion failure as fatal
+			log.Printf("    [MANAGER] failed to configure interface: %v", err)
+			return err
 		}
-	}
 
-	log.Printf("    [MANAGER] Successfully removed route for 10.0.0.0/24 subnet")
-	return nil
-}
-
-// setupSignalHandling sets up signal handlers for graceful shutdown
-func (interfaceManager *InterfaceManager) setupSignalHandling() {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-
-	go func() {
-		sig := <-sigChan
-		log.Printf("    [MANAGER] Received signal %v, shutting down gracefully...", sig)
-		interfaceManager.Cleanup()
-		os.Exit(0)
-	}()
-}
+		log.Printf(
+			"Configured interface %s on bridge %s, MTU %d",
+			interfaceManager.name,
+			interfaceManager.bridge,
+			interfaceManager.mtu,
+		)
+		return nil
+	}
 
-// configure sets up the interface with IP address, netmask, and MTU
-func (interfaceManager *InterfaceManager) configure() error {
 	// Configure the interface using system commands
 	if err := interfaceManager.systemManager.ConfigureInterface(
 		interfaceManager.name,
@@ -171,7 +198,7 @@ func (interfaceManager *InterfaceManager) configure() error {
 		interfaceManager.netmask.String(),
 		interfaceManager.mtu); err != nil {
 
-		log.Fatalf("    [MANAGER] failed to configure interface: %w", err)
+		log.Printf("    [MANAGER] failed to configure interface: %v", err)
 
 		return err
 	}
@@ -200,25 +227,46 @@ func (interfaceManager *InterfaceManager) Start() error {
 
 	log.Printf("    [MANAGER] Starting packet processing on interface %s", interfaceManager.name)
 
-	// Create route for 10.0.0.0/24 subnet
-	if err := interfaceManager.CreateRouteFor10Subnet(); err != nil {
-		return fmt.Errorf("failed to create route for 10 subnet: %w", err)
+	// Route the configured prefixes through the interface
+	if err := interfaceManager.ApplyRoutes(); err != nil {
+		return fmt.Errorf("failed to apply routes: %w", err)
+	}
+
+	// Lock traffic to the tunnel before anything can leak around it
+	if err := interfaceManager.enableKillSwitch(); err != nil {
+		interfaceManager.RemoveRoutes()
+		return fmt.Errorf("failed to enable kill switch: %w", err)
+	}
+
+	// Point the system resolver at the tunnel now that it can reach it
+	if err := interfaceManager.applyDNS(); err != nil {
+		interfaceManager.RemoveRoutes()
+		return fmt.Errorf("failed to apply DNS configuration: %w", err)
 	}
 
-	// Start packet processing in a goroutine
-	interfaceManager.wg.Add(1)
+	// Start packet processing in both directions
+	interfaceManager.wg.Add(2)
 	interfaceManager.isRunning = true
 	interfaceManager.stopChan = make(chan struct{})
 	go interfaceManager.processPackets()
+	go interfaceManager.processIncomingPackets()
 
 	return nil
 }
 
+// maxPacketSize is the largest IP packet, packets are read whole even when
+// they exceed the MTU so they can be refused properly
+const maxPacketSize = 65535
+
+// maxFrameSize is the largest read from a TAP interface, a frame carrying the
+// largest IP packet
+const maxFrameSize = ethernet.HeaderLength + maxPacketSize
+
 // processPackets handles incoming and outgoing packets
 func (interfaceManager *InterfaceManager) processPackets() {
 	defer interfaceManager.wg.Done()
 
-	buffer := make([]byte, interfaceManager.mtu)
+	buffer := make([]byte, maxFrameSize)
 
 	for {
 		select {
@@ -266,78 +314,148 @@ func (interfaceManager *InterfaceManager) processPackets() {
 				break
 			}
 			log.Printf("    [MANAGER] Error reading from interface: %v", err)
+			interfaceManager.stats.readErrors.Add(1)
 			continue
 		}
 
 		// Log packet info but don't echo back to prevent routing loops
 		if n > 0 {
-			interfaceManager.logPacketInfo(buffer[:n])
-			interfaceManager.transport.SendToTransport(n, buffer)
+			if data := interfaceManager.packetOf(buffer[:n]); data == nil {
+				// ARP and whatever else is not IP is for the far end of the
+				// link to answer
+				interfaceManager.stats.recordFrame("read", buffer[:n])
+			} else {
+				parsed := interfaceManager.logPacketInfo(data)
+				interfaceManager.stats.recordRead(n, parsed)
+				interfaceManager.capturer.Capture(capture.Point{Source: capture.SourceTUN, Direction: capture.Outbound}, data)
+
+				if !interfaceManager.aclEngine.Allow(acl.Outbound, parsed) {
+					interfaceManager.stats.deniedOutbound.Add(1)
+					continue
+				}
+
+				if len(data) > interfaceManager.mtu && interfaceManager.refuseTooBig(parsed, buffer[:n]) {
+					continue
+				}
+				interfaceManager.clampMSSOf(parsed)
+			}
+
+			// The transport keeps a reference to the packet, so copy it out
+			// of the read buffer
+			data := make([]byte, n)
+			copy(data, buffer[:n])
+
+			started := time.Now()
+			interfaceManager.transport.SendToTransport(n, data)
+			interfaceManager.stats.handoffDuration.Observe(time.Since(started).Seconds())
 		}
 	}
 }
 
-// logPacketInfo logs packet information without processing
-func (interfaceManager *InterfaceManager) logPacketInfo(packet []byte) {
-	if len(packet) < 20 {
-		return
-	}
+// processIncomingPackets writes packets received from the transport to the interface
+func (interfaceManager *InterfaceManager) processIncomingPackets() {
+	defer interfaceManager.wg.Done()
+
+	for {
+		var received *protobuf.PacketV4
 
-	// Parse IP header
-	version := packet[0] >> 4
-	if version == 4 {
-		interfaceManager.logIPv4Packet(packet)
-	} else if version == 6 {
-		interfaceManager.logIPv6Packet(packet)
+		select {
+		case <-interfaceManager.stopChan:
+			log.Printf("    [MANAGER] Stopping incoming packet processing on interface %s", interfaceManager.name)
+			return
+		case received = <-interfaceManager.transport.ReceiveFromTransport():
+		}
+
+		buffer := received.GetBuffer()
+		if len(buffer) == 0 {
+			continue
+		}
+
+		data := interfaceManager.packetOf(buffer)
+		var parsed *packet.Packet
+		if data != nil {
+			parsed = interfaceManager.logPacketInfo(data)
+			if !interfaceManager.aclEngine.Allow(acl.Inbound, parsed) {
+				interfaceManager.stats.deniedInbound.Add(1)
+				continue
+			}
+			interfaceManager.clampMSSOf(parsed)
+		}
+
+		if _, err := interfaceManager.iface.Write(buffer); err != nil {
+			log.Printf("    [MANAGER] Error writing to interface: %v", err)
+			interfaceManager.stats.writeErrors.Add(1)
+			continue
+		}
+
+		if data == nil {
+			interfaceManager.stats.recordFrame("written", buffer)
+			continue
+		}
+		interfaceManager.stats.recordWritten(len(buffer), parsed)
+		interfaceManager.capturer.Capture(capture.Point{Source: capture.SourceTUN, Direction: capture.Inbound}, data)
 	}
 }
 
-// logIPv4Packet logs IPv4 packet information
-func (interfaceManager *InterfaceManager) logIPv4Packet(packet []byte) {
-	if len(packet) < 20 {
-		return
+// packetOf returns the IP packet read from or written to the interface: the
+// data itself on a TUN interface, the packet inside the frame on a TAP
+// interface. It returns nil for frames that carry no IP packet.
+func (interfaceManager *InterfaceManager) packetOf(data []byte) []byte {
+	if !interfaceManager.tap {
+		return data
 	}
+	return ethernet.Packet(data)
+}
 
-	// Extract source and destination IPs
-	srcIP := net.IP(packet[12:16])
-	dstIP := net.IP(packet[16:20])
-	protocol := packet[9]
+// refuseTooBig answers a packet read from the interface that does not fit
+// the tunnel with an ICMP "fragmentation needed" or Packet Too Big error, so
+// the sender lowers its path MTU. It reports whether the packet was refused.
+// IPv4 packets that may be fragmented are sent whole, the transport carries
+// them as a byte stream. On a TAP interface the error goes back in a frame to
+// the sender of frame.
+func (interfaceManager *InterfaceManager) refuseTooBig(parsed *packet.Packet, frame []byte) bool {
+	if parsed == nil {
+		return false
+	}
+	reply := parsed.TooBig(interfaceManager.mtu)
+	if reply == nil {
+		return false
+	}
 
-	// Log packet information with protocol details
-	protocolName := getProtocolName(protocol)
-	log.Printf("    [MANAGER] [PACKET] IPv4: %s -> %s (%s)", srcIP, dstIP, protocolName)
+	interfaceManager.stats.tooBig.Add(1)
+	log.Printf("    [MANAGER] [MTU] %s does not fit the tunnel MTU of %d, refusing it", parsed, interfaceManager.mtu)
+	if interfaceManager.tap {
+		header, _ := ethernet.Parse(frame)
+		reply = header.Reply(ethernet.TypeOf(reply), reply)
+	}
+	if _, err := interfaceManager.iface.Write(reply); err != nil {
+		log.Printf("    [MANAGER] Error writing ICMP error to interface: %v", err)
+		interfaceManager.stats.writeErrors.Add(1)
+	}
+	return true
 }
 
-// logIPv6Packet logs IPv6 packet information
-func (interfaceManager *InterfaceManager) logIPv6Packet(packet []byte) {
-	if len(packet) < 40 {
+// clampMSSOf lowers the MSS option of a TCP SYN to what fits the tunnel MTU
+func (interfaceManager *InterfaceManager) clampMSSOf(parsed *packet.Packet) {
+	if !interfaceManager.clampMSS || parsed == nil {
 		return
 	}
-
-	// Extract source and destination IPs
-	srcIP := net.IP(packet[8:24])
-	dstIP := net.IP(packet[24:40])
-	nextHeader := packet[6]
-
-	// Log packet information with protocol details
-	protocolName := getProtocolName(nextHeader)
-	log.Printf("    [MANAGER] [PACKET] IPv6: %s -> %s (%s)", srcIP, dstIP, protocolName)
+	if parsed.ClampMSS(mtu.MSS(interfaceManager.mtu, parsed.Version)) {
+		interfaceManager.stats.mssClamped.Add(1)
+	}
 }
 
-// getProtocolName returns the name of the protocol
-func getProtocolName(protocol byte) string {
-	switch protocol {
-	case 1:
-		return "ICMP"
-	case 6:
-		return "TCP"
-	case 17:
-		return "UDP"
-	case 58:
-		return "ICMPv6"
-	default:
-		return fmt.Sprintf("Unknown(%d)", protocol)
+// logPacketInfo logs packet information and returns the parsed packet.
+// It returns nil if the packet is not a valid IP packet.
+func (interfaceManager *InterfaceManager) logPacketInfo(data []byte) *packet.Packet {
+	parsed, err := packet.Parse(data)
+	if err != nil {
+		log.Printf("    [MANAGER] [PACKET] Malformed packet of %d bytes: %v", len(data), err)
+		return nil
 	}
+
+	log.Printf("    [MANAGER] [PACKET] %s", parsed)
+	return parsed
 }
 
 // Stop stops packet processing gracefully
@@ -351,9 +469,9 @@ func (interfaceManager *InterfaceManager) Stop() error {
 
 	log.Printf("    [MANAGER] Stopping packet processing on interface %s", interfaceManager.name)
 
-	// Remove route for 10.0.0.0/24 subnet
-	if err := interfaceManager.RemoveRouteFor10Subnet(); err != nil {
-		log.Printf("    [MANAGER] Warning: failed to remove route for 10 subnet: %v", err)
+	// Remove the routes installed by Start
+	if err := interfaceManager.RemoveRoutes(); err != nil {
+		log.Printf("    [MANAGER] Warning: failed to remove routes: %v", err)
 	}
 
 	// Signal the packet processing goroutine to stop
@@ -389,7 +507,9 @@ func (interfaceManager *InterfaceManager) Close() error {
 	return nil
 }
 
-// Cleanup performs complete cleanup including system-level cleanup
+// Cleanup performs complete cleanup including system-level cleanup. The kill
+// switch stays in place, only an explicit disconnect removes it through
+// DisableKillSwitch.
 func (interfaceManager *InterfaceManager) Cleanup() error {
 	log.Printf("    [MANAGER] Performing complete cleanup for interface %s", interfaceManager.name)
 
@@ -398,6 +518,11 @@ func (interfaceManager *InterfaceManager) Cleanup() error {
 		log.Printf("    [MANAGER] Error during interface close: %v", err)
 	}
 
+	// Put the original resolvers back before the interface disappears
+	if err := interfaceManager.restoreDNS(); err != nil {
+		log.Printf("    [MANAGER] Warning: failed to restore DNS configuration: %v", err)
+	}
+
 	// Clean up system resources
 	if err := interfaceManager.systemManager.DeleteInterface(interfaceManager.name); err != nil {
 		log.Printf("    [MANAGER] Warning: failed to delete system interface: %v", err)
@@ -407,18 +532,201 @@ func (interfaceManager *InterfaceManager) Cleanup() error {
 	return nil
 }
 
+// UseJournal records every system change made for the interface in the
+// journal, so leftovers of a crashed run are rolled back by the next Create
+func (interfaceManager *InterfaceManager) UseJournal(journal *Journal) {
+	interfaceManager.systemManager.UseJournal(journal)
+}
+
+// SystemManager returns the system manager changes for the interface go through
+func (interfaceManager *InterfaceManager) SystemManager() *SystemManager {
+	return interfaceManager.systemManager
+}
+
+// SetDNS configures the DNS servers and search domains pushed when the tunnel
+// comes up. With blockLeaks, DNS traffic outside the tunnel is firewalled off
+// except to the resolvers in allowed.
+func (interfaceManager *InterfaceManager) SetDNS(servers, searchDomains []string, blockLeaks bool, allowed []netip.AddrPort) {
+	interfaceManager.controlMutex.Lock()
+	defer interfaceManager.controlMutex.Unlock()
+
+	interfaceManager.dnsServers = servers
+	interfaceManager.dnsSearchDomains = searchDomains
+	interfaceManager.blockDNSLeaks = blockLeaks
+	interfaceManager.dnsAllowed = allowed
+}
+
+// applyDNS pushes the tunnel resolvers, callers must hold controlMutex
+func (interfaceManager *InterfaceManager) applyDNS() error {
+	if len(interfaceManager.dnsServers) == 0 {
+		return nil
+	}
+
+	actualName := interfaceManager.iface.Name()
+
+	interfaceManager.routeMutex.Lock()
+	routeAll := interfaceManager.interceptAll
+	interfaceManager.routeMutex.Unlock()
+
+	// Recorded first, a crash while applying leaves the resolvers half changed
+	interfaceManager.systemManager.record(journalEntry{Op: journalSetDNS, Interface: actualName})
+	if err := interfaceManager.resolverManager.Apply(
+		actualName,
+		interfaceManager.dnsServers,
+		interfaceManager.dnsSearchDomains,
+		routeAll); err != nil {
+
+		return err
+	}
+
+	if interfaceManager.blockDNSLeaks {
+		if err := interfaceManager.installRuleSet(dnsLeakRuleSet, firewall.DNSLeakRules(actualName, interfaceManager.dnsAllowed)); err != nil {
+			interfaceManager.resolverManager.Restore()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreDNS puts back the original resolvers and lifts the DNS leak block
+func (interfaceManager *InterfaceManager) restoreDNS() error {
+	if err := interfaceManager.removeRuleSet(dnsLeakRuleSet); err != nil {
+		log.Printf("    [MANAGER] Warning: failed to remove DNS leak rules: %v", err)
+	}
+
+	if err := interfaceManager.resolverManager.Restore(); err != nil {
+		return err
+	}
+	if len(interfaceManager.dnsServers) > 0 {
+		interfaceManager.systemManager.record(journalEntry{Op: journalRestoreDNS, Interface: interfaceManager.name})
+	}
+	return nil
+}
+
+// SetKillSwitch configures the kill switch installed when packet processing
+// starts. Only the tunnel, the gateway endpoints, replies from the ports in
+// listenPorts and optionally the LAN stay reachable.
+func (interfaceManager *InterfaceManager) SetKillSwitch(enabled bool, gateways []netip.AddrPort, listenPorts []int, allowLAN bool) {
+	interfaceManager.controlMutex.Lock()
+	defer interfaceManager.controlMutex.Unlock()
+
+	interfaceManager.killSwitch = enabled
+	interfaceManager.killSwitchGateways = gateways
+	interfaceManager.killSwitchListenPorts = listenPorts
+	interfaceManager.killSwitchAllowLAN = allowLAN
+}
+
+// enableKillSwitch installs the kill switch rules, callers must hold controlMutex.
+// The rules stay in place across Stop and transport reconnects.
+func (interfaceManager *InterfaceManager) enableKillSwitch() error {
+	if !interfaceManager.killSwitch {
+		return nil
+	}
+
+	return interfaceManager.installRuleSet(killSwitchRuleSet, firewall.KillSwitchRules(
+		interfaceManager.iface.Name(),
+		interfaceManager.killSwitchGateways,
+		interfaceManager.killSwitchListenPorts,
+		interfaceManager.killSwitchAllowLAN,
+	))
+}
+
+// DisableKillSwitch removes the kill switch rules. It should only be called
+// on an explicit disconnect, otherwise traffic is let out in the clear.
+func (interfaceManager *InterfaceManager) DisableKillSwitch() error {
+	// The rule set a failed run left may still be in place if packet
+	// processing never started to replace it
+	if interfaceManager.killSwitch && !interfaceManager.firewall.IsInstalled(killSwitchRuleSet) {
+		if err := firewall.RemoveLeftover(killSwitchRuleSet); err != nil {
+			return err
+		}
+		interfaceManager.systemManager.record(journalEntry{Op: journalRemoveFirewall, Interface: interfaceManager.name, RuleSet: killSwitchRuleSet})
+		return nil
+	}
+	return interfaceManager.removeRuleSet(killSwitchRuleSet)
+}
+
+// installRuleSet installs a firewall rule set, recorded in the journal first
+// so a crashed run's rules are found by the next one
+func (interfaceManager *InterfaceManager) installRuleSet(name string, rules []firewall.Rule) error {
+	interfaceManager.systemManager.record(journalEntry{Op: journalAddFirewall, Interface: interfaceManager.name, RuleSet: name})
+	return interfaceManager.firewall.Install(name, rules)
+}
+
+// removeRuleSet removes a firewall rule set installed by installRuleSet
+func (interfaceManager *InterfaceManager) removeRuleSet(name string) error {
+	if !interfaceManager.firewall.IsInstalled(name) {
+		return nil
+	}
+	if err := interfaceManager.firewall.Remove(name); err != nil {
+		return err
+	}
+	interfaceManager.systemManager.record(journalEntry{Op: journalRemoveFirewall, Interface: interfaceManager.name, RuleSet: name})
+	return nil
+}
+
+// SetCapturer makes packet processing record the packets read from and
+// written to the interface. It must be called before Start.
+func (interfaceManager *InterfaceManager) SetCapturer(capturer *capture.Capturer) {
+	interfaceManager.capturer = capturer
+}
+
+// SetMSSClamping makes packet processing lower the MSS option of TCP SYNs in
+// both directions to fit the MTU. It must be called before Start.
+func (interfaceManager *InterfaceManager) SetMSSClamping(enabled bool) {
+	interfaceManager.clampMSS = enabled
+}
+
+// SetTAP makes Create open a TAP interface carrying Ethernet frames instead
+// of a TUN interface. hardwareAddr is the Ethernet address of the interface
+// and bridge a Linux bridge it joins, the system picks the address and the
+// interface stays on its own when they are empty. It must be called before
+// Create.
+func (interfaceManager *InterfaceManager) SetTAP(hardwareAddr, bridge string) {
+	interfaceManager.tap = true
+	interfaceManager.hardwareAddr = hardwareAddr
+	interfaceManager.bridge = bridge
+}
+
+// SetACL makes packet processing filter packets in both directions through
+// the engine. It must be called before Start.
+func (interfaceManager *InterfaceManager) SetACL(engine *acl.Engine) {
+	interfaceManager.aclEngine = engine
+}
+
+// InterfaceName returns the name the system gave the interface
+func (interfaceManager *InterfaceManager) InterfaceName() string {
+	interfaceManager.controlMutex.Lock()
+	defer interfaceManager.controlMutex.Unlock()
+
+	if interfaceManager.iface == nil {
+		return interfaceManager.name
+	}
+	return interfaceManager.iface.Name()
+}
+
+// Stats returns a snapshot of the interface counters
+func (interfaceManager *InterfaceManager) Stats() InterfaceStats {
+	return interfaceManager.stats.snapshot()
+}
+
 // GetStatus returns the current status of the interface
 func (interfaceManager *InterfaceManager) GetStatus() map[string]interface{} {
 	interfaceManager.controlMutex.Lock()
 	defer interfaceManager.controlMutex.Unlock()
 
 	status := map[string]interface{}{
-		"name":    interfaceManager.name,
-		"mtu":     interfaceManager.mtu,
-		"address": interfaceManager.address.String(),
-		"netmask": interfaceManager.netmask.String(),
-		"up":      interfaceManager.iface != nil,
-		"running": interfaceManager.isRunning,
+		"name":        interfaceManager.name,
+		"mtu":         interfaceManager.mtu,
+		"address":     interfaceManager.address.String(),
+		"netmask":     interfaceManager.netmask.String(),
+		"up":          interfaceManager.iface != nil,
+		"running":     interfaceManager.isRunning,
+		"tap":         interfaceManager.tap,
+		"kill_switch": interfaceManager.firewall.IsInstalled(killSwitchRuleSet),
+		"stats":       interfaceManager.stats.snapshot(),
+		"transport":   interfaceManager.transport.Stats(),
 	}
 
 	if interfaceManager.iface != nil {
@@ -0,0 +1,90 @@
+package tun
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	tunPacketsDesc = prometheus.NewDesc(
+		"thinkpol_vpn_tun_packets_total",
+		"Packets read from and written to the TUN interface.",
+		[]string{"direction"}, nil,
+	)
+	tunBytesDesc = prometheus.NewDesc(
+		"thinkpol_vpn_tun_bytes_total",
+		"Bytes read from and written to the TUN interface.",
+		[]string{"direction"}, nil,
+	)
+	tunErrorsDesc = prometheus.NewDesc(
+		"thinkpol_vpn_tun_errors_total",
+		"Failed reads from and writes to the TUN interface.",
+		[]string{"direction"}, nil,
+	)
+	tunMalformedDesc = prometheus.NewDesc(
+		"thinkpol_vpn_tun_malformed_packets_total",
+		"Packets through the TUN interface that were not IP packets.",
+		nil, nil,
+	)
+	tunDeniedDesc = prometheus.NewDesc(
+		"thinkpol_vpn_tun_denied_packets_total",
+		"Packets dropped by the ACL.",
+		[]string{"direction"}, nil,
+	)
+	tunTooBigDesc = prometheus.NewDesc(
+		"thinkpol_vpn_tun_too_big_packets_total",
+		"Packets larger than the tunnel MTU refused with an ICMP error.",
+		nil, nil,
+	)
+	tunMSSClampedDesc = prometheus.NewDesc(
+		"thinkpol_vpn_tun_mss_clamped_total",
+		"TCP SYNs whose MSS option was lowered to fit the tunnel MTU.",
+		nil, nil,
+	)
+)
+
+// interfaceCollector exports the interface counters as Prometheus metrics
+type interfaceCollector struct {
+	stats *interfaceStats
+}
+
+// Collector returns a Prometheus collector for the packet pump metrics
+func (interfaceManager *InterfaceManager) Collector() prometheus.Collector {
+	return &interfaceCollector{stats: interfaceManager.stats}
+}
+
+// Describe implements prometheus.Collector
+func (collector *interfaceCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- tunPacketsDesc
+	descs <- tunBytesDesc
+	descs <- tunErrorsDesc
+	descs <- tunMalformedDesc
+	descs <- tunDeniedDesc
+	descs <- tunTooBigDesc
+	descs <- tunMSSClampedDesc
+	collector.stats.protocols.Describe(descs)
+	collector.stats.packetSize.Describe(descs)
+	collector.stats.handoffDuration.Describe(descs)
+}
+
+// Collect implements prometheus.Collector
+func (collector *interfaceCollector) Collect(metrics chan<- prometheus.Metric) {
+	stats := collector.stats.snapshot()
+
+	counter := func(desc *prometheus.Desc, value uint64, labels ...string) {
+		metrics <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), labels...)
+	}
+
+	counter(tunPacketsDesc, stats.PacketsRead, "read")
+	counter(tunPacketsDesc, stats.PacketsWritten, "written")
+	counter(tunBytesDesc, stats.BytesRead, "read")
+	counter(tunBytesDesc, stats.BytesWritten, "written")
+	counter(tunErrorsDesc, stats.ReadErrors, "read")
+	counter(tunErrorsDesc, stats.WriteErrors, "written")
+	counter(tunMalformedDesc, stats.Malformed)
+	counter(tunDeniedDesc, stats.DeniedOutbound, "out")
+	counter(tunDeniedDesc, stats.DeniedInbound, "in")
+	counter(tunTooBigDesc, stats.TooBig)
+	counter(tunMSSClampedDesc, stats.MSSClamped)
+
+	collector.stats.protocols.Collect(metrics)
+	collector.stats.packetSize.Collect(metrics)
+	collector.stats.handoffDuration.Collect(metrics)
+}
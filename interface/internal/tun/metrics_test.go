@@ -0,0 +1,52 @@
+package tun
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInterfaceCollector(t *testing.T) {
+	manager := NewInterfaceManager("utun9", 1500, "10.0.0.1", "255.255.255.0", nil)
+	stats := manager.stats
+	stats.recordRead(60, nil)
+	stats.recordRead(40, nil)
+	stats.recordWritten(1500, nil)
+	stats.readErrors.Add(1)
+	stats.writeErrors.Add(2)
+	stats.deniedOutbound.Add(3)
+	stats.deniedInbound.Add(4)
+
+	expected := `
+# HELP thinkpol_vpn_tun_packets_total Packets read from and written to the TUN interface.
+# TYPE thinkpol_vpn_tun_packets_total counter
+thinkpol_vpn_tun_packets_total{direction="read"} 2
+thinkpol_vpn_tun_packets_total{direction="written"} 1
+# HELP thinkpol_vpn_tun_bytes_total Bytes read from and written to the TUN interface.
+# TYPE thinkpol_vpn_tun_bytes_total counter
+thinkpol_vpn_tun_bytes_total{direction="read"} 100
+thinkpol_vpn_tun_bytes_total{direction="written"} 1500
+# HELP thinkpol_vpn_tun_errors_total Failed reads from and writes to the TUN interface.
+# TYPE thinkpol_vpn_tun_errors_total counter
+thinkpol_vpn_tun_errors_total{direction="read"} 1
+thinkpol_vpn_tun_errors_total{direction="written"} 2
+# HELP thinkpol_vpn_tun_denied_packets_total Packets dropped by the ACL.
+# TYPE thinkpol_vpn_tun_denied_packets_total counter
+thinkpol_vpn_tun_denied_packets_total{direction="in"} 4
+thinkpol_vpn_tun_denied_packets_total{direction="out"} 3
+# HELP thinkpol_vpn_tun_malformed_packets_total Packets through the TUN interface that were not IP packets.
+# TYPE thinkpol_vpn_tun_malformed_packets_total counter
+thinkpol_vpn_tun_malformed_packets_total 3
+`
+
+	if err := testutil.CollectAndCompare(manager.Collector(), strings.NewReader(expected),
+		"thinkpol_vpn_tun_packets_total",
+		"thinkpol_vpn_tun_bytes_total",
+		"thinkpol_vpn_tun_errors_total",
+		"thinkpol_vpn_tun_denied_packets_total",
+		"thinkpol_vpn_tun_malformed_packets_total",
+	); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,264 @@
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+)
+
+// Route is a prefix the manager steers into or around the tunnel
+type Route struct {
+	Prefix netip.Prefix
+	Metric int
+	// Exclude keeps the prefix on the default gateway instead of the tunnel
+	Exclude bool
+}
+
+// fullTunnelRoutes cover the whole IPv4 and IPv6 address space while staying
+// more specific than the default routes, so the original default routes
+// remain untouched and no IPv6 traffic goes around the tunnel
+var fullTunnelRoutes = []string{"0.0.0.0/1", "128.0.0.0/1", "::/1", "8000::/1"}
+
+// staleRoute is an installed route whose deletion failed, with the gateway
+// it was added through
+type staleRoute struct {
+	route   Route
+	gateway string
+}
+
+// routeGateways are the default gateways excluded routes go through, one
+// per address family
+type routeGateways struct {
+	ipv4 string
+	ipv6 string
+}
+
+// forRoute returns the gateway of the address family of the route
+func (gateways routeGateways) forRoute(route Route) string {
+	if route.Prefix.Addr().Is6() {
+		return gateways.ipv6
+	}
+	return gateways.ipv4
+}
+
+// NewRoute parses a route from its configuration form
+func NewRoute(prefix string, metric int, exclude bool) (Route, error) {
+	parsed, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return Route{}, fmt.Errorf("invalid route prefix %q: %w", prefix, err)
+	}
+
+	if metric < 0 {
+		return Route{}, fmt.Errorf("invalid metric %d for %s", metric, prefix)
+	}
+
+	return Route{Prefix: parsed.Masked(), Metric: metric, Exclude: exclude}, nil
+}
+
+// String returns a human readable form of the route
+func (route Route) String() string {
+	direction := "tunnel"
+	if route.Exclude {
+		direction = "gateway"
+	}
+	return fmt.Sprintf("%s via %s (metric %d)", route.Prefix, direction, route.Metric)
+}
+
+// SetRoutes replaces the route set. If routes are currently installed the
+// old set is removed and the new one applied, restoring the old set when
+// the new one cannot be applied.
+func (interfaceManager *InterfaceManager) SetRoutes(routes []Route) error {
+	interfaceManager.routeMutex.Lock()
+	defer interfaceManager.routeMutex.Unlock()
+
+	previous := interfaceManager.routes
+	interfaceManager.routes = routes
+
+	return interfaceManager.reapplyRoutes(previous, interfaceManager.interceptAll)
+}
+
+// InterceptAllTraffic sets up routing to intercept all internet traffic.
+// Exclude routes, such as the one for the gateway endpoint, stay on the default gateway.
+func (interfaceManager *InterfaceManager) InterceptAllTraffic() error {
+	interfaceManager.routeMutex.Lock()
+	defer interfaceManager.routeMutex.Unlock()
+
+	if interfaceManager.interceptAll {
+		return nil
+	}
+
+	interfaceManager.interceptAll = true
+
+	return interfaceManager.reapplyRoutes(interfaceManager.routes, false)
+}
+
+// reapplyRoutes swaps the installed routes for the current route set, going
+// back to the previous one on failure. Callers must hold routeMutex.
+func (interfaceManager *InterfaceManager) reapplyRoutes(previousRoutes []Route, previousInterceptAll bool) error {
+	if interfaceManager.installedRoutes == nil {
+		return nil
+	}
+
+	if err := interfaceManager.removeRoutes(); err != nil {
+		log.Printf("    [MANAGER] Warning: failed to remove previous routes: %v", err)
+	}
+
+	if err := interfaceManager.applyRoutes(); err != nil {
+		interfaceManager.routes = previousRoutes
+		interfaceManager.interceptAll = previousInterceptAll
+		if restoreErr := interfaceManager.applyRoutes(); restoreErr != nil {
+			log.Printf("    [MANAGER] Warning: failed to restore previous routes: %v", restoreErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// ApplyRoutes installs the route set. Either every route is installed or,
+// if one of them fails, the ones already added are rolled back.
+func (interfaceManager *InterfaceManager) ApplyRoutes() error {
+	interfaceManager.routeMutex.Lock()
+	defer interfaceManager.routeMutex.Unlock()
+
+	if interfaceManager.installedRoutes != nil {
+		return nil
+	}
+
+	return interfaceManager.applyRoutes()
+}
+
+// RemoveRoutes removes every route installed by ApplyRoutes
+func (interfaceManager *InterfaceManager) RemoveRoutes() error {
+	interfaceManager.routeMutex.Lock()
+	defer interfaceManager.routeMutex.Unlock()
+
+	return interfaceManager.removeRoutes()
+}
+
+// applyRoutes installs the route set, callers must hold routeMutex
+func (interfaceManager *InterfaceManager) applyRoutes() error {
+	if interfaceManager.iface == nil {
+		return fmt.Errorf("interface not created")
+	}
+
+	routes := interfaceManager.effectiveRoutes()
+	actualName := interfaceManager.iface.Name()
+
+	// Exclusions go to the gateway of their address family we had before
+	// the tunnel came up
+	var gateways routeGateways
+	for _, route := range routes {
+		if !route.Exclude || gateways.forRoute(route) != "" {
+			continue
+		}
+
+		ipv6 := route.Prefix.Addr().Is6()
+		gateway, err := interfaceManager.systemManager.getDefaultGateway(ipv6)
+		if err != nil {
+			return fmt.Errorf("failed to get default gateway for excluded route %s: %w", route, err)
+		}
+		if ipv6 {
+			gateways.ipv6 = gateway
+		} else {
+			gateways.ipv4 = gateway
+		}
+	}
+
+	installed := make([]Route, 0, len(routes))
+	for _, route := range routes {
+		if err := interfaceManager.addRoute(actualName, gateways.forRoute(route), route); err != nil {
+			log.Printf("    [MANAGER] Failed to add route %s, rolling back: %v", route, err)
+
+			for i := len(installed) - 1; i >= 0; i-- {
+				if err := interfaceManager.deleteRoute(actualName, gateways.forRoute(installed[i]), installed[i]); err != nil {
+					log.Printf("    [MANAGER] Warning: could not roll back route %s: %v", installed[i], err)
+				}
+			}
+			return fmt.Errorf("failed to add route %s: %w", route, err)
+		}
+
+		log.Printf("    [MANAGER] Added route %s", route)
+		installed = append(installed, route)
+	}
+
+	interfaceManager.installedRoutes = installed
+	interfaceManager.routeGateways = gateways
+	return nil
+}
+
+// removeRoutes removes the installed routes, callers must hold routeMutex.
+// Routes that cannot be deleted are kept and retried on the next call.
+func (interfaceManager *InterfaceManager) removeRoutes() error {
+	if interfaceManager.installedRoutes == nil && len(interfaceManager.staleRoutes) == 0 {
+		return nil
+	}
+
+	actualName := interfaceManager.name
+	if interfaceManager.iface != nil {
+		actualName = interfaceManager.iface.Name()
+	}
+
+	// Leftovers of an earlier removal go first, they were installed before
+	// the current routes
+	pending := interfaceManager.staleRoutes
+	for _, route := range interfaceManager.installedRoutes {
+		pending = append(pending, staleRoute{route: route, gateway: interfaceManager.routeGateways.forRoute(route)})
+	}
+
+	var errs []error
+	var failed []staleRoute
+	for i := len(pending) - 1; i >= 0; i-- {
+		stale := pending[i]
+		if err := interfaceManager.deleteRoute(actualName, stale.gateway, stale.route); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete route %s: %w", stale.route, err))
+			failed = append([]staleRoute{stale}, failed...)
+			continue
+		}
+		log.Printf("    [MANAGER] Removed route %s", stale.route)
+	}
+
+	interfaceManager.installedRoutes = nil
+	interfaceManager.routeGateways = routeGateways{}
+	interfaceManager.staleRoutes = failed
+	return errors.Join(errs...)
+}
+
+// effectiveRoutes returns the configured routes plus the full tunnel ones.
+// Exclusions are installed first so they are in place before traffic moves.
+func (interfaceManager *InterfaceManager) effectiveRoutes() []Route {
+	var includes, excludes []Route
+
+	if interfaceManager.interceptAll {
+		for _, prefix := range fullTunnelRoutes {
+			includes = append(includes, Route{Prefix: netip.MustParsePrefix(prefix)})
+		}
+	}
+
+	for _, route := range interfaceManager.routes {
+		if route.Exclude {
+			excludes = append(excludes, route)
+		} else {
+			includes = append(includes, route)
+		}
+	}
+
+	return append(excludes, includes...)
+}
+
+// addRoute installs a single route
+func (interfaceManager *InterfaceManager) addRoute(interfaceName, gateway string, route Route) error {
+	if route.Exclude {
+		return interfaceManager.systemManager.AddRouteWithMetric("", route.Prefix.String(), gateway, route.Metric)
+	}
+	return interfaceManager.systemManager.AddRouteWithMetric(interfaceName, route.Prefix.String(), "", route.Metric)
+}
+
+// deleteRoute removes a single route
+func (interfaceManager *InterfaceManager) deleteRoute(interfaceName, gateway string, route Route) error {
+	if route.Exclude {
+		return interfaceManager.systemManager.DeleteRouteWithMetric("", route.Prefix.String(), gateway, route.Metric)
+	}
+	return interfaceManager.systemManager.DeleteRouteWithMetric(interfaceName, route.Prefix.String(), "", route.Metric)
+}
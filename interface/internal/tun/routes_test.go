@@ -0,0 +1,200 @@
+package tun
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/songgao/water"
+)
+
+// fakeSystem records the commands a SystemManager runs and fails the ones
+// containing one of the failing strings
+type fakeSystem struct {
+	commands []string
+	failing  []string
+}
+
+func (system *fakeSystem) run(name string, args ...string) ([]byte, error) {
+	command := strings.Join(append([]string{name}, args...), " ")
+	system.commands = append(system.commands, command)
+
+	for _, failing := range system.failing {
+		if strings.Contains(command, failing) {
+			return []byte("RTNETLINK answers: File exists"), errors.New("exit status 2")
+		}
+	}
+
+	switch command {
+	case "ip route show default":
+		return []byte("default via 192.168.1.1 dev eth0 proto dhcp metric 100\n"), nil
+	case "ip -6 route show default":
+		return []byte("default via fe80::1 dev eth0 proto ra metric 1024 pref medium\n"), nil
+	}
+	return nil, nil
+}
+
+// newTestManager returns an interface manager with a created interface
+// whose system commands go to system
+func newTestManager(t *testing.T, system *fakeSystem) *InterfaceManager {
+	if runtime.GOOS != "linux" {
+		t.Skip("system commands are checked in their iproute2 form")
+	}
+
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(output) })
+
+	manager := NewInterfaceManager("utun9", 1500, "10.0.0.1", "255.255.255.0", nil)
+	manager.systemManager = &SystemManager{run: system.run}
+	manager.iface = &water.Interface{}
+	return manager
+}
+
+func mustRoute(t *testing.T, prefix string, exclude bool) Route {
+	route, err := NewRoute(prefix, 0, exclude)
+	if err != nil {
+		t.Fatalf("NewRoute(%q): %v", prefix, err)
+	}
+	return route
+}
+
+func TestNewRoute(t *testing.T) {
+	tests := []struct {
+		prefix string
+		metric int
+		want   string
+		err    bool
+	}{
+		{prefix: "10.0.0.0/24", want: "10.0.0.0/24"},
+		{prefix: "10.0.0.1/24", want: "10.0.0.0/24"},
+		{prefix: "2001:db8::1/32", metric: 10, want: "2001:db8::/32"},
+		{prefix: "10.0.0.1", err: true},
+		{prefix: "bogus", err: true},
+		{prefix: "10.0.0.0/33", err: true},
+		{prefix: "10.0.0.0/24", metric: -1, err: true},
+	}
+
+	for _, test := range tests {
+		route, err := NewRoute(test.prefix, test.metric, false)
+		if test.err {
+			if err == nil {
+				t.Errorf("NewRoute(%q, %d) = %v, want an error", test.prefix, test.metric, route)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewRoute(%q, %d): %v", test.prefix, test.metric, err)
+			continue
+		}
+		if route.Prefix.String() != test.want || route.Metric != test.metric {
+			t.Errorf("NewRoute(%q, %d) = %v, want %s (metric %d)", test.prefix, test.metric, route, test.want, test.metric)
+		}
+	}
+}
+
+func TestEffectiveRoutes(t *testing.T) {
+	tests := []struct {
+		name         string
+		interceptAll bool
+		want         []string
+	}{
+		{
+			name: "split tunnel",
+			want: []string{"203.0.113.0/24", "2001:db8::/32", "10.1.0.0/16"},
+		},
+		{
+			name:         "full tunnel",
+			interceptAll: true,
+			want:         []string{"203.0.113.0/24", "2001:db8::/32", "0.0.0.0/1", "128.0.0.0/1", "::/1", "8000::/1", "10.1.0.0/16"},
+		},
+	}
+
+	for _, test := range tests {
+		manager := newTestManager(t, &fakeSystem{})
+		manager.routes = []Route{
+			mustRoute(t, "10.1.0.0/16", false),
+			mustRoute(t, "203.0.113.0/24", true),
+			mustRoute(t, "2001:db8::/32", true),
+		}
+		manager.interceptAll = test.interceptAll
+
+		var got []string
+		for _, route := range manager.effectiveRoutes() {
+			got = append(got, route.Prefix.String())
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: effectiveRoutes() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestExcludedRoutesUseGatewayOfTheirFamily(t *testing.T) {
+	system := &fakeSystem{}
+	manager := newTestManager(t, system)
+
+	routes := []Route{mustRoute(t, "203.0.113.0/24", true), mustRoute(t, "2001:db8::/32", true)}
+	if err := manager.SetRoutes(routes); err != nil {
+		t.Fatalf("SetRoutes: %v", err)
+	}
+	if err := manager.ApplyRoutes(); err != nil {
+		t.Fatalf("ApplyRoutes: %v", err)
+	}
+	if err := manager.RemoveRoutes(); err != nil {
+		t.Fatalf("RemoveRoutes: %v", err)
+	}
+
+	want := []string{
+		"ip route show default",
+		"ip -6 route show default",
+		"ip route add 203.0.113.0/24 via 192.168.1.1",
+		"ip route add 2001:db8::/32 via fe80::1 dev eth0",
+		"ip route delete 2001:db8::/32 via fe80::1 dev eth0",
+		"ip route delete 203.0.113.0/24 via 192.168.1.1",
+	}
+	if !slices.Equal(system.commands, want) {
+		t.Errorf("commands = %q, want %q", system.commands, want)
+	}
+}
+
+func TestReapplyRoutesRollsBack(t *testing.T) {
+	system := &fakeSystem{}
+	manager := newTestManager(t, system)
+
+	if err := manager.SetRoutes([]Route{mustRoute(t, "10.1.0.0/16", false)}); err != nil {
+		t.Fatalf("SetRoutes: %v", err)
+	}
+	if err := manager.ApplyRoutes(); err != nil {
+		t.Fatalf("ApplyRoutes: %v", err)
+	}
+
+	system.commands = nil
+	system.failing = []string{"add 10.3.0.0/16"}
+	if err := manager.SetRoutes([]Route{mustRoute(t, "10.2.0.0/16", false), mustRoute(t, "10.3.0.0/16", false)}); err == nil {
+		t.Fatal("SetRoutes succeeded, want the failed route")
+	}
+
+	want := []string{
+		"ip route delete 10.1.0.0/16",
+		"ip route add 10.2.0.0/16",
+		"ip route add 10.3.0.0/16",
+		"ip route delete 10.2.0.0/16",
+		"ip route add 10.1.0.0/16",
+	}
+	if !slices.Equal(system.commands, want) {
+		t.Errorf("commands = %q, want %q", system.commands, want)
+	}
+
+	wantRoutes := []Route{{Prefix: netip.MustParsePrefix("10.1.0.0/16")}}
+	if !slices.Equal(manager.routes, wantRoutes) {
+		t.Errorf("routes = %v, want %v", manager.routes, wantRoutes)
+	}
+	if !slices.Equal(manager.installedRoutes, wantRoutes) {
+		t.Errorf("installedRoutes = %v, want %v", manager.installedRoutes, wantRoutes)
+	}
+}
@@ -0,0 +1,125 @@
+package tun
+
+import (
+	"sync/atomic"
+
+	"thinkpol-vpn/interface/internal/ethernet"
+	"thinkpol-vpn/interface/internal/packet"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// interfaceStats are the runtime counters of the packet pump, safe for concurrent use
+type interfaceStats struct {
+	packetsRead    atomic.Uint64
+	bytesRead      atomic.Uint64
+	packetsWritten atomic.Uint64
+	bytesWritten   atomic.Uint64
+	readErrors     atomic.Uint64
+	writeErrors    atomic.Uint64
+	malformed      atomic.Uint64
+	deniedOutbound atomic.Uint64
+	deniedInbound  atomic.Uint64
+	// tooBig counts packets refused with an ICMP error because they did not
+	// fit the tunnel MTU
+	tooBig atomic.Uint64
+	// mssClamped counts TCP SYNs whose MSS option was lowered
+	mssClamped atomic.Uint64
+
+	// protocols counts packets by direction and IP protocol
+	protocols *prometheus.CounterVec
+	// packetSize is the size distribution of packets by direction
+	packetSize *prometheus.HistogramVec
+	// handoffDuration is how long handing a read packet to the transport blocks
+	handoffDuration prometheus.Histogram
+}
+
+// newInterfaceStats creates the interface counters
+func newInterfaceStats() *interfaceStats {
+	return &interfaceStats{
+		protocols: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thinkpol_vpn_tun_protocol_packets_total",
+			Help: "Packets through the TUN interface by IP protocol.",
+		}, []string{"direction", "protocol"}),
+		packetSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "thinkpol_vpn_tun_packet_size_bytes",
+			Help:    "Size of packets through the TUN interface.",
+			Buckets: []float64{64, 128, 256, 512, 1024, 1280, 1500, 9000},
+		}, []string{"direction"}),
+		handoffDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "thinkpol_vpn_tun_handoff_duration_seconds",
+			Help:    "Time the TUN reader waits to hand a packet to the transport.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 8),
+		}),
+	}
+}
+
+// recordRead counts a packet read from the interface, parsed is nil for malformed packets
+func (stats *interfaceStats) recordRead(bytes int, parsed *packet.Packet) {
+	stats.packetsRead.Add(1)
+	stats.bytesRead.Add(uint64(bytes))
+	stats.packetSize.WithLabelValues("read").Observe(float64(bytes))
+	stats.recordProtocol("read", parsed)
+}
+
+// recordWritten counts a packet written to the interface, parsed is nil for malformed packets
+func (stats *interfaceStats) recordWritten(bytes int, parsed *packet.Packet) {
+	stats.packetsWritten.Add(1)
+	stats.bytesWritten.Add(uint64(bytes))
+	stats.packetSize.WithLabelValues("written").Observe(float64(bytes))
+	stats.recordProtocol("written", parsed)
+}
+
+// recordFrame counts a frame of a TAP interface that carries no IP packet,
+// such as ARP, by its EtherType, or as malformed
+func (stats *interfaceStats) recordFrame(direction string, frame []byte) {
+	parsed, err := ethernet.Parse(frame)
+	if err != nil {
+		stats.malformed.Add(1)
+		return
+	}
+	stats.protocols.WithLabelValues(direction, parsed.Type.String()).Inc()
+}
+
+// recordProtocol counts a packet by protocol, or as malformed
+func (stats *interfaceStats) recordProtocol(direction string, parsed *packet.Packet) {
+	if parsed == nil {
+		stats.malformed.Add(1)
+		return
+	}
+	stats.protocols.WithLabelValues(direction, parsed.Protocol.String()).Inc()
+}
+
+// InterfaceStats is a point in time copy of the interface counters.
+// Read is traffic leaving through the tunnel, written is traffic coming back.
+type InterfaceStats struct {
+	PacketsRead    uint64 `json:"packets_read"`
+	BytesRead      uint64 `json:"bytes_read"`
+	PacketsWritten uint64 `json:"packets_written"`
+	BytesWritten   uint64 `json:"bytes_written"`
+	ReadErrors     uint64 `json:"read_errors"`
+	WriteErrors    uint64 `json:"write_errors"`
+	Malformed      uint64 `json:"malformed"`
+	// Denied packets were dropped by the ACL, outbound ones after they were read
+	DeniedOutbound uint64 `json:"denied_outbound"`
+	DeniedInbound  uint64 `json:"denied_inbound"`
+	TooBig         uint64 `json:"too_big"`
+	MSSClamped     uint64 `json:"mss_clamped"`
+}
+
+// snapshot returns the current value of every counter
+func (stats *interfaceStats) snapshot() InterfaceStats {
+	return InterfaceStats{
+		PacketsRead:    stats.packetsRead.Load(),
+		BytesRead:      stats.bytesRead.Load(),
+		PacketsWritten: stats.packetsWritten.Load(),
+		BytesWritten:   stats.bytesWritten.Load(),
+		ReadErrors:     stats.readErrors.Load(),
+		WriteErrors:    stats.writeErrors.Load(),
+		Malformed:      stats.malformed.Load(),
+		DeniedOutbound: stats.deniedOutbound.Load(),
+		DeniedInbound:  stats.deniedInbound.Load(),
+		TooBig:         stats.tooBig.Load(),
+		MSSClamped:     stats.mssClamped.Load(),
+	}
+}
@@ -3,23 +3,115 @@ package tun
 import (
 	"fmt"
 	"log"
-	"os/exec"
+	"net/netip"
 	"runtime"
+	"slices"
 	"strings"
 
+	"thinkpol-vpn/interface/internal/dns"
+	"thinkpol-vpn/interface/internal/firewall"
+
 	"golang.org/x/sys/execabs"
 )
 
 // SystemManager handles system-level operations for TUN interfaces
-type SystemManager struct{}
+type SystemManager struct {
+	// journal records the changes made so a later run can undo them after a crash
+	journal *Journal
+
+	// run executes a system command and returns its combined output
+	run func(name string, args ...string) ([]byte, error)
+}
 
 // NewSystemManager creates a new system manager
 func NewSystemManager() *SystemManager {
-	return &SystemManager{}
+	return &SystemManager{run: runCommand}
+}
+
+// runCommand executes a system command and returns its combined output
+func runCommand(name string, args ...string) ([]byte, error) {
+	return execabs.Command(name, args...).CombinedOutput()
+}
+
+// UseJournal makes the system manager record every change it makes in the journal
+func (systemManager *SystemManager) UseJournal(journal *Journal) {
+	systemManager.journal = journal
+}
+
+// RecoverFromJournal rolls back the interfaces, routes, DNS settings and
+// firewall rule sets a previous run left behind, newest first, and empties
+// the journal, also when a clean exit left nothing behind. Rule sets named
+// in keep stay in place and in the journal, a kill switch left by a failed
+// run keeps blocking until it is replaced.
+func (systemManager *SystemManager) RecoverFromJournal(keep ...string) error {
+	if systemManager.journal == nil {
+		return nil
+	}
+
+	leftovers, err := systemManager.journal.leftovers()
+	if err != nil {
+		return err
+	}
+
+	if len(leftovers) == 0 {
+		return systemManager.journal.truncate()
+	}
+
+	log.Printf("    [SYSTEM] Found %d leftover changes from a previous run, rolling back", len(leftovers))
+
+	var kept []journalEntry
+	for i := len(leftovers) - 1; i >= 0; i-- {
+		entry := leftovers[i]
+
+		switch entry.Op {
+		case journalAddRoute:
+			if err := systemManager.DeleteRouteWithMetric(entry.Interface, entry.Destination, entry.Gateway, entry.Metric); err != nil {
+				log.Printf("    [SYSTEM] Warning: could not roll back route %s: %v", entry.Destination, err)
+			}
+		case journalAddInterface:
+			if err := systemManager.DeleteInterface(entry.Interface); err != nil {
+				log.Printf("    [SYSTEM] Warning: could not roll back interface %s: %v", entry.Interface, err)
+			}
+		case journalSetDNS:
+			if err := dns.NewResolverManager().Recover(entry.Interface); err != nil {
+				log.Printf("    [SYSTEM] Warning: could not roll back DNS configuration: %v", err)
+			}
+		case journalAddFirewall:
+			if slices.Contains(keep, entry.RuleSet) {
+				log.Printf("    [SYSTEM] Keeping rule set %s until it is replaced", entry.RuleSet)
+				kept = append(kept, entry)
+				continue
+			}
+			if err := firewall.RemoveLeftover(entry.RuleSet); err != nil {
+				log.Printf("    [SYSTEM] Warning: could not roll back rule set %s: %v", entry.RuleSet, err)
+			}
+		}
+	}
+
+	if err := systemManager.journal.truncate(); err != nil {
+		return err
+	}
+	for _, entry := range kept {
+		systemManager.record(entry)
+	}
+	return nil
+}
+
+// record writes a change to the journal, if there is one
+func (systemManager *SystemManager) record(entry journalEntry) {
+	if systemManager.journal == nil {
+		return
+	}
+
+	if err := systemManager.journal.record(entry); err != nil {
+		log.Printf("    [SYSTEM] Warning: could not record %s in journal: %v", entry.Op, err)
+	}
 }
 
 // ConfigureInterface configures a TUN interface with IP address, netmask, and MTU
 func (systemManager *SystemManager) ConfigureInterface(name string, addr, netmask string, mtu int) error {
+	systemManager.record(journalEntry{Op: journalAddInterface, Interface: name})
+
 	// Set IP address and netmask
 	if err := systemManager.setIPAddress(name, addr, netmask); err != nil {
 		return fmt.Errorf("failed to set IP address: %w", err)
@@ -38,16 +130,62 @@ func (systemManager *SystemManager) ConfigureInterface(name string, addr, netmas
 	return nil
 }
 
-// getDefaultGateway gets the current default gateway
-func (systemManager *SystemManager) getDefaultGateway() (string, error) {
-	cmd := execabs.Command("route", "-n", "get", "default")
-	output, err := cmd.CombinedOutput()
+// ConfigureBridgePort sets the MTU of a TAP interface, adds it to a Linux
+// bridge and brings it up. The bridge holds the addresses, the interface
+// gets none.
+func (systemManager *SystemManager) ConfigureBridgePort(name, bridge string, mtu int) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("bridging is only supported on Linux")
+	}
+
+	systemManager.record(journalEntry{Op: journalAddInterface, Interface: name})
+
+	if err := systemManager.setMTU(name, mtu); err != nil {
+		return fmt.Errorf("failed to set MTU: %w", err)
+	}
+
+	// Leaving the bridge happens on its own once the interface is deleted
+	if output, err := systemManager.run("ip", "link", "set", "dev", name, "master", bridge); err != nil {
+		return fmt.Errorf("failed to add interface to bridge %s: %s, %w", bridge, string(output), err)
+	}
+
+	if err := systemManager.bringUp(name); err != nil {
+		return fmt.Errorf("failed to bring interface up: %w", err)
+	}
+
+	return nil
+}
+
+// SetHardwareAddress sets the Ethernet address of a TAP interface
+func (systemManager *SystemManager) SetHardwareAddress(name, mac string) error {
+	args := []string{name, "hw", "ether", mac}
+	if runtime.GOOS == "darwin" {
+		args = []string{name, "ether", mac}
+	}
+
+	output, err := systemManager.run("ifconfig", args...)
 	if err != nil {
-		log.Fatalf("    [SYSTEM] failed to get default gateway: %s, %w", string(output), err)
-		return "", err
+		return fmt.Errorf("ifconfig ether failed: %s, %w", string(output), err)
+	}
+	return nil
+}
+
+// getDefaultGateway gets the current default gateway of IPv4 or IPv6
+func (systemManager *SystemManager) getDefaultGateway(ipv6 bool) (string, error) {
+	if runtime.GOOS == "linux" {
+		return systemManager.getDefaultGatewayLinux(ipv6)
 	}
 
-	// Parse the output to find the gateway
+	args := []string{"-n", "get", "default"}
+	if ipv6 {
+		args = []string{"-n", "get", "-inet6", "default"}
+	}
+	output, err := systemManager.run("route", args...)
+	if err != nil {
+		return "", fmt.Errorf("failed to get default gateway: %s, %w", string(output), err)
+	}
+
+	// Parse the output to find the gateway, link-local ones carry their zone
 	lines := strings.Split(string(output), "\n")
 	for _, line := range lines {
 		if strings.Contains(line, "gateway:") {
@@ -58,8 +196,47 @@ func (systemManager *SystemManager) getDefaultGateway() (string, error) {
 		}
 	}
 
-	log.Fatalln("    [SYSTEM] could not find default gateway in route output")
-	return "", err
+	return "", fmt.Errorf("could not find default gateway in route output")
+}
+
+// getDefaultGatewayLinux gets the current default gateway from iproute2.
+// A link-local gateway gets its device as zone, it is ambiguous without one.
+func (systemManager *SystemManager) getDefaultGatewayLinux(ipv6 bool) (string, error) {
+	args := []string{"route", "show", "default"}
+	if ipv6 {
+		args = append([]string{"-6"}, args...)
+	}
+	output, err := systemManager.run("ip", args...)
+	if err != nil {
+		return "", fmt.Errorf("failed to get default gateway: %s, %w", string(output), err)
+	}
+
+	// default via 192.168.1.1 dev eth0 proto dhcp metric 100
+	// default via fe80::1 dev eth0 proto ra metric 1024 pref medium
+	var gateway, device string
+	for _, line := range strings.Split(string(output), "\n") {
+		device = ""
+		parts := strings.Fields(line)
+		for i := 0; i+1 < len(parts); i++ {
+			switch parts[i] {
+			case "via":
+				gateway = parts[i+1]
+			case "dev":
+				device = parts[i+1]
+			}
+		}
+		if gateway != "" {
+			break
+		}
+	}
+
+	if gateway == "" {
+		return "", fmt.Errorf("could not find default gateway in route output")
+	}
+	if addr, err := netip.ParseAddr(gateway); err == nil && addr.IsLinkLocalUnicast() && device != "" {
+		gateway = addr.WithZone(device).String()
+	}
+	return gateway, nil
 }
 
 // calculateBroadcast calculates the broadcast address from IP and netmask
@@ -90,28 +267,24 @@ func (systemManager *SystemManager) calculateBroadcast(ip, netmask string) strin
 
 // setIPAddress sets the IP address and netmask for the interface
 func (systemManager *SystemManager) setIPAddress(name, addr, netmask string) error {
-	var cmd *exec.Cmd
 	var args []string
 
 	// Handle platform-specific ifconfig syntax
 	if runtime.GOOS == "darwin" {
 		// macOS: bring interface up first, then set IP with broadcast
-		upCmd := exec.Command("ifconfig", name, "up")
-		upCmd.CombinedOutput() // Ignore errors, interface might already be up
+		systemManager.run("ifconfig", name, "up") // Ignore errors, interface might already be up
 
 		// Calculate broadcast address dynamically
 		broadcast := systemManager.calculateBroadcast(addr, netmask)
 
 		// Use broadcast to make it non-P2P
 		args = []string{name, "inet", addr, "netmask", netmask, "broadcast", broadcast}
-		cmd = exec.Command("ifconfig", args...)
 	} else {
 		// Linux and other Unix systems
 		args = []string{name, addr, "netmask", netmask}
-		cmd = exec.Command("ifconfig", args...)
 	}
 
-	output, err := cmd.CombinedOutput()
+	output, err := systemManager.run("ifconfig", args...)
 	if err != nil {
 		return fmt.Errorf("ifconfig failed: %s, %w", string(output), err)
 	}
@@ -120,8 +293,7 @@ func (systemManager *SystemManager) setIPAddress(name, addr, netmask string) err
 
 // setMTU sets the MTU for the interface
 func (systemManager *SystemManager) setMTU(name string, mtu int) error {
-	cmd := exec.Command("ifconfig", name, "mtu", fmt.Sprintf("%d", mtu))
-	output, err := cmd.CombinedOutput()
+	output, err := systemManager.run("ifconfig", name, "mtu", fmt.Sprintf("%d", mtu))
 	if err != nil {
 		return fmt.Errorf("ifconfig mtu failed: %s, %w", string(output), err)
 	}
@@ -130,8 +302,7 @@ func (systemManager *SystemManager) setMTU(name string, mtu int) error {
 
 // bringUp brings the interface up
 func (systemManager *SystemManager) bringUp(name string) error {
-	cmd := exec.Command("ifconfig", name, "up")
-	output, err := cmd.CombinedOutput()
+	output, err := systemManager.run("ifconfig", name, "up")
 	if err != nil {
 		return fmt.Errorf("ifconfig up failed: %s, %w", string(output), err)
 	}
@@ -140,8 +311,7 @@ func (systemManager *SystemManager) bringUp(name string) error {
 
 // bringDown brings the interface down
 func (systemManager *SystemManager) bringDown(name string) error {
-	cmd := exec.Command("ifconfig", name, "down")
-	output, err := cmd.CombinedOutput()
+	output, err := systemManager.run("ifconfig", name, "down")
 	if err != nil {
 		return fmt.Errorf("ifconfig down failed: %s, %w", string(output), err)
 	}
@@ -155,9 +325,11 @@ func (systemManager *SystemManager) DeleteInterface(name string) error {
 		return fmt.Errorf("failed to bring interface down: %w", err)
 	}
 
+	// Down is enough for the interface to stop attracting traffic
+	systemManager.record(journalEntry{Op: journalDeleteInterface, Interface: name})
+
 	// Then delete it (this might require root privileges)
-	cmd := exec.Command("ifconfig", name, "destroy")
-	output, err := cmd.CombinedOutput()
+	output, err := systemManager.run("ifconfig", name, "destroy")
 	if err != nil {
 		// On some systems, the interface is automatically removed when closed
 		// So we'll just log this as a warning and return nil
@@ -170,8 +342,7 @@ func (systemManager *SystemManager) DeleteInterface(name string) error {
 
 // GetInterfaceStatus returns the status of an interface
 func (systemManager *SystemManager) GetInterfaceStatus(name string) (map[string]string, error) {
-	cmd := exec.Command("ifconfig", name)
-	output, err := cmd.CombinedOutput()
+	output, err := systemManager.run("ifconfig", name)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get interface status: %w", err)
 	}
@@ -217,15 +388,22 @@ func (systemManager *SystemManager) parseIfconfigOutput(output string) map[strin
 
 // AddRoute adds a route for the interface
 func (systemManager *SystemManager) AddRoute(interfaceName, destination, gateway string) error {
-	args := []string{"add", destination}
-	if gateway != "" {
-		args = append(args, gateway)
-	}
-	args = append(args, "-interface", interfaceName)
+	return systemManager.AddRouteWithMetric(interfaceName, destination, gateway, 0)
+}
+
+// AddRouteWithMetric adds a route with the given metric, zero leaves the system default.
+// An empty interfaceName sends the destination through the gateway alone.
+func (systemManager *SystemManager) AddRouteWithMetric(interfaceName, destination, gateway string, metric int) error {
+	name, args := routeCommand("add", interfaceName, destination, gateway, metric)
 
-	cmd := exec.Command("route", args...)
-	output, err := cmd.CombinedOutput()
+	// Record the route before adding it, a crash in between leaves a harmless extra entry
+	entry := journalEntry{Op: journalAddRoute, Interface: interfaceName, Destination: destination, Gateway: gateway, Metric: metric}
+	systemManager.record(entry)
+
+	output, err := systemManager.run(name, args...)
 	if err != nil {
+		entry.Op = journalDeleteRoute
+		systemManager.record(entry)
 		return fmt.Errorf("route add failed: %s, %w", string(output), err)
 	}
 	return nil
@@ -233,16 +411,59 @@ func (systemManager *SystemManager) AddRoute(interfaceName, destination, gateway
 
 // DeleteRoute removes a route for the interface
 func (systemManager *SystemManager) DeleteRoute(interfaceName, destination, gateway string) error {
-	args := []string{"delete", destination}
-	if gateway != "" {
-		args = append(args, gateway)
-	}
-	args = append(args, "-interface", interfaceName)
+	return systemManager.DeleteRouteWithMetric(interfaceName, destination, gateway, 0)
+}
+
+// DeleteRouteWithMetric removes a route added by AddRouteWithMetric
+func (systemManager *SystemManager) DeleteRouteWithMetric(interfaceName, destination, gateway string, metric int) error {
+	name, args := routeCommand("delete", interfaceName, destination, gateway, metric)
 
-	cmd := exec.Command("route", args...)
-	output, err := cmd.CombinedOutput()
+	output, err := systemManager.run(name, args...)
 	if err != nil {
 		return fmt.Errorf("route delete failed: %s, %w", string(output), err)
 	}
+
+	systemManager.record(journalEntry{Op: journalDeleteRoute, Interface: interfaceName, Destination: destination, Gateway: gateway, Metric: metric})
 	return nil
 }
+
+// routeCommand builds the platform-specific command line for a route change
+func routeCommand(action, interfaceName, destination, gateway string, metric int) (string, []string) {
+	if runtime.GOOS == "linux" {
+		// ip route add 10.0.0.0/24 via 192.168.1.1 dev tun0 metric 10
+		// iproute2 takes the zone of a link-local gateway as its device
+		args := []string{"route", action, destination}
+		if gateway, zone, found := strings.Cut(gateway, "%"); found {
+			args = append(args, "via", gateway)
+			if interfaceName == "" {
+				interfaceName = zone
+			}
+		} else if gateway != "" {
+			args = append(args, "via", gateway)
+		}
+		if interfaceName != "" {
+			args = append(args, "dev", interfaceName)
+		}
+		if metric > 0 {
+			args = append(args, "metric", fmt.Sprintf("%d", metric))
+		}
+		return "ip", args
+	}
+
+	// route add 10.0.0.0/24 192.168.1.1 -interface utun9 -hopcount 10
+	args := []string{action}
+	if strings.Contains(destination, ":") {
+		args = append(args, "-inet6")
+	}
+	args = append(args, destination)
+	if gateway != "" {
+		args = append(args, gateway)
+	}
+	if interfaceName != "" {
+		args = append(args, "-interface", interfaceName)
+	}
+	if metric > 0 {
+		args = append(args, "-hopcount", fmt.Sprintf("%d", metric))
+	}
+	return "route", args
+}
@@ -0,0 +1,221 @@
+// Package upstream dials the peer through the proxy a network forces
+// traffic through: an HTTP proxy that tunnels with CONNECT, or a SOCKS5
+// proxy, picked from the configuration or from HTTPS_PROXY.
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"thinkpol-vpn/interface/internal/config"
+	"thinkpol-vpn/interface/internal/util"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// Settings are the validated upstream proxy parameters. The zero value
+// connects directly.
+type Settings struct {
+	// proxyURL is the configured proxy, nil to pick one per address
+	proxyURL *url.URL
+	// environment picks the proxy of an address from HTTPS_PROXY and
+	// NO_PROXY, nil to connect directly
+	environment func(*url.URL) (*url.URL, error)
+	dialer      net.Dialer
+}
+
+// New validates the upstream proxy configuration
+func New(proxyConfig config.UpstreamProxyConfig) (Settings, error) {
+	var settings Settings
+
+	if proxyConfig.URL == "" {
+		if proxyConfig.FromEnvironment {
+			settings.environment = httpproxy.FromEnvironment().ProxyFunc()
+		}
+		return settings, nil
+	}
+
+	proxyURL, err := url.Parse(proxyConfig.URL)
+	if err != nil {
+		return Settings{}, fmt.Errorf("invalid upstream proxy: %w", err)
+	}
+	if err := checkScheme(proxyURL); err != nil {
+		return Settings{}, err
+	}
+	if proxyURL.Hostname() == "" {
+		return Settings{}, fmt.Errorf("upstream proxy %q names no host", proxyURL.Redacted())
+	}
+	if proxyConfig.Username != "" || proxyConfig.Password != "" {
+		proxyURL.User = url.UserPassword(proxyConfig.Username, proxyConfig.Password)
+	}
+	settings.proxyURL = proxyURL
+	return settings, nil
+}
+
+// checkScheme makes sure the proxy speaks a protocol that can be dialed through
+func checkScheme(proxyURL *url.URL) error {
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return nil
+	default:
+		return fmt.Errorf("upstream proxy %q is not http, https or socks5", proxyURL.Redacted())
+	}
+}
+
+// Proxy returns the proxy connections to addr go through, nil when they go
+// directly
+func (settings Settings) Proxy(addr string) (*url.URL, error) {
+	if settings.proxyURL != nil {
+		return settings.proxyURL, nil
+	}
+	if settings.environment == nil {
+		return nil, nil
+	}
+
+	// Connections to the peer carry TLS, so HTTPS_PROXY applies
+	proxyURL, err := settings.environment(&url.URL{Scheme: "https", Host: addr})
+	if err != nil || proxyURL == nil {
+		return nil, err
+	}
+	if err := checkScheme(proxyURL); err != nil {
+		return nil, err
+	}
+	return proxyURL, nil
+}
+
+// DialContext connects to addr, through the proxy when there is one. Only
+// TCP goes through proxies.
+func (settings Settings) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxyURL, err := settings.Proxy(addr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return settings.dialer.DialContext(ctx, network, addr)
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("cannot dial %s through proxy %s", network, proxyURL.Redacted())
+	}
+
+	var conn net.Conn
+	if proxyURL.Scheme == "http" || proxyURL.Scheme == "https" {
+		conn, err = settings.dialHTTP(ctx, proxyURL, addr)
+	} else {
+		conn, err = settings.dialSOCKS5(ctx, proxyURL, addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s through proxy %s: %w", addr, proxyURL.Redacted(), err)
+	}
+	return conn, nil
+}
+
+// Dialer returns a copy of base connecting through the proxy. Use it before
+// obfuscate.Settings.Dialer, which keeps the way it connects.
+func (settings Settings) Dialer(base *websocket.Dialer) *websocket.Dialer {
+	dialer := *base
+	dialer.Proxy = nil
+	dialer.NetDialContext = settings.DialContext
+	return &dialer
+}
+
+// dialHTTP opens a tunnel to addr with an HTTP CONNECT request
+func (settings Settings) dialHTTP(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	port := proxyURL.Port()
+	if port == "" {
+		port = "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	conn, err := settings.dialer.DialContext(ctx, "tcp", net.JoinHostPort(proxyURL.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+
+	// The proxy gets until the context is done to answer
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	fail := func(err error) (net.Conn, error) {
+		stop()
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return fail(err)
+		}
+		conn = tlsConn
+	}
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		return fail(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return fail(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fail(fmt.Errorf("proxy answered %s", response.Status))
+	}
+
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if reader.Buffered() > 0 {
+		return &util.BufferedConn{Conn: conn, Reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// dialSOCKS5 connects to addr through a SOCKS5 proxy, which resolves the
+// host name of addr itself
+func (settings Settings) dialSOCKS5(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+	}
+	port := proxyURL.Port()
+	if port == "" {
+		port = "1080"
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", net.JoinHostPort(proxyURL.Hostname(), port), auth, &settings.dialer)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+}
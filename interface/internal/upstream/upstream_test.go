@@ -0,0 +1,217 @@
+package upstream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"thinkpol-vpn/interface/internal/config"
+
+	"github.com/gorilla/websocket"
+)
+
+// echoServer is a websocket server answering every message with itself
+func echoServer(t *testing.T) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(messageType, message)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// checkWebSocket connects to the echo server with dialer and exchanges a message
+func checkWebSocket(t *testing.T, dialer *websocket.Dialer, server *httptest.Server) {
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("packet")); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != "packet" {
+		t.Fatalf("ReadMessage = %q, %v, want the packet echoed", message, err)
+	}
+}
+
+// tunnel copies between both connections until either side is done
+func tunnel(conn io.ReadWriteCloser, upstream net.Conn) {
+	defer conn.Close()
+	defer upstream.Close()
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func TestHTTPProxy(t *testing.T) {
+	server := echoServer(t)
+
+	var connects []string
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := (&http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}).BasicAuth()
+		if r.Method != http.MethodConnect || user != "user" || password != "p@ss:word" {
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		connects = append(connects, r.Host)
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		tunnel(conn, upstream)
+	}))
+	defer proxyServer.Close()
+
+	settings, err := New(config.UpstreamProxyConfig{URL: proxyServer.URL, Username: "user", Password: "p@ss:word"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	checkWebSocket(t, settings.Dialer(websocket.DefaultDialer), server)
+	if want := server.Listener.Addr().String(); len(connects) != 1 || connects[0] != want {
+		t.Errorf("proxy tunneled to %v, want %s", connects, want)
+	}
+
+	settings, _ = New(config.UpstreamProxyConfig{URL: proxyServer.URL})
+	if _, _, err := settings.Dialer(websocket.DefaultDialer).Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("Dial without credentials = %v, want the 407 of the proxy", err)
+	}
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	server := echoServer(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				target, err := acceptSOCKS5(conn, "user", "secret")
+				if err != nil {
+					conn.Close()
+					return
+				}
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				tunnel(conn, upstream)
+			}()
+		}
+	}()
+
+	settings, err := New(config.UpstreamProxyConfig{URL: "socks5://user:secret@" + listener.Addr().String()})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	checkWebSocket(t, settings.Dialer(websocket.DefaultDialer), server)
+
+	settings, _ = New(config.UpstreamProxyConfig{URL: "socks5://user:wrong@" + listener.Addr().String()})
+	if conn, _, err := settings.Dialer(websocket.DefaultDialer).Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil); err == nil {
+		conn.Close()
+		t.Error("connected through the proxy with the wrong password")
+	}
+}
+
+// acceptSOCKS5 checks the credentials of a SOCKS5 client and reads where its
+// CONNECT request goes
+func acceptSOCKS5(conn net.Conn, user, password string) (string, error) {
+	reader := bufio.NewReader(conn)
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(reader, greeting); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(reader, make([]byte, greeting[1])); err != nil {
+		return "", err
+	}
+	conn.Write([]byte{5, 2})
+
+	readString := func() string {
+		size, _ := reader.ReadByte()
+		value := make([]byte, size)
+		io.ReadFull(reader, value)
+		return string(value)
+	}
+	reader.ReadByte()
+	if readString() != user || readString() != password {
+		conn.Write([]byte{1, 1})
+		return "", io.ErrUnexpectedEOF
+	}
+	conn.Write([]byte{1, 0})
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return "", err
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(reader, ip)
+		host = net.IP(ip).String()
+	case 3:
+		host = readString()
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "http://proxy.corp.example:3128")
+	t.Setenv("NO_PROXY", "internal.example")
+
+	settings, err := New(config.UpstreamProxyConfig{FromEnvironment: true})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if proxyURL, err := settings.Proxy("vpn.example.org:443"); err != nil || proxyURL == nil || proxyURL.Host != "proxy.corp.example:3128" {
+		t.Errorf("Proxy = %v, %v, want the proxy in HTTPS_PROXY", proxyURL, err)
+	}
+	if proxyURL, err := settings.Proxy("vpn.internal.example:443"); err != nil || proxyURL != nil {
+		t.Errorf("Proxy for a NO_PROXY host = %v, %v, want a direct connection", proxyURL, err)
+	}
+
+	settings, _ = New(config.UpstreamProxyConfig{})
+	if proxyURL, err := settings.Proxy("vpn.example.org:443"); err != nil || proxyURL != nil {
+		t.Errorf("Proxy = %v, %v, want a direct connection while the environment is ignored", proxyURL, err)
+	}
+
+	if _, err := New(config.UpstreamProxyConfig{URL: "ftp://proxy.corp.example"}); err == nil {
+		t.Error("New accepted an ftp proxy")
+	}
+}
@@ -0,0 +1,17 @@
+package util
+
+import (
+	"bufio"
+	"net"
+)
+
+// BufferedConn is a connection whose first bytes were already read into
+// Reader, reads drain Reader before going to the connection
+type BufferedConn struct {
+	net.Conn
+	Reader *bufio.Reader
+}
+
+func (conn *BufferedConn) Read(b []byte) (int, error) {
+	return conn.Reader.Read(b)
+}